@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	cnmt "github.com/ralim/switchhost/formats/CNMT"
+	nacp "github.com/ralim/switchhost/formats/NACP"
+	"github.com/ralim/switchhost/library"
+	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/titledb"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// Subcommands work on files or the library once and then exit, without starting the servers or the console UI
+// They share the config file, keys and setting flags with the server
+
+// addCommands adds the subcommands to the root command
+func (m *SwitchHost) addCommands(root *cobra.Command) {
+	for _, name := range []string{"config", "keys"} {
+		root.PersistentFlags().AddFlag(root.Flags().Lookup(name))
+	}
+
+	info := &cobra.Command{
+		Use:   "info <file>...",
+		Short: "Print the metadata of NSP/NSZ/XCI/XCZ files",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := m.openLibrary(false); err != nil {
+				return err
+			}
+			return m.runInfo(args)
+		},
+	}
+
+	verify := &cobra.Command{
+		Use:   "verify <file>...",
+		Short: "Check the hashes of NSP/NSZ/XCI/XCZ files, failing if any don't match",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := m.openLibrary(false); err != nil {
+				return err
+			}
+			return m.runVerify(args)
+		},
+	}
+
+	organise := &cobra.Command{
+		Use:   "organise",
+		Short: "Sort the files in the scan folders into the library, then exit (with --dry-run only plan the changes)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := m.openLibrary(true); err != nil {
+				return err
+			}
+			return m.runOrganise()
+		},
+	}
+
+	plan := &cobra.Command{
+		Use:   "plan",
+		Short: "Print the changes planned by a dry run",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := m.openPlan(); err != nil {
+				return err
+			}
+			printPlan(m.lib.Plan())
+			return nil
+		},
+	}
+	plan.AddCommand(&cobra.Command{
+		Use:   "apply",
+		Short: "Make the changes planned by a dry run",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := m.openPlan(); err != nil {
+				return err
+			}
+			return m.runPlanApply()
+		},
+	}, &cobra.Command{
+		Use:   "clear",
+		Short: "Forget the changes planned by a dry run",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := m.openPlan(); err != nil {
+				return err
+			}
+			return m.lib.ClearPlan()
+		},
+	})
+
+	index := &cobra.Command{
+		Use:   "index",
+		Short: "Work with the library index",
+	}
+	index.AddCommand(&cobra.Command{
+		Use:   "export",
+		Short: "Scan the library and print its index as json, without changing any files",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := m.openLibrary(true); err != nil {
+				return err
+			}
+			return m.runIndexExport()
+		},
+	})
+
+	root.AddCommand(info, verify, organise, plan, index)
+}
+
+// openLibrary loads the settings and keys for a subcommand, along with the TitlesDB if it is needed for names
+func (m *SwitchHost) openLibrary(loadTitles bool) error {
+	if err := m.openSettings(); err != nil {
+		return err
+	}
+	if loadTitles {
+		m.loadTitlesDB()
+	} else {
+		m.titleDB = titledb.CreateTitlesDB(m.settings)
+	}
+	m.lib = library.NewLibrary(m.titleDB, m.settings, nil, nil)
+	m.tryAndLoadKeys()
+	if !m.lib.HasKeys() {
+		return library.ErrNeedsKeys
+	}
+	return nil
+}
+
+// openPlan loads the plan saved by a dry run, which only needs the settings
+func (m *SwitchHost) openPlan() error {
+	if err := m.openSettings(); err != nil {
+		return err
+	}
+	m.titleDB = titledb.CreateTitlesDB(m.settings)
+	m.lib = library.NewLibrary(m.titleDB, m.settings, nil, nil)
+	return m.lib.LoadPlan()
+}
+
+// openSettings loads the settings for a subcommand, unlike the server the config file is never written
+func (m *SwitchHost) openSettings() error {
+	settingsPath := "./config.json"
+	if m.ConfigFilePath != "" {
+		settingsPath = m.ConfigFilePath
+	}
+	// Loading logs would get mixed up with the output
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	var err error
+	m.settings, err = settings.ReadSettings(settingsPath)
+	if err != nil {
+		return fmt.Errorf("config file %s could not be loaded (check it with --check-config): %w", settingsPath, err)
+	}
+	if err := m.settings.ApplyOverrides(m.settingOverrides()); err != nil {
+		return err
+	}
+	m.settings.SetupLogging(os.Stderr)
+	return nil
+}
+
+func (m *SwitchHost) runInfo(files []string) error {
+	failed := 0
+	for i, file := range files {
+		if i > 0 {
+			fmt.Println()
+		}
+		details, err := m.lib.GetFileDetails(file)
+		if err != nil {
+			fmt.Printf("%s: %v\n", file, err)
+			failed++
+			continue
+		}
+		info := details.Info
+		fmt.Println(file)
+		fmt.Printf("  Title ID:  %s\n", library.FormatTitleIDToString(info.TitleID))
+		if human := library.FormatVersionToHumanString(info.Version); len(human) > 0 {
+			fmt.Printf("  Version:   %d (%s)\n", info.Version, human)
+		} else {
+			fmt.Printf("  Version:   %d\n", info.Version)
+		}
+		fmt.Printf("  Type:      %s\n", info.Type.String())
+		fmt.Printf("  Title:     %s\n", info.EmbeddedTitle)
+		fmt.Printf("  Size:      %d bytes\n", info.Size)
+		if details.CNMT != nil {
+			fmt.Println("  Contents:")
+			types := make([]cnmt.ContentType, 0, len(details.CNMT.Contents))
+			for contentType := range details.CNMT.Contents {
+				types = append(types, contentType)
+			}
+			sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+			for _, contentType := range types {
+				content := details.CNMT.Contents[contentType]
+				fmt.Printf("    %-16s %s.nca  %d bytes\n", contentType.String(), content.ID, content.Size)
+			}
+		}
+		if details.NACP != nil {
+			fmt.Printf("  Display version: %s\n", details.NACP.DisplayVersion)
+			fmt.Println("  Titles:")
+			languages := make([]nacp.Language, 0, len(details.NACP.Titles))
+			for language, entry := range details.NACP.Titles {
+				if len(entry.Title) > 0 {
+					languages = append(languages, language)
+				}
+			}
+			sort.Slice(languages, func(i, j int) bool { return languages[i] < languages[j] })
+			for _, language := range languages {
+				fmt.Printf("    %-22s %s\n", language.String()+":", details.NACP.Titles[language].Title)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be read", failed, len(files))
+	}
+	return nil
+}
+
+func (m *SwitchHost) runVerify(files []string) error {
+	failed := 0
+	for _, file := range files {
+		if err := m.verifyFile(file); err != nil {
+			fmt.Printf("FAILED %s: %v\n", file, err)
+			failed++
+		} else {
+			fmt.Printf("OK     %s\n", file)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed verification", failed, len(files))
+	}
+	return nil
+}
+
+func (m *SwitchHost) verifyFile(file string) error {
+	if !library.IsScannableFile(file) {
+		return errors.New("not an NSP, NSZ, XCI or XCZ file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		return err
+	}
+	return m.lib.ValidateFile(file)
+}
+
+func (m *SwitchHost) runOrganise() error {
+	moves, err := m.lib.Organise()
+	if m.settings.Current().DryRun {
+		printPlan(m.lib.Plan())
+		return err
+	}
+	for _, move := range moves {
+		fmt.Printf("%s -> %s\n", move.Source, move.Destination)
+	}
+	fmt.Printf("%d files moved\n", len(moves))
+	return err
+}
+
+func (m *SwitchHost) runPlanApply() error {
+	result, err := m.lib.ApplyPlan()
+	for _, change := range result.Applied {
+		fmt.Printf("OK     %s\n", describeChange(change))
+	}
+	for _, failure := range result.Failed {
+		fmt.Printf("FAILED %s: %s\n", describeChange(failure.PlannedChange), failure.Error)
+	}
+	if err != nil {
+		return err
+	}
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d of %d planned changes failed", len(result.Failed), len(result.Applied)+len(result.Failed))
+	}
+	return nil
+}
+
+func printPlan(changes []library.PlannedChange) {
+	for _, change := range changes {
+		fmt.Printf("%s (%s)\n", describeChange(change), change.Reason)
+	}
+	if len(changes) == 0 {
+		fmt.Println("Nothing is planned")
+	} else {
+		fmt.Printf("%d changes planned, make them with: switchhost plan apply\n", len(changes))
+	}
+}
+
+func describeChange(change library.PlannedChange) string {
+	if change.Action == library.PlanDelete {
+		return fmt.Sprintf("delete %s", change.Source)
+	}
+	return fmt.Sprintf("move %s -> %s", change.Source, change.Destination)
+}
+
+func (m *SwitchHost) runIndexExport() error {
+	// Duplicates are deleted as they are added to the index, exporting must not change anything
+	m.settings.Deduplicate = false
+	if err := m.lib.LoadIndex(); err != nil {
+		return err
+	}
+	return m.lib.FileIndex.Export(os.Stdout)
+}
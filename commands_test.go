@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaffee/commandeer/cobrafy"
+	"github.com/ralim/switchhost/library"
+	"github.com/ralim/switchhost/utilities"
+)
+
+func TestOrganiseDryRun(t *testing.T) {
+	folder := t.TempDir()
+	incoming := path.Join(folder, "incoming")
+	if err := os.Mkdir(incoming, 0755); err != nil {
+		t.Fatal(err)
+	}
+	testFile := path.Join(incoming, "UnitTest_[05123A0000000000].nsp")
+	data, err := os.ReadFile("testing_files/UnitTest_[05123A0000000000].nsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(testFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := json.Marshal(map[string]any{
+		"sourceFolders": []string{incoming},
+		"storageFolder": path.Join(folder, "library"),
+		"cacheFolder":   folder,
+		"titlesDbUrls":  []string{}, // Nothing to download in tests
+		"enableSorting": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := path.Join(folder, "config.json")
+	if err := os.WriteFile(configPath, config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	keysPath, err := filepath.Abs("testing_files/prod.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Built the same way as main
+	host := NewSwitchHost()
+	command, err := cobrafy.Command(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.addSettingFlags(command.PersistentFlags())
+	host.addCommands(command)
+	command.SetArgs([]string{"organise", "--dry-run", "--config", configPath, "--keys", keysPath})
+	if err := command.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !utilities.Exists(testFile) {
+		t.Error("A dry run should not move anything")
+	}
+	if plan := host.lib.Plan(); len(plan) != 1 || plan[0].Action != library.PlanMove || plan[0].Source != testFile {
+		t.Errorf("The move should be planned, got %+v", plan)
+	}
+}
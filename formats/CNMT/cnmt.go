@@ -87,6 +87,27 @@ func (t *MetaType) String() string {
 	}
 }
 
+func (t ContentType) String() string {
+	switch t {
+	case Meta:
+		return "Meta"
+	case Program:
+		return "Program"
+	case Data:
+		return "Data"
+	case Control:
+		return "Control"
+	case HTMLDocument:
+		return "HtmlDocument"
+	case LegalInformation:
+		return "LegalInformation"
+	case DeltaFragment:
+		return "DeltaFragment"
+	default:
+		return fmt.Sprintf("Unknown (%d)", int(t))
+	}
+}
+
 func ParseBinary(pfs0 *partitionfs.PartionFS, data []byte) (*ContentMetaAttributes, error) {
 	if pfs0 == nil || len(pfs0.FileEntryTable) != 1 {
 		return nil, errors.New("invalid PartionFS")
@@ -102,9 +123,9 @@ func ParseBinary(pfs0 *partitionfs.PartionFS, data []byte) (*ContentMetaAttribut
 		position := 0x20 /*size of cnmt header*/ + tableOffset + (i * uint16(0x38))
 		hashData := cnmt[position : position+0x20]
 		ncaId := cnmt[position+0x20 : position+0x20+0x10]
-		sizeData := cnmt[position+0x30 : position+0x30+0x06]
-		// only 6 bytes, so need to add two zero pads
-		sizeData = append([]byte{0, 0}, sizeData...)
+		// only 6 bytes, so need to add two zero pads to the (little endian) top
+		sizeData := make([]byte, 8)
+		copy(sizeData, cnmt[position+0x30:position+0x30+0x06])
 		size := binary.LittleEndian.Uint64(sizeData)
 		contentType := ContentType(cnmt[position+0x36])
 		contents[contentType] = Content{ID: fmt.Sprintf("%x", ncaId), Hash: hashData, Size: size, Type: contentType}
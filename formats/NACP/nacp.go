@@ -36,6 +36,18 @@ const (
 	SimplifiedChinese    Language = 14
 )
 
+var languageNames = []string{
+	"AmericanEnglish", "BritishEnglish", "Japanese", "French", "German", "LatinAmericanSpanish", "Spanish", "Italian",
+	"Dutch", "CanadianFrench", "Portuguese", "Russian", "Korean", "TraditionalChinese", "SimplifiedChinese",
+}
+
+func (l Language) String() string {
+	if l < 0 || int(l) >= len(languageNames) {
+		return fmt.Sprintf("Language%d", int(l))
+	}
+	return languageNames[l]
+}
+
 type NacpTitleEntry struct {
 	Language Language
 	Title    string
@@ -111,7 +123,7 @@ func ReadNACP(data []byte, romFsHeader istorage.Header, fileEntry istorage.FileE
 func (n *NACP) GetSuggestedTitle(settings *settings.Settings) string {
 	// Return the titles in preferred order
 	// If not fall back by Language order
-	for index := range settings.PreferredLangOrder {
+	for index := range settings.Current().PreferredLangOrder {
 		v, ok := n.Titles[Language(index)]
 		if ok {
 			if len(v.Title) > 0 {
@@ -0,0 +1,101 @@
+package nca
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ralim/switchhost/keystore"
+)
+
+// Section crypto details, used when the contents of an NCA need to be decrypted and later re-encrypted (NSZ compression)
+
+const (
+	EncTypeNone     = 1
+	EncTypeAesXts   = 2
+	EncTypeAesCtr   = 3
+	EncTypeAesCtrEx = 4
+
+	fsEntryCount = 4
+)
+
+var ErrTitleKeyRequired = errors.New("NCA uses titlekey crypto, but no title key was provided")
+
+// SectionCrypto describes how one FS section of an NCA is encrypted
+type SectionCrypto struct {
+	Offset  int64  // Offset of the section from the start of the NCA
+	Size    int64  // Length of the section in bytes
+	EncType byte   // (1 = None, 2 = AesXts, 3 = AesCtr, 4 = AesCtrEx)
+	Key     []byte // AES-CTR key, only set for AesCtr/AesCtrEx sections
+	Counter []byte // AES-CTR counter, upper 8 bytes are the section counter, lower 8 are left as zero for the offset
+}
+
+// HasRightsID returns true if the NCA is encrypted using a title key, rather than its key area
+func (n *Header) HasRightsID() bool {
+	return !bytes.Equal(n.RightsID, make([]byte, len(n.RightsID)))
+}
+
+// DecryptTitleKey decrypts the title key (from a ticket) for this NCA using the matching titlekek
+func DecryptTitleKey(keystore *keystore.Keystore, header *Header, encryptedTitleKey []byte) ([]byte, error) {
+	keyRevision := header.getKeyRevision()
+	titleKek, err := keystore.GetTitleKek(uint8(keyRevision))
+	if err != nil {
+		return nil, fmt.Errorf("missing titlekek - %02x -> %w", keyRevision, err)
+	}
+	return decryptAes128Ecb(encryptedTitleKey, titleKek)
+}
+
+// GetSectionsCrypto returns the crypto details for all of the populated FS sections, ordered by their offset
+// titleKey should be the decrypted title key if the NCA has a rights ID, otherwise it is ignored and the key area is used
+func GetSectionsCrypto(keystore *keystore.Keystore, header *Header, titleKey []byte) ([]SectionCrypto, error) {
+	var contentKey []byte
+	sections := []SectionCrypto{}
+	for index := 0; index < fsEntryCount; index++ {
+		entry := GetFSEntry(header, index)
+		if entry.Size == 0 {
+			continue
+		}
+		fsHeader, err := GetFSHeader(header, index)
+		if err != nil {
+			return nil, err
+		}
+		section := SectionCrypto{
+			Offset:  int64(entry.StartOffset),
+			Size:    int64(entry.Size),
+			EncType: fsHeader.EncType,
+		}
+		if fsHeader.EncType == EncTypeAesCtr || fsHeader.EncType == EncTypeAesCtrEx {
+			if contentKey == nil {
+				contentKey, err = getContentKey(keystore, header, titleKey)
+				if err != nil {
+					return nil, err
+				}
+			}
+			section.Key = contentKey
+			section.Counter = make([]byte, 0x10)
+			// Section counter is stored little endian, but used big endian
+			for i := 0; i < 8; i++ {
+				section.Counter[i] = fsHeader.FSHeaderBytes[0x140+7-i]
+			}
+		}
+		sections = append(sections, section)
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Offset < sections[j].Offset })
+	return sections, nil
+}
+
+func getContentKey(keystore *keystore.Keystore, header *Header, titleKey []byte) ([]byte, error) {
+	if header.HasRightsID() {
+		if len(titleKey) != 0x10 {
+			return nil, ErrTitleKeyRequired
+		}
+		return titleKey, nil
+	}
+	keyRevision := header.getKeyRevision()
+	key, err := keystore.GetAppKey(uint8(keyRevision))
+	if err != nil {
+		return nil, fmt.Errorf("missing key - %02x -> %w", keyRevision, err)
+	}
+	return decryptAes128Ecb(header.EncryptedKeys[0x20:0x30], key)
+}
@@ -0,0 +1,142 @@
+package nsz
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Block compression, the counterpart to the Decompressor
+// Data is split into 2^BlockSizeExponent sized blocks, each compressed as its own zstd frame so they can be randomly accessed
+// Blocks that do not get smaller are stored as-is, which the decompressor detects by the block size matching the decompressed size
+
+const (
+	MinBlockSizeExponent = 14
+	MaxBlockSizeExponent = 24 // Same limit as nsz, block sizes are stored as uint32 and each CPU holds a block in memory
+
+	blockHeaderVersion = 2
+	blockHeaderType    = 1
+)
+
+var ErrBadBlockSize = errors.New("block size exponent out of range")
+
+// WriteSectionHeader writes out the NCZSECTN header describing how to re-encrypt the decompressed data
+func WriteSectionHeader(writer io.Writer, sections []NSZSection) error {
+	header := make([]byte, 16, 16+len(sections)*0x40)
+	copy(header[0:8], "NCZSECTN")
+	binary.LittleEndian.PutUint64(header[8:16], uint64(len(sections)))
+	for _, section := range sections {
+		entry := make([]byte, 0x40)
+		binary.LittleEndian.PutUint64(entry[0:8], uint64(section.Offset))
+		binary.LittleEndian.PutUint64(entry[8:16], uint64(section.Size))
+		binary.LittleEndian.PutUint64(entry[16:24], uint64(section.CryptoType))
+		binary.LittleEndian.PutUint64(entry[24:32], uint64(section.Pad))
+		copy(entry[32:48], section.CryptoKey)
+		copy(entry[48:64], section.CryptoCounter)
+		header = append(header, entry...)
+	}
+	_, err := writer.Write(header)
+	return err
+}
+
+// CompressBlocks reads size bytes from the reader, and writes them out as an NCZBLOCK stream
+// The block size list is patched in once all blocks are written, so the writer must be seekable
+// progress (if not nil) is called with the number of source bytes consumed as each block is finished
+func CompressBlocks(ctx context.Context, writer io.WriteSeeker, reader io.Reader, size int64, blockSizeExponent int, encoder *zstd.Encoder, progress func(int64)) error {
+	if blockSizeExponent < MinBlockSizeExponent || blockSizeExponent > MaxBlockSizeExponent {
+		return ErrBadBlockSize
+	}
+	blockSize := int64(1) << blockSizeExponent
+	numberOfBlocks := (size + blockSize - 1) / blockSize
+
+	header := make([]byte, 24+4*numberOfBlocks)
+	copy(header[0:8], "NCZBLOCK")
+	header[8] = blockHeaderVersion
+	header[9] = blockHeaderType
+	header[10] = 0
+	header[11] = byte(blockSizeExponent)
+	binary.LittleEndian.PutUint32(header[12:16], uint32(numberOfBlocks))
+	binary.LittleEndian.PutUint64(header[16:24], uint64(size))
+
+	headerStart, err := writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	// Placeholder header until the block sizes are known
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+
+	// Blocks are compressed a batch at a time in parallel, then written out in order
+	batchSize := runtime.NumCPU()
+	raw := make([][]byte, batchSize)
+	compressed := make([][]byte, batchSize)
+	for i := range raw {
+		raw[i] = make([]byte, blockSize)
+	}
+	block := int64(0)
+	for block < numberOfBlocks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		count := 0
+		for ; count < batchSize && block+int64(count) < numberOfBlocks; count++ {
+			length := blockSize
+			if remaining := size - (block+int64(count))*blockSize; remaining < length {
+				length = remaining
+			}
+			if _, err := io.ReadFull(reader, raw[count][:length]); err != nil {
+				return fmt.Errorf("reading block %d failed - %w", block+int64(count), err)
+			}
+			raw[count] = raw[count][:length]
+		}
+		wg := sync.WaitGroup{}
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				compressed[i] = encoder.EncodeAll(raw[i], compressed[i][:0])
+			}(i)
+		}
+		wg.Wait()
+		for i := 0; i < count; i++ {
+			output := compressed[i]
+			if len(output) >= len(raw[i]) {
+				output = raw[i] // Didn't shrink, so store it as-is
+			}
+			if uint64(len(output)) > math.MaxUint32 {
+				return fmt.Errorf("block %d is too large to store its size", block+int64(i))
+			}
+			if _, err := writer.Write(output); err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint32(header[24+4*(block+int64(i)):], uint32(len(output)))
+			if progress != nil {
+				progress(int64(len(raw[i])))
+			}
+			raw[i] = raw[i][:cap(raw[i])]
+		}
+		block += int64(count)
+	}
+
+	// Go back and fill in the block sizes
+	end, err := writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Seek(headerStart, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	_, err = writer.Seek(end, io.SeekStart)
+	return err
+}
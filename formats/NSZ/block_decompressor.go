@@ -1,6 +1,7 @@
 package nsz
 
 import (
+	"errors"
 	"io"
 	"math"
 
@@ -142,3 +143,28 @@ func (d *Decompressor) Close() {
 		d.currentDecompressor.Close()
 	}
 }
+
+// Seek moves the decompressor to the offset in the decompressed data, only io.SeekStart is supported
+// As blocks are independent, only the block holding the offset has to be decompressed to get there
+func (d *Decompressor) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, errors.New("block decompressor can only seek from the start")
+	}
+	if offset < 0 || offset > d.header.DecompressedSize {
+		return 0, errors.New("seek outside of decompressed data")
+	}
+	d.Close()
+	d.currentDecompressor = nil
+	d.currentNotCompressedReader = nil
+	blockStart := (offset / d.blockSize) * d.blockSize
+	d.currentVirtualPos = blockStart
+	if _, err := io.CopyN(io.Discard, d, offset-blockStart); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// DecompressedSize is the total size of the data once decompressed
+func (d *Decompressor) DecompressedSize() int64 {
+	return d.header.DecompressedSize
+}
@@ -0,0 +1,261 @@
+package nsz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	aesctr "github.com/ralim/switchhost/formats/AESCTR"
+)
+
+// NCZReader recreates the original NCA from an NCZ
+// The first 0x4000 bytes are stored as-is, the rest is decompressed and then re-encrypted using the details in the NCZSECTN header
+// Seeking is supported; for block compressed files this only decompresses the block holding the new position,
+// for solid files the stream has to be decompressed from the start (or the current position if seeking forwards)
+
+const UncompressableHeaderSize int64 = 0x4000
+
+type NCZReader struct {
+	source    io.ReadSeeker // Covering only the NCZ file
+	header    []byte        // The uncompressed start of the NCA
+	sections  []NSZSection
+	dataStart int64 // Offset in source the compressed data starts at
+	blockMode bool
+	size      int64 // Size of the NCA
+
+	position      int64     // Current position in the NCA
+	decompressor  io.Reader // *Decompressor or *zstd.Decoder
+	decompressed  int64     // How far into the decompressed data the decompressor is
+	sectionReader io.Reader // Reader for the section holding position, limited to the section end
+	sectionEnd    int64
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	*c.count += int64(n)
+	return n, err
+}
+
+// NewNCZReader parses the NCZ headers from source, which must cover just the NCZ file
+func NewNCZReader(source io.ReadSeeker) (*NCZReader, error) {
+	fileSize, err := source.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := &NCZReader{source: source}
+	headerLength := UncompressableHeaderSize
+	if fileSize < headerLength {
+		headerLength = fileSize
+	}
+	reader.header = make([]byte, headerLength)
+	if _, err := io.ReadFull(source, reader.header); err != nil {
+		return nil, err
+	}
+	reader.size = headerLength
+	if fileSize <= UncompressableHeaderSize {
+		return reader, nil
+	}
+
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(source, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, []byte("NCZSECTN")) {
+		return nil, fmt.Errorf("bad NCZ >NCZSECTN< header >%v<", string(magic))
+	}
+	if _, err := io.ReadFull(source, magic); err != nil {
+		return nil, err
+	}
+	sectionCount := int64(binary.LittleEndian.Uint64(magic))
+	if sectionCount <= 0 || sectionCount > 0x10000 {
+		return nil, fmt.Errorf("bad NCZ section count %d", sectionCount)
+	}
+	reader.sections = make([]NSZSection, sectionCount)
+	for i := range reader.sections {
+		section, err := NSZSectionFromReader(source)
+		if err != nil {
+			return nil, err
+		}
+		reader.sections[i] = *section
+	}
+	if gap := reader.sections[0].Offset - UncompressableHeaderSize; gap > 0 {
+		dummy := NSZSectionDummy(gap, UncompressableHeaderSize)
+		reader.sections = append([]NSZSection{dummy}, reader.sections...)
+	}
+	for _, section := range reader.sections {
+		if end := section.Offset + section.Size; end > reader.size {
+			reader.size = end
+		}
+	}
+
+	if reader.dataStart, err = source.Seek(0, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(source, magic); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(magic, []byte("NCZBLOCK")) {
+		reader.blockMode = true
+		if _, err := source.Seek(reader.dataStart, io.SeekStart); err != nil {
+			return nil, err
+		}
+		blockHeader, err := NewBlockHeader(source)
+		if err != nil {
+			return nil, err
+		}
+		reader.size = UncompressableHeaderSize + blockHeader.DecompressedSize
+	}
+	return reader, nil
+}
+
+// Size is the size of the original NCA
+func (r *NCZReader) Size() int64 {
+	return r.size
+}
+
+func (r *NCZReader) Read(p []byte) (int, error) {
+	if r.position >= r.size {
+		return 0, io.EOF
+	}
+	if r.position < int64(len(r.header)) {
+		n := copy(p, r.header[r.position:])
+		r.position += int64(n)
+		return n, nil
+	}
+	if r.sectionReader == nil {
+		if err := r.openSection(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.sectionReader.Read(p)
+	r.position += int64(n)
+	if err == io.EOF {
+		r.sectionReader = nil
+		if r.position < r.sectionEnd {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (r *NCZReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.position
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of NCA")
+	}
+	if offset != r.position {
+		r.position = offset
+		r.sectionReader = nil
+	}
+	return offset, nil
+}
+
+func (r *NCZReader) Close() {
+	switch decompressor := r.decompressor.(type) {
+	case *Decompressor:
+		decompressor.Close()
+	case *zstd.Decoder:
+		decompressor.Close()
+	}
+	r.decompressor = nil
+}
+
+// openSection sets up the section reader for the current position
+func (r *NCZReader) openSection() error {
+	var section *NSZSection
+	for i := range r.sections {
+		if r.position >= r.sections[i].Offset && r.position < r.sections[i].Offset+r.sections[i].Size {
+			section = &r.sections[i]
+			break
+		}
+	}
+	if section == nil {
+		return fmt.Errorf("no NCZ section covers offset %X", r.position)
+	}
+	// AES-CTR can only be started on a block boundary, so start there and skip forwards
+	start := r.position &^ 0xF
+	if start < section.Offset {
+		start = section.Offset
+	}
+	if start < UncompressableHeaderSize {
+		start = UncompressableHeaderSize
+	}
+	if err := r.seekDecompressed(start - UncompressableHeaderSize); err != nil {
+		return err
+	}
+	var reader io.Reader = countingReader{reader: r.decompressor, count: &r.decompressed}
+	if section.CryptoType == 3 || section.CryptoType == 4 {
+		encrypter, err := aesctr.NewAESCTREncrypter(reader, section.CryptoKey, section.CryptoCounter, []byte{})
+		if err != nil {
+			return err
+		}
+		encrypter.Seek(uint64(start))
+		reader = encrypter
+	}
+	r.sectionEnd = section.Offset + section.Size
+	reader = io.LimitReader(reader, r.sectionEnd-start)
+	if skip := r.position - start; skip > 0 {
+		if _, err := io.CopyN(io.Discard, reader, skip); err != nil {
+			return err
+		}
+	}
+	r.sectionReader = reader
+	return nil
+}
+
+// seekDecompressed moves the decompressor to the offset in the decompressed data
+func (r *NCZReader) seekDecompressed(offset int64) error {
+	if r.decompressor != nil && r.decompressed == offset {
+		return nil
+	}
+	if r.blockMode {
+		if r.decompressor == nil {
+			if _, err := r.source.Seek(r.dataStart, io.SeekStart); err != nil {
+				return err
+			}
+			decompressor, err := NewBlockDecompressor(r.source)
+			if err != nil {
+				return err
+			}
+			r.decompressor = decompressor
+		}
+		if _, err := r.decompressor.(*Decompressor).Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		r.decompressed = offset
+		return nil
+	}
+	// Solid stream, can only go forwards so restart if needed
+	if r.decompressor == nil || offset < r.decompressed {
+		r.Close()
+		if _, err := r.source.Seek(r.dataStart, io.SeekStart); err != nil {
+			return err
+		}
+		decoder, err := zstd.NewReader(r.source)
+		if err != nil {
+			return err
+		}
+		r.decompressor = decoder
+		r.decompressed = 0
+	}
+	skipped, err := io.CopyN(io.Discard, r.decompressor, offset-r.decompressed)
+	r.decompressed += skipped
+	return err
+}
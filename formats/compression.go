@@ -0,0 +1,381 @@
+package formats
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	aesctr "github.com/ralim/switchhost/formats/AESCTR"
+	nca "github.com/ralim/switchhost/formats/NCA"
+	nsz "github.com/ralim/switchhost/formats/NSZ"
+	partitionfs "github.com/ralim/switchhost/formats/partitionFS"
+	"github.com/ralim/switchhost/keystore"
+	"github.com/rs/zerolog/log"
+)
+
+// Compression of NSP/XCI files into NSZ/XCZ
+// NCA's holding program or public data are decrypted and block compressed into NCZ files, with a header describing how to re-encrypt them
+// Everything else is copied across as-is, so the output can be checked with the normal hash validation
+// Sections using AesCtrEx (updates) are decrypted with their base counter, which may not give plaintext but always round trips
+
+type CompressionOptions struct {
+	Level             int                     // zstd level (1-22), same as nsz uses
+	BlockSizeExponent int                     // Blocks are 2^BlockSizeExponent bytes
+	Progress          func(done, total int64) // Optional, called as data is processed
+}
+
+type compressionProgress struct {
+	done     int64
+	total    int64
+	callback func(done, total int64)
+}
+
+func (p *compressionProgress) add(n int64) {
+	p.done += n
+	if p.callback != nil {
+		p.callback(p.done, p.total)
+	}
+}
+
+type partitionCompressor struct {
+	keystore *keystore.Keystore
+	options  CompressionOptions
+	encoder  *zstd.Encoder
+	progress *compressionProgress
+}
+
+// CompressNSP writes an NSZ version of the NSP in reader to the writer
+func CompressNSP(ctx context.Context, keystore *keystore.Keystore, reader ReaderRequired, writer io.WriteSeeker, options CompressionOptions) error {
+	pfs0Header, err := partitionfs.ReadSection(reader, 0)
+	if err != nil {
+		return fmt.Errorf("reading NSP PartionFS failed with - %w", err)
+	}
+	total := int64(pfs0Header.HeaderLen)
+	for _, file := range pfs0Header.FileEntryTable {
+		total += int64(file.Size)
+	}
+	compressor, err := newPartitionCompressor(keystore, options, total)
+	if err != nil {
+		return err
+	}
+	defer compressor.encoder.Close()
+	_, _, err = compressor.compressPartition(ctx, reader, pfs0Header, 0, partitionfs.PFS0Magic, writer)
+	return err
+}
+
+// CompressXCI writes an XCZ version of the XCI in reader to the writer
+// Only the secure partition is compressed, the other partitions are copied as-is
+func CompressXCI(ctx context.Context, keystore *keystore.Keystore, reader ReaderRequired, writer io.WriteSeeker, options CompressionOptions) error {
+	header := make([]byte, XCIHeaderSize)
+	if _, err := reader.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("reading XCI header failed %w", err)
+	}
+	XCIHeaderString := string(header[XCIHeaderMagicStringOffset : XCIHeaderMagicStringOffset+4])
+	if XCIHeaderString != "HEAD" {
+		return fmt.Errorf("invalid XCI headerBytes. Expected 'HEAD', got >%s<", XCIHeaderString)
+	}
+	rootPartitionOffset := int64(binary.LittleEndian.Uint64(header[XCIRootPartionHeaderOffset : XCIRootPartionHeaderOffset+8]))
+	rootHfs0, err := partitionfs.ReadSection(reader, rootPartitionOffset)
+	if err != nil {
+		return fmt.Errorf("reading XCI PartionFS failed with - %w", err)
+	}
+	total := rootPartitionOffset + int64(rootHfs0.HeaderLen)
+	for _, file := range rootHfs0.FileEntryTable {
+		total += int64(file.Size)
+	}
+	compressor, err := newPartitionCompressor(keystore, options, total)
+	if err != nil {
+		return err
+	}
+	defer compressor.encoder.Close()
+
+	// Everything up to the root partition (header, certificate etc) is kept
+	if err := compressor.copyRange(writer, reader, 0, rootPartitionOffset); err != nil {
+		return err
+	}
+	partitions := make([]partitionfs.FileEntryTableItem, len(rootHfs0.FileEntryTable))
+	copy(partitions, rootHfs0.FileEntryTable)
+	rootHeader, err := partitionfs.BuildHeader(partitionfs.HFS0Magic, partitions)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(rootHeader); err != nil {
+		return err
+	}
+	compressor.progress.add(int64(rootHfs0.HeaderLen))
+	for i, partition := range rootHfs0.FileEntryTable {
+		partitionOffset := rootPartitionOffset + int64(partition.StartOffset)
+		if partition.Name != "secure" {
+			if err := compressor.copyRange(writer, reader, partitionOffset, int64(partition.Size)); err != nil {
+				return err
+			}
+			continue
+		}
+		secureHfs0, err := partitionfs.ReadSection(reader, partitionOffset)
+		if err != nil {
+			return fmt.Errorf("reading XCI secure partition failed with - %w", err)
+		}
+		size, secureHeader, err := compressor.compressPartition(ctx, reader, secureHfs0, partitionOffset, partitionfs.HFS0Magic, writer)
+		if err != nil {
+			return err
+		}
+		secureHash := sha256.Sum256(secureHeader)
+		partitions[i].Size = uint64(size)
+		partitions[i].HashedRegionSize = uint32(len(secureHeader))
+		partitions[i].Hash = secureHash[:]
+	}
+
+	// Now the sizes are known, patch up the root partition and the XCI header that points to it
+	rootHeader, err = partitionfs.BuildHeader(partitionfs.HFS0Magic, partitions)
+	if err != nil {
+		return err
+	}
+	rootHash := sha256.Sum256(rootHeader)
+	binary.LittleEndian.PutUint64(header[0x138:0x140], uint64(len(rootHeader)))
+	copy(header[0x140:0x160], rootHash[:])
+	if _, err := writer.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := writer.Seek(rootPartitionOffset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := writer.Write(rootHeader); err != nil {
+		return err
+	}
+	_, err = writer.Seek(0, io.SeekEnd)
+	return err
+}
+
+func newPartitionCompressor(keystore *keystore.Keystore, options CompressionOptions, total int64) (*partitionCompressor, error) {
+	if options.BlockSizeExponent < nsz.MinBlockSizeExponent || options.BlockSizeExponent > nsz.MaxBlockSizeExponent {
+		return nil, nsz.ErrBadBlockSize
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.Level)))
+	if err != nil {
+		return nil, err
+	}
+	return &partitionCompressor{
+		keystore: keystore,
+		options:  options,
+		encoder:  encoder,
+		progress: &compressionProgress{total: total, callback: options.Progress},
+	}, nil
+}
+
+// compressPartition writes out a new copy of the partition, with compressable NCA's replaced by NCZ's
+// Returns the size of the new partition, and its header
+func (c *partitionCompressor) compressPartition(ctx context.Context, reader ReaderRequired, partition *partitionfs.PartionFS, partitionOffset int64, magic string, writer io.WriteSeeker) (int64, []byte, error) {
+	titleKeys := c.readTitleKeys(reader, partition, partitionOffset)
+
+	files := make([]partitionfs.FileEntryTableItem, len(partition.FileEntryTable))
+	copy(files, partition.FileEntryTable)
+	plans := make([][]nsz.NSZSection, len(files))
+	for i, file := range partition.FileEntryTable {
+		sections, err := c.planNCACompression(reader, file, partitionOffset, titleKeys)
+		if err != nil {
+			log.Warn().Err(err).Str("file", file.Name).Msg("NCA will not be compressed")
+			continue
+		}
+		if sections != nil {
+			plans[i] = sections
+			files[i].Name = strings.TrimSuffix(file.Name, ".nca") + ".ncz"
+		}
+	}
+
+	start, err := writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Names don't change length, so the header can be written now and patched with sizes later
+	header, err := partitionfs.BuildHeader(magic, files)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := writer.Write(header); err != nil {
+		return 0, nil, err
+	}
+	c.progress.add(int64(partition.HeaderLen))
+
+	for i, file := range partition.FileEntryTable {
+		fileOffset := partitionOffset + int64(file.StartOffset)
+		if plans[i] == nil {
+			if err := c.copyRange(writer, reader, fileOffset, int64(file.Size)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		log.Info().Str("file", file.Name).Msg("Compressing NCA")
+		size, err := c.compressNCA(ctx, reader, fileOffset, int64(file.Size), plans[i], writer)
+		if err != nil {
+			return 0, nil, fmt.Errorf("compressing %s failed - %w", file.Name, err)
+		}
+		files[i].Size = uint64(size)
+	}
+
+	end, err := writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, nil, err
+	}
+	header, err = partitionfs.BuildHeader(magic, files)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := writer.Seek(start, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	if _, err := writer.Write(header); err != nil {
+		return 0, nil, err
+	}
+	if _, err := writer.Seek(end, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	return end - start, header, nil
+}
+
+// readTitleKeys collects the encrypted title keys out of any tickets in the partition, by rights ID
+func (c *partitionCompressor) readTitleKeys(reader ReaderRequired, partition *partitionfs.PartionFS, partitionOffset int64) map[string][]byte {
+	titleKeys := make(map[string][]byte)
+	for _, file := range partition.FileEntryTable {
+		if !strings.HasSuffix(file.Name, ".tik") {
+			continue
+		}
+		ticket := make([]byte, file.Size)
+		if _, err := reader.ReadAt(ticket, partitionOffset+int64(file.StartOffset)); err != nil {
+			log.Warn().Err(err).Str("file", file.Name).Msg("Could not read ticket")
+			continue
+		}
+		rightsID, titleKey, err := parseTicket(ticket)
+		if err != nil {
+			log.Warn().Err(err).Str("file", file.Name).Msg("Could not parse ticket")
+			continue
+		}
+		titleKeys[rightsID] = titleKey
+	}
+	return titleKeys
+}
+
+// planNCACompression works out the NCZ sections for a file, or returns nil if the file should be copied as-is
+func (c *partitionCompressor) planNCACompression(reader ReaderRequired, file partitionfs.FileEntryTableItem, partitionOffset int64, titleKeys map[string][]byte) ([]nsz.NSZSection, error) {
+	if !strings.HasSuffix(file.Name, ".nca") || strings.HasSuffix(file.Name, ".cnmt.nca") || int64(file.Size) <= UNCOMPRESSABLE_HEADER_SIZE {
+		return nil, nil
+	}
+	header, err := nca.ParseNCAEncryptedHeader(c.keystore, reader, uint64(partitionOffset)+file.StartOffset)
+	if err != nil {
+		return nil, err
+	}
+	// Same as nsz, only the bulk content is compressed; control and meta are left readable
+	if header.ContentType != nca.NCAContentProgram && header.ContentType != nca.NCAContentPublicData {
+		return nil, nil
+	}
+	var titleKey []byte
+	if header.HasRightsID() {
+		encryptedTitleKey, ok := titleKeys[hex.EncodeToString(header.RightsID)]
+		if !ok {
+			return nil, nca.ErrTitleKeyRequired
+		}
+		titleKey, err = nca.DecryptTitleKey(c.keystore, header, encryptedTitleKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	crypto, err := nca.GetSectionsCrypto(c.keystore, header, titleKey)
+	if err != nil {
+		return nil, err
+	}
+	return buildNSZSections(crypto, int64(file.Size))
+}
+
+// buildNSZSections converts the NCA sections into NCZ sections, filling any gaps so that everything after the header is covered
+func buildNSZSections(crypto []nca.SectionCrypto, ncaSize int64) ([]nsz.NSZSection, error) {
+	sections := []nsz.NSZSection{}
+	covered := UNCOMPRESSABLE_HEADER_SIZE
+	for _, section := range crypto {
+		end := section.Offset + section.Size
+		if end > ncaSize {
+			return nil, errors.New("NCA section extends past the end of the file")
+		}
+		if end <= covered {
+			continue
+		}
+		if section.Offset > covered {
+			sections = append(sections, nsz.NSZSection{Offset: covered, Size: section.Offset - covered, CryptoType: nca.EncTypeNone})
+		}
+		nszSection := nsz.NSZSection{
+			Offset:     section.Offset,
+			Size:       section.Size,
+			CryptoType: int64(section.EncType),
+		}
+		if section.EncType == nca.EncTypeAesCtr || section.EncType == nca.EncTypeAesCtrEx {
+			nszSection.CryptoKey = section.Key
+			nszSection.CryptoCounter = section.Counter
+		} else {
+			nszSection.CryptoType = nca.EncTypeNone // Left encrypted, so just passed through
+		}
+		sections = append(sections, nszSection)
+		covered = end
+	}
+	if covered < ncaSize {
+		sections = append(sections, nsz.NSZSection{Offset: covered, Size: ncaSize - covered, CryptoType: nca.EncTypeNone})
+	}
+	return sections, nil
+}
+
+// compressNCA writes out the NCZ form of the NCA, returning the number of bytes written
+func (c *partitionCompressor) compressNCA(ctx context.Context, reader ReaderRequired, ncaOffset, ncaSize int64, sections []nsz.NSZSection, writer io.WriteSeeker) (int64, error) {
+	start, err := writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.copyRange(writer, reader, ncaOffset, UNCOMPRESSABLE_HEADER_SIZE); err != nil {
+		return 0, err
+	}
+	if err := nsz.WriteSectionHeader(writer, sections); err != nil {
+		return 0, err
+	}
+
+	// Build up the decrypted view of the NCA after the header
+	readers := []io.Reader{}
+	for _, section := range sections {
+		sectionStart := section.Offset
+		if sectionStart < UNCOMPRESSABLE_HEADER_SIZE {
+			sectionStart = UNCOMPRESSABLE_HEADER_SIZE
+		}
+		length := section.Offset + section.Size - sectionStart
+		var sectionReader io.Reader = io.NewSectionReader(reader, ncaOffset+sectionStart, length)
+		if section.CryptoType == nca.EncTypeAesCtr || section.CryptoType == nca.EncTypeAesCtrEx {
+			decrypter, err := aesctr.NewAESCTREncrypter(sectionReader, section.CryptoKey, section.CryptoCounter, []byte{})
+			if err != nil {
+				return 0, err
+			}
+			decrypter.Seek(uint64(sectionStart))
+			sectionReader = io.LimitReader(decrypter, length)
+		}
+		readers = append(readers, sectionReader)
+	}
+	err = nsz.CompressBlocks(ctx, writer, io.MultiReader(readers...), ncaSize-UNCOMPRESSABLE_HEADER_SIZE, c.options.BlockSizeExponent, c.encoder, c.progress.add)
+	if err != nil {
+		return 0, err
+	}
+	end, err := writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	return end - start, nil
+}
+
+func (c *partitionCompressor) copyRange(writer io.Writer, reader io.ReaderAt, offset, length int64) error {
+	if _, err := io.Copy(writer, io.NewSectionReader(reader, offset, length)); err != nil {
+		return err
+	}
+	c.progress.add(length)
+	return nil
+}
@@ -0,0 +1,165 @@
+package formats
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	partitionfs "github.com/ralim/switchhost/formats/partitionFS"
+	"github.com/ralim/switchhost/keystore"
+	"github.com/ralim/switchhost/settings"
+)
+
+func loadTestKeys(t *testing.T) *keystore.Keystore {
+	keyReader, err := os.Open("../testing_files/prod.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyReader.Close()
+	keys, err := keystore.NewKeystore(keyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestCompressNSP(t *testing.T) {
+	t.Parallel()
+	keys := loadTestKeys(t)
+	nspReader, err := os.Open("../testing_files/UnitTest_[05123A0000000000].nsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nspReader.Close()
+	nspInfo, _ := nspReader.Stat()
+
+	output, err := os.Create(path.Join(t.TempDir(), "output.nsz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	lastProgress := int64(0)
+	options := CompressionOptions{Level: 18, BlockSizeExponent: 14, Progress: func(done, total int64) { lastProgress = done }}
+	if err := CompressNSP(context.Background(), keys, nspReader, output, options); err != nil {
+		t.Fatal(err)
+	}
+	if lastProgress != nspInfo.Size() {
+		t.Errorf("Progress should reach the source size, got %d wanted %d", lastProgress, nspInfo.Size())
+	}
+
+	outputInfo, _ := output.Stat()
+	if outputInfo.Size() >= nspInfo.Size() {
+		t.Errorf("Compressed file should be smaller, got %d from %d", outputInfo.Size(), nspInfo.Size())
+	}
+	partition, err := partitionfs.ReadSection(output, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nczCount := 0
+	for _, file := range partition.FileEntryTable {
+		if strings.HasSuffix(file.Name, ".ncz") {
+			nczCount++
+		}
+	}
+	if nczCount != 1 {
+		t.Errorf("Only the program NCA should be compressed, got %d NCZ files", nczCount)
+	}
+	if err := ValidateNSPHash(keys, nil, output); err != nil {
+		t.Errorf("Compressed file should validate - %v", err)
+	}
+	info, err := ParseNSPToMetaData(keys, settings.NewSettings(path.Join(t.TempDir(), "settings.json")), output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.TitleID != 0x5123A0000000000 || info.EmbeddedTitle != "UnitTest" {
+		t.Errorf("Compressed file should keep its metadata, got %+v", info)
+	}
+}
+
+// Wraps the test NSP contents into a minimal XCI, as there is no XCI test file
+func buildTestXCI(t *testing.T, nsp *os.File) []byte {
+	nspPartition, err := partitionfs.ReadSection(nsp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make([]partitionfs.FileEntryTableItem, len(nspPartition.FileEntryTable))
+	copy(files, nspPartition.FileEntryTable)
+	secureHeader, err := partitionfs.BuildHeader(partitionfs.HFS0Magic, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure := bytes.NewBuffer(secureHeader)
+	for _, file := range nspPartition.FileEntryTable {
+		data := make([]byte, file.Size)
+		if _, err := nsp.ReadAt(data, int64(file.StartOffset)); err != nil {
+			t.Fatal(err)
+		}
+		secure.Write(data)
+	}
+	rootHeader, err := partitionfs.BuildHeader(partitionfs.HFS0Magic, []partitionfs.FileEntryTableItem{
+		{Name: "update", Size: 0x200},
+		{Name: "secure", Size: uint64(secure.Len())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 0x1000)
+	copy(header[XCIHeaderMagicStringOffset:], "HEAD")
+	binary.LittleEndian.PutUint64(header[XCIRootPartionHeaderOffset:], uint64(len(header)))
+	xci := bytes.NewBuffer(header)
+	xci.Write(rootHeader)
+	xci.Write(bytes.Repeat([]byte{0x5A}, 0x200))
+	xci.Write(secure.Bytes())
+	return xci.Bytes()
+}
+
+func TestCompressXCI(t *testing.T) {
+	t.Parallel()
+	keys := loadTestKeys(t)
+	nspReader, err := os.Open("../testing_files/UnitTest_[05123A0000000000].nsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nspReader.Close()
+	xci := buildTestXCI(t, nspReader)
+	if err := ValidateXCIHash(keys, nil, bytes.NewReader(xci)); err != nil {
+		t.Fatalf("Test XCI should validate before compression - %v", err)
+	}
+
+	output, err := os.Create(path.Join(t.TempDir(), "output.xcz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	if err := CompressXCI(context.Background(), keys, bytes.NewReader(xci), output, CompressionOptions{Level: 3, BlockSizeExponent: 20}); err != nil {
+		t.Fatal(err)
+	}
+	outputInfo, _ := output.Stat()
+	if outputInfo.Size() >= int64(len(xci)) {
+		t.Errorf("Compressed file should be smaller, got %d from %d", outputInfo.Size(), len(xci))
+	}
+	if err := ValidateXCIHash(keys, nil, output); err != nil {
+		t.Errorf("Compressed file should validate - %v", err)
+	}
+	info, err := ParseXCIToMetaData(keys, settings.NewSettings(path.Join(t.TempDir(), "settings.json")), output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.TitleID != 0x5123A0000000000 {
+		t.Errorf("Compressed file should keep its metadata, got %+v", info)
+	}
+}
+
+func TestCompressBadBlockSize(t *testing.T) {
+	t.Parallel()
+	if _, err := newPartitionCompressor(nil, CompressionOptions{Level: 3, BlockSizeExponent: 4}, 0); err == nil {
+		t.Error("Should reject tiny block sizes")
+	}
+	if _, err := newPartitionCompressor(nil, CompressionOptions{Level: 3, BlockSizeExponent: 32}, 0); err == nil {
+		t.Error("Should reject block sizes too large to store")
+	}
+}
@@ -18,10 +18,17 @@ import (
 //Implements the minimum to parse the details we care about out of an NSP file
 
 func ParseNSPToMetaData(keystore *keystore.Keystore, settings *settings.Settings, reader io.ReaderAt) (FileInfo, error) {
-	info := FileInfo{}
+	details, err := ParseNSPDetails(keystore, settings, reader)
+	return details.Info, err
+}
+
+// ParseNSPDetails parses the metadata of the NSP, keeping the CNMT and NACP it was read from
+func ParseNSPDetails(keystore *keystore.Keystore, settings *settings.Settings, reader io.ReaderAt) (FileDetails, error) {
+	details := FileDetails{}
+	info := &details.Info
 	pfs0Header, err := partitionfs.ReadSection(reader, 0)
 	if err != nil {
-		return info, fmt.Errorf("reading NSP PartionFS failed with - %w", err)
+		return details, fmt.Errorf("reading NSP PartionFS failed with - %w", err)
 	}
 
 	for _, pfs0File := range pfs0Header.FileEntryTable {
@@ -29,19 +36,19 @@ func ParseNSPToMetaData(keystore *keystore.Keystore, settings *settings.Settings
 		if strings.HasSuffix(pfs0File.Name, "cnmt.nca") {
 			NCAMetaHeader, err := nca.ParseNCAEncryptedHeader(keystore, reader, pfs0File.StartOffset)
 			if err != nil {
-				return info, fmt.Errorf("ParseNCAEncryptedHeader failed with - %w", err)
+				return details, fmt.Errorf("ParseNCAEncryptedHeader failed with - %w", err)
 			}
 			section, err := nca.DecryptMetaNCADataSection(keystore, reader, NCAMetaHeader, pfs0File.StartOffset)
 			if err != nil {
-				return info, fmt.Errorf("DecryptMetaNCADataSection failed with - %w", err)
+				return details, fmt.Errorf("DecryptMetaNCADataSection failed with - %w", err)
 			}
 			currpfs0, err := partitionfs.ReadSection(bytes.NewReader(section), 0x0)
 			if err != nil {
-				return info, fmt.Errorf("ReadSection failed with - %w", err)
+				return details, fmt.Errorf("ReadSection failed with - %w", err)
 			}
 			currCnmt, err := cnmt.ParseBinary(currpfs0, section)
 			if err != nil {
-				return info, fmt.Errorf("ParseBinary failed with - %w", err)
+				return details, fmt.Errorf("ParseBinary failed with - %w", err)
 			}
 
 			if currCnmt.Type != cnmt.DLC {
@@ -49,18 +56,19 @@ func ParseNSPToMetaData(keystore *keystore.Keystore, settings *settings.Settings
 				if err != nil {
 					log.Warn().Int("type", int(currCnmt.Type)).Err(err).Msg("Failed to extract NACP info from file")
 				} else {
-					// currCnmt.Ncap = nacp
+					details.NACP = nacp
 					info.EmbeddedTitle = nacp.GetSuggestedTitle(settings)
 				}
 			}
 			//Update the info
+			details.CNMT = currCnmt
 			info.TitleID = currCnmt.TitleId
 			info.Version = currCnmt.Version
 			info.Type = currCnmt.Type
 
 		}
 	}
-	return info, nil
+	return details, nil
 }
 
 func ValidateNSPHash(keystore *keystore.Keystore, settings *settings.Settings, reader ReaderRequired) error {
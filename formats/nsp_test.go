@@ -36,3 +36,37 @@ func TestParseNSPToMetaData(t *testing.T) {
 	}
 
 }
+
+func TestParseNSPDetails(t *testing.T) {
+	keyReader, err := os.Open("../testing_files/prod.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyReader.Close()
+	keystore, err := keystore.NewKeystore(keyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nspReader, err := os.Open("../testing_files/UnitTest_[05123A0000000000].nsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nspReader.Close()
+	settings := settings.NewSettings("/tmp/units.settings")
+	details, err := ParseNSPDetails(keystore, settings, nspReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.CNMT == nil || details.CNMT.TitleId != details.Info.TitleID || len(details.CNMT.Contents) == 0 {
+		t.Errorf("Should keep the CNMT, got %+v", details.CNMT)
+	}
+	stat, _ := nspReader.Stat()
+	for _, content := range details.CNMT.Contents {
+		if content.Size == 0 || content.Size > uint64(stat.Size()) {
+			t.Errorf("%s content size %d should fit in the file", content.Type, content.Size)
+		}
+	}
+	if details.NACP == nil || details.NACP.Titles[0].Title != "UnitTest" {
+		t.Errorf("Should keep the NACP, got %+v", details.NACP)
+	}
+}
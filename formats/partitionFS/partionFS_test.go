@@ -96,3 +96,34 @@ func TestParsePFS0FailurePaths(t *testing.T) {
 	}
 
 }
+
+func TestBuildHeaderRoundTrip(t *testing.T) {
+	t.Parallel()
+	for _, magic := range []string{PFS0Magic, HFS0Magic} {
+		files := []FileEntryTableItem{
+			{Name: "first.nca", Size: 0x1234, HashedRegionSize: 0x200, Hash: bytes.Repeat([]byte{0xAA}, 0x20)},
+			{Name: "second.ncz", Size: 0x10, HashedRegionSize: 0x10, Hash: bytes.Repeat([]byte{0x55}, 0x20)},
+		}
+		header, err := BuildHeader(magic, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ReadSection(bytes.NewReader(header), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.HeaderLen != len(header) {
+			t.Errorf("%s header length mismatch %d != %d", magic, parsed.HeaderLen, len(header))
+		}
+		if len(parsed.FileEntryTable) != 2 {
+			t.Fatalf("%s should have 2 files, got %d", magic, len(parsed.FileEntryTable))
+		}
+		second := parsed.FileEntryTable[1]
+		if second.Name != "second.ncz" || second.Size != 0x10 || second.StartOffset != uint64(len(header))+0x1234 {
+			t.Errorf("%s second file parsed wrong %+v", magic, second)
+		}
+		if magic == HFS0Magic && (second.HashedRegionSize != 0x10 || !bytes.Equal(second.Hash, files[1].Hash)) {
+			t.Errorf("HFS0 hashes should be kept %+v", second)
+		}
+	}
+}
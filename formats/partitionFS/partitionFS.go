@@ -28,6 +28,9 @@ type FileEntryTableItem struct {
 	StartOffset uint64
 	Size        uint64
 	Name        string
+	// HFS0 only, hash of the start of the file
+	HashedRegionSize uint32
+	Hash             []byte
 }
 
 // PartionFS struct is the parsed representation of the file header PFS0/HFS0 section
@@ -88,7 +91,10 @@ func parseFileEntryTableAndStrings(fileCount, headerLength, fileEntryTableSize i
 		files[i].Size = binary.LittleEndian.Uint64(data[recordStart+0x08 : recordStart+0x10])
 		stringOffset := binary.LittleEndian.Uint32(data[recordStart+0x10 : recordStart+0x14])
 		//here after is either padding (PFS0) or more checksum info (HFS0)
-		// For now we dont care
+		if fileEntryTableSize == HFSfileEntryTableSize {
+			files[i].HashedRegionSize = binary.LittleEndian.Uint32(data[recordStart+0x14 : recordStart+0x18])
+			files[i].Hash = data[recordStart+0x20 : recordStart+0x40]
+		}
 		stringStart := stringTableStartsAt + int(stringOffset)
 		if stringStart >= len(data) {
 			return files, fmt.Errorf("corrupted File Table Entry, decoded string length beyond end of header for entry %d, gave %d", i, stringStart)
@@ -0,0 +1,66 @@
+package partitionfs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Building new PFS0/HFS0 headers, used when repacking files (such as during compression)
+// Files are laid out back to back in the order given, straight after the header
+
+const (
+	pfs0HeaderAlignment = 0x10
+	hfs0HeaderAlignment = 0x200 // Cartridge media unit size
+)
+
+// BuildHeader creates the header for a partition holding the provided files
+// StartOffset of the files is ignored and recalculated, Size and Name are used; and for HFS0 the hash fields are also written
+// The string table is padded so that the file data starts aligned
+func BuildHeader(magic string, files []FileEntryTableItem) ([]byte, error) {
+	entrySize := 0
+	alignment := 0
+	switch magic {
+	case PFS0Magic:
+		entrySize = PFSfileEntryTableSize
+		alignment = pfs0HeaderAlignment
+	case HFS0Magic:
+		entrySize = HFSfileEntryTableSize
+		alignment = hfs0HeaderAlignment
+	default:
+		return nil, fmt.Errorf("invalid filesystem magic. Wanted %s/%s, got >%s<", PFS0Magic, HFS0Magic, magic)
+	}
+
+	stringTable := []byte{}
+	stringOffsets := make([]int, len(files))
+	for i, file := range files {
+		stringOffsets[i] = len(stringTable)
+		stringTable = append(stringTable, []byte(file.Name)...)
+		stringTable = append(stringTable, 0)
+	}
+	headerLen := PFSStaticHeaderLength + (entrySize * len(files)) + len(stringTable)
+	if remainder := headerLen % alignment; remainder != 0 {
+		padding := alignment - remainder
+		stringTable = append(stringTable, make([]byte, padding)...)
+		headerLen += padding
+	}
+
+	header := make([]byte, headerLen)
+	copy(header[0:4], magic)
+	binary.LittleEndian.PutUint32(header[0x4:0x8], uint32(len(files)))
+	binary.LittleEndian.PutUint32(header[0x8:0xC], uint32(len(stringTable)))
+
+	dataOffset := uint64(0)
+	for i, file := range files {
+		entry := header[PFSStaticHeaderLength+(entrySize*i) : PFSStaticHeaderLength+(entrySize*(i+1))]
+		binary.LittleEndian.PutUint64(entry[0x00:0x08], dataOffset)
+		binary.LittleEndian.PutUint64(entry[0x08:0x10], file.Size)
+		binary.LittleEndian.PutUint32(entry[0x10:0x14], uint32(stringOffsets[i]))
+		if magic == HFS0Magic {
+			binary.LittleEndian.PutUint32(entry[0x14:0x18], file.HashedRegionSize)
+			copy(entry[0x20:0x40], file.Hash)
+		}
+		dataOffset += file.Size
+	}
+	copy(header[PFSStaticHeaderLength+(entrySize*len(files)):], stringTable)
+	return header, nil
+}
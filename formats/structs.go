@@ -4,6 +4,7 @@ import (
 	"io"
 
 	cnmt "github.com/ralim/switchhost/formats/CNMT"
+	nacp "github.com/ralim/switchhost/formats/NACP"
 )
 
 type FileType uint8
@@ -20,6 +21,13 @@ type FileInfo struct {
 	Size          int64
 }
 
+// FileDetails is the FileInfo along with the raw metadata it was parsed from
+type FileDetails struct {
+	Info FileInfo
+	CNMT *cnmt.ContentMetaAttributes
+	NACP *nacp.NACP // nil for DLC, or if it couldn't be read
+}
+
 type ReaderRequired interface {
 	io.ReadSeeker
 	io.ReaderAt
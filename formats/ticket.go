@@ -0,0 +1,50 @@
+package formats
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// Tickets hold the (encrypted) title key for NCA's that use a rights ID
+// Only common tickets are supported, as personalised ones need the console's keys
+// https://switchbrew.org/wiki/Ticket
+
+const (
+	ticketTitleKeyOffset  = 0x40
+	ticketKeyTypeOffset   = 0x141
+	ticketRightsIDOffset  = 0x160
+	ticketDataLength      = 0x180
+	ticketTitleKeyCommon  = 0
+	ticketSignatureLength = 4
+)
+
+var ticketSignatureSizes = map[uint32]int{
+	0x010000: 0x200 + 0x3C, // RSA_4096 SHA1
+	0x010001: 0x100 + 0x3C, // RSA_2048 SHA1
+	0x010002: 0x3C + 0x40,  // ECDSA SHA1
+	0x010003: 0x200 + 0x3C, // RSA_4096 SHA256
+	0x010004: 0x100 + 0x3C, // RSA_2048 SHA256
+	0x010005: 0x3C + 0x40,  // ECDSA SHA256
+}
+
+// parseTicket returns the rights ID (as hex) and the encrypted title key held in a ticket
+func parseTicket(ticket []byte) (string, []byte, error) {
+	if len(ticket) < ticketSignatureLength {
+		return "", nil, fmt.Errorf("ticket too short")
+	}
+	signatureType := binary.LittleEndian.Uint32(ticket[0:4])
+	signatureSize, ok := ticketSignatureSizes[signatureType]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown ticket signature type %X", signatureType)
+	}
+	data := ticket[ticketSignatureLength+signatureSize:]
+	if len(data) < ticketDataLength {
+		return "", nil, fmt.Errorf("ticket too short")
+	}
+	if data[ticketKeyTypeOffset] != ticketTitleKeyCommon {
+		return "", nil, fmt.Errorf("only common tickets are supported")
+	}
+	rightsID := hex.EncodeToString(data[ticketRightsIDOffset : ticketRightsIDOffset+0x10])
+	return rightsID, data[ticketTitleKeyOffset : ticketTitleKeyOffset+0x10], nil
+}
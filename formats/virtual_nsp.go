@@ -0,0 +1,154 @@
+package formats
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	nsz "github.com/ralim/switchhost/formats/NSZ"
+	partitionfs "github.com/ralim/switchhost/formats/partitionFS"
+)
+
+// VirtualNSP presents an NSZ as the NSP it was compressed from, without writing anything to disk
+// A new PFS0 header is generated with the NCZ's renamed back to NCA's at their original sizes
+// NCZ's are decompressed as they are read, everything else is read straight from the NSZ
+
+type virtualNSPFile struct {
+	start        int64 // Offset of the file in the virtual NSP
+	size         int64 // Size of the file in the virtual NSP
+	sourceOffset int64 // Offset of the file in the NSZ
+	sourceSize   int64 // Size of the file in the NSZ
+	compressed   bool
+}
+
+type VirtualNSP struct {
+	source ReaderRequired
+	header []byte
+	files  []virtualNSPFile
+	size   int64
+}
+
+// NewVirtualNSP parses the NSZ in source and works out the layout of the NSP it expands to
+func NewVirtualNSP(source ReaderRequired) (*VirtualNSP, error) {
+	pfs0Header, err := partitionfs.ReadSection(source, 0)
+	if err != nil {
+		return nil, err
+	}
+	nsp := &VirtualNSP{source: source}
+	entries := make([]partitionfs.FileEntryTableItem, len(pfs0Header.FileEntryTable))
+	for i, file := range pfs0Header.FileEntryTable {
+		entries[i] = partitionfs.FileEntryTableItem{Name: file.Name, Size: file.Size}
+		virtualFile := virtualNSPFile{
+			size:         int64(file.Size),
+			sourceOffset: int64(file.StartOffset),
+			sourceSize:   int64(file.Size),
+		}
+		if strings.HasSuffix(file.Name, ".ncz") {
+			nczReader, err := nsz.NewNCZReader(io.NewSectionReader(source, virtualFile.sourceOffset, virtualFile.sourceSize))
+			if err != nil {
+				return nil, err
+			}
+			virtualFile.size = nczReader.Size()
+			virtualFile.compressed = true
+			nczReader.Close()
+			entries[i].Name = strings.TrimSuffix(file.Name, ".ncz") + ".nca"
+			entries[i].Size = uint64(virtualFile.size)
+		}
+		nsp.files = append(nsp.files, virtualFile)
+	}
+	nsp.header, err = partitionfs.BuildHeader(partitionfs.PFS0Magic, entries)
+	if err != nil {
+		return nil, err
+	}
+	nsp.size = int64(len(nsp.header))
+	for i := range nsp.files {
+		nsp.files[i].start = nsp.size
+		nsp.size += nsp.files[i].size
+	}
+	return nsp, nil
+}
+
+// Size is the size of the NSP
+func (v *VirtualNSP) Size() int64 {
+	return v.size
+}
+
+// NewReader returns a new reader over the NSP, each reader has its own position so they can be used concurrently
+func (v *VirtualNSP) NewReader() *VirtualNSPReader {
+	return &VirtualNSPReader{nsp: v, currentFile: -1}
+}
+
+// VirtualNSPReader reads the NSP, implementing io.ReadSeeker
+type VirtualNSPReader struct {
+	nsp         *VirtualNSP
+	position    int64
+	currentFile int // File the NCZ reader is open for, -1 if none
+	ncz         *nsz.NCZReader
+}
+
+func (r *VirtualNSPReader) Read(p []byte) (int, error) {
+	if r.position >= r.nsp.size {
+		return 0, io.EOF
+	}
+	if r.position < int64(len(r.nsp.header)) {
+		n := copy(p, r.nsp.header[r.position:])
+		r.position += int64(n)
+		return n, nil
+	}
+	for i, file := range r.nsp.files {
+		if r.position < file.start || r.position >= file.start+file.size {
+			continue
+		}
+		offset := r.position - file.start
+		if remaining := file.size - offset; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		var n int
+		var err error
+		if file.compressed {
+			if r.currentFile != i {
+				r.Close()
+				r.ncz, err = nsz.NewNCZReader(io.NewSectionReader(r.nsp.source, file.sourceOffset, file.sourceSize))
+				if err != nil {
+					return 0, err
+				}
+				r.currentFile = i
+			}
+			if _, err = r.ncz.Seek(offset, io.SeekStart); err != nil {
+				return 0, err
+			}
+			n, err = r.ncz.Read(p)
+		} else {
+			n, err = r.nsp.source.ReadAt(p, file.sourceOffset+offset)
+		}
+		r.position += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+	return 0, io.ErrUnexpectedEOF
+}
+
+func (r *VirtualNSPReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.position
+	case io.SeekEnd:
+		offset += r.nsp.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of NSP")
+	}
+	r.position = offset
+	return offset, nil
+}
+
+// Close releases the decompressor, the source is left open
+func (r *VirtualNSPReader) Close() {
+	if r.ncz != nil {
+		r.ncz.Close()
+		r.ncz = nil
+	}
+	r.currentFile = -1
+}
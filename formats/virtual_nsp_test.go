@@ -0,0 +1,79 @@
+package formats
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	partitionfs "github.com/ralim/switchhost/formats/partitionFS"
+)
+
+func TestVirtualNSP(t *testing.T) {
+	t.Parallel()
+	keys := loadTestKeys(t)
+	original, err := os.ReadFile("../testing_files/UnitTest_[05123A0000000000].nsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := os.Create(path.Join(t.TempDir(), "UnitTest.nsz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressed.Close()
+	// Small blocks so that reads cross block boundaries
+	if err := CompressNSP(context.Background(), keys, bytes.NewReader(original), compressed, CompressionOptions{Level: 3, BlockSizeExponent: 14}); err != nil {
+		t.Fatal(err)
+	}
+
+	nsp, err := NewVirtualNSP(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded, err := io.ReadAll(nsp.NewReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(expanded)) != nsp.Size() {
+		t.Fatalf("Read %d bytes, but size was reported as %d", len(expanded), nsp.Size())
+	}
+	if err := ValidateNSPHash(keys, nil, bytes.NewReader(expanded)); err != nil {
+		t.Errorf("Expanded NSP should validate - %v", err)
+	}
+
+	// Every file should come back byte for byte
+	originalPartition, _ := partitionfs.ReadSection(bytes.NewReader(original), 0)
+	expandedPartition, err := partitionfs.ReadSection(bytes.NewReader(expanded), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, file := range originalPartition.FileEntryTable {
+		expandedFile := expandedPartition.FileEntryTable[i]
+		if expandedFile.Name != file.Name || expandedFile.Size != file.Size {
+			t.Errorf("File entry mismatch %+v != %+v", expandedFile, file)
+			continue
+		}
+		if !bytes.Equal(original[file.StartOffset:file.StartOffset+file.Size], expanded[expandedFile.StartOffset:expandedFile.StartOffset+expandedFile.Size]) {
+			t.Errorf("File %s content does not match", file.Name)
+		}
+	}
+
+	// Random access should match the sequential read
+	reader := nsp.NewReader()
+	defer reader.Close()
+	for _, offset := range []int64{nsp.Size() - 100, 0x10, 0x20000, 0x4001, nsp.Size() / 2, 0x20000 + 0x3FF0} {
+		if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 0x9000)
+		n, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatalf("Reading at %X failed - %v", offset, err)
+		}
+		if !bytes.Equal(buffer[:n], expanded[offset:offset+int64(n)]) {
+			t.Errorf("Read at %X does not match", offset)
+		}
+	}
+}
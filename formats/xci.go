@@ -23,25 +23,32 @@ const (
 )
 
 func ParseXCIToMetaData(keystore *keystore.Keystore, settings *settings.Settings, reader io.ReaderAt) (FileInfo, error) {
-	info := FileInfo{}
+	details, err := ParseXCIDetails(keystore, settings, reader)
+	return details.Info, err
+}
+
+// ParseXCIDetails parses the metadata of the XCI, keeping the CNMT and NACP it was read from
+func ParseXCIDetails(keystore *keystore.Keystore, settings *settings.Settings, reader io.ReaderAt) (FileDetails, error) {
+	details := FileDetails{}
+	info := &details.Info
 	header := make([]byte, XCIHeaderSize)
 	if _, err := reader.ReadAt(header, 0); err != nil {
-		return info, fmt.Errorf("reading XCI header failed %w", err)
+		return details, fmt.Errorf("reading XCI header failed %w", err)
 	}
 	XCIHeaderString := string(header[XCIHeaderMagicStringOffset : XCIHeaderMagicStringOffset+4])
 	if XCIHeaderString != "HEAD" {
-		return info, fmt.Errorf("invalid XCI headerBytes. Expected 'HEAD', got >%s<", XCIHeaderString)
+		return details, fmt.Errorf("invalid XCI headerBytes. Expected 'HEAD', got >%s<", XCIHeaderString)
 	}
 
 	rootPartitionOffset := binary.LittleEndian.Uint64(header[XCIRootPartionHeaderOffset : XCIRootPartionHeaderOffset+8])
 	rootHfs0, err := partitionfs.ReadSection(reader, int64(rootPartitionOffset))
 	if err != nil {
-		return info, fmt.Errorf("reading XCI PartionFS failed with - %w", err)
+		return details, fmt.Errorf("reading XCI PartionFS failed with - %w", err)
 	}
 
 	secureHfs0, secureOffset, err := readSecurePartition(reader, rootHfs0, rootPartitionOffset)
 	if err != nil {
-		return info, err
+		return details, err
 	}
 
 	for _, pfs0File := range secureHfs0.FileEntryTable {
@@ -52,20 +59,20 @@ func ParseXCIToMetaData(keystore *keystore.Keystore, settings *settings.Settings
 
 			NCAMetaHeader, err := nca.ParseNCAEncryptedHeader(keystore, reader, uint64(fileOffset))
 			if err != nil {
-				return info, fmt.Errorf("ParseNCAEncryptedHeader failed with - %w", err)
+				return details, fmt.Errorf("ParseNCAEncryptedHeader failed with - %w", err)
 			}
 			section, err := nca.DecryptMetaNCADataSection(keystore, reader, NCAMetaHeader, uint64(fileOffset))
 			if err != nil {
-				return info, fmt.Errorf("DecryptMetaNCADataSection failed with - %w", err)
+				return details, fmt.Errorf("DecryptMetaNCADataSection failed with - %w", err)
 			}
 			currpfs0, err := partitionfs.ReadSection(bytes.NewReader(section), 0x0)
 			if err != nil {
-				return info, fmt.Errorf("ReadSection failed with - %w", err)
+				return details, fmt.Errorf("ReadSection failed with - %w", err)
 			}
 
 			currCnmt, err := cnmt.ParseBinary(currpfs0, section)
 			if err != nil {
-				return info, fmt.Errorf("ParseBinary failed with - %w", err)
+				return details, fmt.Errorf("ParseBinary failed with - %w", err)
 			}
 
 			if currCnmt.Type != cnmt.DLC {
@@ -73,17 +80,18 @@ func ParseXCIToMetaData(keystore *keystore.Keystore, settings *settings.Settings
 				if err != nil {
 					log.Warn().Int("type", int(currCnmt.Type)).Err(err).Msg("Failed to extract NACP info from file")
 				} else {
-					// currCnmt.Ncap = nacp
+					details.NACP = nacp
 					info.EmbeddedTitle = nacp.GetSuggestedTitle(settings)
 				}
 			}
 			//Update the info
+			details.CNMT = currCnmt
 			info.TitleID = currCnmt.TitleId
 			info.Version = currCnmt.Version
 			info.Type = currCnmt.Type
 		}
 	}
-	return info, nil
+	return details, nil
 }
 
 func readSecurePartition(file io.ReaderAt, hfs0 *partitionfs.PartionFS, rootPartitionOffset uint64) (*partitionfs.PartionFS, int64, error) {
@@ -3,12 +3,17 @@ module github.com/ralim/switchhost
 go 1.24
 
 require (
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/jaffee/commandeer v0.6.0
 	github.com/justinas/alice v1.2.0
 	github.com/klauspost/compress v1.19.0
 	github.com/rivo/tview v0.42.0
 	github.com/rs/zerolog v1.35.1
+	github.com/spf13/cobra v1.9.1
+	github.com/spf13/pflag v1.0.6
 	goftp.io/server/v2 v2.0.3
+	golang.org/x/crypto v0.39.0
+	golang.org/x/sys v0.33.0
 )
 
 require (
@@ -21,9 +26,6 @@ require (
 	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/rs/xid v1.6.0 // indirect
-	github.com/spf13/cobra v1.9.1 // indirect
-	github.com/spf13/pflag v1.0.6 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/term v0.32.0 // indirect
 	golang.org/x/text v0.26.0 // indirect
 )
@@ -0,0 +1,173 @@
+package index
+
+import (
+	"strconv"
+	"strings"
+
+	cnmt "github.com/ralim/switchhost/formats/CNMT"
+	"github.com/ralim/switchhost/settings"
+	"github.com/rs/zerolog/log"
+)
+
+// AccessFilter limits the files a user can see, following the allow and deny rules of their account
+// A nil filter allows everything
+type AccessFilter struct {
+	allow []accessRule
+	deny  []accessRule
+}
+
+// accessRule is a parsed settings.AccessRule, zero values match anything
+type accessRule struct {
+	titleID     uint64
+	baseTitle   uint64
+	contentType cnmt.MetaType
+	tagged      map[uint64]bool // TitleIDs in the tag, base TitleIDs also match their updates and DLC
+	broken      bool            // Rules that couldn't be parsed never allow, and always deny
+}
+
+// NewAccessFilter builds the filter for the user, returns nil if the user has no rules
+func NewAccessFilter(user settings.AuthUser, tags map[string][]string) *AccessFilter {
+	if len(user.Allow) == 0 && len(user.Deny) == 0 {
+		return nil
+	}
+	filter := &AccessFilter{}
+	for _, rule := range user.Allow {
+		filter.allow = append(filter.allow, parseAccessRule(user.Username, rule, tags))
+	}
+	for _, rule := range user.Deny {
+		filter.deny = append(filter.deny, parseAccessRule(user.Username, rule, tags))
+	}
+	return filter
+}
+
+func parseAccessRule(username string, rule settings.AccessRule, tags map[string][]string) accessRule {
+	parsed := accessRule{}
+	fail := func(reason string) accessRule {
+		log.Warn().Str("user", username).Interface("rule", rule).Msg("Bad access rule, " + reason)
+		return accessRule{broken: true}
+	}
+	var err error
+	if len(rule.TitleID) > 0 {
+		if parsed.titleID, err = ParseHexTitleID(rule.TitleID); err != nil {
+			return fail("bad titleID")
+		}
+	}
+	if len(rule.BaseTitle) > 0 {
+		if parsed.baseTitle, err = ParseHexTitleID(rule.BaseTitle); err != nil {
+			return fail("bad baseTitle")
+		}
+		parsed.baseTitle &= 0xFFFFFFFFFFFFE000
+	}
+	switch strings.ToLower(rule.Type) {
+	case "":
+	case "base":
+		parsed.contentType = cnmt.BaseGame
+	case "update":
+		parsed.contentType = cnmt.Update
+	case "dlc":
+		parsed.contentType = cnmt.DLC
+	default:
+		return fail("unknown type")
+	}
+	if len(rule.Tag) > 0 {
+		titles, ok := tags[rule.Tag]
+		if !ok {
+			return fail("unknown tag")
+		}
+		parsed.tagged = make(map[uint64]bool)
+		for _, title := range titles {
+			titleID, err := ParseHexTitleID(title)
+			if err != nil {
+				return fail("bad titleID in tag")
+			}
+			parsed.tagged[titleID] = true
+		}
+	}
+	return parsed
+}
+
+// ParseHexTitleID parses a TitleID written in hex, with or without a 0x prefix
+func ParseHexTitleID(titleID string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(titleID), "0x"), 16, 64)
+}
+
+// ContentTypeOf works out the type from the TitleID, the same way the index sorts files
+func ContentTypeOf(titleID uint64) cnmt.MetaType {
+	baseTitle := titleID & 0xFFFFFFFFFFFFE000
+	if baseTitle == titleID {
+		return cnmt.BaseGame
+	} else if (titleID & 0x0000000000000800) == 0x800 {
+		return cnmt.Update
+	}
+	return cnmt.DLC
+}
+
+func (rule accessRule) matches(file FileOnDiskRecord) bool {
+	if rule.broken {
+		return false
+	}
+	baseTitle := file.TitleID & 0xFFFFFFFFFFFFE000
+	if rule.titleID != 0 && rule.titleID != file.TitleID {
+		return false
+	}
+	if rule.baseTitle != 0 && rule.baseTitle != baseTitle {
+		return false
+	}
+	if rule.contentType != cnmt.Unknown && rule.contentType != ContentTypeOf(file.TitleID) {
+		return false
+	}
+	if rule.tagged != nil && !rule.tagged[file.TitleID] && !rule.tagged[baseTitle] {
+		return false
+	}
+	return true
+}
+
+// Allows returns true if the user can see the file
+func (f *AccessFilter) Allows(file FileOnDiskRecord) bool {
+	if f == nil {
+		return true
+	}
+	for _, rule := range f.deny {
+		if rule.broken || rule.matches(file) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, rule := range f.allow {
+		if rule.matches(file) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsTitleID returns true if the user can see the title, update or DLC with this ID
+func (f *AccessFilter) AllowsTitleID(titleID uint64) bool {
+	return f.Allows(FileOnDiskRecord{TitleID: titleID})
+}
+
+// Filter returns the files the user can see
+func (f *AccessFilter) Filter(files []FileOnDiskRecord) []FileOnDiskRecord {
+	if f == nil {
+		return files
+	}
+	values := make([]FileOnDiskRecord, 0, len(files))
+	for _, file := range files {
+		if f.Allows(file) {
+			values = append(values, file)
+		}
+	}
+	return values
+}
+
+// AllowsAny returns true if the user can see any of the files, used for showing the title the files belong to
+func (f *AccessFilter) AllowsAny(files []FileOnDiskRecord) bool {
+	for _, file := range files {
+		if f.Allows(file) {
+			return true
+		}
+	}
+	return false
+}
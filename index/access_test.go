@@ -0,0 +1,51 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/ralim/switchhost/settings"
+)
+
+func TestAccessFilter(t *testing.T) {
+	t.Parallel()
+	base := FileOnDiskRecord{TitleID: 0x0100000000010000}
+	update := FileOnDiskRecord{TitleID: 0x0100000000010800}
+	dlc := FileOnDiskRecord{TitleID: 0x0100000000011001}
+	other := FileOnDiskRecord{TitleID: 0x0100000000020000}
+	tags := map[string][]string{"kids": {"0100000000010000"}, "broken": {"zz"}}
+
+	tests := []struct {
+		name  string
+		user  settings.AuthUser
+		allow []bool // base, update, dlc, other
+	}{
+		{"no rules", settings.AuthUser{}, []bool{true, true, true, true}},
+		{"deny dlc", settings.AuthUser{Deny: []settings.AccessRule{{Type: "dlc"}}}, []bool{true, true, false, true}},
+		{"allow base title", settings.AuthUser{Allow: []settings.AccessRule{{BaseTitle: "0100000000010000"}}}, []bool{true, true, true, false}},
+		{"allow exact title", settings.AuthUser{Allow: []settings.AccessRule{{TitleID: "0x0100000000010800"}}}, []bool{false, true, false, false}},
+		{"allow tag without dlc", settings.AuthUser{Allow: []settings.AccessRule{{Tag: "kids"}}, Deny: []settings.AccessRule{{Type: "DLC"}}}, []bool{true, true, false, false}},
+		{"allow tag and type", settings.AuthUser{Allow: []settings.AccessRule{{Tag: "kids", Type: "base"}}}, []bool{true, false, false, false}},
+		{"unknown tag allows nothing", settings.AuthUser{Allow: []settings.AccessRule{{Tag: "nope"}}}, []bool{false, false, false, false}},
+		{"broken deny hides everything", settings.AuthUser{Deny: []settings.AccessRule{{Tag: "broken"}}}, []bool{false, false, false, false}},
+	}
+	for _, test := range tests {
+		filter := NewAccessFilter(test.user, tags)
+		for i, file := range []FileOnDiskRecord{base, update, dlc, other} {
+			if filter.Allows(file) != test.allow[i] {
+				t.Errorf("%s: file %016X should be allowed=%v", test.name, file.TitleID, test.allow[i])
+			}
+		}
+	}
+
+	filter := NewAccessFilter(settings.AuthUser{Deny: []settings.AccessRule{{Type: "dlc"}}}, nil)
+	if files := filter.Filter([]FileOnDiskRecord{base, dlc}); len(files) != 1 || files[0].TitleID != base.TitleID {
+		t.Errorf("Filter should drop the DLC, got %+v", files)
+	}
+	if filter.AllowsAny([]FileOnDiskRecord{dlc}) || !filter.AllowsAny([]FileOnDiskRecord{dlc, update}) {
+		t.Error("AllowsAny should be true if any file is allowed")
+	}
+	var noFilter *AccessFilter
+	if !noFilter.Allows(dlc) || len(noFilter.Filter([]FileOnDiskRecord{dlc})) != 1 {
+		t.Error("nil filter should allow everything")
+	}
+}
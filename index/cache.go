@@ -0,0 +1,118 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The index cache persists the known file records to disk so that on the next startup
+// files that have not changed (same size and modification time) can skip metadata parsing.
+// The cache is only ever advisory, if it is missing, stale or corrupt we just fall back to parsing the files
+
+const indexCacheVersion = 2 // 2 added EmbeddedTitle
+
+type indexCacheFile struct {
+	Version int                `json:"version"`
+	Files   []FileOnDiskRecord `json:"files"`
+}
+
+// LoadCache reads a previously saved cache file, making its records available to LookupCache
+func (idx *Index) LoadCache(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read index cache %s - %w", path, err)
+	}
+	cache := indexCacheFile{}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return fmt.Errorf("couldn't parse index cache %s - %w", path, err)
+	}
+	if cache.Version != indexCacheVersion {
+		return fmt.Errorf("index cache %s is version %d, wanted %d", path, cache.Version, indexCacheVersion)
+	}
+	records := make(map[string]FileOnDiskRecord, len(cache.Files))
+	for _, record := range cache.Files {
+		records[record.Path] = record
+	}
+
+	idx.cacheLock.Lock()
+	defer idx.cacheLock.Unlock()
+	idx.cachedRecords = records
+	return nil
+}
+
+// LookupCache returns the cached record for the file at path, if the file on disk still matches the cached size and modification time
+func (idx *Index) LookupCache(path string, size int64, modTime int64) (FileOnDiskRecord, bool) {
+	idx.cacheLock.RLock()
+	defer idx.cacheLock.RUnlock()
+	record, ok := idx.cachedRecords[path]
+	if !ok || record.Size != size || record.ModTime != modTime {
+		return FileOnDiskRecord{}, false
+	}
+	return record, true
+}
+
+// CacheDirty returns true if the index has changed since the cache was last saved
+func (idx *Index) CacheDirty() bool {
+	idx.RWMutex.RLocker().Lock()
+	defer idx.RWMutex.RLocker().Unlock()
+	return idx.cacheDirty
+}
+
+// SaveCache writes all currently tracked records out to the cache file at path
+// The file is written to a temporary file first and then moved into place so a crash can't leave a half written cache
+func (idx *Index) SaveCache(path string) (err error) {
+	// Clear the dirty flag before snapshotting, so changes made while saving are caught next time
+	idx.setCacheDirty(false)
+	defer func() {
+		if err != nil {
+			idx.setCacheDirty(true)
+		}
+	}()
+	cache := indexCacheFile{
+		Version: indexCacheVersion,
+		Files:   idx.ListFiles(),
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return fmt.Errorf("couldn't JSON'ify index cache - %w", err)
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("couldn't create temp file for index cache - %w", err)
+	}
+	defer os.Remove(tempFile.Name()) // No-op once renamed
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("couldn't write index cache - %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("couldn't write index cache - %w", err)
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return fmt.Errorf("couldn't move index cache into place - %w", err)
+	}
+	return nil
+}
+
+// Export writes all currently tracked records as indented json, sorted by path
+// This is the same format as the cache file, so an export can be used as another instance's cache
+func (idx *Index) Export(writer io.Writer) error {
+	files := idx.ListFiles()
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(indexCacheFile{Version: indexCacheVersion, Files: files}); err != nil {
+		return fmt.Errorf("couldn't export index - %w", err)
+	}
+	return nil
+}
+
+func (idx *Index) setCacheDirty(dirty bool) {
+	idx.RWMutex.Lock()
+	defer idx.RWMutex.Unlock()
+	idx.cacheDirty = dirty
+}
@@ -0,0 +1,107 @@
+package index
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestIndexCacheRoundTrip(t *testing.T) {
+	t.Parallel()
+	tempFolder, err := os.MkdirTemp("", "unit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempFolder)
+	cachePath := path.Join(tempFolder, "index_cache.json")
+
+	idx := NewIndex(nil, nil)
+	idx.AddFileRecord(&FileOnDiskRecord{
+		Path:          "/library/game.nsp",
+		TitleID:       0x50000,
+		Version:       0,
+		Name:          "Test base game",
+		Size:          132,
+		ModTime:       1234,
+		EmbeddedTitle: "Test embedded title",
+	})
+	if !idx.CacheDirty() {
+		t.Error("Adding a record should mark the cache dirty")
+	}
+	if err := idx.SaveCache(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	if idx.CacheDirty() {
+		t.Error("Saving should clear the dirty flag")
+	}
+
+	loaded := NewIndex(nil, nil)
+	if err := loaded.LoadCache(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	record, ok := loaded.LookupCache("/library/game.nsp", 132, 1234)
+	if !ok {
+		t.Fatal("Should find unchanged file in cache")
+	}
+	if record.TitleID != 0x50000 || record.Name != "Test base game" || record.EmbeddedTitle != "Test embedded title" {
+		t.Errorf("Cached record doesnt match, got %+v", record)
+	}
+	if _, ok := loaded.LookupCache("/library/game.nsp", 133, 1234); ok {
+		t.Error("Should miss when size changed")
+	}
+	if _, ok := loaded.LookupCache("/library/game.nsp", 132, 1235); ok {
+		t.Error("Should miss when mtime changed")
+	}
+	if len(loaded.ListFiles()) != 0 {
+		t.Error("Loading cache should not add records to the index itself")
+	}
+}
+
+func TestIndexCacheCorrupt(t *testing.T) {
+	t.Parallel()
+	tempFile, err := os.CreateTemp("", "index_cache_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, _ = tempFile.WriteString("{not json")
+	tempFile.Close()
+
+	idx := NewIndex(nil, nil)
+	if err := idx.LoadCache(tempFile.Name()); err == nil {
+		t.Error("Should error on corrupt cache")
+	}
+	if _, ok := idx.LookupCache("/library/game.nsp", 0, 0); ok {
+		t.Error("Corrupt cache should not give any hits")
+	}
+	if err := idx.LoadCache(path.Join(os.TempDir(), "does_not_exist_cache.json")); err == nil {
+		t.Error("Should error on missing cache")
+	}
+}
+
+func TestIndexExport(t *testing.T) {
+	t.Parallel()
+	idx := NewIndex(nil, nil)
+	idx.AddFileRecord(&FileOnDiskRecord{Path: "/library/b.nsp", TitleID: 0x50000, Name: "B"})
+	idx.AddFileRecord(&FileOnDiskRecord{Path: "/library/a.nsp", TitleID: 0x70000, Name: "A"})
+	exported := &bytes.Buffer{}
+	if err := idx.Export(exported); err != nil {
+		t.Fatal(err)
+	}
+	cachePath := path.Join(t.TempDir(), "index_cache.json")
+	if err := os.WriteFile(cachePath, exported.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewIndex(nil, nil)
+	if err := loaded.LoadCache(cachePath); err != nil {
+		t.Fatalf("Export should load as a cache, got %v", err)
+	}
+	if _, ok := loaded.LookupCache("/library/a.nsp", 0, 0); !ok {
+		t.Error("Exported records should be in the cache")
+	}
+	if first, second := strings.Index(exported.String(), "a.nsp"), strings.Index(exported.String(), "b.nsp"); first > second {
+		t.Error("Export should be sorted by path")
+	}
+}
@@ -1,6 +1,10 @@
 package index
 
-import "strings"
+import (
+	"strings"
+
+	cnmt "github.com/ralim/switchhost/formats/CNMT"
+)
 
 type FileOnDiskRecord struct {
 	Path    string
@@ -8,6 +12,22 @@ type FileOnDiskRecord struct {
 	Version uint32
 	Name    string
 	Size    int64
+	ModTime int64         // Modification time (unix nanoseconds) of the file when it was indexed
+	Type    cnmt.MetaType // Content type parsed out of the CNMT
+	NSPSize int64         // For NSZ files, the size of the NSP it expands to when served as one
+
+	EmbeddedTitle string // Title from the file's own NACP, Name may be from the TitleDB instead
+
+	LastVerified int64  // When the file's hashes were last checked (unix nanoseconds), 0 if never
+	VerifyResult string // VerifyOK, or the error from the last check
+}
+
+// VerifyOK is the VerifyResult of a file that passed its last check
+const VerifyOK = "ok"
+
+// VerifyFailed returns true if the last check of the file found it did not match its hashes
+func (r FileOnDiskRecord) VerifyFailed() bool {
+	return r.LastVerified != 0 && r.VerifyResult != VerifyOK
 }
 
 // ByName implements sort.Interface based on the Name field.
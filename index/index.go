@@ -4,6 +4,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 
@@ -23,38 +25,61 @@ type Index struct {
 	settings *settings.Settings
 
 	filesKnown map[uint64]TitleOnDiskCollection
+	cacheDirty bool // Set when filesKnown changes, cleared when the cache is saved
+	remover    FileRemover
+
+	// Records loaded from the on disk cache, used to skip parsing unchanged files
+	cacheLock     sync.RWMutex
+	cachedRecords map[string]FileOnDiskRecord
 }
 
+// FileRemover removes a file dropped by deduplication, reason says why and kept is the file kept in its place
+type FileRemover func(path, reason, kept string) error
+
 func NewIndex(titledb *titledb.TitlesDB,
 	settings *settings.Settings) *Index {
 	return &Index{
-		titledb:    titledb,
-		settings:   settings,
-		filesKnown: make(map[uint64]TitleOnDiskCollection),
+		titledb:       titledb,
+		settings:      settings,
+		filesKnown:    make(map[uint64]TitleOnDiskCollection),
+		cachedRecords: make(map[string]FileOnDiskRecord),
 	}
 }
 
+// SetRemover replaces deleting the files dropped by deduplication, such as to only record them in a dry run
+// It is called with the index locked, so must not use the index
+func (idx *Index) SetRemover(remover FileRemover) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.remover = remover
+}
+
 func (idx *Index) GetStats() termui.Statistics {
 	idx.RWMutex.RLocker().Lock()
 	defer idx.RWMutex.RLocker().Unlock()
 	return idx.statistics
 }
 
-// Lists all tracked files
+// Lists all tracked files, including every version of updates and DLC
 func (idx *Index) ListFiles() []FileOnDiskRecord {
 	idx.RWMutex.RLocker().Lock()
 	defer idx.RWMutex.RLocker().Unlock()
 
 	values := make([]FileOnDiskRecord, 0, len(idx.filesKnown))
 	for _, v := range idx.filesKnown {
-		if v.BaseTitle != nil {
-			values = append(values, *v.BaseTitle)
-		}
-		if v.Update != nil {
-			values = append(values, *v.Update)
-		}
+		values = append(values, v.GetFiles()...)
+	}
+	return values
+}
 
-		values = append(values, v.DLC...)
+// Lists tracked files, but only the newest version of each update and DLC
+func (idx *Index) ListLatestFiles() []FileOnDiskRecord {
+	idx.RWMutex.RLocker().Lock()
+	defer idx.RWMutex.RLocker().Unlock()
+
+	values := make([]FileOnDiskRecord, 0, len(idx.filesKnown))
+	for _, v := range idx.filesKnown {
+		values = append(values, v.GetLatestFiles()...)
 	}
 	return values
 }
@@ -68,14 +93,28 @@ func (idx *Index) ListTitleFiles() []FileOnDiskRecord {
 	for _, v := range idx.filesKnown {
 		if v.BaseTitle != nil {
 			values = append(values, *v.BaseTitle)
-		} else if v.Update != nil {
-			values = append(values, *v.Update)
+		} else if update := v.LatestUpdate(); update != nil {
+			values = append(values, *update)
 		} else {
-			values = append(values, v.DLC...)
+			values = append(values, v.LatestDLC()...)
 		}
 	}
 	return values
 }
+
+// ListTitleIDs lists the base TitleID of every title with files in the index, in order
+func (idx *Index) ListTitleIDs() []uint64 {
+	idx.RWMutex.RLocker().Lock()
+	defer idx.RWMutex.RLocker().Unlock()
+
+	values := make([]uint64, 0, len(idx.filesKnown))
+	for titleID := range idx.filesKnown {
+		values = append(values, titleID)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
+
 func (idx *Index) LookupFileInfo(file FileOnDiskRecord) (titledb.TitleDBEntry, bool) {
 	return idx.titledb.QueryGameFromTitleID(file.TitleID)
 }
@@ -112,29 +151,38 @@ func (idx *Index) AddFileRecord(file *FileOnDiskRecord) {
 		}
 		oldValue.BaseTitle = idx.handleFileCollision(oldValue.BaseTitle, file)
 	} else if (file.TitleID & 0x0000000000000800) == 0x800 {
-		if oldValue.Update == nil {
-			idx.statistics.TotalUpdates++
-		}
-		oldValue.Update = idx.handleFileCollision(oldValue.Update, file)
+		before := len(oldValue.Updates)
+		oldValue.Updates = idx.addVersionedRecord(oldValue.Updates, file)
+		idx.statistics.TotalUpdates += len(oldValue.Updates) - before
 	} else {
-		if oldValue.DLC == nil {
-			oldValue.DLC = []FileOnDiskRecord{*file}
-			idx.statistics.TotalDLC++
-		} else {
-			matched := false
-			for index, oldFile := range oldValue.DLC {
-				if oldFile.TitleID == file.TitleID {
-					matched = true
-					oldValue.DLC[index] = *idx.handleFileCollision(&oldFile, file)
-				}
+		before := len(oldValue.DLC)
+		oldValue.DLC = idx.addVersionedRecord(oldValue.DLC, file)
+		idx.statistics.TotalDLC += len(oldValue.DLC) - before
+	}
+	idx.filesKnown[baseTitle] = oldValue
+	idx.cacheDirty = true
+}
+
+// addVersionedRecord adds the file to the list of versions held for updates or DLC
+// A file at the path of an existing entry for the same TitleID replaces it, a file matching an existing TitleID+Version goes through collision handling
+// If deduplication is on, only a single version of each TitleID is kept
+func (idx *Index) addVersionedRecord(records []FileOnDiskRecord, file *FileOnDiskRecord) []FileOnDiskRecord {
+	kept := file
+	result := make([]FileOnDiskRecord, 0, len(records)+1)
+	for _, existing := range records {
+		existing := existing
+		if existing.TitleID == file.TitleID {
+			if existing.Path == file.Path {
+				continue // Same file on disk, replaced by the new record
 			}
-			if !matched {
-				oldValue.DLC = append(oldValue.DLC, *file)
-				idx.statistics.TotalDLC++
+			if existing.Version == file.Version || (idx.settings != nil && idx.settings.Current().Deduplicate) {
+				kept = idx.handleFileCollision(&existing, kept)
+				continue
 			}
 		}
+		result = append(result, existing)
 	}
-	idx.filesKnown[baseTitle] = oldValue
+	return append(result, *kept)
 }
 
 func (idx *Index) handleFileCollision(existing, proposed *FileOnDiskRecord) *FileOnDiskRecord {
@@ -155,13 +203,10 @@ func (idx *Index) handleFileCollision(existing, proposed *FileOnDiskRecord) *Fil
 		old = proposed
 		new = existing
 	}
-	if idx.settings.Deduplicate {
+	if idx.settings.Current().Deduplicate {
 		//remove the older of the pair of files, or based on preferences
 		if new.Version != old.Version {
-			log.Info().Str("path", old.Path).Msg("Cleaning up file as newer exists")
-			if err := os.Remove(old.Path); err != nil {
-				log.Warn().Str("path", old.Path).Msg("Failed to delete older file on collision")
-			}
+			idx.removeDuplicate(old.Path, "a newer version exists", new.Path)
 			return new
 		} else {
 			//Same version, cleanup based on file extension
@@ -170,19 +215,13 @@ func (idx *Index) handleFileCollision(existing, proposed *FileOnDiskRecord) *Fil
 			//Prefer compressed files, if they are different we can use this to decide
 			if strings.HasSuffix(extNew, "z") != strings.HasSuffix(extOld, "z") {
 				//Mismatch compression selection
-				selectNew := (strings.HasSuffix(extNew, "z") && idx.settings.PreferCompressed) || strings.HasSuffix(extOld, "z") && !idx.settings.PreferCompressed
+				selectNew := (strings.HasSuffix(extNew, "z") && idx.settings.Current().PreferCompressed) || strings.HasSuffix(extOld, "z") && !idx.settings.Current().PreferCompressed
 
 				if selectNew {
-					log.Info().Str("path", old.Path).Msg("Cleaning up file based on compression rules")
-					if err := os.Remove(old.Path); err != nil {
-						log.Warn().Str("path", old.Path).Msg("Failed to delete older file on collision")
-					}
+					idx.removeDuplicate(old.Path, "compression preference (preferCompressed)", new.Path)
 					return new
 				} else {
-					log.Info().Str("path", new.Path).Msg("Cleaning up file based on compression rules")
-					if err := os.Remove(new.Path); err != nil {
-						log.Warn().Str("path", new.Path).Msg("Failed to delete new file on collision")
-					}
+					idx.removeDuplicate(new.Path, "compression preference (preferCompressed)", old.Path)
 					return old
 				}
 			} else {
@@ -190,32 +229,20 @@ func (idx *Index) handleFileCollision(existing, proposed *FileOnDiskRecord) *Fil
 				if extNew[0:3] != extOld[0:3] {
 					newType := extNew[1:3]
 					oldType := extOld[1:3]
-					if idx.settings.PreferXCI {
+					if idx.settings.Current().PreferXCI {
 						if newType == "xc" {
-							log.Info().Str("path", old.Path).Msg("Cleaning up file as newer is preferred type")
-							if err := os.Remove(old.Path); err != nil {
-								log.Warn().Str("path", old.Path).Msg("Failed to delete older file on preferred type")
-							}
+							idx.removeDuplicate(old.Path, "file type preference (preferXCI)", new.Path)
 							return new
 						} else if oldType == "xc" {
-							log.Info().Str("path", new.Path).Msg("Cleaning up file as older is preferred type")
-							if err := os.Remove(new.Path); err != nil {
-								log.Warn().Str("path", new.Path).Msg("Failed to delete new file on preferred type")
-							}
+							idx.removeDuplicate(new.Path, "file type preference (preferXCI)", old.Path)
 							return old
 						}
 					} else {
 						if newType == "ns" {
-							log.Info().Str("path", old.Path).Msg("Cleaning up file as newer is preferred type")
-							if err := os.Remove(old.Path); err != nil {
-								log.Warn().Str("path", old.Path).Msg("Failed to delete older file on preferred type")
-							}
+							idx.removeDuplicate(old.Path, "file type preference (preferXCI)", new.Path)
 							return new
 						} else if oldType == "ns" {
-							log.Info().Str("path", new.Path).Msg("Cleaning up file as older is preferred type")
-							if err := os.Remove(new.Path); err != nil {
-								log.Warn().Str("path", new.Path).Msg("Failed to delete new file on preferred type")
-							}
+							idx.removeDuplicate(new.Path, "file type preference (preferXCI)", old.Path)
 							return old
 						}
 					}
@@ -227,6 +254,20 @@ func (idx *Index) handleFileCollision(existing, proposed *FileOnDiskRecord) *Fil
 	return new
 }
 
+// removeDuplicate deletes the file at path dropped by deduplication in favour of kept
+func (idx *Index) removeDuplicate(path, reason, kept string) {
+	if idx.remover != nil {
+		if err := idx.remover(path, reason, kept); err != nil {
+			log.Warn().Str("path", path).Err(err).Msg("Failed to remove file on collision")
+		}
+		return
+	}
+	log.Info().Str("path", path).Str("reason", reason).Str("kept", kept).Msg("Cleaning up duplicate file")
+	if err := os.Remove(path); err != nil {
+		log.Warn().Str("path", path).Msg("Failed to delete file on collision")
+	}
+}
+
 func (idx *Index) GetFilesForTitleID(titleID uint64) (TitleOnDiskCollection, bool) {
 	idx.RWMutex.RLocker().Lock()
 	defer idx.RWMutex.RLocker().Unlock()
@@ -243,14 +284,7 @@ func (idx *Index) GetAllRecordsForTitle(titleID uint64) []FileOnDiskRecord {
 	if !ok {
 		return resp
 	}
-	if record.BaseTitle != nil {
-		resp = append(resp, *record.BaseTitle)
-	}
-	if record.Update != nil {
-		resp = append(resp, *record.Update)
-	}
-	resp = append(resp, record.DLC...)
-	return resp
+	return append(resp, record.GetFiles()...)
 }
 
 func (idx *Index) GetFileRecord(titleID uint64, version uint32) (*FileOnDiskRecord, bool) {
@@ -262,25 +296,27 @@ func (idx *Index) GetFileRecord(titleID uint64, version uint32) (*FileOnDiskReco
 		return nil, false
 	}
 	//Now look for the version tag && right titleid
-	if record.BaseTitle != nil {
-		if record.BaseTitle.TitleID == titleID && record.BaseTitle.Version == version {
-			return record.BaseTitle, true
+	for _, v := range record.GetFiles() {
+		if v.TitleID == titleID && v.Version == version {
+			return &v, true
 		}
 	}
-	if record.Update != nil {
-		if record.Update.TitleID == titleID && record.Update.Version == version {
-			return record.Update, true
-		}
-	}
-	if record.DLC != nil {
-		for _, v := range record.DLC {
-			if v.TitleID == titleID && v.Version == version {
-				return &v, true
+	return nil, false
+
+}
+
+// GetFileRecordByPath returns the record tracking the file at the provided path
+func (idx *Index) GetFileRecordByPath(path string) (FileOnDiskRecord, bool) {
+	idx.RWMutex.RLocker().Lock()
+	defer idx.RWMutex.RLocker().Unlock()
+	for _, record := range idx.filesKnown {
+		for _, file := range record.GetFiles() {
+			if file.Path == path {
+				return file, true
 			}
 		}
 	}
-	return nil, false
-
+	return FileOnDiskRecord{}, false
 }
 
 func (idx *Index) GetTitleRecords(titleID uint64) (TitleOnDiskCollection, bool) {
@@ -303,33 +339,76 @@ func (idx *Index) RemoveFile(path string) {
 				item.BaseTitle = nil
 				save = true
 				idx.statistics.TotalTitles--
-			} else if item.Update != nil && oldPath == item.Update.Path {
-				item.Update = nil
+			} else if updates, removed := removeRecordByPath(item.Updates, oldPath); removed {
+				item.Updates = updates
 				save = true
 				idx.statistics.TotalUpdates--
-			} else {
-				//Check the DLC's
-				matchingIndex := -1
-				for i, d := range item.DLC {
-					if d.Path == oldPath {
-
-						matchingIndex = i
-					}
-				}
-				if matchingIndex >= 0 {
-					save = true
-					idx.statistics.TotalDLC--
-					//Slice out the item
-					item.DLC[matchingIndex] = item.DLC[len(item.DLC)-1]
-					item.DLC = item.DLC[:len(item.DLC)-1]
-				}
-
+			} else if dlc, removed := removeRecordByPath(item.DLC, oldPath); removed {
+				item.DLC = dlc
+				save = true
+				idx.statistics.TotalDLC--
 			}
 
 			if save {
 				idx.filesKnown[key] = item
+				idx.cacheDirty = true
 				return
 			}
 		}
 	}
 }
+
+// SetVerification records the result of checking the hashes of the file at path
+// Returns false if the file is no longer in the index
+// Collections already handed out are read without the lock, so the changed record is copied rather than updated in place
+func (idx *Index) SetVerification(path string, verified int64, result string) bool {
+	idx.RWMutex.Lock()
+	defer idx.RWMutex.Unlock()
+	setVerification := func(record *FileOnDiskRecord) {
+		record.LastVerified = verified
+		record.VerifyResult = result
+	}
+	for key, item := range idx.filesKnown {
+		found := false
+		if item.BaseTitle != nil && item.BaseTitle.Path == path {
+			updated := *item.BaseTitle
+			setVerification(&updated)
+			item.BaseTitle = &updated
+			found = true
+		} else if updates, ok := updateRecordByPath(item.Updates, path, setVerification); ok {
+			item.Updates = updates
+			found = true
+		} else if dlc, ok := updateRecordByPath(item.DLC, path, setVerification); ok {
+			item.DLC = dlc
+			found = true
+		}
+		if found {
+			idx.filesKnown[key] = item
+			idx.cacheDirty = true
+			return true
+		}
+	}
+	return false
+}
+
+// updateRecordByPath returns a copy of records with update applied to the record at path
+func updateRecordByPath(records []FileOnDiskRecord, path string, update func(*FileOnDiskRecord)) ([]FileOnDiskRecord, bool) {
+	for i, record := range records {
+		if record.Path == path {
+			updated := slices.Clone(records)
+			update(&updated[i])
+			return updated, true
+		}
+	}
+	return records, false
+}
+
+// removeRecordByPath returns a copy of records without the record at path
+func removeRecordByPath(records []FileOnDiskRecord, path string) ([]FileOnDiskRecord, bool) {
+	for i, record := range records {
+		if record.Path == path {
+			return slices.Delete(slices.Clone(records), i, i+1), true
+		}
+	}
+	return records, false
+}
@@ -1,6 +1,13 @@
 package index
 
-import "testing"
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ralim/switchhost/settings"
+)
 
 func TestIndex_AddFileRecord(t *testing.T) {
 	t.Parallel()
@@ -70,8 +77,8 @@ func TestIndex_AddFileRecord(t *testing.T) {
 	if files.BaseTitle == nil || files.BaseTitle.Size != 132 {
 		t.Error("Should not have lost the base game")
 	}
-	if files.Update.Version != 2 {
-		t.Error("Should only keep the newest update")
+	if len(files.Updates) != 1 || files.LatestUpdate().Version != 2 {
+		t.Error("Should replace the update at the same path")
 	}
 
 	gameDLC1 := FileOnDiskRecord{
@@ -197,3 +204,118 @@ func TestIndex_AddFileRecord_DLCOnly(t *testing.T) {
 		t.Error("Should store all DLC")
 	}
 }
+
+func TestIndex_AddFileRecord_AllVersions(t *testing.T) {
+	t.Parallel()
+	tempFolder, err := os.MkdirTemp("", "unit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempFolder)
+	sett := &settings.Settings{Deduplicate: false}
+	idx := NewIndex(nil, sett)
+
+	makeRecord := func(titleID uint64, version uint32) *FileOnDiskRecord {
+		filePath := path.Join(tempFolder, fmt.Sprintf("%X-%d.nsp", titleID, version))
+		if err := os.WriteFile(filePath, []byte("Test"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return &FileOnDiskRecord{Path: filePath, TitleID: titleID, Version: version}
+	}
+	idx.AddFileRecord(makeRecord(0x50000, 0))
+	idx.AddFileRecord(makeRecord(0x50800, 65536))
+	idx.AddFileRecord(makeRecord(0x50800, 131072))
+	idx.AddFileRecord(makeRecord(0x50001, 0))
+	idx.AddFileRecord(makeRecord(0x50001, 65536))
+
+	if len(idx.ListFiles()) != 5 {
+		t.Errorf("Should keep all versions, got %d files", len(idx.ListFiles()))
+	}
+	if len(idx.ListLatestFiles()) != 3 {
+		t.Errorf("Latest view should only have one of each, got %d files", len(idx.ListLatestFiles()))
+	}
+	if stats := idx.GetStats(); stats.TotalUpdates != 2 || stats.TotalDLC != 2 {
+		t.Errorf("Should count every version, got %+v", stats)
+	}
+	for _, version := range []uint32{65536, 131072} {
+		if _, ok := idx.GetFileRecord(0x50800, version); !ok {
+			t.Errorf("Should resolve update version %d", version)
+		}
+	}
+	if _, ok := idx.GetFileRecord(0x50001, 0); !ok {
+		t.Error("Should resolve older DLC version")
+	}
+
+	old, _ := idx.GetFileRecord(0x50800, 65536)
+	idx.RemoveFile(old.Path)
+	if _, ok := idx.GetFileRecord(0x50800, 65536); ok {
+		t.Error("Should remove just the removed version")
+	}
+	if _, ok := idx.GetFileRecord(0x50800, 131072); !ok {
+		t.Error("Should keep the other versions on remove")
+	}
+
+	// With deduplication back on, adding a newer version drops the older ones from disk
+	sett.Deduplicate = true
+	newest := makeRecord(0x50001, 131072)
+	idx.AddFileRecord(newest)
+	files, _ := idx.GetFilesForTitleID(0x50000)
+	if len(files.DLC) != 1 || files.DLC[0].Path != newest.Path {
+		t.Errorf("Should only keep newest DLC with dedupe, got %+v", files.DLC)
+	}
+	if _, err := os.Stat(path.Join(tempFolder, "50001-0.nsp")); !os.IsNotExist(err) {
+		t.Error("Should have removed older DLC file with dedupe")
+	}
+}
+
+func TestIndex_SetVerification(t *testing.T) {
+	t.Parallel()
+	idx := NewIndex(nil, &settings.Settings{})
+	idx.AddFileRecord(&FileOnDiskRecord{Path: "/base.nsp", TitleID: 0x50000})
+	idx.AddFileRecord(&FileOnDiskRecord{Path: "/update.nsp", TitleID: 0x50800, Version: 65536})
+	idx.AddFileRecord(&FileOnDiskRecord{Path: "/dlc.nsp", TitleID: 0x50001})
+
+	for _, filePath := range []string{"/base.nsp", "/update.nsp", "/dlc.nsp"} {
+		if !idx.SetVerification(filePath, 1234, VerifyOK) {
+			t.Errorf("Should find %s", filePath)
+		}
+	}
+	if idx.SetVerification("/missing.nsp", 1234, VerifyOK) {
+		t.Error("Should report missing files")
+	}
+	idx.SetVerification("/update.nsp", 5678, "hash failed validation")
+	for _, record := range idx.ListFiles() {
+		if record.LastVerified == 0 {
+			t.Errorf("Should record the check on %s", record.Path)
+		}
+		if record.VerifyFailed() != (record.Path == "/update.nsp") {
+			t.Errorf("Only the update should be marked failed, %s got %+v", record.Path, record)
+		}
+	}
+}
+
+func TestIndex_CopyOnWrite(t *testing.T) {
+	t.Parallel()
+	idx := NewIndex(nil, &settings.Settings{})
+	idx.AddFileRecord(&FileOnDiskRecord{Path: "/base.nsp", TitleID: 0x50000})
+	idx.AddFileRecord(&FileOnDiskRecord{Path: "/update.nsp", TitleID: 0x50800, Version: 65536})
+	idx.AddFileRecord(&FileOnDiskRecord{Path: "/dlc1.nsp", TitleID: 0x50001})
+	idx.AddFileRecord(&FileOnDiskRecord{Path: "/dlc2.nsp", TitleID: 0x50002})
+
+	// Collections handed out are read without the lock, so later changes must not show up in them
+	before, _ := idx.GetTitleRecords(0x50000)
+	for _, filePath := range []string{"/base.nsp", "/update.nsp", "/dlc1.nsp"} {
+		idx.SetVerification(filePath, 1234, VerifyOK)
+	}
+	idx.RemoveFile("/dlc1.nsp")
+	if before.BaseTitle.LastVerified != 0 || before.Updates[0].LastVerified != 0 || before.DLC[0].LastVerified != 0 {
+		t.Errorf("Verification should not change records already handed out, got %+v", before)
+	}
+	if len(before.DLC) != 2 || before.DLC[0].Path != "/dlc1.nsp" || before.DLC[1].Path != "/dlc2.nsp" {
+		t.Errorf("Removing a file should not change records already handed out, got %+v", before.DLC)
+	}
+	after, _ := idx.GetTitleRecords(0x50000)
+	if after.BaseTitle.LastVerified != 1234 || after.Updates[0].LastVerified != 1234 || len(after.DLC) != 1 || after.DLC[0].Path != "/dlc2.nsp" {
+		t.Errorf("Index should have the changes, got %+v", after)
+	}
+}
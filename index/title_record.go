@@ -1,22 +1,63 @@
 package index
 
-//TitleOnDiskCollection is a semi-logical grouping of titles on disk
+// TitleOnDiskCollection is a semi-logical grouping of titles on disk
+// Every version of the updates and DLC that is kept on disk is tracked, so older versions can still be served
 type TitleOnDiskCollection struct {
 	BaseTitle *FileOnDiskRecord
-	Update    *FileOnDiskRecord
+	Updates   []FileOnDiskRecord
 	DLC       []FileOnDiskRecord
 }
 
-//Returns all the files in the collection
+// Returns all the files in the collection
 func (r *TitleOnDiskCollection) GetFiles() []FileOnDiskRecord {
 	values := []FileOnDiskRecord{}
 	if r.BaseTitle != nil {
 		values = append(values, *r.BaseTitle)
 	}
-	if r.Update != nil {
-		values = append(values, *r.Update)
+	values = append(values, r.Updates...)
+	values = append(values, r.DLC...)
+	return values
+}
+
+// Returns the base title, the newest update and the newest version of each DLC
+func (r *TitleOnDiskCollection) GetLatestFiles() []FileOnDiskRecord {
+	values := []FileOnDiskRecord{}
+	if r.BaseTitle != nil {
+		values = append(values, *r.BaseTitle)
+	}
+	if update := r.LatestUpdate(); update != nil {
+		values = append(values, *update)
+	}
+	values = append(values, r.LatestDLC()...)
+	return values
+}
+
+// Returns the newest update, or nil if there are none
+func (r *TitleOnDiskCollection) LatestUpdate() *FileOnDiskRecord {
+	latest := newestPerTitleID(r.Updates)
+	if len(latest) == 0 {
+		return nil
 	}
+	return &latest[0]
+}
 
-	values = append(values, r.DLC...)
+// Returns the newest version of each DLC
+func (r *TitleOnDiskCollection) LatestDLC() []FileOnDiskRecord {
+	return newestPerTitleID(r.DLC)
+}
+
+func newestPerTitleID(records []FileOnDiskRecord) []FileOnDiskRecord {
+	values := []FileOnDiskRecord{}
+	positions := make(map[uint64]int)
+	for _, record := range records {
+		if position, ok := positions[record.TitleID]; ok {
+			if record.Version > values[position].Version {
+				values[position] = record
+			}
+		} else {
+			positions[record.TitleID] = len(values)
+			values = append(values, record)
+		}
+	}
 	return values
 }
@@ -8,7 +8,7 @@ import (
 func TestGetFiles(t *testing.T) {
 	itm := TitleOnDiskCollection{
 		BaseTitle: &FileOnDiskRecord{Path: "111"},
-		Update:    &FileOnDiskRecord{Path: "222"},
+		Updates:   []FileOnDiskRecord{{Path: "222"}},
 		DLC:       []FileOnDiskRecord{{Path: "333"}, {Path: "444"}},
 	}
 	files := itm.GetFiles()
@@ -17,3 +17,33 @@ func TestGetFiles(t *testing.T) {
 		t.Errorf("Failed, wanted %v, got %v", expected, files)
 	}
 }
+
+func TestGetLatestFiles(t *testing.T) {
+	itm := TitleOnDiskCollection{
+		BaseTitle: &FileOnDiskRecord{Path: "base", TitleID: 0x50000},
+		Updates: []FileOnDiskRecord{
+			{Path: "update1", TitleID: 0x50800, Version: 1},
+			{Path: "update3", TitleID: 0x50800, Version: 3},
+			{Path: "update2", TitleID: 0x50800, Version: 2},
+		},
+		DLC: []FileOnDiskRecord{
+			{Path: "dlc1v0", TitleID: 0x50001, Version: 0},
+			{Path: "dlc2v0", TitleID: 0x50002, Version: 0},
+			{Path: "dlc1v1", TitleID: 0x50001, Version: 1},
+		},
+	}
+	files := itm.GetLatestFiles()
+	expected := []FileOnDiskRecord{
+		{Path: "base", TitleID: 0x50000},
+		{Path: "update3", TitleID: 0x50800, Version: 3},
+		{Path: "dlc1v1", TitleID: 0x50001, Version: 1},
+		{Path: "dlc2v0", TitleID: 0x50002, Version: 0},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Failed, wanted %v, got %v", expected, files)
+	}
+	empty := TitleOnDiskCollection{}
+	if empty.LatestUpdate() != nil {
+		t.Error("Should have no latest update when there are no updates")
+	}
+}
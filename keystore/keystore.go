@@ -34,7 +34,7 @@ func NewKeystore(r io.Reader) (*Keystore, error) {
 			key := strings.TrimSpace(parts[0])
 			value := strings.TrimSpace(parts[1])
 			//We only care about lines that start with `key_area_key_application_` or `header_key`
-			if key == "header_key" || strings.HasPrefix(key, "key_area_key_application_") {
+			if key == "header_key" || strings.HasPrefix(key, "key_area_key_application_") || strings.HasPrefix(key, "titlekek_") {
 				store.keys[key] = value
 			}
 		}
@@ -55,6 +55,11 @@ func (key *Keystore) GetAppKey(revision uint8) ([]byte, error) {
 	return key.getKey(keyName)
 }
 
+func (key *Keystore) GetTitleKek(revision uint8) ([]byte, error) {
+	keyName := fmt.Sprintf("titlekek_%02x", revision)
+	return key.getKey(keyName)
+}
+
 func (key *Keystore) getKey(keyName string) ([]byte, error) {
 	KeyString, ok := key.keys[keyName]
 	if !ok {
@@ -0,0 +1,134 @@
+package library
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ralim/switchhost/formats"
+	"github.com/ralim/switchhost/index"
+	"github.com/rs/zerolog/log"
+)
+
+// Admin actions let the library be managed while running, rather than by restarting or touching the disk
+// Each action is queued onto the pipeline channels like any other file, and tracked as a job
+
+var (
+	ErrFileNotInLibrary = errors.New("file is not in the library")
+	ErrNeedsKeys        = errors.New("keys must be loaded for this")
+	ErrQueueFull        = errors.New("queue is full, try again later")
+	ErrRescanRunning    = errors.New("a rescan is already running")
+)
+
+// Rescan scans all the folders again, as is done at start, returning the job tracking the scan
+// Each file found gets its own job as it goes through the import
+func (lib *Library) Rescan() (uint64, error) {
+	if lib.keys == nil {
+		return 0, ErrNeedsKeys // Nothing would read the queue
+	}
+	if !lib.rescanRunning.CompareAndSwap(false, true) {
+		return 0, ErrRescanRunning
+	}
+	jobID := lib.newJob("rescan")
+	go func() {
+		defer lib.rescanRunning.Store(false)
+		lib.updateJobByID(jobID, JobRunning, "")
+		lib.scanAllFolders(nil)
+		lib.updateJobByID(jobID, JobDone, "files queued for import")
+	}()
+	return jobID, nil
+}
+
+// RequestRevalidation checks the hashes of a file in the library, recording the result like the background re-validation
+// The file is left in place even if it fails
+func (lib *Library) RequestRevalidation(titleID uint64, version uint32) (uint64, error) {
+	if lib.keys == nil {
+		return 0, ErrNeedsKeys
+	}
+	event, err := lib.adminEvent(titleID, version)
+	if err != nil {
+		return 0, err
+	}
+	event.revalidateOnly = true
+	return lib.queueAdminEvent(lib.fileValidationScanRequests, event, "revalidate")
+}
+
+// RequestCompression compresses a file in the library, even if compression is turned off
+func (lib *Library) RequestCompression(titleID uint64, version uint32) (uint64, error) {
+	if lib.keys == nil {
+		return 0, ErrCompressionNeedsKeys
+	}
+	event, err := lib.adminEvent(titleID, version)
+	if err != nil {
+		return 0, err
+	}
+	if ext := strings.ToLower(path.Ext(event.path)); ext != ".nsp" && ext != ".xci" {
+		return 0, ErrNotCompressable
+	}
+	return lib.queueAdminEvent(lib.fileCompressionRequests, event, "compress")
+}
+
+// RequestDelete deletes a file in the library from disk, and removes it from the index
+func (lib *Library) RequestDelete(titleID uint64, version uint32) (uint64, error) {
+	event, err := lib.adminEvent(titleID, version)
+	if err != nil {
+		return 0, err
+	}
+	event.fileWasDeleted = true
+	event.removeFromDisk = true
+	return lib.queueAdminEvent(lib.fileOrganisationRequests, event, "delete")
+}
+
+// adminEvent makes the pipeline event for an action on a file in the library, the job is made once it is queued
+func (lib *Library) adminEvent(titleID uint64, version uint32) (*fileScanningInfo, error) {
+	record, ok := lib.FileIndex.GetFileRecord(titleID, version)
+	if !ok {
+		return nil, ErrFileNotInLibrary
+	}
+	event := &fileScanningInfo{
+		path:        record.Path,
+		isInLibrary: true,
+		metadata: &formats.FileInfo{
+			Name:          filepath.Base(record.Path),
+			TitleID:       record.TitleID,
+			Version:       record.Version,
+			EmbeddedTitle: record.EmbeddedTitle,
+			Type:          record.Type,
+			Size:          record.Size,
+		},
+	}
+	return event, nil
+}
+
+// queueAdminEvent sends the event without waiting, so requests fail rather than hang when the pipeline is busy
+// The job tracking it is named after the action and file
+func (lib *Library) queueAdminEvent(queue chan *fileScanningInfo, event *fileScanningInfo, action string) (uint64, error) {
+	event.jobID = lib.newJob(action + " " + event.metadata.Name)
+	lib.setJobTitle(event)
+	select {
+	case queue <- event:
+		return event.jobID, nil
+	default:
+		lib.updateJob(event, JobFailed, ErrQueueFull.Error())
+		return 0, ErrQueueFull
+	}
+}
+
+// revalidateRequestedFile checks a file for RequestRevalidation
+func (lib *Library) revalidateRequestedFile(event *fileScanningInfo) {
+	result := index.VerifyOK
+	if err := lib.validateFile(event.path); err != nil {
+		result = err.Error()
+		log.Error().Str("path", event.path).Err(err).Msg("Requested re-validation failed, file no longer matches its hashes")
+		lib.updateJob(event, JobFailed, result)
+	} else {
+		lib.updateJob(event, JobValidated, "")
+	}
+	lib.FileIndex.SetVerification(event.path, time.Now().UnixNano(), result)
+	if lib.ui != nil && lib.ui.Statistics != nil {
+		lib.ui.Statistics.BitrotDetected = len(lib.bitrotReports())
+		lib.ui.Statistics.Redraw()
+	}
+}
@@ -0,0 +1,85 @@
+package library
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/utilities"
+)
+
+func TestAdminRequests(t *testing.T) {
+	t.Parallel()
+	lib, goodPath := makeCompressionTestLibrary(t)
+	lib.FileIndex = index.NewIndex(nil, lib.settings)
+	lib.jobs = newJobJournal(0)
+	lib.fileValidationScanRequests = make(chan *fileScanningInfo, 1)
+	lib.fileCompressionRequests = make(chan *fileScanningInfo, 1)
+	lib.fileOrganisationRequests = make(chan *fileScanningInfo, 1)
+	lib.folderCleanupRequests = make(chan string, 1)
+
+	badPath := path.Join(path.Dir(goodPath), "Bad.nsp")
+	if err := utilities.CopyFile(goodPath, badPath); err != nil {
+		t.Fatal(err)
+	}
+	corruptTestNSP(t, badPath)
+	compressedPath := path.Join(path.Dir(goodPath), "Compressed.nsz")
+	for _, record := range []*index.FileOnDiskRecord{
+		{Path: goodPath, TitleID: 0x05123A0000000000, Name: "Good"},
+		{Path: badPath, TitleID: 0x05123A0000000800, Version: 65536, Name: "Bad"},
+		{Path: compressedPath, TitleID: 0x05123A0000001001, Name: "Compressed"},
+	} {
+		lib.FileIndex.AddFileRecord(record)
+	}
+
+	if _, err := lib.RequestRevalidation(0x05123A0000000800, 1); !errors.Is(err, ErrFileNotInLibrary) {
+		t.Errorf("Should not find missing files, got %v", err)
+	}
+	jobID, err := lib.RequestRevalidation(0x05123A0000000800, 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lib.RequestRevalidation(0x05123A0000000000, 0); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Should refuse when the queue is full, got %v", err)
+	}
+	lib.revalidateRequestedFile(<-lib.fileValidationScanRequests)
+	if job, _ := lib.GetJob(jobID); job.State != JobFailed || job.TitleID != 0x05123A0000000800 || job.Name != "revalidate Bad.nsp" {
+		t.Errorf("Should fail the job, got %+v", job)
+	}
+	if record, _ := lib.FileIndex.GetFileRecordByPath(badPath); !record.VerifyFailed() {
+		t.Errorf("Should record the failed check, got %+v", record)
+	}
+	if !utilities.Exists(badPath) {
+		t.Error("Failed files should be left in place")
+	}
+
+	if _, err := lib.RequestCompression(0x05123A0000001001, 0); !errors.Is(err, ErrNotCompressable) {
+		t.Errorf("Should not compress NSZ files, got %v", err)
+	}
+	if _, err := lib.RequestCompression(0x05123A0000000000, 0); err != nil {
+		t.Error(err)
+	}
+	if event := <-lib.fileCompressionRequests; event.path != goodPath || event.metadata.TitleID != 0x05123A0000000000 {
+		t.Errorf("Should queue the file for compression, got %+v", event)
+	}
+
+	jobID, err = lib.RequestDelete(0x05123A0000000800, 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib.organisationEventHandler(<-lib.fileOrganisationRequests, nil)
+	if _, err := os.Stat(badPath); !os.IsNotExist(err) {
+		t.Error("Should delete the file from disk")
+	}
+	if _, ok := lib.FileIndex.GetFileRecordByPath(badPath); ok {
+		t.Error("Should remove the file from the index")
+	}
+	if job, _ := lib.GetJob(jobID); job.State != JobDone {
+		t.Errorf("Should finish the job, got %+v", job)
+	}
+	if folder := <-lib.folderCleanupRequests; folder != path.Dir(badPath) {
+		t.Errorf("Should clean up the folder, got %s", folder)
+	}
+}
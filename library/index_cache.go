@@ -0,0 +1,43 @@
+package library
+
+import (
+	"path"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The index cache lets startup skip re-parsing files that have not changed since the last run
+// It is periodically saved while running, and once more when the library is stopped
+
+const indexCacheSaveInterval = 5 * time.Minute
+
+func (lib *Library) indexCachePath() string {
+	return path.Join(lib.settings.Current().CacheFolder, "index_cache.json")
+}
+
+func (lib *Library) indexCacheWorker() {
+	defer lib.waitgroup.Done()
+	defer log.Info().Msg("indexCacheWorker task exiting")
+	ticker := time.NewTicker(indexCacheSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lib.exit:
+			lib.exit <- true
+			return
+		case <-ticker.C:
+			if lib.FileIndex.CacheDirty() {
+				lib.saveIndexCache()
+			}
+		}
+	}
+}
+
+func (lib *Library) saveIndexCache() {
+	if err := lib.FileIndex.SaveCache(lib.indexCachePath()); err != nil {
+		log.Warn().Err(err).Msg("Saving index cache failed")
+	} else {
+		log.Debug().Msg("Saved index cache")
+	}
+}
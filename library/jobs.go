@@ -0,0 +1,200 @@
+package library
+
+import (
+	"sync"
+	"time"
+)
+
+// Jobs track each file handed to the ingest pipeline, recording every state it moves through
+// This lets uploaders and admins find out what happened to a file without digging through the logs
+// The journal is bounded, once full the oldest jobs are forgotten
+
+const defaultJobHistory = 1024
+
+type JobState string
+
+const (
+	JobQueued      JobState = "queued"      // Waiting in the ingest pipeline
+	JobMetadata    JobState = "metadata"    // Metadata has been parsed
+	JobValidated   JobState = "validated"   // Hashes have been checked and are correct
+	JobSorted      JobState = "sorted"      // In the library and being served
+	JobCompressed  JobState = "compressed"  // Compressed, the new file is being imported
+	JobRejected    JobState = "rejected"    // Dropped from the pipeline, see the reason
+	JobQuarantined JobState = "quarantined" // Moved to the quarantine folder, see the reason
+
+	// States of admin actions
+	JobRunning JobState = "running" // Being worked on
+	JobDone    JobState = "done"    // Finished
+	JobFailed  JobState = "failed"  // Could not be done, see the reason
+)
+
+type JobTransition struct {
+	State  JobState  `json:"state"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+type Job struct {
+	ID      uint64          `json:"id"`
+	Name    string          `json:"name"`
+	State   JobState        `json:"state"`
+	Reason  string          `json:"reason,omitempty"`
+	User    string          `json:"user,omitempty"` // Who uploaded the file, empty for files the library found itself
+	TitleID uint64          `json:"titleID,omitempty"`
+	Version uint32          `json:"version,omitempty"`
+	Updated time.Time       `json:"updated"`
+	History []JobTransition `json:"history"`
+}
+
+type jobJournal struct {
+	sync.RWMutex
+	limit  int
+	nextID uint64
+	jobs   map[uint64]*Job
+	order  []uint64 // Job ID's, oldest first
+}
+
+func newJobJournal(limit int) *jobJournal {
+	if limit <= 0 {
+		limit = defaultJobHistory
+	}
+	return &jobJournal{
+		limit:  limit,
+		nextID: 1,
+		jobs:   make(map[uint64]*Job),
+		order:  make([]uint64, 0, limit),
+	}
+}
+
+func (j *jobJournal) create(name string, user string) uint64 {
+	j.Lock()
+	defer j.Unlock()
+	id := j.nextID
+	j.nextID++
+	if len(j.order) >= j.limit {
+		delete(j.jobs, j.order[0])
+		j.order = j.order[1:]
+	}
+	now := time.Now()
+	j.jobs[id] = &Job{
+		ID:      id,
+		Name:    name,
+		User:    user,
+		State:   JobQueued,
+		Updated: now,
+		History: []JobTransition{{State: JobQueued, Time: now}},
+	}
+	j.order = append(j.order, id)
+	return id
+}
+
+func (j *jobJournal) update(id uint64, state JobState, reason string, titleID uint64, version uint32) {
+	j.Lock()
+	defer j.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return // Not tracked, or has aged out
+	}
+	now := time.Now()
+	job.State = state
+	job.Reason = reason
+	if titleID != 0 {
+		job.TitleID = titleID
+		job.Version = version
+	}
+	job.Updated = now
+	job.History = append(job.History, JobTransition{State: state, Reason: reason, Time: now})
+}
+
+func (j *jobJournal) setTitle(id uint64, titleID uint64, version uint32) {
+	j.Lock()
+	defer j.Unlock()
+	if job, ok := j.jobs[id]; ok {
+		job.TitleID = titleID
+		job.Version = version
+	}
+}
+
+func (j *jobJournal) get(id uint64) (Job, bool) {
+	j.RLock()
+	defer j.RUnlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.copy(), true
+}
+
+// list returns all the jobs in the journal, newest first
+func (j *jobJournal) list() []Job {
+	j.RLock()
+	defer j.RUnlock()
+	jobs := make([]Job, 0, len(j.order))
+	for i := len(j.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, j.jobs[j.order[i]].copy())
+	}
+	return jobs
+}
+
+func (job *Job) copy() Job {
+	result := *job
+	result.History = append([]JobTransition{}, job.History...)
+	return result
+}
+
+// GetJob returns the current state of the job with the provided ID
+func (lib *Library) GetJob(id uint64) (Job, bool) {
+	if lib.jobs == nil {
+		return Job{}, false
+	}
+	return lib.jobs.get(id)
+}
+
+// ListJobs returns all of the jobs still held in the journal, newest first
+func (lib *Library) ListJobs() []Job {
+	if lib.jobs == nil {
+		return []Job{}
+	}
+	return lib.jobs.list()
+}
+
+// newJob starts tracking a file entering the pipeline, returning its job ID
+func (lib *Library) newJob(name string) uint64 {
+	return lib.newUserJob(name, "")
+}
+
+// newUserJob starts tracking a file uploaded by the user, returning its job ID
+func (lib *Library) newUserJob(name string, user string) uint64 {
+	if lib.jobs == nil {
+		return 0
+	}
+	return lib.jobs.create(name, user)
+}
+
+// setJobTitle records the title of the file in the event on its job, for files already known when the job is made
+func (lib *Library) setJobTitle(event *fileScanningInfo) {
+	if event.jobID == 0 || lib.jobs == nil || event.metadata == nil {
+		return
+	}
+	lib.jobs.setTitle(event.jobID, event.metadata.TitleID, event.metadata.Version)
+}
+
+// updateJobByID records a state change for a job not tied to a file
+func (lib *Library) updateJobByID(id uint64, state JobState, reason string) {
+	if id == 0 || lib.jobs == nil {
+		return
+	}
+	lib.jobs.update(id, state, reason, 0, 0)
+}
+
+// updateJob records a state change for the file in the event, if it is being tracked
+func (lib *Library) updateJob(event *fileScanningInfo, state JobState, reason string) {
+	if event.jobID == 0 || lib.jobs == nil {
+		return
+	}
+	titleID, version := uint64(0), uint32(0)
+	if event.metadata != nil {
+		titleID, version = event.metadata.TitleID, event.metadata.Version
+	}
+	lib.jobs.update(event.jobID, state, reason, titleID, version)
+}
@@ -0,0 +1,45 @@
+package library
+
+import (
+	"testing"
+
+	"github.com/ralim/switchhost/formats"
+)
+
+func TestJobJournal(t *testing.T) {
+	t.Parallel()
+	journal := newJobJournal(2)
+	first := journal.create("first.nsp", "")
+	second := journal.create("second.nsp", "")
+
+	lib := Library{jobs: journal}
+	event := &fileScanningInfo{jobID: second, metadata: &formats.FileInfo{TitleID: 0x50000, Version: 1}}
+	lib.updateJob(event, JobMetadata, "")
+	lib.updateJob(event, JobRejected, "failed validation")
+
+	job, ok := lib.GetJob(second)
+	if !ok {
+		t.Fatal("Should find job")
+	}
+	if job.State != JobRejected || job.Reason != "failed validation" || job.TitleID != 0x50000 {
+		t.Errorf("Job should have latest state, got %+v", job)
+	}
+	if len(job.History) != 3 || job.History[0].State != JobQueued || job.History[1].State != JobMetadata {
+		t.Errorf("Job should record each transition, got %+v", job.History)
+	}
+
+	third := journal.create("third.nsp", "")
+	if _, ok := lib.GetJob(first); ok {
+		t.Error("Oldest job should be dropped once journal is full")
+	}
+	jobs := lib.ListJobs()
+	if len(jobs) != 2 || jobs[0].ID != third || jobs[1].ID != second {
+		t.Errorf("Should list newest first, got %+v", jobs)
+	}
+
+	// Untracked events are ignored
+	lib.updateJob(&fileScanningInfo{}, JobSorted, "")
+	if (&Library{}).newJob("nope") != 0 {
+		t.Error("Library without a journal should not track jobs")
+	}
+}
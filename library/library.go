@@ -5,7 +5,9 @@ import (
 	"github.com/ralim/switchhost/versionsdb"
 	"io"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ralim/switchhost/formats"
 	"github.com/ralim/switchhost/index"
@@ -29,6 +31,15 @@ type fileScanningInfo struct {
 	fileWasDeleted bool
 	// Did this file come from the library folder (else, its upload + startup scan)
 	isInLibrary bool
+	// Job tracking this file, 0 if not tracked
+	jobID uint64
+	// When the file passed validation in the pipeline (unix nanoseconds), 0 if it was not validated
+	validatedAt int64
+	// For NSZ files, the NSP size from the index cache, 0 if it has to be worked out
+	nspSize int64
+	// Admin requests, to only check the hashes of a library file, and to delete the file from disk along with the index
+	revalidateOnly bool
+	removeFromDisk bool
 }
 
 // Library manages the representation of the game files on disk + their metadata
@@ -55,10 +66,20 @@ type Library struct {
 	folderCleanupRequests chan string
 	// 5. Additionally, once a file is in the library, compression may be desired and thus it is passed here
 	fileCompressionRequests chan *fileScanningInfo
-	exit                    chan bool
-	ui                      *termui.TermUI
+	// Folders added to or removed from the scan folders while running, for the watcher
+	watchRequests chan watchRequest
+	exit          chan bool
+	ui            *termui.TermUI
 
 	organisationLocking organisationLocks
+	jobs                *jobJournal
+	quarantineLock      sync.Mutex // Held while picking names in the quarantine folder
+	revalidation        revalidationState
+	validationFailures  atomic.Uint64 // Files that failed validation in the pipeline since start
+	rescanRunning       atomic.Bool
+	watching            atomic.Bool // If the folder watcher is running
+	plan                organisationPlan
+	pipelinePaths       pipelinePaths // Files being changed by the pipeline, for the watcher to ignore
 }
 
 func NewLibrary(titledb *titledb.TitlesDB, settings *settings.Settings, ui *termui.TermUI, versions *versionsdb.VersionDB) *Library {
@@ -69,16 +90,19 @@ func NewLibrary(titledb *titledb.TitlesDB, settings *settings.Settings, ui *term
 		ui:        ui,
 		keys:      nil,
 		// Channels
-		fileMetaScanRequests:       make(chan *fileScanningInfo, settings.QueueLength),
-		fileValidationScanRequests: make(chan *fileScanningInfo, settings.QueueLength),
-		fileOrganisationRequests:   make(chan *fileScanningInfo, settings.QueueLength),
-		fileCompressionRequests:    make(chan *fileScanningInfo, settings.QueueLength),
-		folderCleanupRequests:      make(chan string, settings.QueueLength),
+		fileMetaScanRequests:       make(chan *fileScanningInfo, settings.Current().QueueLength),
+		fileValidationScanRequests: make(chan *fileScanningInfo, settings.Current().QueueLength),
+		fileOrganisationRequests:   make(chan *fileScanningInfo, settings.Current().QueueLength),
+		fileCompressionRequests:    make(chan *fileScanningInfo, settings.Current().QueueLength),
+		folderCleanupRequests:      make(chan string, settings.Current().QueueLength),
+		watchRequests:              make(chan watchRequest, settings.Current().QueueLength),
 		exit:                       make(chan bool, 10),
 		FileIndex:                  index.NewIndex(titledb, settings),
 		waitgroup:                  &sync.WaitGroup{},
 		organisationLocking:        organisationLocks{},
+		jobs:                       newJobJournal(settings.Current().JobHistoryLength),
 	}
+	library.FileIndex.SetRemover(library.removeDuplicate)
 
 	return library
 
@@ -100,15 +124,13 @@ func (lib *Library) LoadKeys(keysDBReader io.Reader) error {
 // Start spawns internal workers and performs any non-trivial setup time tasks
 func (lib *Library) Start() {
 	//Check output folder exists if sorting enabled
-	if lib.settings.EnableSorting {
-		if _, err := os.Stat(lib.settings.StorageFolder); os.IsNotExist(err) {
-			if err := os.Mkdir(lib.settings.StorageFolder, 0755); err != nil {
-				fmt.Fprintf(os.Stderr, "Couldn't create storage folder. Sorting will fail, so disabling")
-				lib.settings.EnableSorting = false
-				lib.settings.Save()
+	if lib.settings.Current().EnableSorting {
+		if err := lib.createStorageFolders(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v. Sorting will fail, so disabling", err)
+			if _, err := lib.settings.Update(strings.NewReader(`{"enableSorting":false}`)); err != nil {
+				log.Warn().Err(err).Msg("Couldn't turn off sorting")
 			}
 		}
-
 	}
 
 	// Internal states of the chain (except organisation) run multiple workers to utilise more cores
@@ -134,6 +156,35 @@ func (lib *Library) Start() {
 	lib.waitgroup.Add(1)
 	go lib.compressionWorker()
 
+	// Load the index cache before scanning so the metadata workers can use it, and keep it saved as we go
+	if lib.settings.Current().UseIndexCache {
+		if err := lib.FileIndex.LoadCache(lib.indexCachePath()); err != nil {
+			log.Info().Err(err).Msg("Index cache not loaded, all files will be parsed")
+		}
+		lib.waitgroup.Add(1)
+		go lib.indexCacheWorker()
+	}
+
+	// Start watching for changes in the folders, only useful if we can parse the files found
+	if lib.settings.Current().WatchFolders && lib.keys != nil {
+		lib.waitgroup.Add(1)
+		go lib.folderWatchWorker()
+	}
+
+	// Background re-validation of the library, only possible with keys
+	if lib.settings.Current().RevalidateEveryHours > 0 && lib.keys != nil {
+		lib.waitgroup.Add(1)
+		go lib.revalidationWorker()
+	}
+
+	// Carry on with the plan from the last dry run
+	if err := lib.LoadPlan(); err != nil {
+		log.Warn().Err(err).Msg("Planned changes not loaded")
+	}
+
+	// Pick up scan folders changed while running
+	lib.settings.Subscribe("library", []string{"sourceFolders", "storageFolder", "storageFolders"}, lib.reloadFolders)
+
 	// Run first file scan in background
 	lib.waitgroup.Add(1)
 	go lib.RunScan()
@@ -146,13 +197,39 @@ func (lib *Library) Stop() {
 	log.Info().Msg("Waiting")
 
 	lib.waitgroup.Wait()
+	if lib.settings.Current().UseIndexCache {
+		lib.saveIndexCache()
+	}
+	if err := lib.flushPlan(); err != nil {
+		log.Warn().Err(err).Msg("Planned changes not saved")
+	}
 }
 
-func (lib *Library) NotifyIncomingFile(path string) {
-	log.Info().Str("path", path).Msg("Notified of uploaded file")
+// NotifyIncomingFile queues an uploaded file for import, name is the name the file was uploaded as and user is who uploaded it
+// Returns the ID of the job that can be used to follow the file through the import
+func (lib *Library) NotifyIncomingFile(path string, name string, user string) uint64 {
+	log.Info().Str("path", path).Str("name", name).Msg("Notified of uploaded file")
 	event := &fileScanningInfo{
 		path:            path,
 		mustCleanupFile: true,
+		jobID:           lib.newUserJob(name, user),
 	}
 	lib.fileMetaScanRequests <- event
+	return event.jobID
+}
+
+// QueueDepths returns how many files are waiting at each step of the import pipeline
+func (lib *Library) QueueDepths() map[string]int {
+	return map[string]int{
+		"metadata":     len(lib.fileMetaScanRequests),
+		"validation":   len(lib.fileValidationScanRequests),
+		"organisation": len(lib.fileOrganisationRequests),
+		"cleanup":      len(lib.folderCleanupRequests),
+		"compression":  len(lib.fileCompressionRequests),
+	}
+}
+
+// ValidationFailures returns how many files have failed validation in the import pipeline since start
+func (lib *Library) ValidationFailures() uint64 {
+	return lib.validationFailures.Load()
 }
@@ -2,38 +2,142 @@ package library
 
 import (
 	"fmt"
+	"os"
+	"path"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ralim/switchhost/index"
 	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/titledb"
+	"github.com/ralim/switchhost/utilities"
 )
 
 func TestStopStart(t *testing.T) {
 	// Test that starting and stopping library with requests outstanding works
-	// Not the best test in the world.. but seems to work for the point, which is that we should wait out the sleep before closing shop
+	// Not the best test in the world.. but seems to work for the point, which is that we should wait out the compression before closing shop
 	// Also making sure we dont race on channels etc
-
-	//This works using sleep, and the fact that sleep adds args (sleeps total of args)
 	t.Parallel()
 	sett := settings.Settings{
-		NSZCommandLine: "sleep 0.1",
-		QueueLength:    2,
+		QueueLength:          2,
+		CompressionLevel:     18,
+		CompressionBlockBits: 14,
+	}
+	lib := NewLibrary(titledb.CreateTitlesDB(&sett), &sett, nil, nil)
+	keys, err := os.Open("../testing_files/prod.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	if err := lib.LoadKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	nspPath := path.Join(t.TempDir(), "UnitTest.nsp")
+	if err := utilities.CopyFile("../testing_files/UnitTest_[05123A0000000000].nsp", nspPath); err != nil {
+		t.Fatal(err)
 	}
-	lib := NewLibrary(nil, &sett, nil, nil)
 
 	//Inject some pending requests
 	lib.fileCompressionRequests <- &fileScanningInfo{
-		path: "0.02",
+		path: nspPath,
 	}
-	now := time.Now()
 	lib.Start()
-	//Yield to let our sleep be selected before the close
+	//Yield to let our compression be selected before the close
 	time.Sleep(time.Millisecond * 100)
 	fmt.Println(".........")
 	lib.Stop()
-	duration := time.Since(now)
 
-	if duration.Milliseconds() < 100 {
-		t.Error("Didnt wait for the sleep")
+	if !utilities.Exists(nspPath[0:len(nspPath)-1] + "z") {
+		t.Error("Didnt wait for the compression")
+	}
+}
+
+func TestCachedMetadata(t *testing.T) {
+	t.Parallel()
+	folder := t.TempDir()
+	sett := settings.Settings{QueueLength: 2, UseIndexCache: true}
+	lib := NewLibrary(titledb.CreateTitlesDB(&sett), &sett, nil, nil)
+	filePath := path.Join(folder, "game.nsp")
+	if err := os.WriteFile(filePath, []byte("Test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileStat, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nszPath := path.Join(folder, "update.nsz")
+	if err := os.WriteFile(nszPath, []byte("Not an NSZ"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nszStat, err := os.Stat(nszPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := index.NewIndex(nil, &sett)
+	cached.AddFileRecord(&index.FileOnDiskRecord{
+		Path:          filePath,
+		TitleID:       0x05123A0000000000,
+		Name:          "TitleDB name",
+		Size:          fileStat.Size(),
+		ModTime:       fileStat.ModTime().UnixNano(),
+		EmbeddedTitle: "Embedded title",
+	})
+	cached.AddFileRecord(&index.FileOnDiskRecord{
+		Path:    nszPath,
+		TitleID: 0x05123A0000000800,
+		Version: 65536,
+		Size:    nszStat.Size(),
+		ModTime: nszStat.ModTime().UnixNano(),
+		NSPSize: 12345,
+	})
+	cachePath := path.Join(folder, "index_cache.json")
+	if err := cached.SaveCache(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.FileIndex.LoadCache(cachePath); err != nil {
+		t.Fatal(err)
+	}
+
+	event := &fileScanningInfo{path: filePath}
+	if err := lib.setFileMeta(event); err != nil {
+		t.Fatal(err)
+	}
+	if event.metadata.EmbeddedTitle != "Embedded title" {
+		t.Errorf("Cache hit should give the file's own title, got %+v", event.metadata)
+	}
+	if record := lib.newFileRecord(event.metadata, filePath, 0, event.nspSize); record.EmbeddedTitle != "Embedded title" {
+		t.Errorf("Record should keep the embedded title, got %+v", record)
+	}
+
+	// The NSZ isn't valid, so its NSP size can only come from the cache
+	nszEvent := &fileScanningInfo{path: nszPath}
+	if err := lib.setFileMeta(nszEvent); err != nil {
+		t.Fatal(err)
+	}
+	if record := lib.newFileRecord(nszEvent.metadata, nszPath, 0, nszEvent.nspSize); record.NSPSize != 12345 {
+		t.Errorf("Record should keep the cached NSP size rather than opening the NSZ, got %+v", record)
+	}
+}
+
+func TestStartDisablesSortingWithoutStorage(t *testing.T) {
+	t.Parallel()
+	folder := t.TempDir()
+	sett := settings.NewSettings(path.Join(folder, "settings.json"))
+	sett.EnableSorting = true
+	sett.StorageFolder = path.Join(folder, "missing", "library") // Parent folders are not made
+	sett.FoldersToScan = []string{}
+	sett.WatchFolders = false
+	sett.UseIndexCache = false
+	sett.CacheFolder = folder
+	lib := NewLibrary(titledb.CreateTitlesDB(sett), sett, nil, nil)
+	lib.Start()
+	defer lib.Stop()
+
+	if sett.Current().EnableSorting {
+		t.Error("Sorting should be turned off in the running settings")
+	}
+	if saved, err := os.ReadFile(path.Join(folder, "settings.json")); err != nil || !strings.Contains(string(saved), `"enableSorting": false`) {
+		t.Errorf("Sorting should be turned off in the saved settings, got %v", err)
 	}
 }
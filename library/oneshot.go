@@ -0,0 +1,135 @@
+package library
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// One-shot passes go over the scan folders once in the calling goroutine, without starting any of the workers
+// These are for the command line, so the library can be worked on without running the servers
+
+var (
+	ErrSortingDisabled = errors.New("sorting is turned off (enableSorting), so nothing would be organised")
+)
+
+// FileMove is a file that sorting moved
+type FileMove struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// HasKeys returns true if keys have been loaded, which parsing and validating files needs
+func (lib *Library) HasKeys() bool {
+	return lib.keys != nil
+}
+
+// LoadIndex fills the index with the files in the scan folders, parsing their metadata without moving or validating anything
+// Deduplication in the index deletes files, so should be turned off first if nothing is to be changed
+func (lib *Library) LoadIndex() error {
+	if lib.keys == nil {
+		return ErrNeedsKeys
+	}
+	if lib.settings.Current().UseIndexCache {
+		if err := lib.FileIndex.LoadCache(lib.indexCachePath()); err != nil {
+			log.Info().Err(err).Msg("Index cache not loaded, all files will be parsed")
+		}
+	}
+	return lib.walkScanFolders(func(event *fileScanningInfo) {
+		if err := lib.setFileMeta(event); err != nil {
+			log.Warn().Err(err).Str("path", event.path).Msg("Couldn't parse file, not adding to the index")
+			return
+		}
+		lib.FileIndex.AddFileRecord(lib.newFileRecord(event.metadata, event.path, 0, event.nspSize))
+	})
+}
+
+// Organise sorts the files in the scan folders into the library, as the ingest pipeline would
+// Files are validated if the settings ask for it, but those that fail are only skipped, and nothing is compressed
+// Returns the files that were moved. In a dry run nothing is moved, and the plan is replaced by the changes that would be made
+func (lib *Library) Organise() ([]FileMove, error) {
+	if lib.keys == nil {
+		return nil, ErrNeedsKeys
+	}
+	if !lib.settings.Current().EnableSorting {
+		return nil, ErrSortingDisabled
+	}
+	if lib.settings.Current().DryRun {
+		// Every file is looked at again, so anything left over is out of date
+		// The saved plan is cleared too, so changes saved as they are planned aren't merged into it
+		lib.plan.Lock()
+		lib.resetPlan()
+		lib.plan.Unlock()
+		if err := lib.SavePlan(); err != nil {
+			return nil, err
+		}
+	} else if err := lib.createStorageFolders(); err != nil {
+		return nil, err
+	}
+	moves := []FileMove{}
+	cleanupFolders := map[string]bool{}
+	err := lib.walkScanFolders(func(event *fileScanningInfo) {
+		if err := lib.setFileMeta(event); err != nil {
+			log.Warn().Err(err).Str("path", event.path).Msg("Couldn't parse file, not moving it")
+			return
+		}
+		shouldValidate := (lib.settings.Current().ValidateLibrary && event.isInLibrary) || (lib.settings.Current().ValidateNewFiles && !event.isInLibrary)
+		if shouldValidate {
+			if err := lib.validateFile(event.path); err != nil {
+				log.Warn().Err(err).Str("path", event.path).Msg("File failed validation, not moving it")
+				return
+			}
+			event.validatedAt = time.Now().UnixNano()
+		}
+		source := event.path
+		lib.organisationEventHandler(event, nil)
+		if event.path != source {
+			moves = append(moves, FileMove{Source: source, Destination: event.path})
+		}
+		// Nothing is reading the worker queues, so take anything queued off them
+		for drained := false; !drained; {
+			select {
+			case folder := <-lib.folderCleanupRequests:
+				cleanupFolders[folder] = true
+			case <-lib.fileCompressionRequests:
+			default:
+				drained = true
+			}
+		}
+	})
+	for folder := range cleanupFolders {
+		lib.cleanupFolder(folder, nil)
+	}
+	if err == nil && lib.settings.Current().DryRun {
+		err = lib.SavePlan()
+	}
+	return moves, err
+}
+
+// walkScanFolders calls handle with each file in the scan folders that would be scanned
+// The files are all found first, so files moved by handle are not found again
+func (lib *Library) walkScanFolders(handle func(event *fileScanningInfo)) error {
+	events := []*fileScanningInfo{}
+	for _, folder := range lib.settings.GetAllScanFolders() {
+		isInLibraryFolder := false
+		if absPath, err := filepath.Abs(folder); err == nil {
+			isInLibraryFolder = lib.isInLibraryFolder(absPath)
+		}
+		err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && IsScannableFile(path) && !lib.isInQuarantine(path) {
+				events = append(events, &fileScanningInfo{path: path, isInLibrary: isInLibraryFolder})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		handle(event)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package library
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/titledb"
+	"github.com/ralim/switchhost/utilities"
+)
+
+func TestOrganise(t *testing.T) {
+	t.Parallel()
+	folder := t.TempDir()
+	sett := settings.Settings{
+		QueueLength:         4,
+		StorageFolder:       path.Join(folder, "library"),
+		FoldersToScan:       []string{path.Join(folder, "incoming")},
+		OrganisationFormat:  "{TitleID}/{TitleName} [{TitleID}]",
+		EnableSorting:       true,
+		CleanupEmptyFolders: true,
+		CacheFolder:         folder,
+		DryRun:              true,
+	}
+	lib := NewLibrary(titledb.CreateTitlesDB(&sett), &sett, nil, nil)
+	if _, err := lib.Organise(); err != ErrNeedsKeys {
+		t.Errorf("Should need keys, got %v", err)
+	}
+	keys, err := os.Open("../testing_files/prod.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	if err := lib.LoadKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	nspPath := path.Join(folder, "incoming", "nested", "UnitTest.nsp")
+	if err := os.MkdirAll(path.Dir(nspPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := utilities.CopyFile("../testing_files/UnitTest_[05123A0000000000].nsp", nspPath); err != nil {
+		t.Fatal(err)
+	}
+	expected := path.Join(folder, "library", "05123A0000000000", "UnitTest [05123A0000000000].nsp")
+
+	moves, err := lib.Organise()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := lib.Plan()
+	if len(moves) != 0 || len(plan) != 1 || plan[0].Action != PlanMove || plan[0].Source != nspPath || plan[0].Destination != expected {
+		t.Errorf("Should plan to move the file to %s, got %+v %+v", expected, moves, plan)
+	}
+	if !utilities.Exists(nspPath) || utilities.Exists(sett.StorageFolder) {
+		t.Error("A dry run should not change anything")
+	}
+	if files := lib.FileIndex.ListFiles(); len(files) != 1 || files[0].Path != nspPath {
+		t.Errorf("File should be in the index where it is, got %+v", files)
+	}
+
+	sett.DryRun = false
+	moves, err = lib.Organise()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != 1 || !utilities.Exists(expected) || utilities.Exists(nspPath) {
+		t.Errorf("File should be moved to %s, got %+v", expected, moves)
+	}
+	if utilities.Exists(path.Dir(nspPath)) {
+		t.Error("Empty folder should be cleaned up")
+	}
+	if files := lib.FileIndex.ListFiles(); len(files) != 1 || files[0].Path != expected {
+		t.Errorf("File should be in the index, got %+v", files)
+	}
+	sett.DryRun = true
+	if _, err := lib.Organise(); err != nil || len(lib.Plan()) != 0 {
+		t.Errorf("Nothing should be left to move, got %+v %v", lib.Plan(), err)
+	}
+
+	sett.EnableSorting = false
+	if _, err := lib.Organise(); err != ErrSortingDisabled {
+		t.Errorf("Should need sorting turned on, got %v", err)
+	}
+	fresh := NewLibrary(titledb.CreateTitlesDB(&sett), &sett, nil, nil)
+	fresh.keys = lib.keys
+	if err := fresh.LoadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if files := fresh.FileIndex.ListFiles(); len(files) != 1 || files[0].Path != expected {
+		t.Errorf("Index should be loaded, got %+v", files)
+	}
+}
@@ -0,0 +1,292 @@
+package library
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ralim/switchhost/utilities"
+	"github.com/rs/zerolog/log"
+)
+
+// In a dry run (the dryRun setting), sorting and deduplication plan the moves and deletes they would make to files already in the scan folders
+// The plan can be looked over (/api/plan or switchhost plan) and then applied in one go
+// Uploaded files are still sorted, as they are not in the library yet, but any duplicates they cause are only planned to be removed
+// The plan is saved in the cache folder, so it can be applied after a restart or from the command line
+// Changes are saved shortly after they are planned, merged into the saved plan so changes applied or cleared from the command line stay gone
+
+type PlanAction string
+
+const (
+	PlanMove   PlanAction = "move"
+	PlanDelete PlanAction = "delete"
+)
+
+type PlannedChange struct {
+	Action      PlanAction `json:"action"`
+	Source      string     `json:"source"`
+	Destination string     `json:"destination,omitempty"` // Where the file is moved to, empty for deletes
+	Reason      string     `json:"reason"`
+	Planned     time.Time  `json:"planned"`
+}
+
+// PlanFailure is a planned change that could not be applied
+type PlanFailure struct {
+	PlannedChange
+	Error string `json:"error"`
+}
+
+// PlanResult is what applying the plan did
+type PlanResult struct {
+	Applied []PlannedChange `json:"applied"`
+	Failed  []PlanFailure   `json:"failed"`
+}
+
+// Planned changes are saved this long after the first unsaved one, so a scan planning many changes doesn't rewrite the plan for each
+const planSaveDelay = time.Second
+
+type organisationPlan struct {
+	sync.Mutex
+	changes   []PlannedChange // Oldest first, only the latest change for each source is kept
+	unsaved   []PlannedChange // Planned since the plan was last saved
+	saveTimer *time.Timer     // Set while unsaved changes are waiting to be saved
+}
+
+func (lib *Library) planPath() string {
+	return path.Join(lib.settings.Current().CacheFolder, "organisation_plan.json")
+}
+
+// planChange records a change in the plan, replacing any change already planned for the file
+func (lib *Library) planChange(change PlannedChange) {
+	change.Planned = time.Now()
+	log.Info().Str("action", string(change.Action)).Str("source", change.Source).Str("destination", change.Destination).Str("reason", change.Reason).Msg("Dry run, change planned")
+	lib.plan.Lock()
+	defer lib.plan.Unlock()
+	lib.plan.changes = mergePlan(lib.plan.changes, []PlannedChange{change})
+	lib.plan.unsaved = mergePlan(lib.plan.unsaved, []PlannedChange{change})
+	if lib.plan.saveTimer == nil {
+		lib.plan.saveTimer = time.AfterFunc(planSaveDelay, func() {
+			if err := lib.flushPlan(); err != nil {
+				log.Warn().Err(err).Msg("Planned changes not saved")
+			}
+		})
+	}
+}
+
+// mergePlan returns the changes with the newer ones added, replacing any changes to the same files
+func mergePlan(changes, newer []PlannedChange) []PlannedChange {
+	changes = slices.DeleteFunc(slices.Clone(changes), func(existing PlannedChange) bool {
+		return slices.ContainsFunc(newer, func(change PlannedChange) bool { return existing.Source == change.Source })
+	})
+	return append(changes, newer...)
+}
+
+// resetPlan forgets all of the planned changes, including those waiting to be saved
+// Must be called with the plan locked
+func (lib *Library) resetPlan() {
+	lib.plan.changes = nil
+	lib.plan.unsaved = nil
+	if lib.plan.saveTimer != nil {
+		lib.plan.saveTimer.Stop()
+		lib.plan.saveTimer = nil
+	}
+}
+
+// removeDuplicate deletes a file dropped by deduplication in the index, or plans to in a dry run
+func (lib *Library) removeDuplicate(filePath, reason, kept string) error {
+	if lib.settings.Current().DryRun {
+		lib.planChange(PlannedChange{Action: PlanDelete, Source: filePath, Reason: fmt.Sprintf("%s, keeping %s", reason, kept)})
+		return nil
+	}
+	log.Info().Str("path", filePath).Str("reason", reason).Str("kept", kept).Msg("Cleaning up duplicate file")
+	lib.markPipelinePaths(filePath)
+	return os.Remove(filePath)
+}
+
+// Plan returns the planned changes, oldest first
+func (lib *Library) Plan() []PlannedChange {
+	lib.plan.Lock()
+	defer lib.plan.Unlock()
+	return slices.Clone(lib.plan.changes)
+}
+
+// ClearPlan forgets all of the planned changes
+func (lib *Library) ClearPlan() error {
+	lib.plan.Lock()
+	lib.resetPlan()
+	lib.plan.Unlock()
+	return lib.SavePlan()
+}
+
+// ApplyPlan makes all of the planned changes, and clears the plan
+// Deletes are done first, then moves. Changes that are out of date, such as the file no longer being there, fail and are dropped
+func (lib *Library) ApplyPlan() (PlanResult, error) {
+	lib.plan.Lock()
+	changes := lib.plan.changes
+	lib.resetPlan()
+	lib.plan.Unlock()
+
+	result := PlanResult{Applied: []PlannedChange{}, Failed: []PlanFailure{}}
+	fail := func(change PlannedChange, err error) {
+		log.Warn().Str("action", string(change.Action)).Str("source", change.Source).Err(err).Msg("Planned change failed")
+		result.Failed = append(result.Failed, PlanFailure{PlannedChange: change, Error: err.Error()})
+	}
+	cleanupFolders := map[string]bool{}
+	deleted := map[string]bool{}
+	for _, change := range changes {
+		if change.Action != PlanDelete {
+			continue
+		}
+		unlock := lib.lockTitleOfFile(change.Source)
+		lib.markPipelinePaths(change.Source)
+		if err := os.Remove(change.Source); err != nil {
+			unlock()
+			fail(change, err)
+			continue
+		}
+		log.Info().Str("path", change.Source).Str("reason", change.Reason).Msg("Deleted file as planned")
+		lib.FileIndex.RemoveFile(change.Source)
+		unlock()
+		deleted[change.Source] = true
+		cleanupFolders[filepath.Dir(change.Source)] = true
+		result.Applied = append(result.Applied, change)
+	}
+	for _, change := range changes {
+		if change.Action != PlanMove {
+			continue
+		}
+		if deleted[change.Source] {
+			fail(change, fmt.Errorf("file was deleted by the plan"))
+			continue
+		}
+		if err := lib.moveFile(change.Source, change.Destination); err != nil {
+			fail(change, err)
+			continue
+		}
+		log.Info().Str("oldPath", change.Source).Str("newPath", change.Destination).Msg("Moved file as planned")
+		cleanupFolders[filepath.Dir(change.Source)] = true
+		result.Applied = append(result.Applied, change)
+	}
+	for folder := range cleanupFolders {
+		lib.cleanupFolder(folder, nil)
+	}
+	return result, lib.SavePlan()
+}
+
+// lockTitleOfFile takes the organisation lock for the title of an indexed file, so it isn't changed under the organiser
+// Returns the function to unlock, files not in the index have nothing to lock
+func (lib *Library) lockTitleOfFile(filePath string) func() {
+	record, ok := lib.FileIndex.GetFileRecordByPath(filePath)
+	if !ok {
+		return func() {}
+	}
+	lib.organisationLocking.Lock(record.TitleID)
+	return func() { lib.organisationLocking.Unlock(record.TitleID) }
+}
+
+// moveFile moves a library file, keeping its record in the index
+// A file already at the destination is replaced, along with its record
+func (lib *Library) moveFile(source, destination string) error {
+	defer lib.lockTitleOfFile(source)()
+	if _, err := os.Stat(source); err != nil {
+		return err
+	}
+	if _, err := os.Stat(destination); err == nil && !lib.settings.Current().Deduplicate {
+		return fmt.Errorf("%s already exists, and deduplication is off", destination)
+	}
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return err
+	}
+	lib.markPipelinePaths(source, destination)
+	if err := utilities.RenameFile(source, destination); err != nil {
+		return err
+	}
+	lib.FileIndex.RemoveFile(destination) // Overwritten by the move
+	if record, ok := lib.FileIndex.GetFileRecordByPath(source); ok {
+		lib.FileIndex.RemoveFile(source)
+		record.Path = destination
+		if fileStat, err := os.Stat(destination); err == nil {
+			record.ModTime = fileStat.ModTime().UnixNano()
+		}
+		lib.FileIndex.AddFileRecord(&record)
+	}
+	return nil
+}
+
+// LoadPlan reads the plan saved in the cache folder, a missing plan is an empty one
+func (lib *Library) LoadPlan() error {
+	changes, err := lib.readPlan()
+	if err != nil {
+		return err
+	}
+	lib.plan.Lock()
+	defer lib.plan.Unlock()
+	lib.plan.changes = changes
+	return nil
+}
+
+func (lib *Library) readPlan() ([]PlannedChange, error) {
+	data, err := os.ReadFile(lib.planPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't read plan - %w", err)
+	}
+	changes := []PlannedChange{}
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return nil, fmt.Errorf("couldn't parse plan %s - %w", lib.planPath(), err)
+	}
+	return changes, nil
+}
+
+// SavePlan writes the plan to the cache folder, or removes the file if there is nothing planned
+func (lib *Library) SavePlan() error {
+	lib.plan.Lock()
+	defer lib.plan.Unlock()
+	lib.plan.unsaved = nil
+	return lib.writePlan(lib.plan.changes)
+}
+
+// flushPlan saves the changes planned since the plan was last saved, merging them into the saved plan
+// The saved plan may have been applied or cleared from the command line, so it is used rather than the plan held here
+func (lib *Library) flushPlan() error {
+	lib.plan.Lock()
+	defer lib.plan.Unlock()
+	if lib.plan.saveTimer != nil {
+		lib.plan.saveTimer.Stop()
+		lib.plan.saveTimer = nil
+	}
+	if len(lib.plan.unsaved) == 0 {
+		return nil
+	}
+	saved, err := lib.readPlan()
+	if err != nil {
+		return err
+	}
+	lib.plan.changes = mergePlan(saved, lib.plan.unsaved)
+	lib.plan.unsaved = nil
+	return lib.writePlan(lib.plan.changes)
+}
+
+// writePlan writes the changes to the plan file, or removes it if there are none
+func (lib *Library) writePlan(changes []PlannedChange) error {
+	if len(changes) == 0 {
+		if err := os.Remove(lib.planPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("couldn't remove plan - %w", err)
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't JSON'ify plan - %w", err)
+	}
+	if err := os.WriteFile(lib.planPath(), data, 0644); err != nil {
+		return fmt.Errorf("couldn't save plan - %w", err)
+	}
+	return nil
+}
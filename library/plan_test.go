@@ -0,0 +1,155 @@
+package library
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/titledb"
+	"github.com/ralim/switchhost/utilities"
+)
+
+func TestPlan(t *testing.T) {
+	t.Parallel()
+	folder := t.TempDir()
+	sett := settings.Settings{
+		QueueLength: 4,
+		CacheFolder: folder,
+		Deduplicate: true,
+		DryRun:      true,
+	}
+	lib := NewLibrary(titledb.CreateTitlesDB(&sett), &sett, nil, nil)
+	older := path.Join(folder, "older.nsp")
+	newer := path.Join(folder, "newer.nsp")
+	for _, file := range []string{older, newer} {
+		if err := os.WriteFile(file, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: older, TitleID: 0x05123A0000000000, Version: 0})
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: newer, TitleID: 0x05123A0000000000, Version: 65536})
+
+	plan := lib.Plan()
+	if len(plan) != 1 || plan[0].Action != PlanDelete || plan[0].Source != older {
+		t.Fatalf("Should plan to delete the older file, got %+v", plan)
+	}
+	if !utilities.Exists(older) {
+		t.Error("A dry run should not delete anything")
+	}
+	moved := path.Join(folder, "sorted", "newer.nsp")
+	lib.planChange(PlannedChange{Action: PlanMove, Source: newer, Destination: moved, Reason: "test"})
+	lib.planChange(PlannedChange{Action: PlanMove, Source: path.Join(folder, "missing.nsp"), Destination: moved, Reason: "test"})
+
+	// The plan should survive a restart
+	if err := lib.SavePlan(); err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewLibrary(titledb.CreateTitlesDB(&sett), &sett, nil, nil)
+	if err := restarted.LoadPlan(); err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.Plan()) != 3 {
+		t.Errorf("Plan should be loaded, got %+v", restarted.Plan())
+	}
+
+	result, err := lib.ApplyPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 2 || len(result.Failed) != 1 || result.Failed[0].Source != path.Join(folder, "missing.nsp") {
+		t.Errorf("Missing file should fail and the rest apply, got %+v", result)
+	}
+	if utilities.Exists(older) || utilities.Exists(newer) || !utilities.Exists(moved) {
+		t.Error("Planned changes should be made on disk")
+	}
+	if files := lib.FileIndex.ListFiles(); len(files) != 1 || files[0].Path != moved {
+		t.Errorf("Index should follow the moved file, got %+v", files)
+	}
+	if len(lib.Plan()) != 0 || utilities.Exists(lib.planPath()) {
+		t.Error("Plan should be cleared once applied")
+	}
+}
+
+func TestPlanMoveOverExistingFile(t *testing.T) {
+	t.Parallel()
+	folder := t.TempDir()
+	sett := settings.Settings{
+		QueueLength: 4,
+		CacheFolder: folder,
+		Deduplicate: true,
+	}
+	lib := NewLibrary(titledb.CreateTitlesDB(&sett), &sett, nil, nil)
+	source := path.Join(folder, "newer.nsp")
+	destination := path.Join(folder, "sorted", "update.nsp")
+	if err := os.MkdirAll(path.Dir(destination), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{source, destination} {
+		if err := os.WriteFile(file, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A different title, so the index can't tell the moved file is replacing it
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: destination, TitleID: 0x05123A0000001001, Version: 65536})
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: source, TitleID: 0x05123A0000000800, Version: 131072})
+	lib.planChange(PlannedChange{Action: PlanMove, Source: source, Destination: destination, Reason: "test"})
+
+	result, err := lib.ApplyPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 1 {
+		t.Errorf("Move should be applied, got %+v", result)
+	}
+	if data, err := os.ReadFile(destination); err != nil || string(data) != source {
+		t.Errorf("Moved file should replace the old one, %v", err)
+	}
+	if files := lib.FileIndex.ListFiles(); len(files) != 1 || files[0].Path != destination || files[0].Version != 131072 {
+		t.Errorf("Index should only have the moved file, got %+v", files)
+	}
+}
+
+func TestPlanSavedAsPlanned(t *testing.T) {
+	t.Parallel()
+	folder := t.TempDir()
+	sett := settings.Settings{
+		QueueLength: 4,
+		CacheFolder: folder,
+		DryRun:      true,
+	}
+	lib := NewLibrary(titledb.CreateTitlesDB(&sett), &sett, nil, nil)
+	if err := lib.removeDuplicate(path.Join(folder, "older.nsp"), "test", path.Join(folder, "newer.nsp")); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); !utilities.Exists(lib.planPath()) && time.Since(start) < 5*planSaveDelay; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fromCommandLine := NewLibrary(titledb.CreateTitlesDB(&sett), &sett, nil, nil)
+	if err := fromCommandLine.LoadPlan(); err != nil {
+		t.Fatal(err)
+	}
+	if plan := fromCommandLine.Plan(); len(plan) != 1 || plan[0].Action != PlanDelete || plan[0].Source != path.Join(folder, "older.nsp") {
+		t.Fatalf("Planned change should be saved, got %+v", plan)
+	}
+
+	// Changes cleared from the command line stay gone when more are planned
+	if err := fromCommandLine.ClearPlan(); err != nil {
+		t.Fatal(err)
+	}
+	lib.planChange(PlannedChange{Action: PlanDelete, Source: path.Join(folder, "other.nsp"), Reason: "test"})
+	if err := lib.flushPlan(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fromCommandLine.LoadPlan(); err != nil {
+		t.Fatal(err)
+	}
+	if plan := fromCommandLine.Plan(); len(plan) != 1 || plan[0].Source != path.Join(folder, "other.nsp") {
+		t.Errorf("Only the new change should be saved, got %+v", plan)
+	}
+	if plan := lib.Plan(); len(plan) != 1 {
+		t.Errorf("Plan should follow the saved plan, got %+v", plan)
+	}
+}
@@ -0,0 +1,210 @@
+package library
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ralim/switchhost/formats"
+	"github.com/ralim/switchhost/utilities"
+	"github.com/rs/zerolog/log"
+)
+
+// Quarantine holds files that failed parsing or validation, so they are out of the way but not lost
+// Each file is stored alongside a sidecar JSON describing why it was quarantined
+// Quarantined files can be retried (sent back through the import like an upload) or purged
+
+const quarantineSidecarSuffix = ".quarantine.json"
+
+const (
+	QuarantineStageMetadata   = "metadata"
+	QuarantineStageValidation = "validation"
+)
+
+var ErrQuarantineDisabled = errors.New("quarantine folder is not set")
+var ErrQuarantineNotFound = errors.New("quarantined file not found")
+
+type QuarantineEntry struct {
+	ID            string    `json:"id"` // Name of the file in the quarantine folder
+	OriginalPath  string    `json:"originalPath"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+	Stage         string    `json:"stage"` // Which step of the import rejected the file
+	Error         string    `json:"error"`
+	NCAName       string    `json:"ncaName,omitempty"`      // Partition that failed its hash check
+	ExpectedHash  string    `json:"expectedHash,omitempty"` // Hash from the CNMT
+	ActualHash    string    `json:"actualHash,omitempty"`   // Hash of the data in the file
+	TitleID       uint64    `json:"titleID,omitempty"`
+	Version       uint32    `json:"version,omitempty"`
+	Name          string    `json:"name,omitempty"`
+	Size          int64     `json:"size"`
+}
+
+// isInQuarantine is used to stop quarantined files being picked up again by scans
+func (lib *Library) isInQuarantine(filePath string) bool {
+	if len(lib.settings.Current().QuarantineFolder) == 0 {
+		return false
+	}
+	quarantine, err := filepath.Abs(lib.settings.Current().QuarantineFolder)
+	if err != nil {
+		return false
+	}
+	filePath, err = filepath.Abs(filePath)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(filePath, quarantine+string(filepath.Separator))
+}
+
+// tryQuarantine quarantines the file if the quarantine is turned on, returning true if the file was quarantined
+func (lib *Library) tryQuarantine(event *fileScanningInfo, stage string, cause error) bool {
+	if len(lib.settings.Current().QuarantineFolder) == 0 || !utilities.Exists(event.path) {
+		return false
+	}
+	if err := lib.quarantineFile(event, stage, cause); err != nil {
+		log.Error().Err(err).Str("path", event.path).Msg("Could not quarantine file")
+		return false
+	}
+	lib.updateJob(event, JobQuarantined, cause.Error())
+	lib.FileIndex.RemoveFile(event.path)
+	return true
+}
+
+// quarantineFile moves the file into the quarantine folder and writes out its sidecar
+// Files already in quarantine (such as a failed retry) keep their name and just get a new sidecar
+func (lib *Library) quarantineFile(event *fileScanningInfo, stage string, cause error) error {
+	if len(lib.settings.Current().QuarantineFolder) == 0 {
+		return ErrQuarantineDisabled
+	}
+	lib.quarantineLock.Lock()
+	defer lib.quarantineLock.Unlock()
+	if err := os.MkdirAll(lib.settings.Current().QuarantineFolder, 0755); err != nil {
+		return err
+	}
+	entry := QuarantineEntry{
+		OriginalPath:  event.path,
+		QuarantinedAt: time.Now(),
+		Stage:         stage,
+		Error:         cause.Error(),
+	}
+	var hashError *formats.HashMismatchError
+	if errors.As(cause, &hashError) {
+		entry.NCAName = hashError.Name
+		entry.ExpectedHash = hex.EncodeToString(hashError.Expected)
+		entry.ActualHash = hex.EncodeToString(hashError.Actual)
+	}
+	if event.metadata != nil {
+		entry.TitleID = event.metadata.TitleID
+		entry.Version = event.metadata.Version
+		entry.Name = event.metadata.EmbeddedTitle
+	}
+	if fileStat, err := os.Stat(event.path); err == nil {
+		entry.Size = fileStat.Size()
+	}
+
+	destination := event.path
+	if !lib.isInQuarantine(event.path) {
+		destination = lib.freeQuarantinePath(filepath.Base(event.path))
+		lib.markPipelinePaths(event.path)
+		if err := utilities.RenameFile(event.path, destination); err != nil {
+			return err
+		}
+		if !event.mustCleanupFile {
+			lib.folderCleanupRequests <- filepath.Dir(event.path)
+		}
+	}
+	entry.ID = filepath.Base(destination)
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Warn().Str("path", event.path).Str("quarantine", destination).Str("stage", stage).Err(cause).Msg("File quarantined")
+	return os.WriteFile(destination+quarantineSidecarSuffix, data, 0666)
+}
+
+// freeQuarantinePath returns a path in the quarantine folder for the file name that is not in use
+func (lib *Library) freeQuarantinePath(name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := filepath.Join(lib.settings.Current().QuarantineFolder, name)
+	for i := 1; utilities.Exists(candidate) || utilities.Exists(candidate+quarantineSidecarSuffix); i++ {
+		candidate = filepath.Join(lib.settings.Current().QuarantineFolder, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+	return candidate
+}
+
+// quarantinedPath resolves the ID of a quarantined file back to its path, refusing anything outside the quarantine folder
+func (lib *Library) quarantinedPath(id string) (string, error) {
+	if len(lib.settings.Current().QuarantineFolder) == 0 {
+		return "", ErrQuarantineDisabled
+	}
+	if id == "" || filepath.Base(id) != id || strings.HasSuffix(id, quarantineSidecarSuffix) {
+		return "", ErrQuarantineNotFound
+	}
+	filePath := filepath.Join(lib.settings.Current().QuarantineFolder, id)
+	if !utilities.Exists(filePath) {
+		return "", ErrQuarantineNotFound
+	}
+	return filePath, nil
+}
+
+// ListQuarantine returns all of the quarantined files, oldest first
+func (lib *Library) ListQuarantine() ([]QuarantineEntry, error) {
+	if len(lib.settings.Current().QuarantineFolder) == 0 {
+		return nil, ErrQuarantineDisabled
+	}
+	entries := []QuarantineEntry{}
+	sidecars, err := filepath.Glob(filepath.Join(lib.settings.Current().QuarantineFolder, "*"+quarantineSidecarSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, sidecar := range sidecars {
+		data, err := os.ReadFile(sidecar)
+		if err != nil {
+			continue
+		}
+		entry := QuarantineEntry{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.Warn().Err(err).Str("path", sidecar).Msg("Unreadable quarantine sidecar")
+			continue
+		}
+		entry.ID = strings.TrimSuffix(filepath.Base(sidecar), quarantineSidecarSuffix)
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].QuarantinedAt.Before(entries[j].QuarantinedAt) })
+	return entries, nil
+}
+
+// RetryQuarantined sends the quarantined file back through the import, as if it was uploaded
+// If it passes it is sorted into the library, otherwise it is quarantined again
+func (lib *Library) RetryQuarantined(id string) (uint64, error) {
+	filePath, err := lib.quarantinedPath(id)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Remove(filePath + quarantineSidecarSuffix); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return lib.NotifyIncomingFile(filePath, id, ""), nil
+}
+
+// PurgeQuarantined deletes the quarantined file and its sidecar
+func (lib *Library) PurgeQuarantined(id string) error {
+	filePath, err := lib.quarantinedPath(id)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("path", filePath).Msg("Purging quarantined file")
+	if err := os.Remove(filePath); err != nil {
+		return err
+	}
+	if err := os.Remove(filePath + quarantineSidecarSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
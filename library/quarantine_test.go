@@ -0,0 +1,131 @@
+package library
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ralim/switchhost/formats"
+	partitionfs "github.com/ralim/switchhost/formats/partitionFS"
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/utilities"
+)
+
+// corruptTestNSP flips a byte in the middle of the largest content NCA, so the file still parses but fails validation
+func corruptTestNSP(t *testing.T, nspPath string) string {
+	file, err := os.OpenFile(nspPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header, err := partitionfs.ReadSection(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var target partitionfs.FileEntryTableItem
+	for _, entry := range header.FileEntryTable {
+		if strings.HasSuffix(entry.Name, ".nca") && !strings.HasSuffix(entry.Name, ".cnmt.nca") && entry.Size > target.Size {
+			target = entry
+		}
+	}
+	offset := int64(target.StartOffset + target.Size/2)
+	value := make([]byte, 1)
+	if _, err := file.ReadAt(value, offset); err != nil {
+		t.Fatal(err)
+	}
+	value[0] ^= 0xFF
+	if _, err := file.WriteAt(value, offset); err != nil {
+		t.Fatal(err)
+	}
+	return target.Name
+}
+
+func TestQuarantine(t *testing.T) {
+	t.Parallel()
+	lib, nspPath := makeCompressionTestLibrary(t)
+	lib.settings.QuarantineFolder = path.Join(t.TempDir(), "quarantine")
+	lib.FileIndex = index.NewIndex(nil, lib.settings)
+	lib.jobs = newJobJournal(10)
+	lib.fileMetaScanRequests = make(chan *fileScanningInfo, 10)
+	lib.folderCleanupRequests = make(chan string, 10)
+	badNCA := corruptTestNSP(t, nspPath)
+
+	validationErr := lib.validateFile(nspPath)
+	if validationErr == nil {
+		t.Fatal("Corrupted file should fail validation")
+	}
+	event := &fileScanningInfo{
+		path:     nspPath,
+		metadata: &formats.FileInfo{TitleID: 0x05123A0000000000, EmbeddedTitle: "UnitTest"},
+		jobID:    lib.newJob("UnitTest.nsp"),
+	}
+	if !lib.tryQuarantine(event, QuarantineStageValidation, validationErr) {
+		t.Fatal("Should quarantine the file")
+	}
+	if utilities.Exists(nspPath) {
+		t.Error("File should be moved out of its folder")
+	}
+	if job, _ := lib.GetJob(event.jobID); job.State != JobQuarantined {
+		t.Errorf("Job should be marked quarantined, got %s", job.State)
+	}
+
+	entries, err := lib.ListQuarantine()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Should list the quarantined file, got %+v %v", entries, err)
+	}
+	entry := entries[0]
+	if entry.ID != "UnitTest.nsp" || entry.OriginalPath != nspPath || entry.Stage != QuarantineStageValidation || entry.TitleID != 0x05123A0000000000 {
+		t.Errorf("Sidecar should describe the file, got %+v", entry)
+	}
+	if entry.NCAName != badNCA || len(entry.ExpectedHash) != 64 || len(entry.ActualHash) != 64 || entry.ExpectedHash == entry.ActualHash {
+		t.Errorf("Sidecar should have the failing NCA and its hashes, got %+v", entry)
+	}
+	if !lib.isInQuarantine(path.Join(lib.settings.QuarantineFolder, entry.ID)) {
+		t.Error("Quarantined file should be inside the quarantine")
+	}
+
+	// Same name again should not overwrite the first one
+	if err := utilities.CopyFile(path.Join(lib.settings.QuarantineFolder, entry.ID), nspPath); err != nil {
+		t.Fatal(err)
+	}
+	if !lib.tryQuarantine(&fileScanningInfo{path: nspPath}, QuarantineStageMetadata, validationErr) {
+		t.Fatal("Should quarantine the second file")
+	}
+	if entries, _ := lib.ListQuarantine(); len(entries) != 2 || entries[1].ID != "UnitTest (1).nsp" {
+		t.Errorf("Should keep both files, got %+v", entries)
+	}
+
+	for _, id := range []string{"", "../UnitTest.nsp", "UnitTest.nsp" + quarantineSidecarSuffix, "missing.nsp"} {
+		if err := lib.PurgeQuarantined(id); err != ErrQuarantineNotFound {
+			t.Errorf("Should refuse to purge >%s<, got %v", id, err)
+		}
+	}
+	if err := lib.PurgeQuarantined("UnitTest (1).nsp"); err != nil {
+		t.Error("Should purge the file", err)
+	}
+
+	jobID, err := lib.RetryQuarantined("UnitTest.nsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry := <-lib.fileMetaScanRequests
+	if retry.jobID != jobID || !retry.mustCleanupFile || retry.path != path.Join(lib.settings.QuarantineFolder, "UnitTest.nsp") {
+		t.Errorf("Retry should import the file like an upload, got %+v", retry)
+	}
+	if entries, _ := lib.ListQuarantine(); len(entries) != 0 {
+		t.Errorf("Retried files should be removed from the list, got %+v", entries)
+	}
+	// Failing the retry quarantines it again in place
+	if !lib.tryQuarantine(retry, QuarantineStageValidation, validationErr) || !utilities.Exists(retry.path) {
+		t.Error("Failed retry should be quarantined in place")
+	}
+
+	lib.settings.QuarantineFolder = ""
+	if _, err := lib.ListQuarantine(); err != ErrQuarantineDisabled {
+		t.Error("Should report quarantine is off", err)
+	}
+	if lib.tryQuarantine(retry, QuarantineStageValidation, validationErr) {
+		t.Error("Should not quarantine when turned off")
+	}
+}
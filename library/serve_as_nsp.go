@@ -0,0 +1,58 @@
+package library
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ralim/switchhost/formats"
+)
+
+// Serving NSZ files as NSP, for installers that can't handle compressed files
+// Nothing is written to disk, the NSP is built up as it is read
+
+var ErrNotServableAsNSP = errors.New("only NSZ files can be served as NSP")
+
+// CanServeAsNSP returns true if the file is compressed and can be expanded back to an NSP when served
+func CanServeAsNSP(filePath string) bool {
+	return strings.ToLower(path.Ext(filePath)) == ".nsz"
+}
+
+// NSPSize returns the size of the NSP the NSZ expands to
+func NSPSize(filePath string) (int64, error) {
+	reader, size, err := OpenAsNSP(filePath)
+	if err != nil {
+		return 0, err
+	}
+	reader.Close()
+	return size, nil
+}
+
+type nspFileReader struct {
+	*formats.VirtualNSPReader
+	file *os.File
+}
+
+func (n *nspFileReader) Close() error {
+	n.VirtualNSPReader.Close()
+	return n.file.Close()
+}
+
+// OpenAsNSP opens an NSZ for reading as the NSP it expands to, returning the reader and the size of the NSP
+func OpenAsNSP(filePath string) (io.ReadSeekCloser, int64, error) {
+	if !CanServeAsNSP(filePath) {
+		return nil, 0, ErrNotServableAsNSP
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	nsp, err := formats.NewVirtualNSP(file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return &nspFileReader{VirtualNSPReader: nsp.NewReader(), file: file}, nsp.Size(), nil
+}
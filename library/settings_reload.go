@@ -0,0 +1,93 @@
+package library
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ralim/switchhost/settings"
+	"github.com/rs/zerolog/log"
+)
+
+// Scan folders can be changed while running
+// New folders are scanned and watched, removed folders stop being watched and their files are dropped from the index
+
+type watchRequest struct {
+	folder string
+	remove bool
+}
+
+// createStorageFolders makes any of the storage roots that don't exist yet
+func (lib *Library) createStorageFolders() error {
+	for _, folder := range lib.settings.GetStorageFolders() {
+		if _, err := os.Stat(folder); os.IsNotExist(err) {
+			if err := os.Mkdir(folder, 0755); err != nil {
+				return fmt.Errorf("couldn't create storage folder %s", folder)
+			}
+		}
+	}
+	return nil
+}
+
+// reloadFolders is called when the scan or storage folders are changed while running
+func (lib *Library) reloadFolders(old, updated *settings.Settings) error {
+	oldFolders := old.GetAllScanFolders()
+	newFolders := updated.GetAllScanFolders()
+	if updated.EnableSorting {
+		if err := lib.createStorageFolders(); err != nil {
+			return err
+		}
+	}
+
+	for _, folder := range oldFolders {
+		if slices.Contains(newFolders, folder) || isUnderAny(folder, newFolders) {
+			continue
+		}
+		log.Info().Str("path", folder).Msg("Folder removed from scanning")
+		lib.requestWatch(watchRequest{folder: folder, remove: true})
+		go func() {
+			lib.notifyRemovedPath(folder)
+			if absPath, err := filepath.Abs(folder); err == nil && absPath != folder {
+				lib.notifyRemovedPath(absPath)
+			}
+		}()
+	}
+
+	added := []string{}
+	for _, folder := range newFolders {
+		if !slices.Contains(oldFolders, folder) {
+			log.Info().Str("path", folder).Msg("Folder added to scanning")
+			lib.requestWatch(watchRequest{folder: folder})
+			added = append(added, folder)
+		}
+	}
+	if len(added) > 0 {
+		go lib.scanFolders(added, nil)
+	}
+	return nil
+}
+
+// requestWatch passes a change of folders to the watcher, if it is running
+func (lib *Library) requestWatch(request watchRequest) {
+	if !lib.watching.Load() {
+		return
+	}
+	select {
+	case lib.watchRequests <- request:
+	default:
+		log.Warn().Str("path", request.folder).Msg("Watcher busy, folder watch not changed until restart")
+	}
+}
+
+// isUnderAny returns true if the folder is inside one of the other folders
+func isUnderAny(folder string, others []string) bool {
+	folder = filepath.Clean(folder)
+	for _, other := range others {
+		if strings.HasPrefix(folder, filepath.Clean(other)+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package library
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/settings"
+)
+
+func TestReloadFolders(t *testing.T) {
+	t.Parallel()
+	tempFolder, err := os.MkdirTemp("", "unit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempFolder)
+	storage, removed, added := path.Join(tempFolder, "library"), path.Join(tempFolder, "removed"), path.Join(tempFolder, "added")
+	for _, folder := range []string{storage, removed, added} {
+		if err := os.Mkdir(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	existingFile := path.Join(added, "existing.nsp")
+	if err := os.WriteFile(existingFile, []byte("Test"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	sett := settings.NewSettings(path.Join(tempFolder, "settings.json"))
+	sett.StorageFolder = storage
+	sett.FoldersToScan = []string{removed}
+	sett.WatchDebounceSeconds = 0
+	lib := Library{
+		settings:                 sett,
+		FileIndex:                index.NewIndex(nil, sett),
+		fileMetaScanRequests:     make(chan *fileScanningInfo, 10),
+		fileOrganisationRequests: make(chan *fileScanningInfo, 10),
+		folderCleanupRequests:    make(chan string, 10),
+		watchRequests:            make(chan watchRequest, 10),
+		exit:                     make(chan bool, 10),
+		waitgroup:                &sync.WaitGroup{},
+	}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: path.Join(removed, "gone.nsp"), TitleID: 0x50000})
+	lib.waitgroup.Add(1)
+	go lib.folderWatchWorker()
+	defer lib.Stop()
+	// Give the watcher a moment to register
+	time.Sleep(time.Millisecond * 100)
+
+	sett.Subscribe("library", []string{"sourceFolders"}, lib.reloadFolders)
+	result, err := sett.Update(strings.NewReader(fmt.Sprintf(`{"sourceFolders":[%q]}`, added)))
+	if err != nil || len(result.Applied) != 1 {
+		t.Fatalf("Library should apply the change, got %+v %v", result, err)
+	}
+	select {
+	case event := <-lib.fileMetaScanRequests:
+		if event.path != existingFile {
+			t.Errorf("Should scan the added folder, got %s", event.path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Added folder wasn't scanned")
+	}
+	select {
+	case event := <-lib.fileOrganisationRequests:
+		if !event.fileWasDeleted || event.path != path.Join(removed, "gone.nsp") {
+			t.Errorf("Files in the removed folder should be dropped, got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Files in the removed folder weren't dropped")
+	}
+
+	// Give the watcher a moment to pick up the request
+	time.Sleep(time.Millisecond * 100)
+	newFile := path.Join(added, "new.nsp")
+	if err := os.WriteFile(newFile, []byte("Test"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(removed, "ignored.nsp"), []byte("Test"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-lib.fileMetaScanRequests:
+		if event.path != newFile {
+			t.Errorf("Should watch the added folder only, got %s", event.path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Added folder isn't watched")
+	}
+}
@@ -28,33 +28,39 @@ func (lib *Library) cleanupFolderWorker() {
 			lib.exit <- true
 			return
 		case cleanupPath := <-lib.folderCleanupRequests:
-			if lib.settings.CleanupEmptyFolders {
-				//need to check that this folder is inside one of the search folders && its not _the_ search folder
-				if cleanupPath, err := filepath.Abs(cleanupPath); err == nil {
-					ok := false
-					parent := ""
-					for _, baseFolder := range lib.settings.GetAllScanFolders() {
-						if folderAbs, err := filepath.Abs(baseFolder); err == nil {
-							if strings.HasPrefix(cleanupPath, folderAbs) && cleanupPath != folderAbs {
-								ok = true
-								parent = folderAbs
-							}
-						}
-					}
-					if ok {
-						if status != nil {
-							status.UpdateStatus(parent)
-						}
-						recursivelyCheckForEmptyFolders(parent)
-						if status != nil {
-							status.UpdateStatus("Idle")
-						}
-					}
+			lib.cleanupFolder(cleanupPath, status)
+		}
+	}
+
+}
+
+// cleanupFolder removes the empty folders in the scan folder holding cleanupPath, if cleanup is turned on
+func (lib *Library) cleanupFolder(cleanupPath string, status *termui.TaskState) {
+	if !lib.settings.Current().CleanupEmptyFolders {
+		return
+	}
+	//need to check that this folder is inside one of the search folders && its not _the_ search folder
+	if cleanupPath, err := filepath.Abs(cleanupPath); err == nil {
+		ok := false
+		parent := ""
+		for _, baseFolder := range lib.settings.GetAllScanFolders() {
+			if folderAbs, err := filepath.Abs(baseFolder); err == nil {
+				if strings.HasPrefix(cleanupPath, folderAbs) && cleanupPath != folderAbs {
+					ok = true
+					parent = folderAbs
 				}
 			}
 		}
+		if ok {
+			if status != nil {
+				status.UpdateStatus(parent)
+			}
+			recursivelyCheckForEmptyFolders(parent)
+			if status != nil {
+				status.UpdateStatus("Idle")
+			}
+		}
 	}
-
 }
 
 func recursivelyCheckForEmptyFolders(pathin string) {
@@ -3,20 +3,28 @@ package library
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path"
 	"strings"
 	"time"
 
+	"github.com/ralim/switchhost/formats"
+	"github.com/ralim/switchhost/keystore"
+	"github.com/ralim/switchhost/settings"
 	"github.com/ralim/switchhost/termui"
 	"github.com/ralim/switchhost/utilities"
 	"github.com/rs/zerolog/log"
 )
 
-var ErrCompressionTimeout = errors.New("Compression timed out")
+var (
+	ErrCompressionTimeout   = errors.New("Compression timed out")
+	ErrCompressionNeedsKeys = errors.New("Compression requires keys to be loaded")
+	ErrNotCompressable      = errors.New("Only NSP and XCI files can be compressed")
+)
 
-// Compression handles compressing files using the existingnsz tooling
+// Compression handles compressing files into NSZ/XCZ using the compressor in formats
 // It runs a single file compression at a time in the background
 
 func (lib *Library) compressionWorker() {
@@ -41,19 +49,14 @@ func (lib *Library) compressionWorker() {
 					if status != nil {
 						status.UpdateStatus(path.Base(request.path))
 					}
-					newpath := request.path[0:len(request.path)-1] + "z"
 					log.Info().Str("path", request.path).Msg("Starting compression")
-					err := lib.NSZCompressFile(request.path)
+					newpath, err := lib.NSZCompressFile(request.path, compressionProgress(status, path.Base(request.path)))
 					if err != nil {
 						log.Err(err).Msg("NSZ compression failed")
-						//Cleanup output if it made one
-						if utilities.Exists(newpath) {
-							if err := os.Remove(newpath); err != nil {
-								log.Error().Err(err).Msg("cleanup output from failing NSZ failed")
-							}
-						}
+						lib.updateJob(request, JobSorted, fmt.Sprintf("compression failed - %v", err))
 					} else {
 						log.Info().Str("path", request.path).Msg("Compression complete")
+						lib.updateJob(request, JobCompressed, "")
 						// Check if the source file has been deleted
 						// Check if the expected output file is made
 
@@ -70,8 +73,9 @@ func (lib *Library) compressionWorker() {
 							//New file exists, put it through the scanner
 							event := &fileScanningInfo{
 								path:        newpath,
-								isInLibrary: !lib.settings.ValidateCompressedFiles,
+								isInLibrary: !lib.settings.Current().ValidateCompressedFiles,
 								metadata:    request.metadata,
+								jobID:       request.jobID,
 							}
 							lib.fileMetaScanRequests <- event
 						}
@@ -84,37 +88,89 @@ func (lib *Library) compressionWorker() {
 		}
 	}
 }
-func (lib *Library) NSZCompressFile(path string) error {
-	//Call out to external tool using the user provided base string
-	parts := strings.Split(lib.settings.NSZCommandLine, " ")
-	cleanedParts := []string{}
-	for _, p := range parts {
-		if len(p) > 0 {
-			cleanedParts = append(cleanedParts, p)
+
+// compressionProgress returns a progress callback that shows the percentage done in the UI
+func compressionProgress(status *termui.TaskState, name string) func(done, total int64) {
+	if status == nil {
+		return nil
+	}
+	lastPercent := int64(-1)
+	return func(done, total int64) {
+		if total <= 0 {
+			return
 		}
+		if percent := done * 100 / total; percent != lastPercent {
+			lastPercent = percent
+			status.UpdateStatus(fmt.Sprintf("%s %d%%", name, percent))
+		}
+	}
+}
+
+// NSZCompressFile compresses the NSP/XCI into its NSZ/XCZ form alongside it, returning the new path
+// The output is built in a temp file and validated, and only then replaces the source file
+func (lib *Library) NSZCompressFile(filePath string, progress func(done, total int64)) (string, error) {
+	if lib.keys == nil {
+		return "", ErrCompressionNeedsKeys
+	}
+	var compress func(context.Context, *keystore.Keystore, formats.ReaderRequired, io.WriteSeeker, formats.CompressionOptions) error
+	var validate func(*keystore.Keystore, *settings.Settings, formats.ReaderRequired) error
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".nsp":
+		compress, validate = formats.CompressNSP, formats.ValidateNSPHash
+	case ".xci":
+		compress, validate = formats.CompressXCI, formats.ValidateXCIHash
+	default:
+		return "", ErrNotCompressable
+	}
+	newPath := filePath[0:len(filePath)-1] + "z"
+
+	source, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+	// Temp file is not a scannable extension, so the watcher leaves it alone while it is being written
+	output, err := os.CreateTemp(path.Dir(filePath), ".switchhost-compress-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("creating temp file for compression failed - %w", err)
 	}
-	cleanedParts = append(cleanedParts, path)
+	defer func() {
+		output.Close()
+		_ = os.Remove(output.Name()) // No-op once renamed
+	}()
 
-	timeoutValue := lib.settings.CompressionTimeoutMins
+	timeoutValue := lib.settings.Current().CompressionTimeoutMins
 	if timeoutValue == 0 {
 		timeoutValue = 60 // If not set, default to an hour
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutValue)*time.Minute)
 	defer cancel() // The cancel should be deferred so resources are cleaned up
 
-	cmd := exec.CommandContext(ctx, cleanedParts[0], cleanedParts[1:]...)
-
-	if ctx.Err() == context.DeadlineExceeded {
-		log.Error().Msg("Compression timed out and was terminated.")
-		return ErrCompressionTimeout
+	options := formats.CompressionOptions{
+		Level:             lib.settings.Current().CompressionLevel,
+		BlockSizeExponent: lib.settings.Current().CompressionBlockBits,
+		Progress:          progress,
 	}
-
-	byteData, err := cmd.CombinedOutput()
-	if err != nil {
-		outputLog := string(byteData)
-		log.Error().Err(err).Str("output", outputLog).Msg("NSZ compression failed")
-		return err
+	if err := compress(ctx, lib.keys, source, output, options); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Error().Msg("Compression timed out and was terminated.")
+			return "", ErrCompressionTimeout
+		}
+		return "", err
 	}
-	return nil
-
+	if err := validate(lib.keys, lib.settings, output); err != nil {
+		return "", fmt.Errorf("compressed file failed validation - %w", err)
+	}
+	if err := output.Close(); err != nil {
+		return "", err
+	}
+	lib.markPipelinePaths(output.Name(), newPath, filePath)
+	if err := os.Rename(output.Name(), newPath); err != nil {
+		return "", fmt.Errorf("moving compressed file into place failed - %w", err)
+	}
+	source.Close()
+	if err := os.Remove(filePath); err != nil {
+		log.Warn().Err(err).Str("path", filePath).Msg("Could not remove source file after compression")
+	}
+	return newPath, nil
 }
@@ -2,68 +2,85 @@ package library
 
 import (
 	"os"
+	"path"
 	"sync"
 	"testing"
 
 	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/utilities"
 )
 
-func TestNSZCompressFile(t *testing.T) {
-	t.Parallel()
-	tempFile, err := os.CreateTemp("", "TestNSZCompressFile-*")
-	if err != nil {
-		t.Error(err)
-	}
-	_, err = tempFile.WriteString("Test")
-	if err != nil {
-		t.Error(err)
-	}
-	tempFile.Close()
-	defer os.Remove(tempFile.Name())
+// makeCompressionTestLibrary returns a library with the test keys loaded, and a copy of the test NSP to work on
+func makeCompressionTestLibrary(t *testing.T) (*Library, string) {
 	sett := settings.Settings{
-		NSZCommandLine: "cat ",
+		CompressionLevel:     3,
+		CompressionBlockBits: 16,
 	}
-	lib := Library{
+	lib := &Library{
 		settings: &sett,
 	}
-	err = lib.NSZCompressFile(tempFile.Name())
+	keys, err := os.Open("../testing_files/prod.keys")
 	if err != nil {
-		t.Error("Should run normal commands fine", err)
+		t.Fatal(err)
 	}
-	sett.NSZCommandLine = "kfkjhksjhfksjhfksjdhfksjdfhksjhfdksdjhfksjhfksjdhfksdhfksjfd"
-	err = lib.NSZCompressFile(tempFile.Name())
-	if err == nil {
-		t.Error("Should throw error on bad ")
+	defer keys.Close()
+	if err := lib.LoadKeys(keys); err != nil {
+		t.Fatal(err)
 	}
-	sett.NSZCommandLine = "cat //"
-	err = lib.NSZCompressFile(tempFile.Name())
-	if err == nil {
-		t.Error("Should throw error on bad ")
+	nspPath := path.Join(t.TempDir(), "UnitTest.nsp")
+	if err := utilities.CopyFile("../testing_files/UnitTest_[05123A0000000000].nsp", nspPath); err != nil {
+		t.Fatal(err)
 	}
+	return lib, nspPath
 }
 
-func TestCompressionWorker(t *testing.T) {
+func TestNSZCompressFile(t *testing.T) {
 	t.Parallel()
-	tempFile, err := os.CreateTemp("", "TestNSZCompressFile-*")
+	lib, nspPath := makeCompressionTestLibrary(t)
+
+	newPath, err := lib.NSZCompressFile(nspPath, nil)
 	if err != nil {
-		t.Error(err)
+		t.Fatal("Should compress the test file", err)
 	}
-	_, err = tempFile.WriteString("Test")
-	if err != nil {
-		t.Error(err)
+	if newPath != nspPath[0:len(nspPath)-1]+"z" {
+		t.Errorf("Should return the NSZ path, got %s", newPath)
 	}
-	tempFile.Close()
-	defer os.Remove(tempFile.Name())
-	sett := settings.Settings{
-		NSZCommandLine: "rm",
+	if !utilities.Exists(newPath) || utilities.Exists(nspPath) {
+		t.Error("Compressed file should replace the source")
+	}
+	folder, _ := os.ReadDir(path.Dir(nspPath))
+	if len(folder) != 1 {
+		t.Errorf("Temp files should be cleaned up, found %d files", len(folder))
+	}
+
+	_, err = lib.NSZCompressFile(newPath, nil)
+	if err != ErrNotCompressable {
+		t.Error("Should refuse to compress a compressed file", err)
+	}
+
+	badPath := path.Join(path.Dir(nspPath), "Bad.nsp")
+	if err := os.WriteFile(badPath, []byte("Test"), 0666); err != nil {
+		t.Fatal(err)
 	}
-	lib := Library{
-		settings:                 &sett,
-		fileCompressionRequests:  make(chan *fileScanningInfo, 10),
-		fileMetaScanRequests:     make(chan *fileScanningInfo, 10),
-		fileOrganisationRequests: make(chan *fileScanningInfo, 10),
-		waitgroup:                &sync.WaitGroup{},
+	if _, err = lib.NSZCompressFile(badPath, nil); err == nil {
+		t.Error("Should throw error on bad file")
 	}
+	if !utilities.Exists(badPath) || utilities.Exists(badPath[0:len(badPath)-1]+"z") {
+		t.Error("Failed compression should leave the source alone")
+	}
+
+	if _, err := (&Library{settings: lib.settings}).NSZCompressFile(badPath, nil); err != ErrCompressionNeedsKeys {
+		t.Error("Should require keys", err)
+	}
+}
+
+func TestCompressionWorker(t *testing.T) {
+	t.Parallel()
+	lib, nspPath := makeCompressionTestLibrary(t)
+	lib.fileCompressionRequests = make(chan *fileScanningInfo, 10)
+	lib.fileMetaScanRequests = make(chan *fileScanningInfo, 10)
+	lib.fileOrganisationRequests = make(chan *fileScanningInfo, 10)
+	lib.waitgroup = &sync.WaitGroup{}
 	lib.waitgroup.Add(1)
 
 	defer close(lib.fileCompressionRequests)
@@ -71,36 +88,23 @@ func TestCompressionWorker(t *testing.T) {
 	defer close(lib.fileOrganisationRequests)
 
 	go lib.compressionWorker()
-	msg := &fileScanningInfo{
-		path: tempFile.Name(),
+	lib.fileCompressionRequests <- &fileScanningInfo{
+		path: nspPath,
 	}
-	lib.fileCompressionRequests <- msg
 
 	result := <-lib.fileOrganisationRequests
-
 	if !result.fileWasDeleted {
 		t.Error("should report file removed")
 	}
-	if result.path != tempFile.Name() {
+	if result.path != nspPath {
 		t.Error("should report file path")
 	}
-	tmpfile, err := os.CreateTemp("", "test_comp*.nsz")
-	if err != nil {
-		t.Error(err)
-	}
-	defer os.Remove(tmpfile.Name())
-	//Test the made new file path
-	lib.settings.NSZCommandLine = "touch"
-	lib.fileCompressionRequests <- &fileScanningInfo{
-		path: tmpfile.Name(),
-	}
 
 	result = <-lib.fileMetaScanRequests
-
 	if result.fileWasDeleted {
 		t.Error("should report file created")
 	}
-	if result.path != tmpfile.Name() {
-		t.Error("should report file path")
+	if result.path != nspPath[0:len(nspPath)-1]+"z" {
+		t.Error("should report new file path", result.path)
 	}
 }
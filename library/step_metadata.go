@@ -11,7 +11,6 @@ import (
 	"github.com/ralim/switchhost/formats"
 	cnmt "github.com/ralim/switchhost/formats/CNMT"
 	"github.com/ralim/switchhost/termui"
-	"github.com/ralim/switchhost/utilities"
 	"github.com/rs/zerolog/log"
 )
 
@@ -49,11 +48,15 @@ func (lib *Library) fileMetadataWorker() {
 			err := lib.setFileMeta(event)
 			if err == nil {
 				// File parsed well; so sent it to the next stage
+				lib.updateJob(event, JobMetadata, "")
 				lib.fileValidationScanRequests <- event
 			} else {
 				//File cant be parsed
-				if event.mustCleanupFile {
-					os.Remove(event.path)
+				if !lib.tryQuarantine(event, QuarantineStageMetadata, err) {
+					lib.updateJob(event, JobRejected, err.Error())
+					if event.mustCleanupFile {
+						os.Remove(event.path)
+					}
 				}
 			}
 			if status != nil {
@@ -68,11 +71,28 @@ func (lib *Library) setFileMeta(info *fileScanningInfo) error {
 	if err != nil {
 		return err
 	}
-	if !utilities.Exists(requestedPath) {
+	fileStat, err := os.Stat(requestedPath)
+	if err != nil {
 		return errors.New("not found")
 	}
 	info.path = requestedPath // store cleaned and checked path
 
+	// If the file is unchanged since we last indexed it, reuse the cached metadata rather than parsing it again
+	if lib.settings.Current().UseIndexCache {
+		if record, ok := lib.FileIndex.LookupCache(requestedPath, fileStat.Size(), fileStat.ModTime().UnixNano()); ok {
+			log.Debug().Str("path", requestedPath).Msg("Using cached metadata")
+			info.metadata = &formats.FileInfo{
+				TitleID:       record.TitleID,
+				Version:       record.Version,
+				EmbeddedTitle: record.EmbeddedTitle,
+				Type:          record.Type,
+				Size:          record.Size,
+			}
+			info.nspSize = record.NSPSize
+			return nil
+		}
+	}
+
 	log.Debug().Str("path", requestedPath).Msg("Starting requested scan")
 	fileInfo, err := lib.getFileInfo(requestedPath)
 	if err != nil {
@@ -84,12 +104,22 @@ func (lib *Library) setFileMeta(info *fileScanningInfo) error {
 
 // getFileInfo will return the parsed fileInfo if we know how to decode the file
 func (lib *Library) getFileInfo(sourceFile string) (*formats.FileInfo, error) {
+	details, err := lib.GetFileDetails(sourceFile)
+	if err != nil {
+		return nil, err
+	}
+	return &details.Info, nil
+}
+
+// GetFileDetails parses the file's metadata, along with the CNMT and NACP it was read from
+func (lib *Library) GetFileDetails(sourceFile string) (*formats.FileDetails, error) {
 
 	file, err := os.Open(sourceFile)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse file metadata for %s due to error %w when opening file", sourceFile, err)
 	}
-	info := formats.FileInfo{}
+	defer file.Close()
+	details := formats.FileDetails{}
 
 	ext := strings.ToLower(filepath.Ext(sourceFile))
 
@@ -97,22 +127,22 @@ func (lib *Library) getFileInfo(sourceFile string) (*formats.FileInfo, error) {
 	case ".nsp":
 		fallthrough
 	case ".nsz":
-		info, err = formats.ParseNSPToMetaData(lib.keys, lib.settings, file)
+		details, err = formats.ParseNSPDetails(lib.keys, lib.settings, file)
 	case ".xci":
 		fallthrough
 	case ".xcz":
-		info, err = formats.ParseXCIToMetaData(lib.keys, lib.settings, file)
+		details, err = formats.ParseXCIDetails(lib.keys, lib.settings, file)
 	default:
-		return &info, fmt.Errorf("not a valid file type - %s", sourceFile)
+		return nil, fmt.Errorf("not a valid file type - %s", sourceFile)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("could not parse file metadata for %s due to error %w during file parsing", sourceFile, err)
 	}
-	if len(info.EmbeddedTitle) == 0 && info.Type != cnmt.DLC {
+	if len(details.Info.EmbeddedTitle) == 0 && details.Info.Type != cnmt.DLC {
 		log.Warn().Str("file", sourceFile).Msg("Parsing embedded title failed")
 	}
 	if fileStat, err := file.Stat(); err == nil {
-		info.Size = fileStat.Size()
+		details.Info.Size = fileStat.Size()
 	}
-	return &info, nil
+	return &details, nil
 }
@@ -72,7 +72,18 @@ func (lib *Library) organisationEventHandler(event *fileScanningInfo, status *te
 		if status != nil {
 			status.UpdateStatus(fmt.Sprintf("Handling Delete of %s", fileShortName))
 		}
+		if event.removeFromDisk {
+			lib.markPipelinePaths(event.path)
+			if err := os.Remove(event.path); err != nil && !os.IsNotExist(err) {
+				log.Error().Str("path", event.path).Err(err).Msg("Deleting file failed")
+				lib.updateJob(event, JobFailed, err.Error())
+				return
+			}
+			log.Info().Str("path", event.path).Msg("Deleted file from library")
+			lib.folderCleanupRequests <- filepath.Dir(event.path)
+		}
 		lib.FileIndex.RemoveFile(event.path)
+		lib.updateJob(event, JobDone, "removed from library")
 	} else {
 		info := event.metadata
 		if status != nil {
@@ -83,28 +94,52 @@ func (lib *Library) organisationEventHandler(event *fileScanningInfo, status *te
 			status.UpdateStatus(fmt.Sprintf("Processing %s", fileShortName))
 		}
 		//Add to our repo, moved or not
-		record := &index.FileOnDiskRecord{
-			Path:    fileResultingPath,
-			TitleID: info.TitleID,
-			Version: info.Version,
-			Name:    info.EmbeddedTitle,
-			Size:    info.Size,
-		}
-		if gameTitle, err := lib.QueryGameTitleFromTitleID(info.TitleID); err == nil {
-			record.Name = gameTitle
-		}
+		record := lib.newFileRecord(info, fileResultingPath, event.validatedAt, event.nspSize)
 		if lib.ui != nil && lib.ui.Statistics != nil {
 			defer lib.ui.Statistics.Redraw()
 		}
 		lib.FileIndex.AddFileRecord(record)
+		lib.updateJob(event, JobSorted, "")
 		event.path = fileResultingPath
 		lib.postFileAddToLibraryHooks(event)
 
 	}
 }
+
+// newFileRecord makes the index record for the file at filePath, validatedAt is when the pipeline validated it (0 if it didn't)
+// nspSize is the NSP size of an NSZ from the index cache, if it is 0 the file is opened to work it out
+func (lib *Library) newFileRecord(info *formats.FileInfo, filePath string, validatedAt int64, nspSize int64) *index.FileOnDiskRecord {
+	record := &index.FileOnDiskRecord{
+		Path:          filePath,
+		TitleID:       info.TitleID,
+		Version:       info.Version,
+		Name:          info.EmbeddedTitle,
+		Size:          info.Size,
+		Type:          info.Type,
+		EmbeddedTitle: info.EmbeddedTitle,
+	}
+	if fileStat, err := os.Stat(filePath); err == nil {
+		record.ModTime = fileStat.ModTime().UnixNano()
+	}
+	lib.carryOverVerification(record, validatedAt)
+	if CanServeAsNSP(filePath) {
+		if nspSize > 0 {
+			record.NSPSize = nspSize
+		} else if size, err := NSPSize(filePath); err == nil {
+			record.NSPSize = size
+		} else {
+			log.Warn().Err(err).Str("path", filePath).Msg("Could not work out NSP size, it will only be served compressed")
+		}
+	}
+	if gameTitle, err := lib.QueryGameTitleFromTitleID(info.TitleID); err == nil {
+		record.Name = gameTitle
+	}
+	return record
+}
+
 func (lib *Library) postFileAddToLibraryHooks(event *fileScanningInfo) {
 	//Dispatch any post hooks
-	if lib.settings.CompressionEnabled {
+	if lib.settings.Current().CompressionEnabled {
 		extension := strings.ToLower(path.Ext(event.path))
 		if len(extension) == 4 {
 			if extension[3] != 'z' {
@@ -120,8 +155,41 @@ func (lib *Library) postFileAddToLibraryHooks(event *fileScanningInfo) {
 // If sorting is turned off, or if the sorting fails for one reason or another, just returns the source path
 // If the file is moved, it returns the updated path
 // If the file is moved, it will also notify the cleanup handler to go scan if the folder needs cleanup
+// In a dry run, files that are not incoming are left where they are and the move is planned instead
 func (lib *Library) sortFileIfApplicable(infoInfo *formats.FileInfo, currentPath string, isIncomingFile bool) string {
-	shouldSort := lib.settings.EnableSorting
+	newPath := lib.sortDestination(infoInfo, currentPath, isIncomingFile)
+	if newPath != currentPath && lib.settings.Current().DryRun && !isIncomingFile {
+		reason := "organisationFormat"
+		if _, err := os.Stat(newPath); err == nil {
+			reason += ", replacing the file already there"
+		}
+		lib.planChange(PlannedChange{Action: PlanMove, Source: currentPath, Destination: newPath, Reason: reason})
+		return currentPath
+	}
+	if newPath != currentPath {
+		log.Debug().Str("oldPath", currentPath).Str("newPath", newPath).Msg("Attempting move")
+		err := os.MkdirAll(path.Dir(newPath), 0755)
+		if err != nil {
+			log.Warn().Str("oldPath", currentPath).Str("newPath", newPath).Err(err).Msg("Moving file raised error")
+		} else {
+			lib.markPipelinePaths(currentPath, newPath)
+			err = utilities.RenameFile(currentPath, newPath)
+			if err != nil {
+				log.Warn().Str("oldPath", currentPath).Str("newPath", newPath).Err(err).Msg("Moving file raised error")
+			} else {
+				log.Info().Str("oldPath", currentPath).Str("newPath", newPath).Msg("Done moving")
+				//Push the folder to the cleanup path
+				lib.folderCleanupRequests <- filepath.Dir(currentPath)
+				return newPath
+			}
+		}
+	}
+	return currentPath
+}
+
+// sortDestination returns where sorting would move the file to, or the current path if it would be left where it is
+func (lib *Library) sortDestination(infoInfo *formats.FileInfo, currentPath string, isIncomingFile bool) string {
+	shouldSort := lib.settings.Current().EnableSorting
 	if isIncomingFile {
 		shouldSort = true // Have to sort incoming files
 	}
@@ -134,41 +202,24 @@ func (lib *Library) sortFileIfApplicable(infoInfo *formats.FileInfo, currentPath
 		log.Warn().Err(err).Str("path", currentPath).Msg("Determining ideal path failed")
 		return currentPath
 	}
-	if err == nil {
-		if newPath != currentPath {
-			log.Debug().Str("oldPath", currentPath).Str("newPath", newPath).Msg("Attempting move")
-			err := os.MkdirAll(path.Dir(newPath), 0755)
-			if err != nil {
-				log.Warn().Str("oldPath", currentPath).Str("newPath", newPath).Err(err).Msg("Moving file raised error")
-			} else {
-				//Check if file exists already, if it does then only overwrite if dedupe is on
-				if _, err := os.Stat(newPath); err == nil {
-					// File exists, so abort if not allowed to overwrite
-					if !lib.settings.Deduplicate {
-						log.Debug().Str("oldPath", currentPath).Str("newPath", newPath).Msg("Not moving file as deduplication is disabled")
-						return currentPath
-					}
-				}
-				err = utilities.RenameFile(currentPath, newPath)
-				if err != nil {
-					log.Warn().Str("oldPath", currentPath).Str("newPath", newPath).Err(err).Msg("Moving file raised error")
-				} else {
-					log.Info().Str("oldPath", currentPath).Str("newPath", newPath).Msg("Done moving")
-					//Push the folder to the cleanup path
-					lib.folderCleanupRequests <- filepath.Dir(currentPath)
-					return newPath
-				}
+	if newPath != currentPath {
+		//Check if file exists already, if it does then only overwrite if dedupe is on
+		if _, err := os.Stat(newPath); err == nil {
+			// File exists, so abort if not allowed to overwrite
+			if !lib.settings.Current().Deduplicate {
+				log.Debug().Str("oldPath", currentPath).Str("newPath", newPath).Msg("Not moving file as deduplication is disabled")
+				return currentPath
 			}
 		}
 	}
-	return currentPath
+	return newPath
 }
 
 // determineIdealFilePath is used for sorting files into the managed folder structure
 func (lib *Library) determineIdealFilePath(info *formats.FileInfo, sourceFile string) (string, error) {
 	//Using the template we want to create the new file path
 	//Since go doesnt really do named args; using string replacements for now
-	outputName := lib.settings.OrganisationFormat
+	outputName := lib.settings.Current().OrganisationFormat
 
 	outputName = strings.ReplaceAll(outputName, FormatTitleIDSub, FormatTitleIDToString(info.TitleID))
 	outputName = strings.ReplaceAll(outputName, FormatVersionSub, FormatVersionToString(info.Version))
@@ -192,8 +243,12 @@ func (lib *Library) determineIdealFilePath(info *formats.FileInfo, sourceFile st
 	extension := filepath.Ext(sourceFile)
 	extension = strings.ToLower(extension)
 	outputName += extension
-	outputName = path.Join(lib.settings.StorageFolder, outputName)
-	outputName, err := filepath.Abs(outputName)
+	storageRoot, err := lib.pickStorageRoot(info, sourceFile)
+	if err != nil {
+		return "", err
+	}
+	outputName = path.Join(storageRoot, outputName)
+	outputName, err = filepath.Abs(outputName)
 	return outputName, err
 
 }
@@ -0,0 +1,234 @@
+package library
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/termui"
+	"github.com/rs/zerolog/log"
+)
+
+// Revalidation re-checks the hashes of files already in the library in the background, to catch bitrot
+// Each run checks a limited batch (by file count and size) of the files that have gone the longest without a check,
+// so over time the whole library is covered without ever tying up the disks for long
+// Results are stored on the file records (and so the index cache), failures are reported but the files are left alone
+
+// The first run waits a little after startup so the initial scan gets the disks first
+const revalidationStartDelay = 10 * time.Minute
+
+type RevalidationStatus struct {
+	Enabled      bool           `json:"enabled"`
+	Running      bool           `json:"running"`
+	LastRun      *time.Time     `json:"lastRun,omitempty"` // When the last run finished
+	NextRun      *time.Time     `json:"nextRun,omitempty"`
+	LastRunFiles int            `json:"lastRunFiles"` // Files checked in the last run
+	LastRunBytes int64          `json:"lastRunBytes"`
+	Bitrot       []BitrotReport `json:"bitrot"` // Files that failed their last check
+}
+
+type BitrotReport struct {
+	Path         string    `json:"path"`
+	TitleID      uint64    `json:"titleID"`
+	Version      uint32    `json:"version"`
+	Name         string    `json:"name"`
+	LastVerified time.Time `json:"lastVerified"`
+	Error        string    `json:"error"`
+}
+
+type revalidationState struct {
+	sync.Mutex
+	running      bool
+	lastRun      time.Time
+	nextRun      time.Time
+	lastRunFiles int
+	lastRunBytes int64
+}
+
+func (lib *Library) revalidationWorker() {
+	defer lib.waitgroup.Done()
+	defer log.Info().Msg("revalidationWorker task exiting")
+	var status *termui.TaskState
+	if lib.ui != nil {
+		status = lib.ui.RegisterTask("Revalidation")
+		defer status.UpdateStatus("Exited")
+		status.UpdateStatus("Idle")
+	}
+	if lib.keys == nil {
+		log.Error().Msg("No keys are loaded, so library re-validation can't work.")
+		return
+	}
+
+	// Validating a large file takes a while, so runs watch this rather than the exit channel directly so they can be abandoned part way
+	stop := make(chan struct{})
+	go func() {
+		<-lib.exit
+		lib.exit <- true
+		close(stop)
+	}()
+
+	lib.setNextRevalidation(time.Now().Add(revalidationStartDelay))
+	timer := time.NewTimer(revalidationStartDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			lib.runRevalidation(stop, status)
+			interval := time.Duration(lib.settings.Current().RevalidateEveryHours) * time.Hour
+			lib.setNextRevalidation(time.Now().Add(interval))
+			timer.Reset(interval)
+		}
+	}
+}
+
+func (lib *Library) setNextRevalidation(next time.Time) {
+	lib.revalidation.Lock()
+	defer lib.revalidation.Unlock()
+	lib.revalidation.nextRun = next
+}
+
+// pickRevalidationBatch returns the files for the next run, files never checked first and then oldest checked
+func (lib *Library) pickRevalidationBatch(now time.Time) []index.FileOnDiskRecord {
+	files := lib.FileIndex.ListFiles()
+	sort.SliceStable(files, func(i, j int) bool { return files[i].LastVerified < files[j].LastVerified })
+	minAge := time.Duration(lib.settings.Current().RevalidateMinAgeDays) * 24 * time.Hour
+	maxBytes := int64(lib.settings.Current().RevalidateMaxGB) * 1024 * 1024 * 1024
+
+	batch := []index.FileOnDiskRecord{}
+	var batchBytes int64
+	for _, file := range files {
+		if file.LastVerified != 0 && now.Sub(time.Unix(0, file.LastVerified)) < minAge {
+			break // Sorted, so the rest are newer still
+		}
+		if lib.settings.Current().RevalidateMaxFiles > 0 && len(batch) >= lib.settings.Current().RevalidateMaxFiles {
+			break
+		}
+		if maxBytes > 0 && len(batch) > 0 && batchBytes+file.Size > maxBytes {
+			break // Always check at least one file, so huge files still get their turn
+		}
+		batch = append(batch, file)
+		batchBytes += file.Size
+	}
+	return batch
+}
+
+// runRevalidation checks one batch of files, stopping early if stop is closed
+func (lib *Library) runRevalidation(stop <-chan struct{}, status *termui.TaskState) {
+	lib.revalidation.Lock()
+	lib.revalidation.running = true
+	lib.revalidation.Unlock()
+	defer func() {
+		lib.revalidation.Lock()
+		lib.revalidation.running = false
+		lib.revalidation.Unlock()
+	}()
+
+	batch := lib.pickRevalidationBatch(time.Now())
+	log.Info().Int("files", len(batch)).Msg("Starting library re-validation run")
+	checkedFiles := 0
+	var checkedBytes int64
+	for _, file := range batch {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if _, err := os.Stat(file.Path); err != nil {
+			continue // Moved or removed since the batch was picked
+		}
+		if status != nil {
+			status.UpdateStatus(file.Path)
+		}
+		result := index.VerifyOK
+		err := lib.validateFileUntil(file.Path, stop)
+		if errors.Is(err, ErrValidationStopped) {
+			return
+		}
+		if err != nil {
+			result = err.Error()
+			log.Error().Str("path", file.Path).Str("title", file.Name).Err(err).Msg("Bitrot detected, file no longer matches its hashes")
+		}
+		lib.FileIndex.SetVerification(file.Path, time.Now().UnixNano(), result)
+		checkedFiles++
+		checkedBytes += file.Size
+	}
+	if status != nil {
+		status.UpdateStatus("Idle")
+	}
+
+	now := time.Now()
+	lib.revalidation.Lock()
+	lib.revalidation.lastRun = now
+	lib.revalidation.lastRunFiles = checkedFiles
+	lib.revalidation.lastRunBytes = checkedBytes
+	lib.revalidation.Unlock()
+	bitrot := lib.bitrotReports()
+	log.Info().Int("files", checkedFiles).Int("bitrot", len(bitrot)).Msg("Finished library re-validation run")
+	if lib.ui != nil && lib.ui.Statistics != nil {
+		lib.ui.Statistics.BitrotDetected = len(bitrot)
+		lib.ui.Statistics.LastRevalidation = now.Format(time.DateTime)
+		lib.ui.Statistics.Redraw()
+	}
+}
+
+func (lib *Library) bitrotReports() []BitrotReport {
+	reports := []BitrotReport{}
+	for _, file := range lib.FileIndex.ListFiles() {
+		if file.VerifyFailed() {
+			reports = append(reports, BitrotReport{
+				Path:         file.Path,
+				TitleID:      file.TitleID,
+				Version:      file.Version,
+				Name:         file.Name,
+				LastVerified: time.Unix(0, file.LastVerified),
+				Error:        file.VerifyResult,
+			})
+		}
+	}
+	return reports
+}
+
+// GetRevalidationStatus reports on the background re-validation and any bitrot it has found
+func (lib *Library) GetRevalidationStatus() RevalidationStatus {
+	lib.revalidation.Lock()
+	defer lib.revalidation.Unlock()
+	status := RevalidationStatus{
+		Enabled:      lib.settings.Current().RevalidateEveryHours > 0,
+		Running:      lib.revalidation.running,
+		LastRunFiles: lib.revalidation.lastRunFiles,
+		LastRunBytes: lib.revalidation.lastRunBytes,
+		Bitrot:       lib.bitrotReports(),
+	}
+	if !lib.revalidation.lastRun.IsZero() {
+		lastRun := lib.revalidation.lastRun
+		status.LastRun = &lastRun
+	}
+	if !lib.revalidation.nextRun.IsZero() {
+		nextRun := lib.revalidation.nextRun
+		status.NextRun = &nextRun
+	}
+	return status
+}
+
+// carryOverVerification keeps the last check of a file that is re-added to the index unchanged
+// Files that were just validated in the pipeline are marked as checked now instead
+func (lib *Library) carryOverVerification(record *index.FileOnDiskRecord, validatedAt int64) {
+	if validatedAt != 0 {
+		record.LastVerified = validatedAt
+		record.VerifyResult = index.VerifyOK
+		return
+	}
+	previous, ok := lib.FileIndex.GetFileRecordByPath(record.Path)
+	if !ok && lib.settings.Current().UseIndexCache {
+		previous, ok = lib.FileIndex.LookupCache(record.Path, record.Size, record.ModTime)
+	}
+	if ok && previous.Size == record.Size && previous.ModTime == record.ModTime {
+		record.LastVerified = previous.LastVerified
+		record.VerifyResult = previous.VerifyResult
+	}
+}
@@ -0,0 +1,78 @@
+package library
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/utilities"
+)
+
+func TestRevalidation(t *testing.T) {
+	t.Parallel()
+	lib, goodPath := makeCompressionTestLibrary(t)
+	lib.FileIndex = index.NewIndex(nil, lib.settings)
+	lib.settings.RevalidateEveryHours = 24
+	lib.settings.RevalidateMaxFiles = 1
+	lib.settings.RevalidateMinAgeDays = 30
+
+	badPath := path.Join(path.Dir(goodPath), "Bad.nsp")
+	if err := utilities.CopyFile(goodPath, badPath); err != nil {
+		t.Fatal(err)
+	}
+	corruptTestNSP(t, badPath)
+	for _, record := range []*index.FileOnDiskRecord{
+		{Path: goodPath, TitleID: 0x05123A0000000000, Name: "Good", Size: 100, LastVerified: time.Now().Add(-40 * 24 * time.Hour).UnixNano(), VerifyResult: index.VerifyOK},
+		{Path: badPath, TitleID: 0x05123A0000000800, Version: 65536, Name: "Bad", Size: 100},
+	} {
+		lib.FileIndex.AddFileRecord(record)
+	}
+
+	batch := lib.pickRevalidationBatch(time.Now())
+	if len(batch) != 1 || batch[0].Path != badPath {
+		t.Fatalf("Should pick the never checked file first, got %+v", batch)
+	}
+	lib.settings.RevalidateMaxFiles = 0
+	lib.settings.RevalidateMaxGB = 1
+	if batch := lib.pickRevalidationBatch(time.Now()); len(batch) != 2 {
+		t.Errorf("Should pick both files within the size limit, got %d", len(batch))
+	}
+
+	stopped := make(chan struct{})
+	close(stopped)
+	lib.runRevalidation(stopped, nil)
+	if status := lib.GetRevalidationStatus(); status.LastRun != nil || len(status.Bitrot) != 0 {
+		t.Errorf("Stopped run should not check anything, got %+v", status)
+	}
+
+	lib.runRevalidation(make(chan struct{}), nil)
+	status := lib.GetRevalidationStatus()
+	if !status.Enabled || status.Running || status.LastRun == nil || status.LastRunFiles != 2 {
+		t.Errorf("Should report the run, got %+v", status)
+	}
+	if len(status.Bitrot) != 1 || status.Bitrot[0].Path != badPath || status.Bitrot[0].Error == "" {
+		t.Errorf("Should report bitrot on the corrupted file, got %+v", status.Bitrot)
+	}
+	if record, _ := lib.FileIndex.GetFileRecordByPath(goodPath); record.VerifyResult != index.VerifyOK || time.Since(time.Unix(0, record.LastVerified)) > time.Minute {
+		t.Errorf("Good file should be marked checked now, got %+v", record)
+	}
+	if batch := lib.pickRevalidationBatch(time.Now()); len(batch) != 0 {
+		t.Errorf("Recently checked files should be skipped, got %+v", batch)
+	}
+	if _, err := os.Stat(badPath); err != nil {
+		t.Error("Bitrot files should be left in place", err)
+	}
+
+	// Unchanged files keep their last check when re-added to the index, validated ones are marked checked
+	record := &index.FileOnDiskRecord{Path: badPath, Size: 100}
+	lib.carryOverVerification(record, 0)
+	if !record.VerifyFailed() {
+		t.Errorf("Should carry over the failed check, got %+v", record)
+	}
+	lib.carryOverVerification(record, 1234)
+	if record.LastVerified != 1234 || record.VerifyFailed() {
+		t.Errorf("Should mark validated files as checked, got %+v", record)
+	}
+}
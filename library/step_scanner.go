@@ -19,7 +19,17 @@ func (lib *Library) RunScan() {
 		status = lib.ui.RegisterTask("File Scanner")
 		defer status.UpdateStatus("Done")
 	}
-	for _, folder := range lib.settings.GetAllScanFolders() {
+	lib.scanAllFolders(status)
+}
+
+// scanAllFolders scans each of the scan folders, showing progress on the status if it's not nil
+func (lib *Library) scanAllFolders(status *termui.TaskState) {
+	lib.scanFolders(lib.settings.GetAllScanFolders(), status)
+}
+
+// scanFolders scans each of the folders, showing progress on the status if it's not nil
+func (lib *Library) scanFolders(folders []string, status *termui.TaskState) {
+	for _, folder := range folders {
 		if status != nil {
 			status.UpdateStatus(folder)
 		}
@@ -32,31 +42,21 @@ func (lib *Library) RunScan() {
 
 //ScanFolder recursively scans the provied folder and feeds it to the organisation queue
 func (lib *Library) ScanFolder(path string) error {
-	isInLibraryFolder := strings.HasPrefix(path, lib.settings.StorageFolder)
+	isInLibraryFolder := false
+	if absPath, err := filepath.Abs(path); err == nil {
+		isInLibraryFolder = lib.isInLibraryFolder(absPath)
+	}
 	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		if err == nil {
 
 			if !info.IsDir() {
-
-				ext := filepath.Ext(path)
-				ext = strings.ToUpper(ext)
-				shouldScan := false
-				switch ext {
-				case ".NSP":
-					shouldScan = true
-				case ".NSZ":
-					shouldScan = true
-				case ".XCI":
-					shouldScan = true
-				case ".XCZ":
-					shouldScan = true
-				}
-				if shouldScan {
+				if IsScannableFile(path) && !lib.isInQuarantine(path) {
 					//This is a file, so push it to the queue
 					log.Debug().Str("path", path).Msg("File scan requested")
 					event := &fileScanningInfo{
 						path:        path,
 						isInLibrary: isInLibraryFolder,
+						jobID:       lib.newJob(filepath.Base(path)),
 					}
 					lib.fileMetaScanRequests <- event
 				}
@@ -65,3 +65,20 @@ func (lib *Library) ScanFolder(path string) error {
 		return nil
 	})
 }
+
+// IsScannableFile returns true if the file extension is one of the formats we can parse
+func IsScannableFile(path string) bool {
+	ext := filepath.Ext(path)
+	ext = strings.ToUpper(ext)
+	switch ext {
+	case ".NSP":
+		return true
+	case ".NSZ":
+		return true
+	case ".XCI":
+		return true
+	case ".XCZ":
+		return true
+	}
+	return false
+}
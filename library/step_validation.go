@@ -1,9 +1,11 @@
 package library
 
 import (
+	"errors"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/ralim/switchhost/formats"
 	"github.com/ralim/switchhost/termui"
@@ -35,16 +37,34 @@ func (lib *Library) fileValidationWorker() {
 			if status != nil {
 				status.UpdateStatus(path.Base(event.path))
 			}
+			if event.revalidateOnly {
+				lib.revalidateRequestedFile(event)
+				if status != nil {
+					status.UpdateStatus("Idle")
+				}
+				continue
+			}
 
 			// This file has had its metadata parsed, so we want to validate integrity if desired
 			// If it parses validation send it on, if not.. handle it
-			shouldValidate := (lib.settings.ValidateLibrary && event.isInLibrary) || (lib.settings.ValidateNewFiles && !event.isInLibrary)
+			shouldValidate := (lib.settings.Current().ValidateLibrary && event.isInLibrary) || (lib.settings.Current().ValidateNewFiles && !event.isInLibrary)
 
-			if !shouldValidate || lib.validateFile(requestedPath) {
+			var validationErr error
+			if shouldValidate {
+				if validationErr = lib.validateFile(requestedPath); validationErr != nil {
+					lib.validationFailures.Add(1)
+				}
+			}
+			if validationErr == nil {
 				//Validated, send onwards
+				if shouldValidate {
+					lib.updateJob(event, JobValidated, "")
+					event.validatedAt = time.Now().UnixNano()
+				}
 				lib.fileOrganisationRequests <- event
-			} else {
-				if lib.settings.DeleteValidationFails || event.mustCleanupFile {
+			} else if !lib.tryQuarantine(event, QuarantineStageValidation, validationErr) {
+				lib.updateJob(event, JobRejected, "failed validation")
+				if lib.settings.Current().DeleteValidationFails || event.mustCleanupFile {
 					log.Warn().Str("path", requestedPath).Str("embeddedTitle", event.metadata.EmbeddedTitle).Uint("version", uint(event.metadata.Version)).Msg("File failed valiation, deleting file")
 					if err := os.Remove(requestedPath); err != nil {
 						log.Error().Str("path", requestedPath).Msg("File failed valiation, tried deleting file, but it failed")
@@ -61,38 +81,74 @@ func (lib *Library) fileValidationWorker() {
 	}
 }
 
-func (lib *Library) validateFile(filepath string) bool {
-	//Returns false if file fails validation, true if good or uncertain
+func (lib *Library) validateFile(filepath string) error {
+	return lib.validateFileUntil(filepath, nil)
+}
+
+// ValidateFile checks the hashes of the file, returning the error if it fails
+// Files that can't be opened or aren't a type that can be validated are not errors, so check these first
+func (lib *Library) ValidateFile(filepath string) error {
+	return lib.validateFile(filepath)
+}
 
+// validateFileUntil validates the file, giving up with ErrValidationStopped if stop is closed part way through
+// Returns the error if file fails validation, nil if good or uncertain
+func (lib *Library) validateFileUntil(filepath string, stop <-chan struct{}) error {
 	ext := strings.ToLower(path.Ext(filepath))
 	if len(ext) == 4 {
 
 		if ext[0:3] == ".ns" {
 			file, err := os.Open(filepath)
 			if err != nil {
-				return true
+				return nil
 			}
 			defer file.Close()
-			if err := formats.ValidateNSPHash(lib.keys, lib.settings, file); err != nil {
+			if err := formats.ValidateNSPHash(lib.keys, lib.settings, stoppableReader{file, stop}); err != nil {
 				log.Warn().Str("path", filepath).Err(err).Msg("Failed validation")
-				return false
+				return err
 			}
 		} else if ext[0:3] == ".xc" {
 			file, err := os.Open(filepath)
 			if err != nil {
-				return true
+				return nil
 			}
 			defer file.Close()
-			if err := formats.ValidateXCIHash(lib.keys, lib.settings, file); err != nil {
+			if err := formats.ValidateXCIHash(lib.keys, lib.settings, stoppableReader{file, stop}); err != nil {
 				log.Warn().Str("path", filepath).Err(err).Msg("Failed validation")
-				return false
+				return err
 			}
 
 		} else {
-			return true // can't validate
+			return nil // can't validate
 		}
 
 	}
-	return true
+	return nil
 
 }
+
+var ErrValidationStopped = errors.New("validation stopped")
+
+// stoppableReader fails reads once stop is closed, so long validations can be abandoned
+type stoppableReader struct {
+	*os.File
+	stop <-chan struct{}
+}
+
+func (r stoppableReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.stop:
+		return 0, ErrValidationStopped
+	default:
+		return r.File.Read(p)
+	}
+}
+
+func (r stoppableReader) ReadAt(p []byte, off int64) (int, error) {
+	select {
+	case <-r.stop:
+		return 0, ErrValidationStopped
+	default:
+		return r.File.ReadAt(p, off)
+	}
+}
@@ -0,0 +1,227 @@
+package library
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/ralim/switchhost/formats"
+	"github.com/ralim/switchhost/termui"
+	"github.com/rs/zerolog/log"
+)
+
+// Watcher monitors the scan folders + library for changes while running
+// New or modified files are held until they have been quiet for the debounce time (so partial copies are not parsed), then pushed to the metadata queue
+// Removed or renamed files are pushed to the organiser as deletes so the index does not keep stale records
+// Files the pipeline itself moves, writes or removes are marked for a short while first, and the watcher ignores them as the pipeline already queues what is needed
+
+// How long after being marked the watcher ignores changes to a pipeline path, long enough for the watcher to see the change
+const pipelinePathGrace = 10 * time.Second
+
+// pipelinePaths are the files the pipeline is changing, and when to stop ignoring them
+type pipelinePaths struct {
+	sync.Mutex
+	paths map[string]time.Time
+}
+
+// markPipelinePaths tells the watcher to ignore changes to these paths, called just before the pipeline changes them
+func (lib *Library) markPipelinePaths(paths ...string) {
+	lib.pipelinePaths.Lock()
+	defer lib.pipelinePaths.Unlock()
+	if lib.pipelinePaths.paths == nil {
+		lib.pipelinePaths.paths = make(map[string]time.Time)
+	}
+	until := time.Now().Add(pipelinePathGrace)
+	for _, filePath := range paths {
+		if absPath, err := filepath.Abs(filePath); err == nil {
+			lib.pipelinePaths.paths[absPath] = until
+		}
+	}
+}
+
+// isPipelinePath returns true if the pipeline is changing the file at path, forgetting any paths that have expired
+func (lib *Library) isPipelinePath(filePath string) bool {
+	lib.pipelinePaths.Lock()
+	defer lib.pipelinePaths.Unlock()
+	now := time.Now()
+	for markedPath, until := range lib.pipelinePaths.paths {
+		if now.After(until) {
+			delete(lib.pipelinePaths.paths, markedPath)
+		}
+	}
+	_, ok := lib.pipelinePaths.paths[filePath]
+	return ok
+}
+
+func (lib *Library) folderWatchWorker() {
+	defer lib.waitgroup.Done()
+	defer log.Info().Msg("folderWatchWorker task exiting")
+	var status *termui.TaskState
+	if lib.ui != nil {
+		status = lib.ui.RegisterTask("Watcher")
+		defer status.UpdateStatus("Exited")
+		status.UpdateStatus("Idle")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not create folder watcher, new files will only be found at startup")
+		return
+	}
+	defer watcher.Close()
+	lib.watching.Store(true)
+	defer lib.watching.Store(false)
+	for _, folder := range lib.settings.GetAllScanFolders() {
+		lib.watchFolderRecursively(watcher, folder)
+	}
+
+	debounce := time.Duration(lib.settings.Current().WatchDebounceSeconds) * time.Second
+	// Paths we have seen writes to, and when the last write was seen
+	pendingFiles := make(map[string]time.Time)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lib.exit:
+			lib.exit <- true
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			lib.handleWatchEvent(watcher, event, pendingFiles)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warn().Err(err).Msg("Folder watcher error")
+		case request := <-lib.watchRequests:
+			if request.remove {
+				unwatchFolderRecursively(watcher, request.folder)
+			} else {
+				lib.watchFolderRecursively(watcher, request.folder)
+			}
+		case now := <-ticker.C:
+			for filePath, lastWrite := range pendingFiles {
+				if now.Sub(lastWrite) >= debounce {
+					delete(pendingFiles, filePath)
+					if status != nil {
+						status.UpdateStatus(filepath.Base(filePath))
+					}
+					lib.queueWatchedFile(filePath)
+				}
+			}
+			if status != nil {
+				status.UpdateStatus("Idle")
+			}
+		}
+	}
+}
+
+func (lib *Library) handleWatchEvent(watcher *fsnotify.Watcher, event fsnotify.Event, pendingFiles map[string]time.Time) {
+	eventPath, err := filepath.Abs(event.Name)
+	if err != nil {
+		return
+	}
+	if lib.isPipelinePath(eventPath) {
+		return // The pipeline already queued anything needed for this change
+	}
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		// Renames show up as a remove of the old path, and a create of the new path
+		delete(pendingFiles, eventPath)
+		lib.notifyRemovedPath(eventPath)
+		return
+	}
+	if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+		if info, err := os.Stat(eventPath); err == nil && info.IsDir() {
+			if event.Has(fsnotify.Create) {
+				// New folder, watch it and pick up anything that landed in it before the watch was added
+				lib.watchFolderRecursively(watcher, eventPath)
+				_ = filepath.Walk(eventPath, func(path string, info os.FileInfo, err error) error {
+					if err == nil && !info.IsDir() && IsScannableFile(path) {
+						pendingFiles[path] = time.Now()
+					}
+					return nil
+				})
+			}
+			return
+		}
+		if IsScannableFile(eventPath) {
+			pendingFiles[eventPath] = time.Now()
+		}
+	}
+}
+
+func (lib *Library) watchFolderRecursively(watcher *fsnotify.Watcher, folder string) {
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			if err := watcher.Add(path); err != nil {
+				log.Warn().Err(err).Str("path", path).Msg("Could not watch folder")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("path", folder).Msg("Could not watch folder")
+	}
+}
+
+// unwatchFolderRecursively stops watching the folder and everything under it
+func unwatchFolderRecursively(watcher *fsnotify.Watcher, folder string) {
+	absFolder, err := filepath.Abs(folder)
+	if err != nil {
+		return
+	}
+	for _, watched := range watcher.WatchList() {
+		if absWatched, err := filepath.Abs(watched); err == nil && (absWatched == absFolder || strings.HasPrefix(absWatched, absFolder+string(filepath.Separator))) {
+			_ = watcher.Remove(watched)
+		}
+	}
+}
+
+// queueWatchedFile sends a file that has finished changing to the metadata queue, unless it is already indexed unchanged
+func (lib *Library) queueWatchedFile(filePath string) {
+	if lib.isInQuarantine(filePath) {
+		return // Quarantined files are only retried on request
+	}
+	if lib.isPipelinePath(filePath) {
+		return
+	}
+	fileStat, err := os.Stat(filePath)
+	if err != nil {
+		return // Gone again before it settled
+	}
+	if record, ok := lib.FileIndex.GetFileRecordByPath(filePath); ok {
+		if record.Size == fileStat.Size() && record.ModTime == fileStat.ModTime().UnixNano() {
+			return // Most likely the organiser moving it into place
+		}
+	}
+	log.Info().Str("path", filePath).Msg("Watcher found new file")
+	lib.fileMetaScanRequests <- &fileScanningInfo{
+		path:        filePath,
+		isInLibrary: lib.isInLibraryFolder(filePath),
+		jobID:       lib.newJob(filepath.Base(filePath)),
+	}
+}
+
+// notifyRemovedPath sends delete events for any indexed files at or underneath the removed path
+func (lib *Library) notifyRemovedPath(removedPath string) {
+	folderPrefix := removedPath + string(filepath.Separator)
+	for _, record := range lib.FileIndex.ListFiles() {
+		if record.Path == removedPath || strings.HasPrefix(record.Path, folderPrefix) {
+			log.Info().Str("path", record.Path).Msg("Watcher found removed file")
+			lib.fileOrganisationRequests <- &fileScanningInfo{
+				path:           record.Path,
+				fileWasDeleted: true,
+				metadata: &formats.FileInfo{
+					TitleID: record.TitleID,
+					Version: record.Version,
+				},
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package library
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ralim/switchhost/formats"
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/utilities"
+)
+
+func TestFolderWatchWorker(t *testing.T) {
+	t.Parallel()
+	tempFolder, err := os.MkdirTemp("", "unit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempFolder)
+	sett := settings.Settings{
+		StorageFolder:        tempFolder,
+		WatchDebounceSeconds: 0,
+	}
+	lib := Library{
+		settings:                 &sett,
+		FileIndex:                index.NewIndex(nil, &sett),
+		fileMetaScanRequests:     make(chan *fileScanningInfo, 10),
+		fileOrganisationRequests: make(chan *fileScanningInfo, 10),
+		exit:                     make(chan bool, 10),
+		waitgroup:                &sync.WaitGroup{},
+	}
+	lib.waitgroup.Add(1)
+	go lib.folderWatchWorker()
+	defer lib.Stop()
+	// Give the watcher a moment to register
+	time.Sleep(time.Millisecond * 100)
+
+	newFile := path.Join(tempFolder, "sub", "game.nsp")
+	if err := os.MkdirAll(path.Dir(newFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newFile, []byte("Test"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(tempFolder, "notes.txt"), []byte("Test"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-lib.fileMetaScanRequests:
+		if event.path != newFile {
+			t.Errorf("Should report new file, got %s", event.path)
+		}
+		if !event.isInLibrary {
+			t.Error("File should be marked as in library")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watcher didn't report new file")
+	}
+
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: newFile, TitleID: 0x50000})
+	if err := os.RemoveAll(path.Dir(newFile)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-lib.fileOrganisationRequests:
+		if !event.fileWasDeleted || event.path != newFile {
+			t.Errorf("Should report deleted file, got %+v", event)
+		}
+		if event.metadata == nil || event.metadata.TitleID != 0x50000 {
+			t.Error("Delete event should carry the titleID")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watcher didn't report removed file")
+	}
+	if len(lib.fileMetaScanRequests) != 0 {
+		t.Error("Should ignore files we can't parse")
+	}
+}
+
+func TestFolderWatchWorkerIgnoresCompression(t *testing.T) {
+	t.Parallel()
+	tempFolder := t.TempDir()
+	sett := settings.Settings{
+		StorageFolder:        tempFolder,
+		WatchDebounceSeconds: 0,
+		CompressionLevel:     3,
+		CompressionBlockBits: 14,
+	}
+	lib := Library{
+		settings:                 &sett,
+		FileIndex:                index.NewIndex(nil, &sett),
+		fileMetaScanRequests:     make(chan *fileScanningInfo, 10),
+		fileOrganisationRequests: make(chan *fileScanningInfo, 10),
+		fileCompressionRequests:  make(chan *fileScanningInfo, 10),
+		exit:                     make(chan bool, 10),
+		waitgroup:                &sync.WaitGroup{},
+	}
+	keys, err := os.Open("../testing_files/prod.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	if err := lib.LoadKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	nspPath := path.Join(tempFolder, "UnitTest.nsp")
+	if err := utilities.CopyFile("../testing_files/UnitTest_[05123A0000000000].nsp", nspPath); err != nil {
+		t.Fatal(err)
+	}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: nspPath, TitleID: 0x05123A0000000000})
+
+	lib.waitgroup.Add(2)
+	go lib.folderWatchWorker()
+	go lib.compressionWorker()
+	defer lib.Stop()
+	// Give the watcher a moment to register
+	time.Sleep(time.Millisecond * 100)
+	lib.fileCompressionRequests <- &fileScanningInfo{path: nspPath, metadata: &formats.FileInfo{TitleID: 0x05123A0000000000}}
+
+	select {
+	case event := <-lib.fileMetaScanRequests:
+		if event.path != path.Join(tempFolder, "UnitTest.nsz") {
+			t.Errorf("Should queue the compressed file, got %s", event.path)
+		}
+	case <-time.After(60 * time.Second):
+		t.Fatal("Compressed file wasn't queued")
+	}
+	// Let the watcher catch up on the rename and remove
+	time.Sleep(3 * time.Second)
+	if len(lib.fileMetaScanRequests) != 0 {
+		t.Errorf("Compressed file should only be queued once, %d more were queued", len(lib.fileMetaScanRequests))
+	}
+	if deletes := len(lib.fileOrganisationRequests); deletes != 1 {
+		t.Errorf("Source file should get one delete event, got %d", deletes)
+	}
+}
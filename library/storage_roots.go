@@ -0,0 +1,114 @@
+package library
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ralim/switchhost/formats"
+	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/utilities"
+	"github.com/rs/zerolog/log"
+)
+
+// Storage roots
+// The library can be spread over multiple folders (usually one per disk), each of which is organised the same way
+// When a file is sorted, the root it goes into is picked by the placement policy in the settings
+// Files already in a root stay on it, only their path inside the root is updated, so re-sorting never shuffles files between disks
+
+var ErrNoStorageRoom = errors.New("no storage folder has room for the file")
+
+// storageRoots returns the absolute paths of all the storage roots, the main storage folder first
+func (lib *Library) storageRoots() []string {
+	roots := make([]string, 0, len(lib.settings.Current().StorageFolders)+1)
+	for _, folder := range lib.settings.GetStorageFolders() {
+		if folderAbs, err := filepath.Abs(folder); err == nil {
+			roots = append(roots, folderAbs)
+		}
+	}
+	return roots
+}
+
+// storageRootOf returns the storage root that filePath is inside of
+func (lib *Library) storageRootOf(filePath string) (string, bool) {
+	filePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", false
+	}
+	for _, root := range lib.storageRoots() {
+		if filePath == root || strings.HasPrefix(filePath, root+string(filepath.Separator)) {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+func (lib *Library) isInLibraryFolder(filePath string) bool {
+	_, ok := lib.storageRootOf(filePath)
+	return ok
+}
+
+// pickStorageRoot selects the storage root the file should be sorted into
+func (lib *Library) pickStorageRoot(info *formats.FileInfo, currentPath string) (string, error) {
+	roots := lib.storageRoots()
+	if len(roots) == 0 {
+		return "", ErrNoStorageRoom
+	}
+	if len(roots) == 1 {
+		return roots[0], nil
+	}
+	if root, ok := lib.storageRootOf(currentPath); ok {
+		return root, nil
+	}
+
+	needed := uint64(info.Size)
+	if needed == 0 {
+		if fileStat, err := os.Stat(currentPath); err == nil {
+			needed = uint64(fileStat.Size())
+		}
+	}
+	needed += uint64(lib.settings.Current().StorageReserveMB) * 1024 * 1024
+	freeSpace := make(map[string]uint64, len(roots))
+	for _, root := range roots {
+		free, err := utilities.FreeSpace(root)
+		if err != nil {
+			log.Warn().Err(err).Str("root", root).Msg("Couldn't read free space of storage folder, skipping it")
+			continue
+		}
+		freeSpace[root] = free
+	}
+	hasRoom := func(root string) bool {
+		free, ok := freeSpace[root]
+		return ok && free >= needed
+	}
+
+	switch lib.settings.Current().StoragePlacement {
+	case settings.StoragePlacementFirstWithRoom:
+		for _, root := range roots {
+			if hasRoom(root) {
+				return root, nil
+			}
+		}
+		return "", ErrNoStorageRoom
+	case settings.StoragePlacementMostFree:
+		// Handled below
+	default:
+		// Keep the title together, falling back to the most free space for new titles or if its root is full
+		for _, record := range lib.FileIndex.GetAllRecordsForTitle(info.TitleID) {
+			if root, ok := lib.storageRootOf(record.Path); ok && record.Path != currentPath && hasRoom(root) {
+				return root, nil
+			}
+		}
+	}
+	best := ""
+	for _, root := range roots {
+		if hasRoom(root) && (best == "" || freeSpace[root] > freeSpace[best]) {
+			best = root
+		}
+	}
+	if best == "" {
+		return "", ErrNoStorageRoom
+	}
+	return best, nil
+}
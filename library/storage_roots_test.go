@@ -0,0 +1,64 @@
+package library
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ralim/switchhost/formats"
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/settings"
+)
+
+func TestPickStorageRoot(t *testing.T) {
+	t.Parallel()
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	incoming := t.TempDir()
+	sett := settings.Settings{
+		StorageFolder:    rootA,
+		StorageFolders:   []string{rootB, rootA},
+		StoragePlacement: settings.StoragePlacementSameDisk,
+	}
+	lib := &Library{
+		settings:  &sett,
+		FileIndex: index.NewIndex(nil, &sett),
+	}
+	if roots := lib.storageRoots(); len(roots) != 2 || roots[0] != rootA || roots[1] != rootB {
+		t.Fatalf("Should list each root once, main one first, got %v", roots)
+	}
+	incomingFile := path.Join(incoming, "game.nsp")
+	if err := os.WriteFile(incomingFile, []byte("Test"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	info := &formats.FileInfo{TitleID: 0x0100000000010800, Size: 4}
+
+	// New title should land somewhere with room
+	if root, err := lib.pickStorageRoot(info, incomingFile); err != nil || (root != rootA && root != rootB) {
+		t.Errorf("Should pick a storage root, got %s %v", root, err)
+	}
+	// Updates/DLC should follow the base title
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: path.Join(rootB, "base.nsp"), TitleID: 0x0100000000010000})
+	if root, err := lib.pickStorageRoot(info, incomingFile); err != nil || root != rootB {
+		t.Errorf("Should keep the title together on %s, got %s %v", rootB, root, err)
+	}
+	// Files already in the library stay on their root
+	if root, err := lib.pickStorageRoot(info, path.Join(rootA, "sub", "update.nsp")); err != nil || root != rootA {
+		t.Errorf("Should leave library files on their root, got %s %v", root, err)
+	}
+	if !lib.isInLibraryFolder(path.Join(rootB, "base.nsp")) || lib.isInLibraryFolder(incomingFile) || lib.isInLibraryFolder(rootA+"-other/file.nsp") {
+		t.Error("Should only treat files inside a root as in the library")
+	}
+
+	sett.StoragePlacement = settings.StoragePlacementFirstWithRoom
+	if root, err := lib.pickStorageRoot(info, incomingFile); err != nil || root != rootA {
+		t.Errorf("Should pick the first root, got %s %v", root, err)
+	}
+	sett.StorageReserveMB = 1 << 40 // No disk has this much space
+	for _, policy := range []string{settings.StoragePlacementSameDisk, settings.StoragePlacementMostFree, settings.StoragePlacementFirstWithRoom} {
+		sett.StoragePlacement = policy
+		if _, err := lib.pickStorageRoot(info, incomingFile); err != ErrNoStorageRoom {
+			t.Errorf("Should fail when no root has room with policy %s, got %v", policy, err)
+		}
+	}
+}
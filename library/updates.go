@@ -17,8 +17,8 @@ func (lib *Library) GetGamesNeedingUpdate() []GameUpdatePair {
 		titleInfo, _ := lib.FileIndex.GetTitleRecords(title.TitleID)
 		latest := lib.versiondb.LookupLatestVersion(title.TitleID)
 		updateLatest := uint32(0)
-		if titleInfo.Update != nil {
-			updateLatest = titleInfo.Update.Version
+		if update := titleInfo.LatestUpdate(); update != nil {
+			updateLatest = update.Version
 		}
 		if latest > updateLatest {
 			results = append(results, GameUpdatePair{
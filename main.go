@@ -2,13 +2,25 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/jaffee/commandeer/cobrafy"
 )
 
 func main() {
-	err := cobrafy.Execute(NewSwitchHost())
+	host := NewSwitchHost()
+	command, err := cobrafy.Command(host)
 	if err != nil {
 		fmt.Println(err)
+		os.Exit(1)
+	}
+	host.addSettingFlags(command.PersistentFlags())
+	host.addCommands(command)
+	// Errors are printed below, and only some are from bad arguments
+	command.SilenceUsage = true
+	command.SilenceErrors = true
+	if err := command.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/ralim/switchhost/library"
+	"github.com/ralim/switchhost/settings"
+)
+
+// API serves machine readable views of the server state as JSON
+
+func (server *Server) httpHandleAPI(respWriter http.ResponseWriter, req *http.Request) {
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+	switch head {
+	case "admin":
+		server.httpHandleAPIAdmin(respWriter, req)
+	case "jobs":
+		server.httpHandleAPIJobs(respWriter, req)
+	case "plan":
+		server.httpHandleAPIPlan(respWriter, req)
+	case "quarantine":
+		server.httpHandleAPIQuarantine(respWriter, req)
+	case "revalidation":
+		server.httpHandleAPIRevalidation(respWriter, req)
+	case "stats":
+		server.httpHandleAPIStats(respWriter, req)
+	case "tokens":
+		server.httpHandleAPITokens(respWriter, req)
+	case "v1":
+		server.httpHandleAPIv1(respWriter, req)
+	default:
+		http.Error(respWriter, "Unknown API", http.StatusNotFound)
+	}
+}
+
+// writeJSON sends the value as the JSON response
+func writeJSON(respWriter http.ResponseWriter, value interface{}) {
+	respWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(respWriter).Encode(value); err != nil {
+		http.Error(respWriter, "Generating response failed", http.StatusInternalServerError)
+	}
+}
+
+// httpHandleAPIJobs lists jobs on /api/jobs, or a single job on /api/jobs/<id>
+// Jobs expose file names, so users allowed to edit settings see them all and other users only see the ones for their uploads
+// Jobs for titles the user's access rules hide are left out, the same as in the listings
+func (server *Server) httpHandleAPIJobs(respWriter http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(respWriter, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	allJobs := server.checkSettingsEdit(req)
+	user, ok := server.basicAuthUser(req)
+	if !allJobs && !ok {
+		respWriter.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(respWriter, "Auth required", http.StatusUnauthorized)
+		return
+	}
+	filter := server.accessFilter(req)
+	canSee := func(job library.Job) bool {
+		if job.TitleID != 0 && !filter.AllowsTitleID(job.TitleID) {
+			return false
+		}
+		return allJobs || job.User == user.Username
+	}
+	param, _ := ShiftPath(req.URL.Path)
+	if param == "" {
+		jobs := server.library.ListJobs()
+		writeJSON(respWriter, slices.DeleteFunc(jobs, func(job library.Job) bool { return !canSee(job) }))
+		return
+	}
+	jobID, err := strconv.ParseUint(param, 10, 64)
+	if err != nil {
+		http.Error(respWriter, "Bad job ID", http.StatusBadRequest)
+		return
+	}
+	job, ok := server.library.GetJob(jobID)
+	if !ok || !canSee(job) {
+		http.Error(respWriter, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(respWriter, job)
+}
+
+// httpHandleAPIPlan manages the moves and deletes planned in a dry run, as it exposes file paths it requires a user allowed to edit settings
+// GET /api/plan lists the changes, POST /api/plan/apply makes them all, DELETE /api/plan forgets them
+func (server *Server) httpHandleAPIPlan(respWriter http.ResponseWriter, req *http.Request) {
+	if !server.checkSettingsEdit(req) {
+		respWriter.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(respWriter, "Auth required", http.StatusUnauthorized)
+		return
+	}
+	action, _ := ShiftPath(req.URL.Path)
+	switch {
+	case req.Method == http.MethodGet && action == "":
+		writeJSON(respWriter, server.library.Plan())
+	case req.Method == http.MethodPost && action == "apply":
+		result, err := server.library.ApplyPlan()
+		if err != nil {
+			http.Error(respWriter, "Saving plan failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(respWriter, result)
+	case req.Method == http.MethodDelete && action == "":
+		if err := server.library.ClearPlan(); err != nil {
+			http.Error(respWriter, "Clearing plan failed", http.StatusInternalServerError)
+			return
+		}
+		respWriter.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(respWriter, "Unknown plan request", http.StatusBadRequest)
+	}
+}
+
+// httpHandleAPIQuarantine manages the quarantine folder, as it exposes file paths it requires a user allowed to edit settings
+// GET /api/quarantine lists the files, POST /api/quarantine/<id>/retry re-imports one, DELETE /api/quarantine/<id> purges one
+func (server *Server) httpHandleAPIQuarantine(respWriter http.ResponseWriter, req *http.Request) {
+	if !server.checkSettingsEdit(req) {
+		respWriter.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(respWriter, "Auth required", http.StatusUnauthorized)
+		return
+	}
+	id, rest := ShiftPath(req.URL.Path)
+	action, _ := ShiftPath(rest)
+	switch {
+	case req.Method == http.MethodGet && id == "":
+		entries, err := server.library.ListQuarantine()
+		if err != nil {
+			writeQuarantineError(respWriter, err)
+			return
+		}
+		writeJSON(respWriter, entries)
+	case req.Method == http.MethodPost && id != "" && action == "retry":
+		jobID, err := server.library.RetryQuarantined(id)
+		if err != nil {
+			writeQuarantineError(respWriter, err)
+			return
+		}
+		job, _ := server.library.GetJob(jobID)
+		respWriter.Header().Set("Content-Type", "application/json")
+		respWriter.Header().Set("Location", "/api/jobs/"+strconv.FormatUint(jobID, 10))
+		respWriter.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(respWriter).Encode(job)
+	case req.Method == http.MethodDelete && id != "":
+		if err := server.library.PurgeQuarantined(id); err != nil {
+			writeQuarantineError(respWriter, err)
+			return
+		}
+		respWriter.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(respWriter, "Unknown quarantine request", http.StatusBadRequest)
+	}
+}
+
+func writeQuarantineError(respWriter http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, library.ErrQuarantineDisabled), errors.Is(err, library.ErrQuarantineNotFound):
+		http.Error(respWriter, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(respWriter, "Quarantine request failed", http.StatusInternalServerError)
+	}
+}
+
+// httpHandleAPIStats reports usage of the server, GET /api/stats/downloads gives the transfer history
+// As it shows what each user downloads it requires a user allowed to edit settings
+func (server *Server) httpHandleAPIStats(respWriter http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(respWriter, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.checkSettingsEdit(req) {
+		respWriter.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(respWriter, "Auth required", http.StatusUnauthorized)
+		return
+	}
+	switch kind, _ := ShiftPath(req.URL.Path); kind {
+	case "downloads":
+		writeJSON(respWriter, server.transfers.GetStats())
+	default:
+		http.Error(respWriter, "Unknown stats", http.StatusNotFound)
+	}
+}
+
+// httpHandleAPIRevalidation reports on the background re-validation of the library and any bitrot found
+// As it exposes file paths it requires a user allowed to edit settings
+func (server *Server) httpHandleAPIRevalidation(respWriter http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(respWriter, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.checkSettingsEdit(req) {
+		respWriter.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(respWriter, "Auth required", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(respWriter, server.library.GetRevalidationStatus())
+}
+
+// httpHandleAPITokens manages the download tokens of the logged in user, users allowed to edit settings can pick the user with ?user=
+// GET /api/tokens lists them, POST /api/tokens?name=<name> makes one, DELETE /api/tokens/<id> revokes one
+// Only password logins are accepted, so a leaked token can't be used to make more
+func (server *Server) httpHandleAPITokens(respWriter http.ResponseWriter, req *http.Request) {
+	user, ok := server.basicAuthUser(req)
+	if !ok {
+		respWriter.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(respWriter, "Auth required", http.StatusUnauthorized)
+		return
+	}
+	username := user.Username
+	if requested := req.URL.Query().Get("user"); requested != "" && requested != username {
+		if !user.AllowSettings {
+			http.Error(respWriter, "Not allowed", http.StatusForbidden)
+			return
+		}
+		username = requested
+	}
+	id, _ := ShiftPath(req.URL.Path)
+	var err error
+	switch {
+	case req.Method == http.MethodGet && id == "":
+		var tokens []settings.DownloadToken
+		if tokens, err = server.settings.ListDownloadTokens(username); err == nil {
+			writeJSON(respWriter, tokens)
+			return
+		}
+	case req.Method == http.MethodPost && id == "":
+		var token settings.DownloadToken
+		if token, err = server.settings.CreateDownloadToken(username, req.URL.Query().Get("name")); err == nil {
+			respWriter.Header().Set("Content-Type", "application/json")
+			respWriter.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(respWriter).Encode(token)
+			return
+		}
+	case req.Method == http.MethodDelete && id != "":
+		if err = server.settings.RevokeDownloadToken(username, id); err == nil {
+			respWriter.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		http.Error(respWriter, "Unknown token request", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case errors.Is(err, settings.ErrUserNotFound), errors.Is(err, settings.ErrTokenNotFound):
+		http.Error(respWriter, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(respWriter, "Token request failed", http.StatusInternalServerError)
+	}
+}
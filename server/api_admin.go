@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/library"
+)
+
+// Admin API to manage the library while running, requires a user allowed to edit settings
+// Each action is queued and answered with the job tracking it, which can be followed on /api/jobs/<id>
+// Files hidden by the user's access rules are treated as missing
+//
+//	POST /api/admin/rescan                               scans all the folders again
+//	POST /api/admin/revalidate/<hex TitleID>/<version>   checks the hashes of a file
+//	POST /api/admin/compress/<hex TitleID>/<version>     compresses a file to NSZ/XCZ
+//	DELETE /api/admin/files/<hex TitleID>/<version>      deletes a file from disk and the library
+
+func (server *Server) httpHandleAPIAdmin(respWriter http.ResponseWriter, req *http.Request) {
+	if !server.checkSettingsEdit(req) {
+		respWriter.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(respWriter, "Auth required", http.StatusUnauthorized)
+		return
+	}
+	action, rest := ShiftPath(req.URL.Path)
+	filter := server.accessFilter(req)
+	var jobID uint64
+	var err error
+	switch {
+	case req.Method == http.MethodPost && action == "rescan":
+		jobID, err = server.library.Rescan()
+	case req.Method == http.MethodPost && action == "revalidate":
+		jobID, err = server.withFileParams(rest, filter, server.library.RequestRevalidation)
+	case req.Method == http.MethodPost && action == "compress":
+		jobID, err = server.withFileParams(rest, filter, server.library.RequestCompression)
+	case req.Method == http.MethodDelete && action == "files":
+		jobID, err = server.withFileParams(rest, filter, server.library.RequestDelete)
+	default:
+		http.Error(respWriter, "Unknown admin request", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeAdminError(respWriter, err)
+		return
+	}
+	job, _ := server.library.GetJob(jobID)
+	respWriter.Header().Set("Content-Type", "application/json")
+	respWriter.Header().Set("Location", "/api/jobs/"+strconv.FormatUint(jobID, 10))
+	respWriter.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(respWriter).Encode(job)
+}
+
+var errBadFileParams = errors.New("path must be /<hex TitleID>/<version>")
+
+// withFileParams parses the /<hex TitleID>/<version> path and runs the action on that file, if the filter allows it
+func (server *Server) withFileParams(path string, filter *index.AccessFilter, action func(titleID uint64, version uint32) (uint64, error)) (uint64, error) {
+	titleParam, rest := ShiftPath(path)
+	versionParam, _ := ShiftPath(rest)
+	titleID, err := index.ParseHexTitleID(titleParam)
+	if err != nil {
+		return 0, errBadFileParams
+	}
+	version, err := strconv.ParseUint(versionParam, 10, 32)
+	if err != nil {
+		return 0, errBadFileParams
+	}
+	if record, ok := server.library.FileIndex.GetFileRecord(titleID, uint32(version)); ok && !filter.Allows(*record) {
+		return 0, library.ErrFileNotInLibrary
+	}
+	return action(titleID, uint32(version))
+}
+
+func writeAdminError(respWriter http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errBadFileParams), errors.Is(err, library.ErrNotCompressable):
+		http.Error(respWriter, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, library.ErrFileNotInLibrary):
+		http.Error(respWriter, err.Error(), http.StatusNotFound)
+	case errors.Is(err, library.ErrRescanRunning), errors.Is(err, library.ErrNeedsKeys), errors.Is(err, library.ErrCompressionNeedsKeys):
+		http.Error(respWriter, err.Error(), http.StatusConflict)
+	case errors.Is(err, library.ErrQueueFull):
+		respWriter.Header().Set("Retry-After", "10")
+		http.Error(respWriter, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(respWriter, "Admin request failed", http.StatusInternalServerError)
+	}
+}
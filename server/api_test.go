@@ -0,0 +1,440 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/library"
+	"github.com/ralim/switchhost/settings"
+)
+
+func TestAPIJobs(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.Users = []settings.AuthUser{
+		{Username: "admin", Password: "admin", AllowSettings: true},
+		{Username: "uploader", Password: "uploader"},
+		{Username: "other", Password: "other"},
+		{Username: "limited", Password: "limited", AllowSettings: true, Deny: []settings.AccessRule{{TitleID: "05123A0000000000"}}},
+	}
+	jobID := lib.NotifyIncomingFile(tempFolder+"/upload.nsp", "upload.nsp", "uploader")
+	lib.NotifyIncomingFile(tempFolder+"/found.nsp", "found.nsp", "")
+
+	request := func(target, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if user != "" {
+			req.SetBasicAuth(user, user)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.httpHandleAPI).ServeHTTP(rr, req)
+		return rr
+	}
+	listJobs := func(user string) []library.Job {
+		jobs := []library.Job{}
+		if err := json.Unmarshal(request("/jobs", user).Body.Bytes(), &jobs); err != nil {
+			t.Fatal(err)
+		}
+		return jobs
+	}
+	if rr := request("/jobs", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Should require a login, got %d", rr.Code)
+	}
+	if jobs := listJobs("admin"); len(jobs) != 2 {
+		t.Errorf("Settings users should see all the jobs, got %+v", jobs)
+	}
+	if jobs := listJobs("uploader"); len(jobs) != 1 || jobs[0].ID != jobID || jobs[0].State != library.JobQueued || jobs[0].User != "uploader" {
+		t.Errorf("Should list only the user's queued upload, got %+v", jobs)
+	}
+	if jobs := listJobs("other"); len(jobs) != 0 {
+		t.Errorf("Should not list other users' jobs, got %+v", jobs)
+	}
+
+	job := library.Job{}
+	if err := json.Unmarshal(request("/jobs/1", "uploader").Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Name != "upload.nsp" {
+		t.Errorf("Should return the single job, got %+v", job)
+	}
+	if rr := request("/jobs/1", "other"); rr.Code != http.StatusNotFound {
+		t.Errorf("Should hide other users' jobs, got %d", rr.Code)
+	}
+	if rr := request("/jobs/2", "admin"); rr.Code != http.StatusOK {
+		t.Errorf("Settings users should see any job, got %d", rr.Code)
+	}
+
+	// Jobs for denied titles are hidden, even from settings users
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: path.Join(tempFolder, "base.nsp"), TitleID: 0x05123A0000000000})
+	deleteID, err := lib.RequestDelete(0x05123A0000000000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs := listJobs("admin"); len(jobs) != 3 || jobs[0].ID != deleteID || jobs[0].TitleID != 0x05123A0000000000 {
+		t.Errorf("Should list the delete with its title, got %+v", jobs)
+	}
+	if jobs := listJobs("limited"); len(jobs) != 2 || slices.ContainsFunc(jobs, func(job library.Job) bool { return job.ID == deleteID }) {
+		t.Errorf("Should not list the denied title's job, got %+v", jobs)
+	}
+	if rr := request("/jobs/"+strconv.FormatUint(deleteID, 10), "limited"); rr.Code != http.StatusNotFound {
+		t.Errorf("Should hide the denied title's job, got %d", rr.Code)
+	}
+
+	if rr := request("/jobs/abc", "admin"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Should reject bad job ID's, got %d", rr.Code)
+	}
+}
+
+func TestAPIQuarantine(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.Users = []settings.AuthUser{{Username: "admin", Password: "admin", AllowSettings: true}, {Username: "user", Password: "user"}}
+
+	request := func(method, target, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.SetBasicAuth(user, user)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.httpHandleAPI).ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := request("GET", "/quarantine", "user"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Should require settings access, got %d", rr.Code)
+	}
+	if rr := request("GET", "/quarantine", "admin"); rr.Code != http.StatusNotFound {
+		t.Errorf("Should report quarantine is off, got %d", rr.Code)
+	}
+
+	server.settings.QuarantineFolder = path.Join(tempFolder, "quarantine")
+	if err := os.MkdirAll(server.settings.QuarantineFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	quarantined := path.Join(server.settings.QuarantineFolder, "bad.nsp")
+	if err := os.WriteFile(quarantined, []byte("Test"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(quarantined+".quarantine.json", []byte(`{"stage":"metadata","error":"bad file"}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := request("GET", "/quarantine", "admin")
+	entries := []library.QuarantineEntry{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != "bad.nsp" || entries[0].Error != "bad file" {
+		t.Errorf("Should list the quarantined file, got %+v", entries)
+	}
+
+	rr = request("POST", "/quarantine/bad.nsp/retry", "admin")
+	job := library.Job{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusAccepted || job.Name != "bad.nsp" || job.State != library.JobQueued {
+		t.Errorf("Retry should queue a job, got %d %+v", rr.Code, job)
+	}
+	if _, ok := lib.GetJob(job.ID); !ok {
+		t.Error("Retry job should be tracked")
+	}
+
+	if rr := request("DELETE", "/quarantine/bad.nsp", "admin"); rr.Code != http.StatusNoContent {
+		t.Errorf("Should purge the file, got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/quarantine/bad.nsp", "admin"); rr.Code != http.StatusNotFound {
+		t.Errorf("Purged file should be gone, got %d", rr.Code)
+	}
+}
+
+func TestAPIPlan(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.Users = []settings.AuthUser{{Username: "admin", Password: "admin", AllowSettings: true}, {Username: "user", Password: "user"}}
+	server.settings.Deduplicate = true
+	server.settings.DryRun = true
+
+	request := func(method, target, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.SetBasicAuth(user, user)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.httpHandleAPI).ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := request("GET", "/plan", "user"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Should require settings access, got %d", rr.Code)
+	}
+
+	older := path.Join(tempFolder, "older.nsp")
+	newer := path.Join(tempFolder, "newer.nsp")
+	for _, file := range []string{older, newer} {
+		if err := os.WriteFile(file, []byte("Test"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: older, TitleID: 0x0100000000010000, Version: 0})
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: newer, TitleID: 0x0100000000010000, Version: 65536})
+
+	rr := request("GET", "/plan", "admin")
+	changes := []library.PlannedChange{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Action != library.PlanDelete || changes[0].Source != older {
+		t.Errorf("Should list the planned delete, got %+v", changes)
+	}
+
+	rr = request("POST", "/plan/apply", "admin")
+	result := library.PlanResult{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 1 || len(result.Failed) != 0 {
+		t.Errorf("Should apply the plan, got %+v", result)
+	}
+	if _, err := os.Stat(older); !os.IsNotExist(err) {
+		t.Error("Applying the plan should delete the older file")
+	}
+
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: older, TitleID: 0x0100000000010000, Version: 0})
+	if rr := request("DELETE", "/plan", "admin"); rr.Code != http.StatusNoContent {
+		t.Errorf("Should clear the plan, got %d", rr.Code)
+	}
+	if len(lib.Plan()) != 0 {
+		t.Errorf("Plan should be empty, got %+v", lib.Plan())
+	}
+}
+
+func TestAPIRevalidation(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.Users = []settings.AuthUser{{Username: "admin", Password: "admin", AllowSettings: true}}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: "/rotten.nsp", TitleID: 0x05123A0000000000, LastVerified: 1, VerifyResult: "hash failed validation"})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.httpHandleAPI).ServeHTTP(rr, httptest.NewRequest("GET", "/revalidation", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Should require settings access, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/revalidation", nil)
+	req.SetBasicAuth("admin", "admin")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(server.httpHandleAPI).ServeHTTP(rr, req)
+	status := library.RevalidationStatus{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Enabled || len(status.Bitrot) != 1 || status.Bitrot[0].Path != "/rotten.nsp" {
+		t.Errorf("Should report the bitrot, got %+v", status)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.Users = []settings.AuthUser{{Username: "admin", Password: "admin", AllowHTTP: true, AllowSettings: true}, {Username: "user", Password: "user", AllowHTTP: true}}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{
+		Path:    "../testing_files/UnitTest_[05123A0000000000].nsp",
+		TitleID: 0x05123A0000000000,
+		Version: 0x0,
+		Name:    "UnitTest",
+	})
+
+	request := func(method, target, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if user != "" {
+			req.SetBasicAuth(user, user)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := request("GET", "/api/tokens?user=admin", "user"); rr.Code != http.StatusForbidden {
+		t.Errorf("Should not see other users tokens, got %d", rr.Code)
+	}
+	rr := request("POST", "/api/tokens?name=dbi", "user")
+	token := settings.DownloadToken{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &token); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusCreated || token.Name != "dbi" || token.Token == "" {
+		t.Errorf("Should make a token, got %d %+v", rr.Code, token)
+	}
+
+	// The listing links carry the token, not the password
+	rr = request("GET", "/vIndex/365418291444842496/", "user")
+	if !strings.Contains(rr.Body.String(), "-"+token.Token+".nsp") {
+		t.Errorf("Listing should use the token, got %s", rr.Body.String())
+	}
+	fileURL := "/vIndex/365418291444842496/365418291444842496-0-" + token.Token + ".nsp"
+	if rr := request("GET", fileURL, ""); rr.Code != http.StatusOK {
+		t.Errorf("Token should allow the download, got %d", rr.Code)
+	}
+	if rr := request("GET", "/vIndex/365418291444842496/365418291444842496-0-bad.nsp", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Bad token should be refused, got %d", rr.Code)
+	}
+	// Tokens can't be used to manage tokens
+	if rr := request("DELETE", "/api/tokens/"+token.ID+"-"+token.Token, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Token API should need a password, got %d", rr.Code)
+	}
+
+	if rr := request("DELETE", "/api/tokens/"+token.ID+"?user=user", "admin"); rr.Code != http.StatusNoContent {
+		t.Errorf("Admin should be able to revoke the token, got %d", rr.Code)
+	}
+	if rr := request("GET", fileURL, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Revoked token should be refused, got %d", rr.Code)
+	}
+}
+
+func TestAPIv1(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.Users = []settings.AuthUser{
+		{Username: "admin", Password: "admin", AllowSettings: true},
+		{Username: "kid", Password: "kid", Deny: []settings.AccessRule{{TitleID: "0200000000010000"}}},
+	}
+	for _, record := range []index.FileOnDiskRecord{
+		{Path: "/a.nsp", TitleID: 0x0100000000010000, Name: "Alpha", Size: 10},
+		{Path: "/a-update.nsp", TitleID: 0x0100000000010800, Version: 65536, Name: "Alpha", Size: 5},
+		{Path: "/a-dlc.nsp", TitleID: 0x0100000000011001, Name: "Alpha Extra", Size: 2},
+		{Path: "/b.nsp", TitleID: 0x0200000000010000, Name: "Bravo", Size: 20},
+	} {
+		lib.FileIndex.AddFileRecord(&record)
+	}
+	request := func(url, user string, value interface{}) int {
+		req := httptest.NewRequest("GET", url, nil)
+		if user != "" {
+			req.SetBasicAuth(user, user)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.httpHandleAPI).ServeHTTP(rr, req)
+		if value != nil && rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Code
+	}
+
+	page := apiTitlePage{}
+	request("/v1/titles", "", &page)
+	if page.Total != 2 || len(page.Titles) != 2 || page.Titles[0].TitleID != "0100000000010000" {
+		t.Errorf("Should list both titles in order, got %+v", page)
+	}
+	alpha := page.Titles[0]
+	if !alpha.HasBase || alpha.UpdateVersion != 65536 || alpha.UpdateCount != 1 || alpha.DLCCount != 1 || alpha.Size != 17 || alpha.Name != "Alpha" {
+		t.Errorf("Should summarise the title, got %+v", alpha)
+	}
+	page = apiTitlePage{}
+	request("/v1/titles?type=dlc", "", &page)
+	if page.Total != 1 || page.Titles[0].Name != "Alpha" {
+		t.Errorf("Should filter by type, got %+v", page)
+	}
+	page = apiTitlePage{}
+	request("/v1/titles?name=brav", "", &page)
+	if page.Total != 1 || page.Titles[0].Name != "Bravo" {
+		t.Errorf("Should filter by name, got %+v", page)
+	}
+	page = apiTitlePage{}
+	request("/v1/titles?pageSize=1&page=2", "", &page)
+	if page.Total != 2 || len(page.Titles) != 1 || page.Titles[0].Name != "Bravo" {
+		t.Errorf("Should page the titles, got %+v", page)
+	}
+	page = apiTitlePage{}
+	request("/v1/titles", "kid", &page)
+	if page.Total != 1 {
+		t.Errorf("Should only list allowed titles, got %+v", page)
+	}
+	if code := request("/v1/titles?type=game", "", nil); code != http.StatusBadRequest {
+		t.Errorf("Should reject unknown types, got %d", code)
+	}
+
+	title := apiTitle{}
+	request("/v1/titles/0100000000011001", "", &title)
+	if title.BaseTitle == nil || len(title.Updates) != 1 || len(title.DLC) != 1 || title.DLC[0].Type != "dlc" {
+		t.Errorf("Should send the whole title, got %+v", title)
+	}
+	if title.BaseTitle != nil && title.BaseTitle.Path != "" {
+		t.Error("Should not send paths to normal users")
+	}
+	if code := request("/v1/titles/0200000000010000", "kid", nil); code != http.StatusNotFound {
+		t.Errorf("Should hide denied titles, got %d", code)
+	}
+
+	file := apiFile{}
+	request("/v1/files/0100000000010800/65536", "admin", &file)
+	if file.Type != "update" || file.Path != "/a-update.nsp" || !strings.Contains(file.URL, "/vfile/72057594037995520/65536/") {
+		t.Errorf("Should send the file with its path to admins, got %+v", file)
+	}
+	if code := request("/v1/files/0100000000010800/1", "", nil); code != http.StatusNotFound {
+		t.Errorf("Should not find missing versions, got %d", code)
+	}
+
+	stats := apiStats{}
+	request("/v1/stats", "kid", &stats)
+	if stats.Titles != 1 || stats.Updates != 1 || stats.DLC != 1 || len(stats.Queues) == 0 {
+		t.Errorf("Should total the allowed files, got %+v", stats)
+	}
+}
+
+func TestAPIAdmin(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.Users = []settings.AuthUser{
+		{Username: "admin", Password: "admin", AllowSettings: true},
+		{Username: "user", Password: "user"},
+		{Username: "limited", Password: "limited", AllowSettings: true, Deny: []settings.AccessRule{{TitleID: "05123A0000000000"}}},
+	}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: path.Join(tempFolder, "base.nsp"), TitleID: 0x05123A0000000000})
+	request := func(method, url, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.SetBasicAuth(user, user)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.httpHandleAPI).ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := request("DELETE", "/admin/files/05123A0000000000/0", "user"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Should require settings access, got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/admin/files/05123A0000000000/0", "limited"); rr.Code != http.StatusNotFound {
+		t.Errorf("Should hide files the user's rules deny, got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/admin/files/05123A0000000000/1", "admin"); rr.Code != http.StatusNotFound {
+		t.Errorf("Should not find missing files, got %d", rr.Code)
+	}
+	if rr := request("POST", "/admin/compress/nothex/0", "admin"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Should reject bad TitleIDs, got %d", rr.Code)
+	}
+	if rr := request("POST", "/admin/rescan", "admin"); rr.Code != http.StatusConflict {
+		t.Errorf("Should need keys to rescan, got %d", rr.Code)
+	}
+	rr := request("DELETE", "/admin/files/05123A0000000000/0", "admin")
+	job := library.Job{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusAccepted || job.State != library.JobQueued || rr.Header().Get("Location") != "/api/jobs/"+strconv.FormatUint(job.ID, 10) {
+		t.Errorf("Should queue the delete, got %d %+v", rr.Code, job)
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cnmt "github.com/ralim/switchhost/formats/CNMT"
+	"github.com/ralim/switchhost/index"
+)
+
+// Version 1 of the JSON API for the library index, on /api/v1
+// Only the titles and files the user is allowed to see are included
+
+const (
+	apiDefaultPageSize = 50
+	apiMaxPageSize     = 500
+)
+
+// apiFile is a file in the index
+type apiFile struct {
+	TitleID      string     `json:"titleID"` // Hex TitleID
+	Version      uint32     `json:"version"`
+	Type         string     `json:"type"` // base, update or dlc
+	Name         string     `json:"name"`
+	Size         int64      `json:"size"`
+	NSPSize      int64      `json:"nspSize,omitempty"` // For NSZ files, the size when served as an NSP
+	ModTime      time.Time  `json:"modTime"`
+	LastVerified *time.Time `json:"lastVerified,omitempty"` // When the hashes were last checked, if ever
+	VerifyResult string     `json:"verifyResult,omitempty"`
+	URL          string     `json:"url"`            // Where to download the file from
+	Path         string     `json:"path,omitempty"` // Only sent to users allowed to edit settings
+}
+
+// apiTitleSummary is a title along with its updates and DLC, as listed on /api/v1/titles
+type apiTitleSummary struct {
+	TitleID       string `json:"titleID"` // Hex base TitleID
+	Name          string `json:"name"`
+	HasBase       bool   `json:"hasBase"`
+	UpdateVersion uint32 `json:"updateVersion"` // Newest update on disk, 0 if none
+	MissingUpdate bool   `json:"missingUpdate"`
+	LatestVersion uint32 `json:"latestVersion,omitempty"` // Newest update released, only set if missing
+	UpdateCount   int    `json:"updateCount"`
+	DLCCount      int    `json:"dlcCount"`
+	Size          int64  `json:"size"` // Total of all files
+}
+
+// apiTitle is a title with all of its files
+type apiTitle struct {
+	apiTitleSummary
+	BaseTitle *apiFile  `json:"baseTitle"`
+	Updates   []apiFile `json:"updates"`
+	DLC       []apiFile `json:"dlc"`
+}
+
+type apiTitlePage struct {
+	Page     int               `json:"page"`
+	PageSize int               `json:"pageSize"`
+	Total    int               `json:"total"` // Titles matching, over all pages
+	Titles   []apiTitleSummary `json:"titles"`
+}
+
+type apiStats struct {
+	Titles             int            `json:"titles"`
+	Updates            int            `json:"updates"`
+	DLC                int            `json:"dlc"`
+	MissingUpdates     int            `json:"missingUpdates"`
+	Bitrot             int            `json:"bitrot"`             // Files that failed their last re-validation
+	ValidationFailures uint64         `json:"validationFailures"` // Files that failed validation on import since start
+	Queues             map[string]int `json:"queues"`             // Files waiting at each step of the import pipeline
+}
+
+func (server *Server) httpHandleAPIv1(respWriter http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(respWriter, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var head string
+	head, req.URL.Path = ShiftPath(req.URL.Path)
+	switch head {
+	case "titles":
+		if titleID, _ := ShiftPath(req.URL.Path); titleID != "" {
+			server.httpHandleAPIv1Title(respWriter, req, titleID)
+		} else {
+			server.httpHandleAPIv1Titles(respWriter, req)
+		}
+	case "files":
+		server.httpHandleAPIv1File(respWriter, req)
+	case "stats":
+		server.httpHandleAPIv1Stats(respWriter, req)
+	default:
+		http.Error(respWriter, "Unknown API", http.StatusNotFound)
+	}
+}
+
+// httpHandleAPIv1Titles lists titles on /api/v1/titles
+// Takes the optional query parameters type (base, update or dlc), name (part of the name), missingUpdate (true), page and pageSize
+func (server *Server) httpHandleAPIv1Titles(respWriter http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	contentType := cnmt.Unknown
+	switch strings.ToLower(query.Get("type")) {
+	case "":
+	case "base":
+		contentType = cnmt.BaseGame
+	case "update":
+		contentType = cnmt.Update
+	case "dlc":
+		contentType = cnmt.DLC
+	default:
+		http.Error(respWriter, "Unknown type, use base, update or dlc", http.StatusBadRequest)
+		return
+	}
+	name := strings.ToLower(query.Get("name"))
+	missingUpdate := query.Get("missingUpdate") == "true"
+	page, err := queryInt(query.Get("page"), 1)
+	if err != nil || page < 1 {
+		http.Error(respWriter, "Bad page", http.StatusBadRequest)
+		return
+	}
+	pageSize, err := queryInt(query.Get("pageSize"), apiDefaultPageSize)
+	if err != nil || pageSize < 1 || pageSize > apiMaxPageSize {
+		http.Error(respWriter, "Bad pageSize", http.StatusBadRequest)
+		return
+	}
+
+	filter := server.accessFilter(req)
+	updates := server.latestUpdates()
+	matching := []apiTitleSummary{}
+	for _, titleID := range server.library.FileIndex.ListTitleIDs() {
+		records, ok := server.library.FileIndex.GetTitleRecords(titleID)
+		if !ok {
+			continue
+		}
+		records = filterTitleRecords(records, filter)
+		files := records.GetFiles()
+		if len(files) == 0 {
+			continue
+		}
+		if contentType != cnmt.Unknown && !hasContentType(files, contentType) {
+			continue
+		}
+		summary := server.summariseTitle(titleID, records, updates)
+		if missingUpdate && !summary.MissingUpdate {
+			continue
+		}
+		if name != "" && !strings.Contains(strings.ToLower(summary.Name), name) {
+			continue
+		}
+		matching = append(matching, summary)
+	}
+
+	result := apiTitlePage{Page: page, PageSize: pageSize, Total: len(matching), Titles: []apiTitleSummary{}}
+	if start := (page - 1) * pageSize; start < len(matching) {
+		end := min(start+pageSize, len(matching))
+		result.Titles = matching[start:end]
+	}
+	writeJSON(respWriter, result)
+}
+
+// httpHandleAPIv1Title sends a title with all of its files on /api/v1/titles/<hex TitleID>
+// Any TitleID of the title, its updates or DLC can be used
+func (server *Server) httpHandleAPIv1Title(respWriter http.ResponseWriter, req *http.Request, param string) {
+	titleID, err := index.ParseHexTitleID(param)
+	if err != nil {
+		http.Error(respWriter, "Bad TitleID", http.StatusBadRequest)
+		return
+	}
+	records, ok := server.library.FileIndex.GetTitleRecords(titleID)
+	if ok {
+		records = filterTitleRecords(records, server.accessFilter(req))
+	}
+	if !ok || len(records.GetFiles()) == 0 {
+		http.Error(respWriter, "Title not found", http.StatusNotFound)
+		return
+	}
+	baseTitle := titleID & 0xFFFFFFFFFFFFE000
+	title := apiTitle{
+		apiTitleSummary: server.summariseTitle(baseTitle, records, server.latestUpdates()),
+		Updates:         []apiFile{},
+		DLC:             []apiFile{},
+	}
+	showPath := server.checkSettingsEdit(req)
+	if records.BaseTitle != nil {
+		file := server.apiFileFromRecord(*records.BaseTitle, req, showPath)
+		title.BaseTitle = &file
+	}
+	for _, update := range records.Updates {
+		title.Updates = append(title.Updates, server.apiFileFromRecord(update, req, showPath))
+	}
+	for _, dlc := range records.DLC {
+		title.DLC = append(title.DLC, server.apiFileFromRecord(dlc, req, showPath))
+	}
+	writeJSON(respWriter, title)
+}
+
+// httpHandleAPIv1File sends a single file on /api/v1/files/<hex TitleID>/<version>
+func (server *Server) httpHandleAPIv1File(respWriter http.ResponseWriter, req *http.Request) {
+	param, rest := ShiftPath(req.URL.Path)
+	versionParam, _ := ShiftPath(rest)
+	titleID, err := index.ParseHexTitleID(param)
+	if err != nil {
+		http.Error(respWriter, "Bad TitleID", http.StatusBadRequest)
+		return
+	}
+	version, err := strconv.ParseUint(versionParam, 10, 32)
+	if err != nil {
+		http.Error(respWriter, "Bad version", http.StatusBadRequest)
+		return
+	}
+	record, ok := server.library.FileIndex.GetFileRecord(titleID, uint32(version))
+	if !ok || !server.accessFilter(req).Allows(*record) {
+		http.Error(respWriter, "File not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(respWriter, server.apiFileFromRecord(*record, req, server.checkSettingsEdit(req)))
+}
+
+// httpHandleAPIv1Stats sends the totals of the library on /api/v1/stats
+func (server *Server) httpHandleAPIv1Stats(respWriter http.ResponseWriter, req *http.Request) {
+	filter := server.accessFilter(req)
+	updates := server.latestUpdates()
+	stats := apiStats{
+		ValidationFailures: server.library.ValidationFailures(),
+		Queues:             server.library.QueueDepths(),
+	}
+	for _, titleID := range server.library.FileIndex.ListTitleIDs() {
+		records, ok := server.library.FileIndex.GetTitleRecords(titleID)
+		if !ok {
+			continue
+		}
+		records = filterTitleRecords(records, filter)
+		files := records.GetFiles()
+		if len(files) == 0 {
+			continue
+		}
+		if records.BaseTitle != nil {
+			stats.Titles++
+		}
+		stats.Updates += len(records.Updates)
+		stats.DLC += len(records.DLC)
+		if server.summariseTitle(titleID, records, updates).MissingUpdate {
+			stats.MissingUpdates++
+		}
+		for _, file := range files {
+			if file.VerifyFailed() {
+				stats.Bitrot++
+			}
+		}
+	}
+	writeJSON(respWriter, stats)
+}
+
+// latestUpdates returns the newest released update of titles missing it, by base TitleID
+func (server *Server) latestUpdates() map[uint64]uint32 {
+	latest := map[uint64]uint32{}
+	for _, update := range server.library.GetGamesNeedingUpdate() {
+		latest[update.TitleID&0xFFFFFFFFFFFFE000] = update.LatestVersion
+	}
+	return latest
+}
+
+// summariseTitle totals up the files of a title, latestUpdates is from server.latestUpdates
+func (server *Server) summariseTitle(baseTitle uint64, records index.TitleOnDiskCollection, latestUpdates map[uint64]uint32) apiTitleSummary {
+	summary := apiTitleSummary{
+		TitleID:     formatTitleID(baseTitle),
+		HasBase:     records.BaseTitle != nil,
+		UpdateCount: len(records.Updates),
+		DLCCount:    len(records.DLC),
+	}
+	if update := records.LatestUpdate(); update != nil {
+		summary.UpdateVersion = update.Version
+	}
+	if latest, ok := latestUpdates[baseTitle]; ok && latest > summary.UpdateVersion {
+		summary.MissingUpdate = true
+		summary.LatestVersion = latest
+	}
+	files := records.GetFiles()
+	for _, file := range files {
+		summary.Size += file.Size
+	}
+	// Prefer the name in the base title, as DLC have their own names
+	if records.BaseTitle != nil {
+		summary.Name = records.BaseTitle.Name
+	}
+	if summary.Name == "" && server.titledb != nil {
+		if entry, ok := server.titledb.QueryGameFromTitleID(baseTitle); ok {
+			summary.Name = entry.Name
+		}
+	}
+	if summary.Name == "" && len(files) > 0 {
+		summary.Name = files[0].Name
+	}
+	return summary
+}
+
+// apiFileFromRecord converts the record for the API, the on disk path is only included if showPath is set
+func (server *Server) apiFileFromRecord(record index.FileOnDiskRecord, req *http.Request, showPath bool) apiFile {
+	file := apiFile{
+		TitleID:      formatTitleID(record.TitleID),
+		Version:      record.Version,
+		Type:         contentTypeName(index.ContentTypeOf(record.TitleID)),
+		Name:         record.Name,
+		Size:         record.Size,
+		NSPSize:      record.NSPSize,
+		ModTime:      time.Unix(0, record.ModTime),
+		VerifyResult: record.VerifyResult,
+		URL:          server.GenerateVirtualFilePath(record, req.Host, req.TLS != nil, false),
+	}
+	if record.LastVerified != 0 {
+		lastVerified := time.Unix(0, record.LastVerified)
+		file.LastVerified = &lastVerified
+	}
+	if showPath {
+		file.Path = record.Path
+	}
+	return file
+}
+
+// filterTitleRecords drops the files from the title that the filter doesn't allow
+func filterTitleRecords(records index.TitleOnDiskCollection, filter *index.AccessFilter) index.TitleOnDiskCollection {
+	if records.BaseTitle != nil && !filter.Allows(*records.BaseTitle) {
+		records.BaseTitle = nil
+	}
+	records.Updates = filter.Filter(records.Updates)
+	records.DLC = filter.Filter(records.DLC)
+	return records
+}
+
+func hasContentType(files []index.FileOnDiskRecord, contentType cnmt.MetaType) bool {
+	for _, file := range files {
+		if index.ContentTypeOf(file.TitleID) == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// contentTypeName is the name used for the type in the API, matching the access rule types
+func contentTypeName(contentType cnmt.MetaType) string {
+	switch contentType {
+	case cnmt.BaseGame:
+		return "base"
+	case cnmt.Update:
+		return "update"
+	default:
+		return "dlc"
+	}
+}
+
+func formatTitleID(titleID uint64) string {
+	return fmt.Sprintf("%016X", titleID)
+}
+
+// queryInt parses an integer query parameter, returning fallback if it was not given
+func queryInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
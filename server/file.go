@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/library"
 	"github.com/ralim/switchhost/utilities"
 )
 
@@ -23,53 +24,72 @@ var ErrInvalidPath error = errors.New("invalid path")
 
 // Given valid input, these two functions are each others inverse
 
-func (server *Server) GenerateVirtualFilePath(file index.FileOnDiskRecord, hostNameToUse string, useHTTPS bool) string {
+// NSZ files can also be requested as the NSP they expand to, these use nsp.bin rather than data.bin
+const (
+	virtualFileName      = "data.bin"
+	virtualFileNameAsNSP = "nsp.bin"
+)
+
+func (server *Server) GenerateVirtualFilePath(file index.FileOnDiskRecord, hostNameToUse string, useHTTPS bool, asNSP bool) string {
 	ext := path.Ext(file.Path)
 	ext = strings.ToLower(ext)
+	fileName := virtualFileName
+	if asNSP && library.CanServeAsNSP(file.Path) {
+		ext = ".nsp"
+		fileName = virtualFileNameAsNSP
+	}
 	fileFinalName := fmt.Sprintf("%s [%016X][v%d]%s", utilities.CleanName(file.Name), file.TitleID, file.Version, ext)
-	base := fmt.Sprintf("/vfile/%d/%d/data.bin#%s", file.TitleID, file.Version, fileFinalName)
-	if useHTTPS || (server.settings.HTTPSRewriteDomain == hostNameToUse) {
+	base := fmt.Sprintf("/vfile/%d/%d/%s#%s", file.TitleID, file.Version, fileName, fileFinalName)
+	if useHTTPS || (server.settings.Current().HTTPSRewriteDomain == hostNameToUse) {
 		base = "https://" + hostNameToUse + base
 	} else {
 		base = "http://" + hostNameToUse + base
 	}
 	return base
 }
-func (server *Server) LookupVirtualFilePath(path string) (uint64, uint32, error) {
+
+// LookupVirtualFilePath returns the TitleID and version the path refers to, and if the file was requested as an NSP
+func (server *Server) LookupVirtualFilePath(path string) (uint64, uint32, bool, error) {
 	splits := strings.Split(path, "/")
 	if len(splits) != 4 {
-		return 0, 0, ErrInvalidPath
+		return 0, 0, false, ErrInvalidPath
 	}
 	//Split out the two numbers
 	titleID, err := strconv.ParseUint(splits[1], 10, 64)
 	if err != nil {
-		return 0, 0, ErrInvalidPath
+		return 0, 0, false, ErrInvalidPath
 	}
 	version, err := strconv.ParseUint(splits[2], 10, 32)
 	if err != nil {
-		return 0, 0, ErrInvalidPath
+		return 0, 0, false, ErrInvalidPath
 	}
-	return titleID, uint32(version), nil
+	return titleID, uint32(version), splits[3] == virtualFileNameAsNSP, nil
 }
 
-func (server *Server) getFileFromVirtualPath(path string) (io.ReadSeekCloser, string, int64, error) {
-	titleID, version, err := server.LookupVirtualFilePath(path)
+// getFileFromVirtualPath opens the file the path refers to, files not allowed by the filter are treated as missing
+// The record of the file is returned along with the name to send it as
+func (server *Server) getFileFromVirtualPath(path string, filter *index.AccessFilter) (io.ReadSeekCloser, string, *index.FileOnDiskRecord, error) {
+	titleID, version, asNSP, err := server.LookupVirtualFilePath(path)
 	if err != nil {
-		return nil, "", 0, fmt.Errorf("couldn't interpret path %s - %w", path, err)
+		return nil, "", nil, fmt.Errorf("couldn't interpret path %s - %w", path, err)
 	}
 	//Otherwise we can now look up the actual on disk path to said file
 	info, ok := server.library.FileIndex.GetFileRecord(titleID, version)
-	if !ok {
-		return nil, "", 0, fmt.Errorf("couldn't lookup path %s", path)
+	if !ok || !filter.Allows(*info) {
+		return nil, "", nil, fmt.Errorf("couldn't lookup path %s", path)
+	}
+	if asNSP && library.CanServeAsNSP(info.Path) {
+		reader, _, err := library.OpenAsNSP(info.Path)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("couldn't open path %s as NSP - %w", path, err)
+		}
+		_, filename := filepath.Split(info.Path)
+		return reader, strings.TrimSuffix(filename, filepath.Ext(filename)) + ".nsp", info, nil
 	}
 	file, err := os.Open(info.Path)
 	if err != nil {
-		return nil, "", 0, fmt.Errorf("couldn't lookup path %s", path)
+		return nil, "", nil, fmt.Errorf("couldn't lookup path %s", path)
 	}
 	_, filename := filepath.Split(info.Path)
-	finfo, err := file.Stat()
-	if err != nil {
-		return nil, "", 0, fmt.Errorf("couldn't lookup path %s", path)
-	}
-	return file, filename, finfo.Size(), err
+	return file, filename, info, nil
 }
@@ -1,19 +1,27 @@
 package server
 
 import (
-	"crypto/subtle"
-	"encoding/base64"
+	"bytes"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/justinas/alice"
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/server/transfers"
+	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/utilities"
 	"github.com/ralim/switchhost/webui"
 	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
@@ -21,7 +29,57 @@ import (
 
 var ErrInvalidHeader = errors.New("invalid request header")
 
-func (server *Server) StartHTTP() {
+// httpListener hands out plain or TLS connections, so TLS can be turned on and off without giving up the port
+type httpListener struct {
+	net.Listener
+	tlsConfig atomic.Pointer[tls.Config] // nil to serve plain HTTP
+}
+
+func (l *httpListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if config := l.tlsConfig.Load(); config != nil {
+		return tls.Server(conn, config), nil
+	}
+	return conn, nil
+}
+
+// setTLS switches new connections over to the current TLS certificates, or to plain HTTP if TLS is off
+func (l *httpListener) setTLS(certificates *utilities.CertificateLoader) {
+	if certificates == nil {
+		l.tlsConfig.Store(nil)
+		return
+	}
+	l.tlsConfig.Store(certificates.TLSConfig())
+}
+
+// listenHTTP binds the HTTP port
+func (server *Server) listenHTTP(port int) (*httpListener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	wrapped := &httpListener{Listener: listener}
+	wrapped.setTLS(server.tlsCertificates)
+	return wrapped, nil
+}
+
+// startHTTP opens the HTTP listener and serves on it in the background
+// Must be called with listenerLock held
+func (server *Server) startHTTP() error {
+	listener, err := server.listenHTTP(server.settings.Current().HTTPPort)
+	if err != nil {
+		return err
+	}
+	server.serveHTTP(listener)
+	return nil
+}
+
+// serveHTTP serves the HTTP interface on an already bound listener in the background
+// Must be called with listenerLock held
+func (server *Server) serveHTTP(listener *httpListener) {
 
 	c := alice.New()
 
@@ -44,13 +102,22 @@ func (server *Server) StartHTTP() {
 
 	// Here is your final handleS
 	h := c.Then(server)
-	server.httpServer = &http.Server{Addr: fmt.Sprintf(":%d", server.settings.HTTPPort), Handler: h}
-	if err := server.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Error().Err(err).Msg("HTTP server closed")
+	httpServer := &http.Server{Handler: h}
+	server.httpServer = httpServer
+	server.httpListener = listener
+	if listener.tlsConfig.Load() != nil {
+		log.Info().Int("port", listener.Addr().(*net.TCPAddr).Port).Msg("Serving HTTPS")
 	} else {
-		log.Warn().Msg("HTTP server closed")
+		log.Info().Int("port", listener.Addr().(*net.TCPAddr).Port).Msg("Serving HTTP")
 	}
-
+	go func() {
+		err := httpServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			log.Error().Err(err).Msg("HTTP server closed")
+		} else {
+			log.Warn().Msg("HTTP server closed")
+		}
+	}()
 }
 
 func (server *Server) httpHandleJSON(respWriter http.ResponseWriter, req *http.Request) {
@@ -66,11 +133,55 @@ func (server *Server) httpHandleJSON(respWriter http.ResponseWriter, req *http.R
 			headers = &[]string{"Authorization: " + v[0]}
 		}
 	}
-	err := server.generateFileJSONPayload(respWriter, req.Host, false, headers)
+	// Clients can ask for a specific view of the versions, otherwise use the configured default
+	allVersions := server.settings.Current().ShopAllVersions
+	switch req.URL.Query().Get("versions") {
+	case "all":
+		allVersions = true
+	case "latest":
+		allVersions = false
+	}
+	filter := server.accessFilter(req)
+	// Likewise for installers that can't handle NSZ files
+	nszAsNSP := server.settings.Current().ShopNSZAsNSP
+	switch req.URL.Query().Get("format") {
+	case "nsp":
+		nszAsNSP = true
+	case "original":
+		nszAsNSP = false
+	}
+	if !server.wantsTinfoilIndex(req) {
+		err := server.generateFileJSONPayload(respWriter, req.Host, req.TLS != nil, allVersions, nszAsNSP, filter, headers)
+		if err != nil {
+			http.Error(respWriter, "Generating index failed", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+	// Tinfoil format, the index is generated and then wrapped up
+	payload := bytes.NewBuffer(nil)
+	if err := server.generateFileJSONPayload(payload, req.Host, req.TLS != nil, allVersions, nszAsNSP, filter, headers); err != nil {
+		http.Error(respWriter, "Generating index failed", http.StatusInternalServerError)
+		return
+	}
+	var publicKey *rsa.PublicKey
+	if len(server.settings.Current().TinfoilPublicKey) > 0 {
+		key, err := loadTinfoilPublicKey(server.settings.Current().TinfoilPublicKey)
+		if err != nil {
+			log.Error().Err(err).Str("path", server.settings.Current().TinfoilPublicKey).Msg("Loading tinfoil public key failed")
+			http.Error(respWriter, "Generating index failed", http.StatusInternalServerError)
+			return
+		}
+		publicKey = key
+	}
+	encoded, err := encodeTinfoilIndex(payload.Bytes(), server.settings.Current().TinfoilCompression, publicKey)
 	if err != nil {
+		log.Error().Err(err).Msg("Encoding tinfoil index failed")
 		http.Error(respWriter, "Generating index failed", http.StatusInternalServerError)
 		return
 	}
+	respWriter.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = respWriter.Write(encoded)
 }
 func (server *Server) httpHandleTitlesDB(respWriter http.ResponseWriter, r *http.Request) {
 	respWriter.Header().Set("Content-Type", "application/json")
@@ -80,58 +191,109 @@ func (server *Server) httpHandleTitlesDB(respWriter http.ResponseWriter, r *http
 		return
 	}
 }
-func (server *Server) parseRangeHeader(rangeHeader string) (int64, int64, error) {
-	rangeHeader = strings.ReplaceAll(rangeHeader, "bytes=", "")
-	rangeSplit := strings.Split(rangeHeader, "-")
-	if len(rangeSplit) != 2 {
-		return 0, 0, ErrInvalidHeader
-
-	}
-	startB, err := strconv.ParseInt(rangeSplit[0], 10, 64)
-	if err != nil {
-		return 0, 0, ErrInvalidHeader
-	}
-	endB, err := strconv.ParseInt(rangeSplit[1], 10, 64)
-	if err != nil {
-		return 0, 0, ErrInvalidHeader
-	}
-	return startB, endB, nil
-}
 func (server *Server) httpHandlevFile(respWriter http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		http.Error(respWriter, "Only GET is allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	reader, name, size, err := server.getFileFromVirtualPath(req.URL.Path)
+	reader, name, info, err := server.getFileFromVirtualPath(req.URL.Path, server.accessFilter(req))
 	if err != nil {
 		http.Error(respWriter, "Path not found", http.StatusNotFound)
 		return
 	}
+	transfer, ok := server.startTransfer(respWriter, req, info, reader)
+	if !ok {
+		reader.Close()
+		return
+	}
+	reader = transfer.Reader(reader)
 
 	defer reader.Close()
 	respWriter.Header().Add("content-disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
-	respWriter.Header().Add("Accept-Ranges", "bytes")
-	rangeHeader, ok := req.Header["Range"]
-	if ok {
-		startb, endb, err := server.parseRangeHeader(rangeHeader[0])
-		if err != nil {
-			http.Error(respWriter, "Invalid range bytes", http.StatusRequestedRangeNotSatisfiable)
-			return
+	serveFileContent(respWriter, req, reader)
+	if req.Context().Err() != nil {
+		transfer.Abort()
+	}
+}
+
+// startTransfer starts a limited transfer of the file in the reader for the requesting user, if they are at a limit this sends the error response and returns false
+func (server *Server) startTransfer(respWriter http.ResponseWriter, req *http.Request, info *index.FileOnDiskRecord, reader io.Seeker) (*transfers.Transfer, bool) {
+	username := ""
+	if user, ok := server.requestUser(req); ok {
+		username = user.Username
+	}
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = reader.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		http.Error(respWriter, "Reading file failed", http.StatusInternalServerError)
+		return nil, false
+	}
+	transfer, err := server.transfers.Start(transfers.Record{
+		User:     username,
+		Client:   req.RemoteAddr,
+		Protocol: transfers.ProtocolHTTP,
+		TitleID:  fmt.Sprintf("%016X", info.TitleID),
+		Version:  info.Version,
+		Expected: expectedBytes(req, size),
+	})
+	if err != nil {
+		respWriter.Header().Set("Retry-After", "10")
+		http.Error(respWriter, err.Error(), http.StatusTooManyRequests)
+		return nil, false
+	}
+	return transfer, true
+}
+
+// expectedBytes returns how much of a file of the size serveFileContent sends for the request, the length of the ranges asked for or the whole file
+// Anything http.ServeContent would not serve as ranges counts as the whole file, so failed requests aren't recorded as completed
+func expectedBytes(req *http.Request, size int64) int64 {
+	spec, ok := strings.CutPrefix(req.Header.Get("Range"), "bytes=")
+	if !ok || req.Header.Get("If-Range") != "" {
+		return size // No modification time is sent, so If-Range never matches
+	}
+	total := int64(0)
+	for _, part := range strings.Split(spec, ",") {
+		startText, endText, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			return size
 		}
-		_, err = reader.Seek(int64(startb), io.SeekStart)
-		if err != nil {
-			http.Error(respWriter, "Invalid range bytes", http.StatusRequestedRangeNotSatisfiable)
-			return
+		start, end := int64(0), size-1
+		if startText == "" {
+			// Suffix range, the last bytes of the file
+			length, err := strconv.ParseInt(endText, 10, 64)
+			if err != nil || length < 0 {
+				return size
+			}
+			start = max(size-length, 0)
+		} else {
+			var err error
+			if start, err = strconv.ParseInt(startText, 10, 64); err != nil || start < 0 {
+				return size
+			}
+			if endText != "" {
+				if end, err = strconv.ParseInt(endText, 10, 64); err != nil || end < start {
+					return size
+				}
+				end = min(end, size-1)
+			}
+		}
+		if start < size {
+			total += end - start + 1
 		}
-		//Now safe to send final headers and push the payload out
-		respWriter.Header().Add("Content-Range", fmt.Sprintf("%d-%d/%d", startb, endb, size))
-		respWriter.WriteHeader(http.StatusPartialContent)
-
-		_, _ = io.CopyN(respWriter, reader, endb-startb+1)
-	} else {
-		_, _ = io.Copy(respWriter, reader)
 	}
+	if total == 0 || total > size {
+		return size
+	}
+	return total
+}
 
+// serveFileContent sends out a game file, handling range requests
+// Files served as NSP are generated on the fly, so no modification time is sent
+func serveFileContent(respWriter http.ResponseWriter, req *http.Request, reader io.ReadSeeker) {
+	respWriter.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(respWriter, req, "", time.Time{}, reader)
 }
 func (server *Server) httpHandleIndex(respWriter http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
@@ -139,7 +301,7 @@ func (server *Server) httpHandleIndex(respWriter http.ResponseWriter, req *http.
 		return
 	}
 	respWriter.Header().Set("Content-Type", "text/html; charset=UTF-8")
-	err := server.webui.RenderGameListing(respWriter)
+	err := server.webui.RenderGameListing(respWriter, server.accessFilter(req))
 
 	if err != nil {
 		http.Error(respWriter, "Sending file failed", http.StatusInternalServerError)
@@ -160,7 +322,7 @@ func (server *Server) httpHandleGameInfo(respWriter http.ResponseWriter, req *ht
 		http.Error(respWriter, "Bad TitleID", http.StatusBadRequest)
 		return
 	}
-	err = server.webui.RenderTitleInfo(titleID, respWriter)
+	err = server.webui.RenderTitleInfo(titleID, respWriter, server.accessFilter(req))
 
 	if err != nil {
 		http.Error(respWriter, "Sending file failed", http.StatusInternalServerError)
@@ -176,64 +338,64 @@ func (server *Server) httpHandleCSS(respWriter http.ResponseWriter, _ *http.Requ
 	}
 }
 func (server *Server) checkAuth(req *http.Request) bool {
-	if server.settings.AllowAnonHTTP {
+	if server.settings.Current().AllowAnonHTTP {
 		return true // All is allowed if anon is on
 	}
-	username, password, ok := req.BasicAuth()
-	if !ok {
-		// Due to limitations in the DBI file parsing, we cant encode username for files in the URL pararmeters
-		// So we have to check for a token in the URL itself :(
-		//It is the last `-` seperated field in the url before the extension
-		// This is a bit of a hack, but it works
-		chunk := strings.Split(req.URL.Path, "-")
-		// Get the basename (without extension) of the last chunk
-		token := strings.TrimSuffix(filepath.Base(chunk[len(chunk)-1]), filepath.Ext(chunk[len(chunk)-1]))
-		if token != "" {
-			// Split the token into username and password by the first colon after base64 decoding
-			decoded, err := base64.StdEncoding.DecodeString(token)
-			if err == nil {
-				// Split decoded on the colon into username/password
-				// If there is no colon, return false
-				decoded_str := string(decoded)
-				split := strings.SplitN(decoded_str, ":", 2)
-				if len(split) != 2 {
-					return false
-				}
-				username = split[0]
-				password = split[1]
-			}
-		} else {
-			return false
-		}
+	// Due to limitations in the DBI file parsing, we cant send credentials for files
+	// So requestUser also checks for a download token in the URL itself :(
+	user, ok := server.requestUser(req)
+	return ok && user.AllowHTTP
+}
+
+// urlDownloadToken returns the token in the path, it is the last `-` seperated field in the url before the extension
+// This is a bit of a hack, but it works
+func urlDownloadToken(urlPath string) string {
+	chunk := strings.Split(urlPath, "-")
+	if len(chunk) < 2 {
+		return ""
 	}
+	last := filepath.Base(chunk[len(chunk)-1])
+	return strings.TrimSuffix(last, filepath.Ext(last))
+}
 
-	match := false
-	for _, user := range server.settings.Users {
-		if subtle.ConstantTimeCompare([]byte(user.Username), []byte(username)) == 1 && subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
-			if user.AllowHTTP {
-				match = true
-			}
-		}
+// requestUser returns the user the request is from, either by basic auth or the download token in the URL
+func (server *Server) requestUser(req *http.Request) (settings.AuthUser, bool) {
+	if user, ok := server.basicAuthUser(req); ok {
+		return user, true
 	}
+	return server.settings.UserForToken(urlDownloadToken(req.URL.Path))
+}
 
-	return match
+// accessFilter returns the filter of titles the requesting user can see, nil for anonymous requests
+func (server *Server) accessFilter(req *http.Request) *index.AccessFilter {
+	user, ok := server.requestUser(req)
+	if !ok {
+		return nil
+	}
+	return index.NewAccessFilter(user, server.settings.Current().TitleTags)
 }
-func (server *Server) checkSettingsEdit(req *http.Request) bool {
+
+// basicAuthUser returns the user account matching the basic auth credentials of the request
+func (server *Server) basicAuthUser(req *http.Request) (settings.AuthUser, bool) {
 	username, password, ok := req.BasicAuth()
 	if !ok {
-		return false
+		return settings.AuthUser{}, false
 	}
+	return server.settings.AuthenticateUser(username, password)
+}
 
-	match := false
-	for _, user := range server.settings.Users {
-		if subtle.ConstantTimeCompare([]byte(user.Username), []byte(username)) == 1 && subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
-			if user.AllowSettings {
-				match = true
-			}
-		}
-	}
+func (server *Server) checkSettingsEdit(req *http.Request) bool {
+	user, ok := server.basicAuthUser(req)
+	return ok && user.AllowSettings
+}
 
-	return match
+// checkUpload requires uploads to be turned on, and a user account that is allowed to upload
+func (server *Server) checkUpload(req *http.Request) bool {
+	if !server.settings.Current().UploadingAllowed {
+		return false
+	}
+	user, ok := server.basicAuthUser(req)
+	return ok && user.AllowHTTP && user.AllowUpload
 }
 func (server *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	var head string
@@ -243,6 +405,11 @@ func (server *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		res.WriteHeader(http.StatusOK)
 		return
 	}
+	// Metrics can have their own login for scrapers, so are checked separately
+	if head == "metrics" {
+		server.httpHandleMetrics(res, req)
+		return
+	}
 	//Check auth
 	if !server.checkAuth(req) {
 		res.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -273,6 +440,10 @@ func (server *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		server.httpHandleConfig(res, req)
 	case "info":
 		server.httpHandleGameInfo(res, req)
+	case "upload":
+		server.httpHandleUpload(res, req)
+	case "api":
+		server.httpHandleAPI(res, req)
 	default:
 		res.WriteHeader(http.StatusNotFound)
 	}
@@ -298,11 +469,33 @@ func (server *Server) httpHandleConfig(respWriter http.ResponseWriter, req *http
 			return
 		}
 		log.Info().Msg("Loading settings patch from http request")
-		server.settings.LoadFrom(req.Body)
-		server.settings.Save()
+		result, err := server.settings.Update(req.Body)
+		var problems settings.ValidationErrors
+		if errors.As(err, &problems) {
+			// List the problems for each setting, so a settings editor can point at them
+			respWriter.Header().Set("Content-Type", "application/json")
+			respWriter.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(respWriter).Encode(struct {
+				Errors settings.ValidationErrors `json:"errors"`
+			}{problems})
+			return
+		} else if errors.Is(err, settings.ErrInvalidSettings) {
+			http.Error(respWriter, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Error().Err(err).Msg("Updating settings failed")
+			http.Error(respWriter, "Updating settings failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(respWriter, result)
 	} else if req.Method == http.MethodGet {
+		if !server.checkSettingsEdit(req) {
+			respWriter.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			http.Error(respWriter, "Auth required", http.StatusUnauthorized)
+			return
+		}
 		respWriter.Header().Set("Content-Type", "application/json")
-		err := server.settings.SaveTo(respWriter)
+		err := server.settings.SaveRedactedTo(respWriter)
 		if err != nil {
 			log.Error().Err(err).Msg("Saving settings out failed")
 		}
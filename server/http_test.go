@@ -2,16 +2,26 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
+	"github.com/ralim/switchhost/formats"
 	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/keystore"
 	"github.com/ralim/switchhost/library"
+	"github.com/ralim/switchhost/server/transfers"
 	"github.com/ralim/switchhost/settings"
 	"github.com/ralim/switchhost/titledb"
+	"github.com/ralim/switchhost/utilities"
 )
 
 func maketestServer(t *testing.T) (*Server, *library.Library, string) {
@@ -22,9 +32,10 @@ func maketestServer(t *testing.T) (*Server, *library.Library, string) {
 
 	settings := settings.NewSettings(path.Join(tempFolder, "settings.json"))
 	settings.ServerMOTD = "SwitchRoooooot" // using different one to ensure its honoured
+	settings.CacheFolder = tempFolder
 	titledb := titledb.CreateTitlesDB(settings)
 	lib := library.NewLibrary(titledb, settings, nil, nil)
-	server := NewServer(lib, titledb, settings)
+	server := NewServer(lib, titledb, settings, nil)
 	return server, lib, tempFolder
 }
 
@@ -37,7 +48,7 @@ func TestHTTPServerbasics(t *testing.T) {
 	//Now we can fake poke server handlers
 	tempBuffer := bytes.NewBuffer([]byte{})
 
-	err := server.generateFileJSONPayload(tempBuffer, "test", false, nil)
+	err := server.generateFileJSONPayload(tempBuffer, "test", false, false, false, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,7 +64,7 @@ func TestHTTPServerbasics(t *testing.T) {
 		Name:    "UnitTest",
 	}
 	lib.FileIndex.AddFileRecord(file)
-	err = server.generateFileJSONPayload(tempBuffer, "test", false, nil)
+	err = server.generateFileJSONPayload(tempBuffer, "test", false, false, false, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -100,6 +111,28 @@ func TestHTTPFileServingJSON(t *testing.T) {
 	}
 }
 
+func TestHTTPFileServingJSONOverTLS(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{
+		Path:    "../testing_files/UnitTest_[05123A0000000000].nsp",
+		TitleID: 0x05123A0000000000,
+		Version: 0x0,
+		Name:    "UnitTest",
+	})
+
+	req := httptest.NewRequest("GET", "https://test/index.json", nil)
+	req.TLS = &tls.ConnectionState{}
+	requestRecorder := httptest.NewRecorder()
+	server.httpHandleJSON(requestRecorder, req)
+
+	if !strings.Contains(requestRecorder.Body.String(), `"url":"https://test/vfile/`) {
+		t.Errorf("file urls should use https when the request used TLS, got %s", requestRecorder.Body.String())
+	}
+}
+
 func TestHTTPFileServingBinary(t *testing.T) {
 	t.Parallel()
 
@@ -182,3 +215,434 @@ func TestHTTPFileServingBinaryRangeBytes(t *testing.T) {
 			rr.Body.Len(), expectedLength)
 	}
 }
+
+func TestHTTPFileServingNSZAsNSP(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.CompressionLevel = 3
+	server.settings.CompressionBlockBits = 16
+
+	keysFile, err := os.ReadFile("../testing_files/prod.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.LoadKeys(bytes.NewReader(keysFile)); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keystore.NewKeystore(bytes.NewReader(keysFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nspPath := path.Join(tempFolder, "UnitTest.nsp")
+	if err := utilities.CopyFile("../testing_files/UnitTest_[05123A0000000000].nsp", nspPath); err != nil {
+		t.Fatal(err)
+	}
+	nszPath, err := lib.NSZCompressFile(nspPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nspSize, err := library.NSPSize(nszPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{
+		Path:    nszPath,
+		TitleID: 0x05123A0000000000,
+		Version: 0x0,
+		Name:    "UnitTest",
+		NSPSize: nspSize,
+	})
+
+	req := httptest.NewRequest("GET", "/index.json?format=nsp", nil)
+	rr := httptest.NewRecorder()
+	server.httpHandleJSON(rr, req)
+	if !strings.Contains(rr.Body.String(), fmt.Sprintf(`/nsp.bin#UnitTest [05123A0000000000][v0].nsp","size":%d`, nspSize)) {
+		t.Errorf("Should list the NSZ as an NSP, got %s", rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/vfile/365418291444842496/0/nsp.bin", nil)
+	req.URL.Path = "vfile/365418291444842496/0/nsp.bin"
+	rr = httptest.NewRecorder()
+	server.httpHandlevFile(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	full := rr.Body.Bytes()
+	if int64(len(full)) != nspSize {
+		t.Fatalf("Should send the whole NSP, got %d bytes want %d bytes", len(full), nspSize)
+	}
+	if err := formats.ValidateNSPHash(keys, server.settings, bytes.NewReader(full)); err != nil {
+		t.Error("Served NSP should validate", err)
+	}
+
+	req.Header.Add("Range", "bytes=20000-30000")
+	rr = httptest.NewRecorder()
+	server.httpHandlevFile(rr, req)
+	if rr.Code != http.StatusPartialContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusPartialContent)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), full[20000:30001]) {
+		t.Error("Range request should match the same bytes of the full NSP")
+	}
+}
+
+func TestHTTPAccessRules(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.TitleTags = map[string][]string{"kids": {"05123A0000000000"}}
+	server.settings.Users = []settings.AuthUser{
+		{Username: "adult", Password: "adult", AllowHTTP: true},
+		{Username: "kid", Password: "kid", AllowHTTP: true, Allow: []settings.AccessRule{{Tag: "kids"}}, Deny: []settings.AccessRule{{Type: "dlc"}}},
+	}
+	for _, titleID := range []uint64{0x05123A0000000000, 0x05123A0000001001, 0x0200000000010000} {
+		lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{
+			Path:    "../testing_files/UnitTest_[05123A0000000000].nsp",
+			TitleID: titleID,
+			Name:    "UnitTest",
+		})
+	}
+
+	request := func(target, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth(user, user)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+	if body := request("/index.json", "adult").Body.String(); strings.Count(body, `"url"`) != 3 {
+		t.Errorf("adult should see every file, got %s", body)
+	}
+	body := request("/index.json", "kid").Body.String()
+	if strings.Count(body, `"url"`) != 1 || !strings.Contains(body, "/vfile/365418291444842496/") {
+		t.Errorf("kid should only see the tagged base title, got %s", body)
+	}
+	if rr := request("/vfile/365418291444846593/0/data.bin", "kid"); rr.Code != http.StatusNotFound {
+		t.Errorf("kid should not be able to download the DLC, got %d", rr.Code)
+	}
+	if rr := request("/vfile/365418291444846593/0/data.bin", "adult"); rr.Code != http.StatusOK {
+		t.Errorf("adult should be able to download the DLC, got %d", rr.Code)
+	}
+	if body := request("/vIndex/", "kid").Body.String(); strings.Contains(body, "144115188075921408") {
+		t.Errorf("kid should not see the other title, got %s", body)
+	}
+	if body := request("/vIndex/365418291444842496/", "kid").Body.String(); strings.Contains(body, "DLC") {
+		t.Errorf("kid should not see the DLC in the listing, got %s", body)
+	}
+}
+
+func TestHTTPTransferLimit(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.UserMaxTransfers = 1
+	server.settings.Users = []settings.AuthUser{{Username: "user", Password: "user", AllowHTTP: true}}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{
+		Path:    "../testing_files/UnitTest_[05123A0000000000].nsp",
+		TitleID: 0x05123A0000000000,
+		Name:    "UnitTest",
+	})
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/vfile/365418291444842496/0/data.bin", nil)
+		req.SetBasicAuth("user", "user")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	running, err := server.transfers.Start(transfers.Record{User: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := request(); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("should refuse a second transfer, got %d", rr.Code)
+	}
+	running.Finish()
+	if rr := request(); rr.Code != http.StatusOK {
+		t.Errorf("should allow the transfer, got %d", rr.Code)
+	}
+	if server.transfers.Running() != 0 {
+		t.Error("finished download should free its slot")
+	}
+}
+
+func TestAPIStatsDownloads(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.Users = []settings.AuthUser{
+		{Username: "user", Password: "user", AllowHTTP: true},
+		{Username: "admin", Password: "admin", AllowHTTP: true, AllowSettings: true},
+	}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{
+		Path:    "../testing_files/UnitTest_[05123A0000000000].nsp",
+		TitleID: 0x05123A0000000000,
+		Name:    "UnitTest",
+	})
+	req := httptest.NewRequest("GET", "/vfile/365418291444842496/0/data.bin", nil)
+	req.SetBasicAuth("user", "user")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("should serve the file, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/stats/downloads", nil)
+	req.SetBasicAuth("user", "user")
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("should require settings access, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/stats/downloads", nil)
+	req.SetBasicAuth("admin", "admin")
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	stats := transfers.Stats{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	title := stats.Titles["05123A0000000000"]
+	if stats.Totals.Completed != 1 || title == nil || title.Bytes == 0 || stats.Users["user"] == nil {
+		t.Errorf("should count the download, got %+v", stats)
+	}
+	if len(stats.Recent) != 1 || stats.Recent[0].Protocol != transfers.ProtocolHTTP || !stats.Recent[0].Completed {
+		t.Errorf("should list the download, got %+v", stats.Recent)
+	}
+}
+
+// cutOffWriter fails writes once limit bytes have been written, like a client dropping the connection
+type cutOffWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *cutOffWriter) Write(data []byte) (int, error) {
+	if w.Body.Len()+len(data) > w.limit {
+		return 0, errors.New("connection dropped")
+	}
+	return w.ResponseRecorder.Write(data)
+}
+
+func TestHTTPDownloadCutOff(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.AllowAnonHTTP = true
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{
+		Path:    "../testing_files/UnitTest_[05123A0000000000].nsp",
+		TitleID: 0x05123A0000000000,
+		Name:    "UnitTest",
+	})
+
+	req := httptest.NewRequest("GET", "/vfile/365418291444842496/0/data.bin", nil)
+	req.Header.Set("Range", "bytes=100-199")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPartialContent || rr.Body.Len() != 100 {
+		t.Fatalf("should serve the range, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/vfile/365418291444842496/0/data.bin", nil)
+	server.ServeHTTP(&cutOffWriter{ResponseRecorder: httptest.NewRecorder(), limit: 64 * 1024}, req)
+
+	recent := server.transfers.GetStats().Recent
+	// Newest first
+	if len(recent) != 2 || !recent[1].Completed || recent[1].Expected != 100 {
+		t.Errorf("should record the range as completed, got %+v", recent)
+	}
+	if len(recent) != 2 || recent[0].Completed || recent[0].Bytes >= recent[0].Expected || recent[0].Expected != 589016 {
+		t.Errorf("should record the cut off download as not completed, got %+v", recent)
+	}
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestHTTPConfigRedacted(t *testing.T) {
+	t.Parallel()
+
+	server, _, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.AllowAnonHTTP = true
+	server.settings.MetricsPassword = "scrape"
+	server.settings.Users = []settings.AuthUser{{Username: "admin", Password: "admin", AllowHTTP: true, AllowSettings: true}, {Username: "user", Password: "user", AllowHTTP: true}}
+	if _, err := server.settings.CreateDownloadToken("user", "dbi"); err != nil {
+		t.Fatal(err)
+	}
+
+	getConfig := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/config", nil)
+		if user != "" {
+			req.SetBasicAuth(user, user)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+	for _, user := range []string{"", "user"} {
+		if rr := getConfig(user); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Config should need settings access, %q got %d", user, rr.Code)
+		}
+	}
+	rr := getConfig("admin")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Admin should get the config, got %d", rr.Code)
+	}
+	config := struct {
+		MetricsPassword *string                      `json:"metricsPassword"`
+		Users           []map[string]json.RawMessage `json:"users"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.MetricsPassword != nil {
+		t.Error("Metrics password should be left out")
+	}
+	if len(config.Users) != 2 {
+		t.Fatalf("Users should be listed, got %+v", config.Users)
+	}
+	for _, user := range config.Users {
+		for _, secret := range []string{"password", "passwordHash", "tokens"} {
+			if _, ok := user[secret]; ok {
+				t.Errorf("%s should be left out, got %s", secret, user[secret])
+			}
+		}
+	}
+	if strings.Contains(rr.Body.String(), "scrape") || strings.Contains(rr.Body.String(), "$2a$") {
+		t.Errorf("No secrets should be sent, got %s", rr.Body.String())
+	}
+}
+
+func TestHTTPConfigReload(t *testing.T) {
+	t.Parallel()
+
+	server, _, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.HTTPPort = freePort(t)
+	server.settings.FTPPort = freePort(t)
+	server.settings.FTPHost = "127.0.0.1"
+	server.settings.Users = []settings.AuthUser{{Username: "admin", Password: "admin", AllowHTTP: true, AllowSettings: true}}
+	server.Run()
+	defer server.Stop()
+
+	postConfig := func(port int, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/config", port), strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("admin", "admin")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	oldPort := server.settings.HTTPPort
+	if resp := postConfig(oldPort, `{"httpPort":0}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Invalid settings should be refused, got %d", resp.StatusCode)
+	} else {
+		problems := struct{ Errors settings.ValidationErrors }{}
+		if err := json.NewDecoder(resp.Body).Decode(&problems); err != nil || len(problems.Errors) != 1 || problems.Errors[0].Field != "httpPort" {
+			t.Errorf("Should list the problems, got %+v %v", problems, err)
+		}
+	}
+
+	newHTTPPort, newFTPPort := freePort(t), freePort(t)
+	resp := postConfig(oldPort, fmt.Sprintf(`{"httpPort":%d,"ftpPort":%d,"queueLength":12}`, newHTTPPort, newFTPPort))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Update should be accepted, got %d", resp.StatusCode)
+	}
+	result := settings.UpdateResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(result.Applied, ",") != "http,ftp" || strings.Join(result.RestartRequired, ",") != "queueLength" {
+		t.Errorf("Listeners should be restarted, got %+v", result)
+	}
+
+	if resp := postConfig(newHTTPPort, `{}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("Should serve on the new port, got %d", resp.StatusCode)
+	}
+	if _, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", oldPort)); err == nil {
+		t.Error("Old port should be closed")
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", newFTPPort))
+	if err != nil {
+		t.Fatalf("FTP should listen on the new port, %v", err)
+	}
+	conn.Close()
+}
+
+func TestHTTPConfigReloadPortInUse(t *testing.T) {
+	t.Parallel()
+
+	server, _, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.HTTPPort = freePort(t)
+	server.Run()
+	defer server.Stop()
+
+	// Validation checks the port is free, but it can be taken before the listener is moved
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	old := &settings.Settings{HTTPPort: server.settings.HTTPPort}
+	updated := &settings.Settings{HTTPPort: busy.Addr().(*net.TCPAddr).Port}
+	if err := server.reloadHTTP(old, updated); err == nil {
+		t.Error("Moving to a port in use should fail")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", old.HTTPPort))
+	if err != nil {
+		t.Fatalf("Old port should keep serving, %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestHTTPConfigReloadTLSSamePort(t *testing.T) {
+	t.Parallel()
+
+	server, _, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.HTTPPort = freePort(t)
+	server.Run()
+	defer server.Stop()
+
+	certPath, keyPath, err := utilities.EnsureSelfSignedCertificate(tempFolder, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.settings.TLSCertFile, server.settings.TLSKeyFile = certPath, keyPath
+	old := &settings.Settings{HTTPPort: server.settings.HTTPPort}
+	updated := &settings.Settings{HTTPPort: server.settings.HTTPPort, TLSEnabled: true}
+	if err := server.reloadHTTP(old, updated); err != nil {
+		t.Fatal(err)
+	}
+
+	// Turning TLS on keeps the same port open, new connections get TLS
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/", old.HTTPPort))
+	if err != nil {
+		t.Fatalf("Should serve HTTPS on the same port, %v", err)
+	}
+	resp.Body.Close()
+}
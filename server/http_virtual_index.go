@@ -1,7 +1,6 @@
 package server
 
 import (
-	"encoding/base64"
 	"fmt"
 	"io"
 	"math"
@@ -12,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/library"
 	"github.com/ralim/switchhost/utilities"
 	"github.com/rs/zerolog/log"
 )
@@ -30,7 +30,8 @@ func (server *Server) httpHandleVirtualIndex(respWriter http.ResponseWriter, req
 	log.Info().Str("path", req.URL.Path).Str("head", head).Msg("HTTP Request")
 
 	if head == "" {
-		server.renderHTTPGameIndex(respWriter)
+		server.renderHTTPGameIndex(respWriter, req)
+		return
 	}
 	baseTitleID, err := strconv.ParseUint(head, 10, 64)
 	if err != nil {
@@ -59,75 +60,80 @@ func (server *Server) httpHandleVirtualIndex(respWriter http.ResponseWriter, req
 		return
 	}
 
-	server.serveHTTPGameFiles(TitleID, uint32(version), respWriter, req)
+	// NSZ files are also listed with an nsp extension, which serves them decompressed
+	asNSP := len(splits1) > 1 && strings.ToLower(splits1[len(splits1)-1]) == "nsp"
+	server.serveHTTPGameFiles(TitleID, uint32(version), asNSP, respWriter, req)
 
 }
-func (server *Server) serveHTTPGameFiles(titleID uint64, version uint32, respWriter http.ResponseWriter, req *http.Request) {
 
-	log.Info().Uint64("title", titleID).Uint32("version", version).Msg("HTTP File Serving Request")
+// serveHTTPGameFiles sends the file, if asNSP is set and the file is an NSZ it is sent as the NSP it expands to
+func (server *Server) serveHTTPGameFiles(titleID uint64, version uint32, asNSP bool, respWriter http.ResponseWriter, req *http.Request) {
+
+	log.Info().Uint64("title", titleID).Uint32("version", version).Bool("asNSP", asNSP).Msg("HTTP File Serving Request")
 	info, ok := server.library.FileIndex.GetFileRecord(titleID, version)
-	if !ok {
+	if !ok || !server.accessFilter(req).Allows(*info) {
+		http.Error(respWriter, "Path not found", http.StatusNotFound)
 		return
 	}
-	file, err := os.Open(info.Path)
-	if err != nil {
-		return
+	var reader io.ReadSeekCloser
+	var err error
+	if asNSP && library.CanServeAsNSP(info.Path) {
+		reader, _, err = library.OpenAsNSP(info.Path)
+	} else {
+		reader, err = os.Open(info.Path)
 	}
-	finfo, err := file.Stat()
 	if err != nil {
+		http.Error(respWriter, "Path not found", http.StatusNotFound)
 		return
 	}
-	size := finfo.Size()
-	if err != nil {
-		http.Error(respWriter, "Path not found", http.StatusNotFound)
+	transfer, ok := server.startTransfer(respWriter, req, info, reader)
+	if !ok {
+		reader.Close()
 		return
 	}
+	reader = transfer.Reader(reader)
 
-	defer file.Close()
-	//respWriter.Header().Add("content-disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
-	respWriter.Header().Add("Accept-Ranges", "bytes")
-	rangeHeader, ok := req.Header["Range"]
-	if ok {
-		startb, endb, err := server.parseRangeHeader(rangeHeader[0])
-		if err != nil {
-			http.Error(respWriter, "Invalid range bytes", http.StatusRequestedRangeNotSatisfiable)
-			return
-		}
-		_, err = file.Seek(int64(startb), io.SeekStart)
-		if err != nil {
-			http.Error(respWriter, "Invalid range bytes", http.StatusRequestedRangeNotSatisfiable)
-			return
-		}
-		//Now safe to send final headers and push the payload out
-		respWriter.Header().Add("Content-Range", fmt.Sprintf("%d-%d/%d", startb, endb, size))
-		respWriter.WriteHeader(http.StatusPartialContent)
-
-		_, _ = io.CopyN(respWriter, file, endb-startb+1)
-	} else {
-		_, _ = io.Copy(respWriter, file)
+	defer reader.Close()
+	serveFileContent(respWriter, req, reader)
+	if req.Context().Err() != nil {
+		transfer.Abort()
 	}
 }
 func (server *Server) renderHTTPGameFiles(titleID uint64, respWriter http.ResponseWriter, req *http.Request) {
 	_, _ = respWriter.Write([]byte("<!DOCTYPE HTML PUBLIC \"-//W3C//DTD HTML 3.2 Final//EN\">\n<html>\n <head>\n  <title>Index of /</title>\n </head>\n <body>\n<h1>Index of /</h1>\n<ul><ul><li><a href=\"/\"> Parent Directory</a></li>"))
 	records, ok := server.library.FileIndex.GetTitleRecords(titleID)
-	username, password, _ := req.BasicAuth() // If no auth, goes to "" which is fine
-
-	encodedAuthparam := base64.URLEncoding.EncodeToString([]byte(username + ":" + password))
+	filter := server.accessFilter(req)
+	// Links carry a download token for the user, as DBI can't send credentials for files
+	// If no auth, the token is left empty which is fine
+	token := ""
+	if user, ok := server.basicAuthUser(req); ok {
+		var err error
+		if token, err = server.settings.DownloadTokenFor(user.Username); err != nil {
+			log.Warn().Err(err).Str("user", user.Username).Msg("Couldn't get download token")
+		}
+	}
 
 	if ok {
 		writeFile := func(w http.ResponseWriter, file index.FileOnDiskRecord, fType string) {
+			if !filter.Allows(file) {
+				return
+			}
 			ext := path.Ext(file.Path)
 			ext = strings.ToLower(ext)
 			fileFinalName := fmt.Sprintf("%s - %s - [%d][v%d]", utilities.CleanName(file.Name), fType, file.TitleID, file.Version)
-			base := fmt.Sprintf("%d-%d-%s%s", file.TitleID, file.Version, encodedAuthparam, ext)
+			base := fmt.Sprintf("%d-%d-%s%s", file.TitleID, file.Version, token, ext)
 
 			_, _ = w.Write([]byte(fmt.Sprintf("<li><a href=\"%s\"> %s</a></li>\n", base, fileFinalName)))
+			if library.CanServeAsNSP(file.Path) {
+				base = fmt.Sprintf("%d-%d-%s.nsp", file.TitleID, file.Version, token)
+				_, _ = w.Write([]byte(fmt.Sprintf("<li><a href=\"%s\"> %s (as NSP)</a></li>\n", base, fileFinalName)))
+			}
 		}
 		if records.BaseTitle != nil {
 			writeFile(respWriter, *records.BaseTitle, "Base")
 		}
-		if records.Update != nil {
-			writeFile(respWriter, *records.Update, "Update")
+		for _, file := range records.Updates {
+			writeFile(respWriter, file, "Update")
 		}
 		for _, file := range records.DLC {
 			writeFile(respWriter, file, "DLC")
@@ -137,10 +143,14 @@ func (server *Server) renderHTTPGameFiles(titleID uint64, respWriter http.Respon
 	}
 	_, _ = respWriter.Write([]byte("</ul>\n</body></html>"))
 }
-func (server *Server) renderHTTPGameIndex(respWriter http.ResponseWriter) {
+func (server *Server) renderHTTPGameIndex(respWriter http.ResponseWriter, req *http.Request) {
 	_, _ = respWriter.Write([]byte("<!DOCTYPE HTML PUBLIC \"-//W3C//DTD HTML 3.2 Final//EN\">\n<html>\n <head>\n  <title>Index of /</title>\n </head>\n <body>\n<h1>Index of /</h1>\n<ul><ul><li><a href=\"/\"> Parent Directory</a></li>"))
 	allTitles := server.library.FileIndex.ListTitleFiles()
+	filter := server.accessFilter(req)
 	for _, file := range allTitles {
+		if records, ok := server.library.FileIndex.GetTitleRecords(file.TitleID); !ok || !filter.AllowsAny(records.GetFiles()) {
+			continue
+		}
 		fileFinalName := fmt.Sprintf("%s [%016X]", utilities.CleanName(file.Name), file.TitleID)
 		base := fmt.Sprintf("%d/", file.TitleID)
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/ralim/switchhost/index"
 	"github.com/ralim/switchhost/titledb"
 	"github.com/ralim/switchhost/utilities"
 )
@@ -24,19 +25,30 @@ type jsonIndex struct {
 	Headers         *[]string                       `json:"headers,omitempty"`
 }
 
-func (server *Server) generateFileJSONPayload(writer io.Writer, hostNameToUse string, useHTTPS bool, customHeaders *[]string) error {
+// generateFileJSONPayload writes out the shop index, if allVersions is set every stored version of updates and DLC are listed instead of just the newest
+// If nszAsNSP is set, NSZ files are listed as the NSP they expand to, and only files allowed by the filter are listed
+func (server *Server) generateFileJSONPayload(writer io.Writer, hostNameToUse string, useHTTPS bool, allVersions bool, nszAsNSP bool, filter *index.AccessFilter, customHeaders *[]string) error {
 	response := jsonIndex{
 		Files:           []fileEntry{},
 		TitleDB:         make(map[string]titledb.TitleDBEntry),
-		BackupLocations: server.settings.JSONLocations,
+		BackupLocations: server.settings.Current().JSONLocations,
 		Headers:         customHeaders,
 	}
-	if len(server.settings.ServerMOTD) > 0 {
-		response.MOTD = &server.settings.ServerMOTD
+	if len(server.settings.Current().ServerMOTD) > 0 {
+		response.MOTD = &server.settings.Current().ServerMOTD
 	}
 
-	for _, file := range server.library.FileIndex.ListFiles() {
-		response.Files = append(response.Files, fileEntry{URL: server.GenerateVirtualFilePath(file, hostNameToUse, useHTTPS), Size: file.Size, Name: utilities.CleanName(file.Name)})
+	files := server.library.FileIndex.ListLatestFiles()
+	if allVersions {
+		files = server.library.FileIndex.ListFiles()
+	}
+	for _, file := range filter.Filter(files) {
+		entry := fileEntry{URL: server.GenerateVirtualFilePath(file, hostNameToUse, useHTTPS, false), Size: file.Size, Name: utilities.CleanName(file.Name)}
+		if nszAsNSP && file.NSPSize > 0 {
+			entry.URL = server.GenerateVirtualFilePath(file, hostNameToUse, useHTTPS, true)
+			entry.Size = file.NSPSize
+		}
+		response.Files = append(response.Files, entry)
 		fileinfo, ok := server.library.FileIndex.LookupFileInfo(file)
 		if ok {
 			response.TitleDB[fileinfo.StringID] = fileinfo
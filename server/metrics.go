@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Metrics are served in the Prometheus text format on /metrics
+// These are gathered fresh on each scrape from the library, index, workers and transfers
+
+// metricsWriter writes out metric families in the Prometheus text exposition format
+type metricsWriter struct {
+	out *bufio.Writer
+}
+
+// family writes the help and type lines that start a metric
+func (m metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(m.out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a single value, labels are given as name, value pairs
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	m.out.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1])))
+		}
+		m.out.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintf(m.out, " %v\n", value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// workerState sorts the free text status of a worker task into idle, exited or busy
+func workerState(status string) string {
+	switch status {
+	case "Idle", "Done", "Loading...":
+		return "idle"
+	case "Exited":
+		return "exited"
+	default:
+		return "busy"
+	}
+}
+
+// checkMetricsAuth uses the metrics login if one is set, otherwise the normal auth
+func (server *Server) checkMetricsAuth(req *http.Request) bool {
+	if server.settings.Current().MetricsUsername == "" {
+		return server.checkAuth(req)
+	}
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(server.settings.Current().MetricsUsername)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(server.settings.Current().MetricsPassword)) == 1
+	return usernameOK && passwordOK
+}
+
+func (server *Server) httpHandleMetrics(respWriter http.ResponseWriter, req *http.Request) {
+	if !server.settings.Current().MetricsEnabled {
+		http.Error(respWriter, "Metrics are turned off", http.StatusNotFound)
+		return
+	}
+	if !server.checkMetricsAuth(req) {
+		respWriter.Header().Set("WWW-Authenticate", `Basic realm="metrics", charset="UTF-8"`)
+		http.Error(respWriter, "Auth required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != http.MethodGet {
+		http.Error(respWriter, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	respWriter.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(respWriter)
+	defer out.Flush()
+	server.writeMetrics(metricsWriter{out: out})
+}
+
+func (server *Server) writeMetrics(m metricsWriter) {
+	stats := server.library.FileIndex.GetStats()
+	m.family("switchhost_library_titles", "gauge", "Files in the library index by type.")
+	m.sample("switchhost_library_titles", float64(stats.TotalTitles), "type", "base")
+	m.sample("switchhost_library_titles", float64(stats.TotalUpdates), "type", "update")
+	m.sample("switchhost_library_titles", float64(stats.TotalDLC), "type", "dlc")
+
+	queues := server.library.QueueDepths()
+	names := make([]string, 0, len(queues))
+	for name := range queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m.family("switchhost_queue_length", "gauge", "Files waiting at each step of the import pipeline.")
+	for _, name := range names {
+		m.sample("switchhost_queue_length", float64(queues[name]), "queue", name)
+	}
+	m.family("switchhost_queue_capacity", "gauge", "Files each import pipeline queue can hold.")
+	m.sample("switchhost_queue_capacity", float64(server.settings.Current().QueueLength))
+
+	if server.ui != nil {
+		type workerKey struct{ task, state string }
+		workers := map[workerKey]int{}
+		keys := []workerKey{}
+		for _, task := range server.ui.TaskStates() {
+			key := workerKey{task.Name, workerState(task.Status)}
+			if _, ok := workers[key]; !ok {
+				keys = append(keys, key)
+			}
+			workers[key]++
+		}
+		m.family("switchhost_workers", "gauge", "Worker tasks by state.")
+		for _, key := range keys {
+			m.sample("switchhost_workers", float64(workers[key]), "task", key.task, "state", key.state)
+		}
+	}
+
+	m.family("switchhost_validation_failures_total", "counter", "Files that failed validation when imported since start.")
+	m.sample("switchhost_validation_failures_total", float64(server.library.ValidationFailures()))
+	m.family("switchhost_bitrot_files", "gauge", "Library files that failed their last re-validation.")
+	m.sample("switchhost_bitrot_files", float64(len(server.library.GetRevalidationStatus().Bitrot)))
+
+	transferStats := server.transfers.GetStats()
+	m.family("switchhost_transfers_active", "gauge", "Downloads running now.")
+	m.sample("switchhost_transfers_active", float64(transferStats.Running))
+	m.family("switchhost_transfers_total", "counter", "Downloads finished, by whether they completed.")
+	m.sample("switchhost_transfers_total", float64(transferStats.Totals.Completed), "result", "completed")
+	m.sample("switchhost_transfers_total", float64(transferStats.Totals.Aborted), "result", "aborted")
+	m.family("switchhost_transfer_bytes_total", "counter", "Bytes sent by downloads over HTTP and FTP.")
+	m.sample("switchhost_transfer_bytes_total", float64(transferStats.Totals.Bytes))
+}
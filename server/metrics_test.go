@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/termui"
+)
+
+func TestHTTPMetrics(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.ui = termui.NewTermUI(true)
+	server.ui.RegisterTask("Validation").UpdateStatus("Idle")
+	server.ui.RegisterTask("Validation").UpdateStatus("file.nsp")
+	server.settings.Users = []settings.AuthUser{{Username: "user", Password: "user", AllowHTTP: true}}
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{Path: "/base.nsp", TitleID: 0x05123A0000000000})
+
+	scrape := func(username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := scrape("", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("should use the normal auth, got %d", rr.Code)
+	}
+	rr := scrape("user", "user")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("user should be able to scrape, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		"# TYPE switchhost_library_titles gauge\n",
+		`switchhost_library_titles{type="base"} 1` + "\n",
+		`switchhost_queue_length{queue="validation"} 0` + "\n",
+		`switchhost_workers{task="Validation",state="idle"} 1` + "\n",
+		`switchhost_workers{task="Validation",state="busy"} 1` + "\n",
+		"switchhost_validation_failures_total 0\n",
+		`switchhost_transfers_total{result="completed"} 0` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics should contain %q, got\n%s", want, body)
+		}
+	}
+
+	// A separate login replaces the user accounts
+	server.settings.MetricsUsername = "prometheus"
+	server.settings.MetricsPassword = "scrape"
+	if rr := scrape("user", "user"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("user accounts should not be used with a metrics login, got %d", rr.Code)
+	}
+	if rr := scrape("prometheus", "scrape"); rr.Code != http.StatusOK {
+		t.Errorf("metrics login should work, got %d", rr.Code)
+	}
+
+	server.settings.MetricsEnabled = false
+	if rr := scrape("prometheus", "scrape"); rr.Code != http.StatusNotFound {
+		t.Errorf("metrics should be turned off, got %d", rr.Code)
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	t.Parallel()
+	if got := escapeLabelValue("a\\b\"c\nd"); got != `a\\b\"c\nd` {
+		t.Errorf("should escape label values, got %s", got)
+	}
+}
@@ -3,11 +3,15 @@ package server
 import (
 	"context"
 	"net/http"
+	"sync"
 
 	"github.com/ralim/switchhost/library"
+	"github.com/ralim/switchhost/server/transfers"
 	"github.com/ralim/switchhost/server/virtualftp"
 	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/termui"
 	"github.com/ralim/switchhost/titledb"
+	"github.com/ralim/switchhost/utilities"
 	"github.com/ralim/switchhost/webui"
 	"github.com/rs/zerolog/log"
 )
@@ -19,30 +23,145 @@ type Server struct {
 	webui    *webui.WebUI
 	settings *settings.Settings
 	titledb  *titledb.TitlesDB
+	ui       *termui.TermUI // Only used for its task states, may be nil
 
-	httpServer *http.Server
-	ftpServer  *virtualftp.FTPServer
+	listenerLock    sync.Mutex // Held while starting or stopping the HTTP and FTP servers
+	httpServer      *http.Server
+	httpListener    *httpListener
+	ftpServer       *virtualftp.FTPServer
+	tlsCertificates *utilities.CertificateLoader // nil unless TLS is turned on
+	transfers       *transfers.Manager
 }
 
-func NewServer(lib *library.Library, titledb *titledb.TitlesDB, settings *settings.Settings) *Server {
+func NewServer(lib *library.Library, titledb *titledb.TitlesDB, settings *settings.Settings, ui *termui.TermUI) *Server {
 	return &Server{
-		library:  lib,
-		webui:    webui.NewWebUI(lib, titledb),
-		settings: settings,
-		titledb:  titledb,
+		library:   lib,
+		webui:     webui.NewWebUI(lib, titledb),
+		settings:  settings,
+		titledb:   titledb,
+		ui:        ui,
+		transfers: transfers.NewManager(settings, ui),
 	}
 }
 
+// Settings only read when the listeners are started
+var httpSettingFields = []string{"httpPort", "tlsEnabled", "tlsCertFile", "tlsKeyFile"}
+var ftpSettingFields = []string{"publicIP", "ftpPort", "FTPPassivePorts", "FTPHost", "ftpsMode", "ftpsCertFile", "ftpsKeyFile", "ftpForceTLS", "allowAnonFTP", "serverMOTD", "tlsCertFile", "tlsKeyFile"}
+
 func (server *Server) Run() {
 	log.Info().Msg("Starting servers, press ctrl-c to exit cleanly")
 
-	server.ftpServer = virtualftp.CreateVirtualFTP(server.library, server.settings)
-	go server.StartHTTP()
-	go server.ftpServer.Start()
+	if err := server.transfers.LoadHistory(); err != nil {
+		log.Warn().Err(err).Msg("Couldn't load transfer history")
+	}
+
+	server.listenerLock.Lock()
+	defer server.listenerLock.Unlock()
+	startHTTP := true
+	if server.settings.Current().TLSEnabled {
+		// Don't fall back to plain HTTP, as that would send credentials in the clear
+		if err := server.loadTLSCertificates(); err != nil {
+			log.Error().Err(err).Msg("Loading TLS certificate failed, HTTP server will not be started")
+			startHTTP = false
+		}
+	}
+
+	startFTP := true
+	ftpsCertificates, err := server.ftpsCertificates()
+	if err != nil {
+		// Likewise, FTP is not started without its TLS
+		log.Error().Err(err).Msg("Loading FTPS certificate failed, FTP server will not be started")
+		startFTP = false
+	}
+
+	if startHTTP {
+		if err := server.startHTTP(); err != nil {
+			log.Error().Err(err).Msg("HTTP server could not be started")
+		}
+	}
+	if startFTP {
+		if err := server.startFTP(ftpsCertificates); err != nil {
+			log.Error().Err(err).Msg("FTP server creation failed")
+		}
+	}
+
+	// Restart the listeners when their settings are changed
+	server.settings.Subscribe("http", httpSettingFields, server.reloadHTTP)
+	server.settings.Subscribe("ftp", ftpSettingFields, server.reloadFTP)
+}
+
+// startFTP creates the FTP server and serves in the background
+// Must be called with listenerLock held
+func (server *Server) startFTP(certificates *utilities.CertificateLoader) error {
+	ftpServer, err := virtualftp.CreateVirtualFTP(server.library, server.settings, certificates, server.transfers)
+	if err != nil {
+		return err
+	}
+	server.ftpServer = ftpServer
+	go ftpServer.Start()
+	return nil
+}
+
+// reloadHTTP restarts the HTTP server with changed settings
+// The old server stops listening, but downloads already running are left to finish
+func (server *Server) reloadHTTP(old, updated *settings.Settings) error {
+	server.listenerLock.Lock()
+	defer server.listenerLock.Unlock()
+	if updated.TLSEnabled {
+		if err := server.loadTLSCertificates(); err != nil {
+			return err
+		}
+	} else {
+		server.tlsCertificates = nil
+	}
+	previousServer, previousListener := server.httpServer, server.httpListener
+	if previousListener != nil && old.HTTPPort == updated.HTTPPort {
+		// Same port, keep serving on it and only switch TLS for new connections
+		previousListener.setTLS(server.tlsCertificates)
+		log.Info().Bool("tls", server.tlsCertificates != nil).Msg("HTTP server updated with new settings")
+		return nil
+	}
+	// Bind the new port before letting go of the old one, so a port that can't be used leaves HTTP running
+	listener, err := server.listenHTTP(updated.HTTPPort)
+	if err != nil {
+		return err
+	}
+	server.serveHTTP(listener)
+	if previousServer != nil {
+		go func() { _ = previousServer.Shutdown(context.Background()) }()
+	}
+	log.Info().Msg("HTTP server restarted with new settings")
+	return nil
+}
 
+// reloadFTP restarts the FTP server with changed settings, sessions already connected are kept
+func (server *Server) reloadFTP(old, updated *settings.Settings) error {
+	server.listenerLock.Lock()
+	defer server.listenerLock.Unlock()
+	certificates, err := server.ftpsCertificates()
+	if err != nil {
+		return err
+	}
+	previousServer := server.ftpServer
+	if previousServer != nil && old.FTPPort == updated.FTPPort && old.FTPHost == updated.FTPHost {
+		// Same address, so it has to be freed first
+		previousServer.Stop()
+		previousServer = nil
+	}
+	if err := server.startFTP(certificates); err != nil {
+		server.ftpServer = previousServer
+		return err
+	}
+	if previousServer != nil {
+		previousServer.Stop()
+	}
+	log.Info().Msg("FTP server restarted with new settings")
+	return nil
 }
 
 func (server *Server) Stop() {
+	server.listenerLock.Lock()
+	defer server.listenerLock.Unlock()
 	if server.httpServer != nil {
 		_ = server.httpServer.Shutdown(context.Background())
 		log.Info().Msg("HTTP task exiting")
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ralim/switchhost/settings"
+)
+
+// Tinfoil index format
+// Tinfoil can read the shop index compressed, and encrypted so that only it can read it (with the matching private key)
+// The layout is:
+//	"TINFOIL" magic
+//	Flag byte, compression type | encryption flag
+//	0x100 bytes of the AES key, encrypted with RSA-OAEP (SHA256) using the public key (zeros if not encrypted)
+//	u64 LE size of the compressed index
+//	The compressed index, AES-128-ECB encrypted after zero padding to 16 bytes (if encrypted)
+
+const (
+	tinfoilMagic           = "TINFOIL"
+	tinfoilNoCompression   = 0x00
+	tinfoilZstdCompression = 0x0D
+	tinfoilZlibCompression = 0x0E
+	tinfoilEncrypted       = 0xF0
+	tinfoilSessionKeySize  = 0x100
+)
+
+var ErrTinfoilKeyNotRSA = errors.New("tinfoil public key is not an RSA key")
+var ErrTinfoilKeySize = errors.New("tinfoil public key must be 2048 bits")
+
+// wantsTinfoilIndex returns true if the index should be sent in the Tinfoil format to this client
+func (server *Server) wantsTinfoilIndex(req *http.Request) bool {
+	switch server.settings.Current().TinfoilIndexMode {
+	case settings.TinfoilIndexAlways:
+		return true
+	case settings.TinfoilIndexTinfoil:
+		return strings.HasPrefix(strings.ToLower(req.UserAgent()), "tinfoil")
+	}
+	return false
+}
+
+// loadTinfoilPublicKey reads the PEM encoded public key, accepting both PKIX and PKCS1 encodings
+func loadTinfoilPublicKey(keyPath string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", keyPath)
+	}
+	var key *rsa.PublicKey
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PublicKey); !ok {
+			return nil, ErrTinfoilKeyNotRSA
+		}
+	}
+	// The encrypted AES key has a fixed size in the header
+	if key.Size() != tinfoilSessionKeySize {
+		return nil, ErrTinfoilKeySize
+	}
+	return key, nil
+}
+
+// encodeTinfoilIndex wraps the json index in the Tinfoil format, encrypting it if a public key is given
+func encodeTinfoilIndex(index []byte, compression string, publicKey *rsa.PublicKey) ([]byte, error) {
+	var flag byte
+	var payload []byte
+	switch compression {
+	case "zstd":
+		flag = tinfoilZstdCompression
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		payload = encoder.EncodeAll(index, nil)
+		encoder.Close()
+	case "zlib":
+		flag = tinfoilZlibCompression
+		compressed := bytes.NewBuffer(nil)
+		writer := zlib.NewWriter(compressed)
+		if _, err := writer.Write(index); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		payload = compressed.Bytes()
+	case "none", "":
+		flag = tinfoilNoCompression
+		payload = index
+	default:
+		return nil, fmt.Errorf("unknown tinfoil index compression %s", compression)
+	}
+	payloadSize := len(payload)
+
+	sessionKey := make([]byte, tinfoilSessionKeySize)
+	if publicKey != nil {
+		flag |= tinfoilEncrypted
+		aesKey := make([]byte, 16)
+		if _, err := rand.Read(aesKey); err != nil {
+			return nil, err
+		}
+		encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, aesKey, []byte{})
+		if err != nil {
+			return nil, err
+		}
+		copy(sessionKey, encryptedKey)
+
+		if padding := len(payload) % aes.BlockSize; padding != 0 {
+			payload = append(payload, make([]byte, aes.BlockSize-padding)...)
+		}
+		cipher, err := aes.NewCipher(aesKey)
+		if err != nil {
+			return nil, err
+		}
+		// ECB, so each block is encrypted on its own
+		encrypted := make([]byte, len(payload))
+		for i := 0; i < len(payload); i += aes.BlockSize {
+			cipher.Encrypt(encrypted[i:i+aes.BlockSize], payload[i:i+aes.BlockSize])
+		}
+		payload = encrypted
+	}
+
+	output := bytes.NewBuffer(make([]byte, 0, len(tinfoilMagic)+1+tinfoilSessionKeySize+8+len(payload)))
+	output.WriteString(tinfoilMagic)
+	output.WriteByte(flag)
+	output.Write(sessionKey)
+	_ = binary.Write(output, binary.LittleEndian, uint64(payloadSize))
+	output.Write(payload)
+	return output.Bytes(), nil
+}
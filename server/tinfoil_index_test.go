@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ralim/switchhost/settings"
+)
+
+// decodeTinfoilIndex undoes encodeTinfoilIndex, as Tinfoil would
+func decodeTinfoilIndex(t *testing.T, data []byte, privateKey *rsa.PrivateKey) []byte {
+	t.Helper()
+	headerLen := len(tinfoilMagic) + 1 + tinfoilSessionKeySize + 8
+	if len(data) < headerLen || string(data[:len(tinfoilMagic)]) != tinfoilMagic {
+		t.Fatalf("missing tinfoil header")
+	}
+	flag := data[len(tinfoilMagic)]
+	sessionKey := data[len(tinfoilMagic)+1 : len(tinfoilMagic)+1+tinfoilSessionKeySize]
+	size := binary.LittleEndian.Uint64(data[headerLen-8 : headerLen])
+	payload := data[headerLen:]
+
+	if flag&tinfoilEncrypted == tinfoilEncrypted {
+		aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, sessionKey, []byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher, err := aes.NewCipher(aesKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payload)%aes.BlockSize != 0 {
+			t.Fatalf("encrypted payload is not block aligned, %d", len(payload))
+		}
+		decrypted := make([]byte, len(payload))
+		for i := 0; i < len(payload); i += aes.BlockSize {
+			cipher.Decrypt(decrypted[i:i+aes.BlockSize], payload[i:i+aes.BlockSize])
+		}
+		payload = decrypted
+	}
+	payload = payload[:size]
+
+	switch flag &^ tinfoilEncrypted {
+	case tinfoilZstdCompression:
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		out, err := decoder.DecodeAll(payload, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	case tinfoilZlibCompression:
+		reader, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	return payload
+}
+
+func TestHTTPTinfoilIndexEncrypted(t *testing.T) {
+	t.Parallel()
+
+	server, _, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := path.Join(tempFolder, "public.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keyBytes}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server.settings.TinfoilIndexMode = settings.TinfoilIndexTinfoil
+	server.settings.TinfoilPublicKey = keyPath
+
+	expected := `{"files":[],"directories":null,"success":"SwitchRoooooot","titledb":{},"locations":[]}`
+
+	// Other clients still get plain json
+	req := httptest.NewRequest("GET", "/index.json", nil)
+	recorder := httptest.NewRecorder()
+	server.httpHandleJSON(recorder, req)
+	if recorder.Body.String() != expected {
+		t.Errorf("non tinfoil client got %q", recorder.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/index.json", nil)
+	req.Header.Set("User-Agent", "Tinfoil/17.0")
+	recorder = httptest.NewRecorder()
+	server.httpHandleJSON(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("handler returned %d", recorder.Code)
+	}
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	body := recorder.Body.Bytes()
+	if body[len(tinfoilMagic)] != tinfoilZstdCompression|tinfoilEncrypted {
+		t.Errorf("unexpected flags %02X", body[len(tinfoilMagic)])
+	}
+	if decoded := decodeTinfoilIndex(t, body, privateKey); string(decoded) != expected {
+		t.Errorf("decoded index doesnt match, got %q", string(decoded))
+	}
+}
+
+func TestEncodeTinfoilIndexUnencrypted(t *testing.T) {
+	t.Parallel()
+	index := []byte(`{"files":[]}`)
+	for _, compression := range []string{"zstd", "zlib", "none"} {
+		encoded, err := encodeTinfoilIndex(index, compression, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded[len(tinfoilMagic)]&tinfoilEncrypted != 0 {
+			t.Errorf("%s: should not be flagged encrypted", compression)
+		}
+		if decoded := decodeTinfoilIndex(t, encoded, nil); !bytes.Equal(decoded, index) {
+			t.Errorf("%s: decoded index doesnt match, got %q", compression, string(decoded))
+		}
+	}
+	if _, err := encodeTinfoilIndex(index, "lzma", nil); err == nil {
+		t.Error("unknown compression should fail")
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"os"
+
+	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/utilities"
+)
+
+// loadTLSCertificates sets up the TLS certificate from the settings, or a self-signed one if none is set
+func (server *Server) loadTLSCertificates() error {
+	loader, err := server.certificateLoader(server.settings.Current().TLSCertFile, server.settings.Current().TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	server.tlsCertificates = loader
+	return nil
+}
+
+// ftpsCertificates returns the certificate for FTPS, which is the HTTP one unless FTPS has its own files set
+func (server *Server) ftpsCertificates() (*utilities.CertificateLoader, error) {
+	if server.settings.Current().FTPSMode == settings.FTPSOff || server.settings.Current().FTPSMode == "" {
+		return nil, nil
+	}
+	if len(server.settings.Current().FTPSCertFile) == 0 && len(server.settings.Current().FTPSKeyFile) == 0 && server.tlsCertificates != nil {
+		return server.tlsCertificates, nil
+	}
+	if len(server.settings.Current().FTPSCertFile) == 0 && len(server.settings.Current().FTPSKeyFile) == 0 {
+		return server.certificateLoader(server.settings.Current().TLSCertFile, server.settings.Current().TLSKeyFile)
+	}
+	return server.certificateLoader(server.settings.Current().FTPSCertFile, server.settings.Current().FTPSKeyFile)
+}
+
+// certificateLoader loads the given certificate files, if both are empty a self-signed certificate in the CacheFolder is used
+func (server *Server) certificateLoader(certFile, keyFile string) (*utilities.CertificateLoader, error) {
+	if len(certFile) == 0 && len(keyFile) == 0 {
+		hosts := []string{server.settings.Current().PublicIP, server.settings.Current().HTTPSRewriteDomain}
+		if hostname, err := os.Hostname(); err == nil {
+			hosts = append(hosts, hostname)
+		}
+		var err error
+		certFile, keyFile, err = utilities.EnsureSelfSignedCertificate(server.settings.Current().CacheFolder, hosts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return utilities.NewCertificateLoader(certFile, keyFile)
+}
@@ -0,0 +1,45 @@
+package transfers
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket rate limiter, allowing up to a second of burst
+// Reservations can take the bucket negative, the caller then waits for it to refill
+type bucket struct {
+	lock   sync.Mutex
+	rate   float64 // Bytes per second, 0 for no limit
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) setRate(bytesPerSecond int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if float64(bytesPerSecond) != b.rate {
+		b.rate = float64(bytesPerSecond)
+		b.tokens = 0
+		b.last = time.Now()
+	}
+}
+
+// reserve takes n bytes from the bucket, returning how long to wait before sending them
+func (b *bucket) reserve(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
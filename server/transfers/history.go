@@ -0,0 +1,170 @@
+package transfers
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// History of transfers
+// Each transfer is appended as a line of JSON to a log in the cache folder, which is read back at start to rebuild the totals
+
+const historyFileName = "transfer_history.jsonl"
+
+// How many of the latest transfers are kept in memory for the API
+const recentHistoryLength = 100
+
+// Protocols transfers can be made over
+const (
+	ProtocolHTTP = "http"
+	ProtocolFTP  = "ftp"
+)
+
+// Record is a single transfer in the history
+type Record struct {
+	Time       time.Time `json:"time"`       // When the transfer started
+	User       string    `json:"user"`       // Username, empty for anonymous access
+	Client     string    `json:"client"`     // Address of the client
+	Protocol   string    `json:"protocol"`   // One of the Protocol* values
+	TitleID    string    `json:"titleID"`    // Hex TitleID of the file
+	Version    uint32    `json:"version"`    // Version of the file
+	Expected   int64     `json:"expected"`   // Bytes the client asked for, 0 if not known
+	Bytes      int64     `json:"bytes"`      // Bytes sent
+	DurationMs int64     `json:"durationMs"` // How long the transfer ran
+	Completed  bool      `json:"completed"`  // False if the transfer was aborted part way
+}
+
+// Count is the number of transfers and bytes sent for a user or title
+type Count struct {
+	Transfers int   `json:"transfers"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// Totals over all transfers in the history
+type Totals struct {
+	Completed int   `json:"completed"`
+	Aborted   int   `json:"aborted"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// Stats is the summary of the transfer history
+type Stats struct {
+	Running int               `json:"running"`
+	Totals  Totals            `json:"totals"`
+	Users   map[string]*Count `json:"users"`  // By username, anonymous transfers are under ""
+	Titles  map[string]*Count `json:"titles"` // By hex TitleID
+	Recent  []Record          `json:"recent"` // Latest transfers, newest first
+}
+
+func (m *Manager) historyPath() string {
+	return path.Join(m.settings.Current().CacheFolder, historyFileName)
+}
+
+// LoadHistory reads the transfer history log to restore the totals
+func (m *Manager) LoadHistory() error {
+	file, err := os.Open(m.historyPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue // Likely a partial line from a crash, skip it
+		}
+		m.count(record)
+	}
+	m.updateUI(m.Running())
+	return scanner.Err()
+}
+
+// count adds the record to the totals
+func (m *Manager) count(record Record) {
+	m.historyLock.Lock()
+	defer m.historyLock.Unlock()
+	if record.Completed {
+		m.totals.Completed++
+	} else {
+		m.totals.Aborted++
+	}
+	m.totals.Bytes += record.Bytes
+	for key, counts := range map[string]map[string]*Count{record.User: m.byUser, record.TitleID: m.byTitle} {
+		if _, ok := counts[key]; !ok {
+			counts[key] = &Count{}
+		}
+		counts[key].Transfers++
+		counts[key].Bytes += record.Bytes
+	}
+	m.recent = append(m.recent, record)
+	if len(m.recent) > recentHistoryLength {
+		m.recent = m.recent[len(m.recent)-recentHistoryLength:]
+	}
+}
+
+// record adds a finished transfer to the history
+func (m *Manager) record(record Record) {
+	m.count(record)
+	log.Info().Str("user", record.User).Str("protocol", record.Protocol).Str("titleID", record.TitleID).Uint32("version", record.Version).Int64("bytes", record.Bytes).Bool("completed", record.Completed).Msg("Transfer finished")
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	m.historyLock.Lock()
+	defer m.historyLock.Unlock()
+	file, err := os.OpenFile(m.historyPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Warn().Err(err).Msg("Couldn't open transfer history")
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Warn().Err(err).Msg("Couldn't write transfer history")
+	}
+}
+
+// GetStats returns a summary of the transfer history
+func (m *Manager) GetStats() Stats {
+	running := m.Running()
+	m.historyLock.Lock()
+	defer m.historyLock.Unlock()
+	stats := Stats{
+		Running: running,
+		Totals:  m.totals,
+		Users:   make(map[string]*Count, len(m.byUser)),
+		Titles:  make(map[string]*Count, len(m.byTitle)),
+		Recent:  make([]Record, 0, len(m.recent)),
+	}
+	for user, count := range m.byUser {
+		copied := *count
+		stats.Users[user] = &copied
+	}
+	for title, count := range m.byTitle {
+		copied := *count
+		stats.Titles[title] = &copied
+	}
+	for i := len(m.recent) - 1; i >= 0; i-- {
+		stats.Recent = append(stats.Recent, m.recent[i])
+	}
+	return stats
+}
+
+func (m *Manager) updateUI(running int) {
+	if m.ui == nil || m.ui.Statistics == nil {
+		return
+	}
+	m.historyLock.Lock()
+	m.ui.Statistics.ActiveTransfers = running
+	m.ui.Statistics.Downloads = m.totals.Completed
+	m.ui.Statistics.DownloadedBytes = m.totals.Bytes
+	m.historyLock.Unlock()
+	m.ui.Statistics.Redraw()
+}
@@ -0,0 +1,198 @@
+package transfers
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/termui"
+)
+
+// Transfers tracks the file downloads over HTTP and FTP, limiting how many can run at once and how fast they go
+// Limits are read from the settings as each transfer starts, so changes apply to new transfers
+// Every transfer is recorded in the history once it ends
+
+var ErrTooManyTransfers = errors.New("too many transfers running")
+
+// Reads are split into chunks of this size, so rate limited transfers are sent smoothly
+const maxChunk = 32 * 1024
+
+type Manager struct {
+	settings *settings.Settings
+	ui       *termui.TermUI
+
+	lock    sync.Mutex
+	running int
+	users   map[string]*userState
+	global  bucket
+
+	historyLock sync.Mutex
+	totals      Totals
+	byUser      map[string]*Count
+	byTitle     map[string]*Count
+	recent      []Record // Newest last, up to recentHistoryLength
+}
+
+type userState struct {
+	name    string
+	running int
+	limit   bucket
+}
+
+// Transfer is a single running download
+type Transfer struct {
+	manager *Manager
+	user    *userState
+	once    sync.Once
+	record  Record
+	started time.Time
+	sent    atomic.Int64
+	aborted atomic.Bool
+}
+
+func NewManager(settings *settings.Settings, ui *termui.TermUI) *Manager {
+	return &Manager{
+		settings: settings,
+		ui:       ui,
+		users:    make(map[string]*userState),
+		byUser:   make(map[string]*Count),
+		byTitle:  make(map[string]*Count),
+	}
+}
+
+// userLimits returns the rate (bytes/s) and transfer limits of the user, 0 meaning no limit
+func (m *Manager) userLimits(username string) (int64, int) {
+	rate, transfers := m.settings.Current().UserRateLimitKBps, m.settings.Current().UserMaxTransfers
+	if user, ok := m.settings.GetUser(username); ok {
+		if user.RateLimitKBps != 0 {
+			rate = user.RateLimitKBps
+		}
+		if user.MaxTransfers != 0 {
+			transfers = user.MaxTransfers
+		}
+	}
+	// Negative per user values turn the default limit off for the user
+	if rate < 0 {
+		rate = 0
+	}
+	if transfers < 0 {
+		transfers = 0
+	}
+	return int64(rate) * 1024, transfers
+}
+
+// Start begins a transfer of the file in the record, failing with ErrTooManyTransfers if at a limit
+// Limits apply to the user, or the client for anonymous access
+// The returned transfer must be finished, either by Finish or closing a reader from it
+func (m *Manager) Start(record Record) (*Transfer, error) {
+	user := ClientKey(record.User, record.Client)
+	rate, maxUser := m.userLimits(record.User)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	state, ok := m.users[user]
+	if !ok {
+		state = &userState{name: user}
+		m.users[user] = state
+	}
+	if m.settings.Current().MaxTransfers > 0 && m.running >= m.settings.Current().MaxTransfers {
+		return nil, ErrTooManyTransfers
+	}
+	if maxUser > 0 && state.running >= maxUser {
+		return nil, ErrTooManyTransfers
+	}
+	m.running++
+	state.running++
+	m.global.setRate(int64(m.settings.Current().RateLimitKBps) * 1024)
+	state.limit.setRate(rate)
+	m.updateUI(m.running)
+	return &Transfer{manager: m, user: state, record: record, started: time.Now()}, nil
+}
+
+// ClientKey returns who the limits of a transfer apply to, the user if logged in or else the client address
+func ClientKey(username string, remoteAddr string) string {
+	if len(username) > 0 {
+		return username
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+	return "anonymous@" + remoteAddr
+}
+
+// Running returns the number of transfers running
+func (m *Manager) Running() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.running
+}
+
+// Abort marks the transfer as ended early, such as the client going away
+func (t *Transfer) Abort() {
+	t.aborted.Store(true)
+}
+
+// Finish ends the transfer, freeing its slot and recording it. Safe to call more than once
+func (t *Transfer) Finish() {
+	t.once.Do(func() {
+		t.manager.lock.Lock()
+		t.manager.running--
+		t.user.running--
+		// Forget idle users, so anonymous clients don't build up
+		if t.user.running == 0 {
+			delete(t.manager.users, t.user.name)
+		}
+		running := t.manager.running
+		t.manager.lock.Unlock()
+
+		record := t.record
+		record.Time = t.started
+		record.Bytes = t.sent.Load()
+		record.DurationMs = time.Since(t.started).Milliseconds()
+		record.Completed = !t.aborted.Load() && (record.Expected == 0 || record.Bytes >= record.Expected)
+		t.manager.record(record)
+		t.manager.updateUI(running)
+	})
+}
+
+// wait blocks until n bytes can be sent under both the global and user limits
+func (t *Transfer) wait(n int) {
+	delay := t.manager.global.reserve(n)
+	if userDelay := t.user.limit.reserve(n); userDelay > delay {
+		delay = userDelay
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Reader wraps the reader so reads are rate limited, closing it finishes the transfer
+func (t *Transfer) Reader(reader io.ReadSeekCloser) io.ReadSeekCloser {
+	return &limitedReader{ReadSeekCloser: reader, transfer: t}
+}
+
+type limitedReader struct {
+	io.ReadSeekCloser
+	transfer *Transfer
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err := r.ReadSeekCloser.Read(p)
+	if n > 0 {
+		r.transfer.sent.Add(int64(n))
+		r.transfer.wait(n)
+	}
+	return n, err
+}
+
+func (r *limitedReader) Close() error {
+	r.transfer.Finish()
+	return r.ReadSeekCloser.Close()
+}
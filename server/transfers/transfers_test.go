@@ -0,0 +1,149 @@
+package transfers
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ralim/switchhost/settings"
+)
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+func makeTestSettings(t *testing.T) *settings.Settings {
+	tempFolder, err := os.MkdirTemp("", "unit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempFolder) })
+	setting := settings.NewSettings(path.Join(tempFolder, "settings.json"))
+	setting.CacheFolder = tempFolder
+	return setting
+}
+
+func TestTransferLimits(t *testing.T) {
+	t.Parallel()
+	setting := makeTestSettings(t)
+	setting.MaxTransfers = 3
+	setting.UserMaxTransfers = 1
+	setting.Users = []settings.AuthUser{{Username: "greedy", MaxTransfers: -1}}
+	manager := NewManager(setting, nil)
+
+	first, err := manager.Start(Record{User: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Start(Record{User: "user"}); err != ErrTooManyTransfers {
+		t.Error("user should be limited to one transfer")
+	}
+	if _, err := manager.Start(Record{User: "greedy"}); err != nil {
+		t.Error("per user setting should remove the limit")
+	}
+	if _, err := manager.Start(Record{User: "greedy"}); err != nil {
+		t.Error("per user setting should remove the limit")
+	}
+	if _, err := manager.Start(Record{User: "greedy"}); err != ErrTooManyTransfers {
+		t.Error("global limit should still apply")
+	}
+	reader := first.Reader(nopCloser{bytes.NewReader(nil)})
+	_ = reader.Close()
+	first.Finish() // Safe to finish twice
+	if manager.Running() != 2 {
+		t.Errorf("closing the reader should finish the transfer, %d running", manager.Running())
+	}
+	if _, err := manager.Start(Record{User: "user"}); err != nil {
+		t.Error("user should be able to start again")
+	}
+}
+
+func TestTransferRateLimit(t *testing.T) {
+	t.Parallel()
+	setting := makeTestSettings(t)
+	setting.UserRateLimitKBps = 1024
+	manager := NewManager(setting, nil)
+
+	transfer, err := manager.Start(Record{User: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := transfer.Reader(nopCloser{bytes.NewReader(make([]byte, 512*1024))})
+	defer reader.Close()
+	start := time.Now()
+	n, err := io.Copy(io.Discard, reader)
+	if err != nil || n != 512*1024 {
+		t.Fatalf("should read everything, got %d %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("512KB at 1MB/s should take about half a second, took %s", elapsed)
+	}
+}
+
+func TestTransferHistory(t *testing.T) {
+	t.Parallel()
+	setting := makeTestSettings(t)
+	manager := NewManager(setting, nil)
+
+	complete, err := manager.Start(Record{User: "user", Protocol: ProtocolFTP, TitleID: "0100000000010000", Expected: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := complete.Reader(nopCloser{bytes.NewReader(make([]byte, 4))})
+	_, _ = io.Copy(io.Discard, reader)
+	_ = reader.Close()
+
+	short, err := manager.Start(Record{User: "user", Protocol: ProtocolFTP, TitleID: "0100000000010000", Expected: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = short.Reader(nopCloser{bytes.NewReader(make([]byte, 4))})
+	_, _ = reader.Read(make([]byte, 2))
+	_ = reader.Close()
+
+	aborted, err := manager.Start(Record{Client: "10.0.0.1:1234", Protocol: ProtocolHTTP, TitleID: "0100000000010800"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted.Abort()
+	aborted.Finish()
+
+	check := func(stats Stats) {
+		t.Helper()
+		if stats.Totals.Completed != 1 || stats.Totals.Aborted != 2 || stats.Totals.Bytes != 6 {
+			t.Errorf("wrong totals, got %+v", stats.Totals)
+		}
+		if user := stats.Users["user"]; user == nil || user.Transfers != 2 || user.Bytes != 6 {
+			t.Errorf("wrong user counts, got %+v", user)
+		}
+		if title := stats.Titles["0100000000010800"]; title == nil || title.Transfers != 1 {
+			t.Errorf("wrong title counts, got %+v", title)
+		}
+		if len(stats.Recent) != 3 || stats.Recent[0].Protocol != ProtocolHTTP {
+			t.Errorf("recent should be newest first, got %+v", stats.Recent)
+		}
+	}
+	check(manager.GetStats())
+
+	// A new manager picks the history back up from the log
+	reloaded := NewManager(setting, nil)
+	if err := reloaded.LoadHistory(); err != nil {
+		t.Fatal(err)
+	}
+	check(reloaded.GetStats())
+}
+
+func TestClientKey(t *testing.T) {
+	t.Parallel()
+	if key := ClientKey("user", "10.0.0.1:1234"); key != "user" {
+		t.Errorf("logged in users use their name, got %s", key)
+	}
+	if key := ClientKey("", "10.0.0.1:1234"); key != "anonymous@10.0.0.1" {
+		t.Errorf("anonymous clients use their address, got %s", key)
+	}
+}
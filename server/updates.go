@@ -8,6 +8,14 @@ import (
 func (server *Server) handleServingUpdatesList(respWriter http.ResponseWriter, req *http.Request) {
 	respWriter.Header().Set("Content-Type", "application/json")
 	updates := server.library.GetGamesNeedingUpdate()
+	filter := server.accessFilter(req)
+	allowed := updates[:0]
+	for _, update := range updates {
+		if filter.AllowsTitleID(update.TitleID) {
+			allowed = append(allowed, update)
+		}
+	}
+	updates = allowed
 	data, _ := json.MarshalIndent(updates, "", "  ")
 	_, _ = respWriter.Write(data)
 
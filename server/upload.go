@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ralim/switchhost/library"
+	"github.com/rs/zerolog/log"
+)
+
+// Uploads over HTTP, for where FTP is not usable
+// Files can be sent as a PUT to /upload/<filename> or as a multipart POST to /upload
+// They are streamed to the temp folder and then handed to the library, the same as FTP uploads
+// Multipart files are only handed over once the whole form is read, so a failed part leaves none of them queued
+// Each file gets a job that can be polled with a GET to /upload/<id> to see if it was accepted
+
+var ErrBadFileType = errors.New("bad file type")
+
+func (server *Server) httpHandleUpload(respWriter http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		server.httpHandleUploadStatus(respWriter, req)
+		return
+	}
+	if req.Method != http.MethodPut && req.Method != http.MethodPost {
+		http.Error(respWriter, "Only GET, PUT and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.checkUpload(req) {
+		respWriter.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(respWriter, "Upload not allowed", http.StatusUnauthorized)
+		return
+	}
+	user, _ := server.basicAuthUser(req)
+	uploads := []savedUpload{}
+	if req.Method == http.MethodPut {
+		name, _ := ShiftPath(req.URL.Path)
+		upload, err := server.saveUpload(name, req.Body)
+		if err != nil {
+			server.uploadError(respWriter, name, err)
+			return
+		}
+		uploads = append(uploads, upload)
+	} else {
+		reader, err := req.MultipartReader()
+		if err != nil {
+			http.Error(respWriter, "Expected multipart form", http.StatusBadRequest)
+			return
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				removeUploads(uploads)
+				http.Error(respWriter, "Reading multipart form failed", http.StatusBadRequest)
+				return
+			}
+			if part.FileName() == "" {
+				continue // Not a file field
+			}
+			upload, err := server.saveUpload(part.FileName(), part)
+			part.Close()
+			if err != nil {
+				removeUploads(uploads)
+				server.uploadError(respWriter, part.FileName(), err)
+				return
+			}
+			uploads = append(uploads, upload)
+		}
+	}
+	jobs := []library.Job{}
+	for _, upload := range uploads {
+		jobID := server.library.NotifyIncomingFile(upload.path, upload.name, user.Username)
+		job, _ := server.library.GetJob(jobID)
+		jobs = append(jobs, job)
+	}
+	respWriter.Header().Set("Content-Type", "application/json")
+	respWriter.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(respWriter).Encode(jobs)
+}
+
+func (server *Server) httpHandleUploadStatus(respWriter http.ResponseWriter, req *http.Request) {
+	if param, _ := ShiftPath(req.URL.Path); param == "" {
+		http.Error(respWriter, "Bad job ID", http.StatusBadRequest)
+		return
+	}
+	server.httpHandleAPIJobs(respWriter, req)
+}
+
+// savedUpload is an uploaded file in the temp folder, waiting to be handed to the library
+type savedUpload struct {
+	path string
+	name string
+}
+
+// saveUpload streams the upload into the temp folder
+func (server *Server) saveUpload(name string, data io.Reader) (savedUpload, error) {
+	name = path.Base(name)
+	if !library.IsScannableFile(name) {
+		return savedUpload{}, ErrBadFileType
+	}
+	extension := strings.ToLower(path.Ext(name))
+	tmpFile, err := os.CreateTemp(server.settings.Current().TempFilesFolder, "switchhost-upload-*"+extension)
+	if err != nil {
+		return savedUpload{}, fmt.Errorf("creating temp file for upload failed - %w", err)
+	}
+	if _, err := io.Copy(tmpFile, data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return savedUpload{}, fmt.Errorf("copying data in HTTP upload failed - %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return savedUpload{}, fmt.Errorf("closing HTTP upload failed - %w", err)
+	}
+	return savedUpload{path: tmpFile.Name(), name: name}, nil
+}
+
+// removeUploads deletes uploads that won't be handed to the library
+func removeUploads(uploads []savedUpload) {
+	for _, upload := range uploads {
+		if err := os.Remove(upload.path); err != nil {
+			log.Warn().Err(err).Str("path", upload.path).Msg("Removing HTTP upload failed")
+		}
+	}
+}
+
+func (server *Server) uploadError(respWriter http.ResponseWriter, name string, err error) {
+	if errors.Is(err, ErrBadFileType) {
+		http.Error(respWriter, "Bad file type", http.StatusUnsupportedMediaType)
+		return
+	}
+	log.Warn().Err(err).Str("name", name).Msg("HTTP upload failed")
+	http.Error(respWriter, "Upload failed", http.StatusInternalServerError)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/ralim/switchhost/library"
+	"github.com/ralim/switchhost/settings"
+)
+
+func TestHTTPUpload(t *testing.T) {
+	t.Parallel()
+
+	server, lib, tempFolder := maketestServer(t)
+	defer os.RemoveAll(tempFolder)
+	server.settings.TempFilesFolder = tempFolder
+	server.settings.UploadingAllowed = true
+	server.settings.Users = []settings.AuthUser{{Username: "test", Password: "testPass", AllowHTTP: true, AllowUpload: true}}
+
+	doRequest := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(server.httpHandleUpload).ServeHTTP(rr, req)
+		return rr
+	}
+
+	req := httptest.NewRequest("PUT", "/game.nsp", bytes.NewBufferString("Test"))
+	if rr := doRequest(req); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Should reject upload without auth, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/notes.txt", bytes.NewBufferString("Test"))
+	req.SetBasicAuth("test", "testPass")
+	if rr := doRequest(req); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Should reject bad file types, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/game.nsp", bytes.NewBufferString("Test"))
+	req.SetBasicAuth("test", "testPass")
+	rr := doRequest(req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Should accept upload, got %d", rr.Code)
+	}
+	jobs := []library.Job{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Name != "game.nsp" || jobs[0].State != library.JobQueued {
+		t.Errorf("Should return queued job, got %+v", jobs)
+	}
+
+	// Multipart uploads
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "other.xci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write([]byte("Test"))
+	writer.Close()
+	req = httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.SetBasicAuth("test", "testPass")
+	rr = doRequest(req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Should accept multipart upload, got %d", rr.Code)
+	}
+
+	// A failed part leaves none of the form queued
+	saved, _ := filepath.Glob(path.Join(tempFolder, "switchhost-upload-*"))
+	body = &bytes.Buffer{}
+	writer = multipart.NewWriter(body)
+	for _, name := range []string{"first.nsp", "notes.txt"} {
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = part.Write([]byte("Test"))
+	}
+	writer.Close()
+	req = httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.SetBasicAuth("test", "testPass")
+	if rr := doRequest(req); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Should reject the bad part, got %d", rr.Code)
+	}
+	if jobs := lib.ListJobs(); len(jobs) != 2 {
+		t.Errorf("Should not queue any of the form, got %+v", jobs)
+	}
+	if remaining, _ := filepath.Glob(path.Join(tempFolder, "switchhost-upload-*")); len(remaining) != len(saved) {
+		t.Errorf("Should remove the saved parts, got %v", remaining)
+	}
+
+	// Polling the job
+	req = httptest.NewRequest("GET", "/1", nil)
+	if rr := doRequest(req); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Should require a login to poll jobs, got %d", rr.Code)
+	}
+	req = httptest.NewRequest("GET", "/1", nil)
+	req.SetBasicAuth("test", "testPass")
+	rr = doRequest(req)
+	job := library.Job{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != 1 || job.Name != "game.nsp" {
+		t.Errorf("Should return the job, got %+v", job)
+	}
+	req = httptest.NewRequest("GET", "/404", nil)
+	req.SetBasicAuth("test", "testPass")
+	if rr := doRequest(req); rr.Code != http.StatusNotFound {
+		t.Errorf("Should 404 unknown jobs, got %d", rr.Code)
+	}
+
+	server.settings.UploadingAllowed = false
+	req = httptest.NewRequest("PUT", "/game.nsp", bytes.NewBufferString("Test"))
+	req.SetBasicAuth("test", "testPass")
+	if rr := doRequest(req); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Should reject upload when uploads are off, got %d", rr.Code)
+	}
+}
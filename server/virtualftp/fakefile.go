@@ -9,6 +9,7 @@ type FakeFile struct {
 	os.FileInfo
 	fakePath string
 	realFile os.FileInfo
+	size     int64 // Overrides the real file size if set
 }
 
 func NewFakeFile(fakepath string, realFile os.FileInfo) FakeFile {
@@ -18,10 +19,22 @@ func NewFakeFile(fakepath string, realFile os.FileInfo) FakeFile {
 	}
 }
 
+// NewFakeFileWithSize is used for files that are served differently to how they are stored, such as NSZ served as NSP
+func NewFakeFileWithSize(fakepath string, realFile os.FileInfo, size int64) FakeFile {
+	return FakeFile{
+		fakePath: fakepath,
+		realFile: realFile,
+		size:     size,
+	}
+}
+
 func (v *FakeFile) Name() string {
 	return v.fakePath
 }
 func (v *FakeFile) Size() int64 {
+	if v.size > 0 {
+		return v.size
+	}
 	return v.realFile.Size()
 
 }
@@ -5,7 +5,10 @@ import (
 	"path"
 	"testing"
 
+	"github.com/ralim/switchhost/index"
+	"github.com/ralim/switchhost/library"
 	"github.com/ralim/switchhost/settings"
+	"github.com/ralim/switchhost/titledb"
 	ftpserver "goftp.io/server/v2"
 )
 
@@ -131,9 +134,9 @@ func TestEnsureFTPHandlesNotUsedFeatures(t *testing.T) {
 	if err != ErrNotAllowed {
 		t.Error("Should raise error on any delete")
 	}
-	err = driver.DeleteFile(nil, "")
+	err = driver.DeleteFile(&ftpserver.Context{Sess: &ftpserver.Session{Data: make(map[string]interface{})}}, "")
 	if err != ErrNotAllowed {
-		t.Error("Should raise error on any delete")
+		t.Error("Should raise error on anonymous delete")
 	}
 	err = driver.Rename(nil, "", "")
 	if err != ErrNotAllowed {
@@ -144,3 +147,159 @@ func TestEnsureFTPHandlesNotUsedFeatures(t *testing.T) {
 		t.Error("Should silently drop MakeDir")
 	}
 }
+
+func TestAuthCheckPasswdForceTLS(t *testing.T) {
+
+	tempFolder, err := os.MkdirTemp("", "unit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempFolder)
+	setting := settings.NewSettings(path.Join(tempFolder, "settings.json"))
+	setting.Users = []settings.AuthUser{{Username: "test", Password: "testPass", AllowFTP: true, AllowUpload: true}}
+	setting.AllowAnonFTP = true
+	setting.FTPSMode = settings.FTPSExplicit
+	setting.FTPForceTLS = true
+	driver := NewDriver(nil, setting)
+	ctx := &ftpserver.Context{
+		Sess: &ftpserver.Session{
+			Data: make(map[string]interface{}),
+		},
+	}
+
+	// Anonymous can stay plaintext
+	ok, err := driver.CheckPasswd(ctx, "anonymous", "")
+	if !ok || err != nil {
+		t.Error("anonymous should not need TLS")
+	}
+	// Users must be on TLS
+	ok, err = driver.CheckPasswd(ctx, "test", "testPass")
+	if ok || err != ErrTLSRequired {
+		t.Error("user should be refused without TLS")
+	}
+	if value, ok := ctx.Sess.Data["uploadAllowed"]; !ok || value.(bool) {
+		t.Error("Should not allow uploads when refused")
+	}
+	ctx.Sess.Data[sessionTLSKey] = true
+	ok, err = driver.CheckPasswd(ctx, "test", "testPass")
+	if !ok || err != nil {
+		t.Error("user should be allowed over TLS")
+	}
+	// Implicit sessions are always TLS
+	delete(ctx.Sess.Data, sessionTLSKey)
+	setting.FTPSMode = settings.FTPSImplicit
+	ok, _ = driver.CheckPasswd(ctx, "test", "testPass")
+	if !ok {
+		t.Error("user should be allowed over implicit TLS")
+	}
+}
+
+func TestFTPCommandsWrapAuth(t *testing.T) {
+	commands := ftpCommands()
+	if _, ok := commands["AUTH"].(authCommand); !ok {
+		t.Error("AUTH should be wrapped")
+	}
+	if _, ok := ftpserver.DefaultCommands()["AUTH"].(authCommand); ok {
+		t.Error("default commands should not be changed")
+	}
+	if len(commands) != len(ftpserver.DefaultCommands()) {
+		t.Error("all other commands should be kept")
+	}
+}
+
+func TestListDirAccessRules(t *testing.T) {
+	tempFolder, err := os.MkdirTemp("", "unit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempFolder)
+	setting := settings.NewSettings(path.Join(tempFolder, "settings.json"))
+	setting.Users = []settings.AuthUser{{Username: "kid", Password: "kid", AllowFTP: true, Deny: []settings.AccessRule{{Type: "dlc"}}}}
+	lib := library.NewLibrary(titledb.CreateTitlesDB(setting), setting, nil, nil)
+	for _, titleID := range []uint64{0x05123A0000000000, 0x05123A0000001001} {
+		lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{
+			Path:    "../../testing_files/UnitTest_[05123A0000000000].nsp",
+			TitleID: titleID,
+			Name:    "UnitTest",
+		})
+	}
+	driver := NewDriver(lib, setting)
+	ctx := &ftpserver.Context{
+		Sess: &ftpserver.Session{
+			Data: make(map[string]interface{}),
+		},
+	}
+	list := func() []string {
+		names := []string{}
+		_ = driver.ListDir(ctx, "/UnitTest [365418291444842496]", func(info os.FileInfo) error {
+			names = append(names, info.Name())
+			return nil
+		})
+		return names
+	}
+	if names := list(); len(names) != 2 {
+		t.Errorf("anonymous should see both files, got %v", names)
+	}
+	if ok, _ := driver.CheckPasswd(ctx, "kid", "kid"); !ok {
+		t.Fatal("should log in")
+	}
+	names := list()
+	if len(names) != 1 {
+		t.Fatalf("kid should only see the base title, got %v", names)
+	}
+	if _, _, err := driver.GetFile(ctx, "/UnitTest [365418291444842496]/UnitTest - [365418291444846593][0].nsp", 0); err == nil {
+		t.Error("kid should not be able to download the DLC")
+	}
+}
+
+func TestDeleteFileAdmin(t *testing.T) {
+	tempFolder, err := os.MkdirTemp("", "unit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempFolder)
+	setting := settings.NewSettings(path.Join(tempFolder, "settings.json"))
+	setting.Users = []settings.AuthUser{
+		{Username: "user", Password: "user", AllowFTP: true},
+		{Username: "admin", Password: "admin", AllowFTP: true, AllowSettings: true},
+		{Username: "limited", Password: "limited", AllowFTP: true, AllowSettings: true, Deny: []settings.AccessRule{{TitleID: "05123A0000000000"}}},
+	}
+	lib := library.NewLibrary(titledb.CreateTitlesDB(setting), setting, nil, nil)
+	lib.FileIndex.AddFileRecord(&index.FileOnDiskRecord{
+		Path:    path.Join(tempFolder, "UnitTest.nsp"),
+		TitleID: 0x05123A0000000000,
+		Name:    "UnitTest",
+	})
+	driver := NewDriver(lib, setting)
+	ctx := &ftpserver.Context{
+		Sess: &ftpserver.Session{
+			Data: make(map[string]interface{}),
+		},
+	}
+	filePath := "/UnitTest [365418291444842496]/UnitTest - [365418291444842496][0].nsp"
+
+	if ok, _ := driver.CheckPasswd(ctx, "user", "user"); !ok {
+		t.Fatal("should log in")
+	}
+	if err := driver.DeleteFile(ctx, filePath); err != ErrNotAllowed {
+		t.Errorf("normal users should not delete, got %v", err)
+	}
+	if ok, _ := driver.CheckPasswd(ctx, "limited", "limited"); !ok {
+		t.Fatal("should log in")
+	}
+	if err := driver.DeleteFile(ctx, filePath); err != ErrNotAllowed {
+		t.Errorf("should not delete titles the user can't see, got %v", err)
+	}
+	if ok, _ := driver.CheckPasswd(ctx, "admin", "admin"); !ok {
+		t.Fatal("should log in")
+	}
+	if err := driver.DeleteFile(ctx, "/UnitTest [365418291444842496]/Missing - [365418291444842496][1].nsp"); err == nil {
+		t.Error("should not delete missing files")
+	}
+	if err := driver.DeleteFile(ctx, filePath); err != nil {
+		t.Errorf("admin should be able to delete, got %v", err)
+	}
+	if jobs := lib.ListJobs(); len(jobs) != 1 || jobs[0].Name != "delete UnitTest.nsp" {
+		t.Errorf("should queue the delete, got %+v", jobs)
+	}
+}
@@ -1,10 +1,10 @@
 package virtualftp
 
 import (
-	"crypto/subtle"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path"
 	"regexp"
@@ -14,6 +14,7 @@ import (
 
 	"github.com/ralim/switchhost/index"
 	"github.com/ralim/switchhost/library"
+	"github.com/ralim/switchhost/server/transfers"
 	"github.com/ralim/switchhost/settings"
 	"github.com/ralim/switchhost/utilities"
 	"github.com/rs/zerolog/log"
@@ -23,54 +24,83 @@ import (
 var ErrNotAllowed error = errors.New("not allowed")
 
 type FTPServer struct {
-	server *ftpserver.Server
+	server   *ftpserver.Server
+	listener net.Listener // Opened here for plain FTP, goftp listens itself for FTPS as that's where it sets up its TLS
 }
 
-func CreateVirtualFTP(lib *library.Library, settings *settings.Settings) *FTPServer {
+// CreateVirtualFTP sets up the FTP server, certificates are used for FTPS and must be set unless it is turned off
+// Downloads are limited by the transfers manager, shared with the HTTP server
+func CreateVirtualFTP(lib *library.Library, settings *settings.Settings, certificates *utilities.CertificateLoader, transfers *transfers.Manager) (*FTPServer, error) {
 	driver := NewDriver(lib, settings)
+	driver.transfers = transfers
 	perm := ftpserver.NewSimplePerm("switch", "switch")
 	opt := &ftpserver.Options{
-		Commands:       nil,
+		Commands:       ftpCommands(),
 		Driver:         driver,
 		Auth:           driver,
 		Perm:           perm,
 		Name:           "switchhost",
-		Hostname:       settings.FTPHost,
-		PublicIP:       settings.PublicIP,
-		PassivePorts:   settings.FTPPassivePorts,
-		Port:           settings.FTPPort,
+		Hostname:       settings.Current().FTPHost,
+		PublicIP:       settings.Current().PublicIP,
+		PassivePorts:   settings.Current().FTPPassivePorts,
+		Port:           settings.Current().FTPPort,
 		TLS:            false,
 		ExplicitFTPS:   false,
 		ForceTLS:       false,
-		WelcomeMessage: settings.ServerMOTD,
+		WelcomeMessage: settings.Current().ServerMOTD,
 		Logger:         nil,
 		RateLimit:      0,
 	}
+	if certificates != nil && driver.ftpsEnabled() {
+		opt.TLS = true
+		opt.TLSConfig = certificates.TLSConfig()
+		opt.ExplicitFTPS = !driver.ftpsImplicit()
+		// Without anonymous access every session logs in, so the whole session can be forced to TLS
+		opt.ForceTLS = settings.Current().FTPForceTLS && !settings.Current().AllowAnonFTP
+	}
 	// start ftp server
 	ftpServer, err := ftpserver.NewServer(opt)
 	if err != nil {
-		log.Error().Err(err).Msg("FTP server creation failed")
+		return nil, err
+	}
+	result := &FTPServer{server: ftpServer}
+	if !opt.TLS {
+		// Listening here reports a port in use straight away
+		result.listener, err = net.Listen("tcp", net.JoinHostPort(opt.Hostname, strconv.Itoa(opt.Port)))
+		if err != nil {
+			return nil, err
+		}
 	}
-	return &FTPServer{server: ftpServer}
+	return result, nil
 
 }
 
 func (ftp *FTPServer) Start() {
-	err := ftp.server.ListenAndServe()
-	if err != nil {
+	var err error
+	if ftp.listener != nil {
+		log.Info().Str("address", ftp.listener.Addr().String()).Msg("Serving FTP")
+		err = ftp.server.Serve(ftp.listener)
+	} else {
+		err = ftp.server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
 		log.Warn().Err(err).Msg("FTP server exited")
 	}
 }
 func (ftp *FTPServer) Stop() {
-	if ftp.server != nil {
+	if ftp.listener != nil {
+		// goftp's Shutdown isn't synchronised with Serve, closing the listener stops it just the same
+		_ = ftp.listener.Close()
+	} else if ftp.server != nil {
 		_ = ftp.server.Shutdown()
 	}
 }
 
 // Driver for the ftp lib to remap the virtual index
 type FTPDriver struct {
-	library  *library.Library
-	settings *settings.Settings
+	library   *library.Library
+	settings  *settings.Settings
+	transfers *transfers.Manager // If nil, downloads are not limited
 }
 
 // NewDriver creates a new FTPDriver for the virtual FTP hosting
@@ -112,8 +142,12 @@ func (driver *FTPDriver) ListDir(ctx *ftpserver.Context, path string, callback f
 		//Returning virtual folder of titles
 		titlesList := driver.library.FileIndex.ListTitleFiles()
 		sort.Sort(index.ByName(titlesList))
+		filter := driver.accessFilter(ctx)
 
 		for _, titleInfo := range titlesList {
+			if records, ok := driver.library.FileIndex.GetTitleRecords(titleInfo.TitleID); !ok || !filter.AllowsAny(records.GetFiles()) {
+				continue
+			}
 			//Generate title virtual path
 			_ = callback(driver.getFakeFolderFileInfo(titleInfo))
 		}
@@ -123,11 +157,16 @@ func (driver *FTPDriver) ListDir(ctx *ftpserver.Context, path string, callback f
 			val, ok := driver.library.FileIndex.GetFilesForTitleID(titleID)
 			if ok {
 				//Now need to yield os info's for all the underlying files
-				for _, file := range val.GetFiles() {
+				for _, file := range driver.accessFilter(ctx).Filter(val.GetFiles()) {
 					info, err := os.Stat(file.Path)
 					if err == nil {
-						fakeFile := NewFakeFile(driver.getFakePathForRealFile(file), info)
+						fakeFile := NewFakeFile(driver.getFakePathForRealFile(file, false), info)
 						_ = callback(&fakeFile)
+						// NSZ files are also listed as the NSP they expand to
+						if file.NSPSize > 0 {
+							fakeNSP := NewFakeFileWithSize(driver.getFakePathForRealFile(file, true), info, file.NSPSize)
+							_ = callback(&fakeNSP)
+						}
 					}
 				}
 			}
@@ -135,33 +174,54 @@ func (driver *FTPDriver) ListDir(ctx *ftpserver.Context, path string, callback f
 	}
 	return nil
 }
-func (driver *FTPDriver) getFakePathForRealFile(file index.FileOnDiskRecord) string {
+
+// accessFilter returns the filter of titles the logged in user can see, nil for anonymous sessions
+func (driver *FTPDriver) accessFilter(ctx *ftpserver.Context) *index.AccessFilter {
+	username, ok := ctx.Sess.Data["username"].(string)
+	if !ok {
+		return nil
+	}
+	user, ok := driver.settings.GetUser(username)
+	if !ok {
+		// Account removed while logged in, so show nothing
+		return index.NewAccessFilter(settings.AuthUser{Deny: []settings.AccessRule{{}}}, nil)
+	}
+	return index.NewAccessFilter(user, driver.settings.Current().TitleTags)
+}
+
+func (driver *FTPDriver) getFakePathForRealFile(file index.FileOnDiskRecord, asNSP bool) string {
 	ext := path.Ext(file.Path)
+	if asNSP {
+		ext = ".nsp"
+	}
 	fileTitle := fmt.Sprintf("%s - [%d][%d]%s", file.Name, file.TitleID, file.Version, ext)
 	return path.Join(fileTitle)
 }
-func (driver *FTPDriver) getRealFilePathFromVirtual(path string) (string, bool) {
+
+// getRealFileFromVirtual finds the record for the virtual path, and if the NSZ should be served as an NSP
+func (driver *FTPDriver) getRealFileFromVirtual(virtualPath string) (*index.FileOnDiskRecord, bool, bool) {
 
 	//Lookup the titleID to check against
 	//Then just match paths :shrug:
 	reg := regexp.MustCompile(`/.+\[(\d+)\]\[(\d+)\]\..+$`)
-	match := reg.FindStringSubmatch(path)
+	match := reg.FindStringSubmatch(virtualPath)
 	if len(match) != 3 {
-		return "", false
+		return nil, false, false
 	}
 	titleID, err := strconv.ParseUint(match[1], 10, 64)
 	if err != nil {
-		return "", false
+		return nil, false, false
 	}
 	version, err := strconv.ParseUint(match[2], 10, 32)
 	if err != nil {
-		return "", false
+		return nil, false, false
 	}
 	value, ok := driver.library.FileIndex.GetFileRecord(titleID, uint32(version))
 	if !ok {
-		return "", false
+		return nil, false, false
 	}
-	return value.Path, true
+	asNSP := strings.ToLower(path.Ext(virtualPath)) == ".nsp" && library.CanServeAsNSP(value.Path)
+	return value, asNSP, true
 }
 
 func (driver *FTPDriver) Stat(ctx *ftpserver.Context, path string) (os.FileInfo, error) {
@@ -172,30 +232,40 @@ func (driver *FTPDriver) Stat(ctx *ftpserver.Context, path string) (os.FileInfo,
 	if titleid, err := driver.dirPathToTitleID(path); err == nil {
 		//This is a file folder, generate faux info
 		if titleInfo, ok := driver.library.FileIndex.GetFilesForTitleID(titleid); ok {
-			files := titleInfo.GetFiles()
+			files := driver.accessFilter(ctx).Filter(titleInfo.GetFiles())
 			if len(files) > 0 {
 				return driver.getFakeFolderFileInfo(files[0]), err
 			}
 		}
 	}
-	realPath, ok := driver.getRealFilePathFromVirtual(path)
-	if !ok {
+	record, asNSP, ok := driver.getRealFileFromVirtual(path)
+	if !ok || !driver.accessFilter(ctx).Allows(*record) {
 		return nil, errors.New("cant find it")
 	}
-	fileInfo, err := os.Stat(realPath)
+	fileInfo, err := os.Stat(record.Path)
 	if err != nil {
 		return fileInfo, err
 	}
 	fakeFile := NewFakeFile(path, fileInfo)
+	if asNSP {
+		fakeFile = NewFakeFileWithSize(path, fileInfo, record.NSPSize)
+	}
 	return &fakeFile, nil
 }
 
 func (driver *FTPDriver) GetFile(ctx *ftpserver.Context, path string, offset int64) (int64, io.ReadCloser, error) {
-	realPath, ok := driver.getRealFilePathFromVirtual(path)
-	if !ok {
+	record, asNSP, ok := driver.getRealFileFromVirtual(path)
+	if !ok || !driver.accessFilter(ctx).Allows(*record) {
 		return 0, nil, errors.New("cant find file")
 	}
-	f, err := os.Open(realPath)
+	var f io.ReadSeekCloser
+	var size int64
+	var err error
+	if asNSP {
+		f, size, err = library.OpenAsNSP(record.Path)
+	} else {
+		f, size, err = openWithSize(record.Path)
+	}
 	if err != nil {
 		return 0, nil, fmt.Errorf("reading file from offset failed open - %w", err)
 	}
@@ -206,11 +276,6 @@ func (driver *FTPDriver) GetFile(ctx *ftpserver.Context, path string, offset int
 		}
 	}()
 
-	info, err := f.Stat()
-	if err != nil {
-		return 0, nil, fmt.Errorf("reading file from offset failed stat - %w", err)
-	}
-
 	_, err = f.Seek(offset, io.SeekStart)
 	if err != nil {
 		return 0, nil, fmt.Errorf("reading file from offset failed seek - %w", err)
@@ -219,12 +284,42 @@ func (driver *FTPDriver) GetFile(ctx *ftpserver.Context, path string, offset int
 	if !ok {
 		username = "unknown"
 	}
+	if driver.transfers != nil {
+		entry := transfers.Record{
+			Client:   ctx.Sess.RemoteAddr().String(),
+			Protocol: transfers.ProtocolFTP,
+			TitleID:  fmt.Sprintf("%016X", record.TitleID),
+			Version:  record.Version,
+			Expected: size - offset,
+		}
+		if ok {
+			entry.User = username
+		}
+		var transfer *transfers.Transfer
+		if transfer, err = driver.transfers.Start(entry); err != nil {
+			return 0, nil, err
+		}
+		f = transfer.Reader(f)
+	}
 	log.Info().Str("user", username).Str("path", path).Msg("Started FTP stream")
-	return info.Size() - offset, f, nil
+	return size - offset, f, nil
+}
+
+func openWithSize(filePath string) (io.ReadSeekCloser, int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
 }
 
 func (driver *FTPDriver) PutFile(ctx *ftpserver.Context, destPath string, data io.Reader, offset int64) (int64, error) {
-	if !driver.settings.UploadingAllowed {
+	if !driver.settings.Current().UploadingAllowed {
 		return 0, ErrNotAllowed
 	}
 	if allowed, ok := ctx.Sess.Data["uploadAllowed"]; !ok || !(allowed.(bool)) {
@@ -236,17 +331,12 @@ func (driver *FTPDriver) PutFile(ctx *ftpserver.Context, destPath string, data i
 		return 0, errors.New("no partial uploads")
 	}
 	//File uploads are filtered by file extension, and anything that isnt a NS? or XC? is rejected
-	extension := strings.ToLower(path.Ext(destPath))
-	switch extension {
-	case ".nsp":
-	case ".nsz":
-	case ".xci":
-	case ".xcz":
-	default:
+	if !library.IsScannableFile(destPath) {
 		return 0, errors.New("bad file type")
 	}
+	extension := strings.ToLower(path.Ext(destPath))
 	// We upload the file to a location in tmp during the upload and then sort or delete
-	tmpFile, err := os.CreateTemp(driver.settings.TempFilesFolder, "switchhost-upload-*"+extension)
+	tmpFile, err := os.CreateTemp(driver.settings.Current().TempFilesFolder, "switchhost-upload-*"+extension)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed creating temp file for upload")
 	}
@@ -261,7 +351,8 @@ func (driver *FTPDriver) PutFile(ctx *ftpserver.Context, destPath string, data i
 	//Notify the library code to scan this file and sort it or delete it
 	tmpFile.Close()
 
-	driver.library.NotifyIncomingFile(tmpFile.Name())
+	username, _ := ctx.Sess.Data["username"].(string)
+	driver.library.NotifyIncomingFile(tmpFile.Name(), path.Base(destPath), username)
 
 	return bytesSaved, nil
 }
@@ -270,8 +361,28 @@ func (driver *FTPDriver) DeleteDir(ctx *ftpserver.Context, path string) error {
 	return ErrNotAllowed
 }
 
+// DeleteFile removes a file from the library, only for users allowed to edit settings and only files their access rules let them see
 func (driver *FTPDriver) DeleteFile(ctx *ftpserver.Context, path string) error {
-	return ErrNotAllowed
+	username, ok := ctx.Sess.Data["username"].(string)
+	if !ok {
+		return ErrNotAllowed
+	}
+	if user, ok := driver.settings.GetUser(username); !ok || !user.AllowSettings {
+		return ErrNotAllowed
+	}
+	record, _, ok := driver.getRealFileFromVirtual(path)
+	if !ok {
+		return errors.New("cant find file")
+	}
+	if !driver.accessFilter(ctx).Allows(*record) {
+		return ErrNotAllowed
+	}
+	jobID, err := driver.library.RequestDelete(record.TitleID, record.Version)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("user", username).Str("path", record.Path).Uint64("job", jobID).Msg("File deleted over FTP")
+	return nil
 }
 
 func (driver *FTPDriver) Rename(ctx *ftpserver.Context, fromPath string, toPath string) error {
@@ -285,18 +396,20 @@ func (driver *FTPDriver) MakeDir(ctx *ftpserver.Context, path string) error {
 
 func (driver *FTPDriver) CheckPasswd(ctx *ftpserver.Context, username string, password string) (bool, error) {
 	ctx.Sess.Data["uploadAllowed"] = false
+	delete(ctx.Sess.Data, "username")
 	match := false
-	for _, user := range driver.settings.Users {
-		if subtle.ConstantTimeCompare([]byte(user.Username), []byte(username)) == 1 && subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
-			if user.AllowFTP {
-				ctx.Sess.Data["uploadAllowed"] = user.AllowUpload
-				ctx.Sess.Data["username"] = username
-				match = true
-			}
+	if user, ok := driver.settings.AuthenticateUser(username, password); ok && user.AllowFTP {
+		// The password has already been sent, but refusing it at least makes the mistake visible
+		if driver.settings.Current().FTPForceTLS && !driver.sessionIsTLS(ctx) {
+			log.Warn().Str("user", username).Msg("FTP login without TLS refused")
+			return false, ErrTLSRequired
 		}
+		ctx.Sess.Data["uploadAllowed"] = user.AllowUpload
+		ctx.Sess.Data["username"] = username
+		match = true
 	}
 	// If anon is enabled, anyone can download, but upload is controlled by user accounts
-	if driver.settings.AllowAnonFTP {
+	if driver.settings.Current().AllowAnonFTP {
 		return true, nil
 	}
 
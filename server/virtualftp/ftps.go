@@ -0,0 +1,54 @@
+package virtualftp
+
+import (
+	"errors"
+
+	"github.com/ralim/switchhost/settings"
+	ftpserver "goftp.io/server/v2"
+)
+
+var ErrTLSRequired = errors.New("TLS is required to log in with a password")
+
+// Session data key set once a session has upgraded to TLS with AUTH TLS
+const sessionTLSKey = "tls"
+
+// ftpCommands returns the default commands, with AUTH wrapped so that TLS sessions can be told apart
+func ftpCommands() map[string]ftpserver.Command {
+	commands := make(map[string]ftpserver.Command)
+	for name, command := range ftpserver.DefaultCommands() {
+		commands[name] = command
+	}
+	commands["AUTH"] = authCommand{commands["AUTH"]}
+	return commands
+}
+
+// authCommand records when a session has upgraded to TLS, as the ftp lib doesn't expose this to the driver
+type authCommand struct {
+	ftpserver.Command
+}
+
+func (cmd authCommand) Execute(sess *ftpserver.Session, param string) {
+	cmd.Command.Execute(sess, param)
+	// The ftp lib only accepts this exact param, and only when TLS is turned on
+	// A failed handshake leaves the connection unusable, so a client can't carry on without TLS after this
+	if param == "TLS" && sess.Options().TLS {
+		sess.Data[sessionTLSKey] = true
+	}
+}
+
+func (driver *FTPDriver) ftpsEnabled() bool {
+	return driver.settings.Current().FTPSMode == settings.FTPSExplicit || driver.ftpsImplicit()
+}
+
+func (driver *FTPDriver) ftpsImplicit() bool {
+	return driver.settings.Current().FTPSMode == settings.FTPSImplicit
+}
+
+// sessionIsTLS returns true if the session is running over TLS
+func (driver *FTPDriver) sessionIsTLS(ctx *ftpserver.Context) bool {
+	if driver.ftpsImplicit() {
+		return true
+	}
+	isTLS, ok := ctx.Sess.Data[sessionTLSKey].(bool)
+	return ok && isTLS
+}
@@ -0,0 +1,242 @@
+package settings
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are stored as bcrypt hashes, plaintext passwords in the settings file are hashed when it is loaded
+// Download tokens are random, revocable, strings that can be put into file URLs for clients that can't send credentials
+
+var ErrUserNotFound = errors.New("user not found")
+var ErrTokenNotFound = errors.New("token not found")
+
+// DownloadToken lets a client authenticate as the user with just the token in the URL
+type DownloadToken struct {
+	ID      string `json:"id"`      // Short ID used to refer to the token without revealing it
+	Token   string `json:"token"`   // The secret token itself
+	Name    string `json:"name"`    // Free text, to tell tokens apart
+	Created int64  `json:"created"` // Unix seconds the token was made
+}
+
+// keepUserSecrets gives users that were posted without a password or tokens (as the redacted settings are) the ones they already have
+func (s *Settings) keepUserSecrets(old *Settings) {
+	for i, user := range s.Users {
+		for _, existing := range old.Users {
+			if existing.Username != user.Username {
+				continue
+			}
+			if len(user.PasswordHash) == 0 && len(user.Password) == 0 {
+				s.Users[i].PasswordHash = existing.PasswordHash
+			}
+			if user.Tokens == nil {
+				s.Users[i].Tokens = existing.Tokens
+			}
+		}
+	}
+}
+
+// authCacheEntry remembers a successful password check, as bcrypt is too slow to run on every request
+type authCacheEntry struct {
+	passwordHash string
+	digest       [sha256.Size]byte
+}
+
+// hashPlaintextPasswords moves any plaintext passwords over to hashes, returns true if any were changed
+// Must be called with authLock held
+func (s *Settings) hashPlaintextPasswords() bool {
+	changed := false
+	for i, user := range s.Users {
+		if len(user.Password) == 0 {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Warn().Err(err).Str("user", user.Username).Msg("Couldn't hash password, leaving it as is")
+			continue
+		}
+		s.Users[i].PasswordHash = string(hash)
+		s.Users[i].Password = ""
+		changed = true
+	}
+	if changed {
+		log.Info().Msg("Hashed plaintext user passwords")
+	}
+	return changed
+}
+
+// AuthenticateUser returns the user matching the username and password
+func (s *Settings) AuthenticateUser(username, password string) (AuthUser, bool) {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	for _, user := range s.Users {
+		if subtle.ConstantTimeCompare([]byte(user.Username), []byte(username)) == 1 && s.passwordMatches(user, password) {
+			return user, true
+		}
+	}
+	return AuthUser{}, false
+}
+
+func (s *Settings) passwordMatches(user AuthUser, password string) bool {
+	if len(user.PasswordHash) == 0 {
+		// Accounts set at runtime that have not been hashed yet
+		return len(user.Password) > 0 && subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+	}
+	digest := sha256.Sum256([]byte(password))
+	s.authCacheLock.Lock()
+	cached, ok := s.authCache[user.Username]
+	s.authCacheLock.Unlock()
+	if ok && cached.passwordHash == user.PasswordHash && subtle.ConstantTimeCompare(cached.digest[:], digest[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return false
+	}
+	s.authCacheLock.Lock()
+	if s.authCache == nil {
+		s.authCache = make(map[string]authCacheEntry)
+	}
+	s.authCache[user.Username] = authCacheEntry{passwordHash: user.PasswordHash, digest: digest}
+	s.authCacheLock.Unlock()
+	return true
+}
+
+// SetUserPassword hashes and sets the password for the user, and saves the settings
+func (s *Settings) SetUserPassword(username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	for i := range s.Users {
+		if s.Users[i].Username == username {
+			s.Users[i].PasswordHash = string(hash)
+			s.Users[i].Password = ""
+			s.Save()
+			return nil
+		}
+	}
+	return ErrUserNotFound
+}
+
+// UserForToken returns the user owning the download token
+func (s *Settings) UserForToken(token string) (AuthUser, bool) {
+	if len(token) == 0 {
+		return AuthUser{}, false
+	}
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	for _, user := range s.Users {
+		for _, t := range user.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+				return user, true
+			}
+		}
+	}
+	return AuthUser{}, false
+}
+
+// ListDownloadTokens returns the tokens of the user
+func (s *Settings) ListDownloadTokens(username string) ([]DownloadToken, error) {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	for _, user := range s.Users {
+		if user.Username == username {
+			return append([]DownloadToken{}, user.Tokens...), nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// CreateDownloadToken makes a new token for the user, and saves the settings
+func (s *Settings) CreateDownloadToken(username, name string) (DownloadToken, error) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	return s.createDownloadToken(username, name)
+}
+
+// must be called with authLock held for writing
+func (s *Settings) createDownloadToken(username, name string) (DownloadToken, error) {
+	for i := range s.Users {
+		if s.Users[i].Username != username {
+			continue
+		}
+		// Hex only, as tokens are put into URLs between `-` and `.` separators
+		secret := make([]byte, 24)
+		id := make([]byte, 4)
+		if _, err := rand.Read(secret); err != nil {
+			return DownloadToken{}, err
+		}
+		if _, err := rand.Read(id); err != nil {
+			return DownloadToken{}, err
+		}
+		token := DownloadToken{ID: hex.EncodeToString(id), Token: hex.EncodeToString(secret), Name: name, Created: time.Now().Unix()}
+		s.Users[i].Tokens = append(s.Users[i].Tokens, token)
+		s.Save()
+		return token, nil
+	}
+	return DownloadToken{}, ErrUserNotFound
+}
+
+// DownloadTokenFor returns a token for the user to put into URLs, making one if they have none
+func (s *Settings) DownloadTokenFor(username string) (string, error) {
+	s.authLock.RLock()
+	for _, user := range s.Users {
+		if user.Username == username && len(user.Tokens) > 0 {
+			s.authLock.RUnlock()
+			return user.Tokens[0].Token, nil
+		}
+	}
+	s.authLock.RUnlock()
+
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	// Check again, another request may have made one while unlocked
+	for _, user := range s.Users {
+		if user.Username == username && len(user.Tokens) > 0 {
+			return user.Tokens[0].Token, nil
+		}
+	}
+	token, err := s.createDownloadToken(username, "auto")
+	return token.Token, err
+}
+
+// RevokeDownloadToken removes the token with the ID from the user, and saves the settings
+func (s *Settings) RevokeDownloadToken(username, id string) error {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	for i := range s.Users {
+		if s.Users[i].Username != username {
+			continue
+		}
+		for j, t := range s.Users[i].Tokens {
+			if t.ID == id {
+				s.Users[i].Tokens = append(s.Users[i].Tokens[:j:j], s.Users[i].Tokens[j+1:]...)
+				s.Save()
+				return nil
+			}
+		}
+		return ErrTokenNotFound
+	}
+	return ErrUserNotFound
+}
+
+// GetUser returns the user with the username
+func (s *Settings) GetUser(username string) (AuthUser, bool) {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	for _, user := range s.Users {
+		if user.Username == username {
+			return user, true
+		}
+	}
+	return AuthUser{}, false
+}
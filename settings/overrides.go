@@ -0,0 +1,220 @@
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// Any setting can be overridden from the environment (SWITCHHOST_HTTP_PORT) or the command line (--http-port)
+// Precedence, lowest first, is the defaults, the settings file, the environment and then the command line
+// Overrides are only held in memory, Save keeps writing the settings file's own values for them
+
+const EnvPrefix = "SWITCHHOST_"
+
+// Overridable describes how a setting can be overridden
+type Overridable struct {
+	Name        string // json name in the settings file
+	Flag        string // Command line flag, without the leading dashes
+	Env         string // Environment variable
+	Description string
+	Bool        bool // The flag can be given on its own to turn the setting on
+}
+
+// Override is a value for a setting from outside the settings file
+type Override struct {
+	Name   string // json name of the setting
+	Value  string // Lists can be comma separated, and anything can be given as json
+	Source string // Where the value came from, for errors
+}
+
+// overriddenValue remembers the value of an overridden setting, and what it was in the settings file
+type overriddenValue struct {
+	fileValue json.RawMessage
+	override  json.RawMessage
+}
+
+// OverridableSettings lists every setting, along with its flag and environment variable names
+func OverridableSettings() []Overridable {
+	comments, _ := fieldComments() // Descriptions are only for help text
+	result := []Overridable{}
+	settingsType := reflect.TypeOf(Settings{})
+	for i := 0; i < settingsType.NumField(); i++ {
+		name, ok := jsonFieldName(settingsType.Field(i))
+		if !ok {
+			continue
+		}
+		flag := flagName(name)
+		result = append(result, Overridable{
+			Name:        name,
+			Flag:        flag,
+			Env:         EnvPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_")),
+			Description: comments["Settings"][settingsType.Field(i).Name],
+			Bool:        settingsType.Field(i).Type.Kind() == reflect.Bool,
+		})
+	}
+	return result
+}
+
+// EnvironmentOverrides returns the overrides set in the environment, environ is in the form of os.Environ()
+func EnvironmentOverrides(environ []string) []Override {
+	byEnv := map[string]string{}
+	for _, setting := range OverridableSettings() {
+		byEnv[setting.Env] = setting.Name
+	}
+	result := []Override{}
+	for _, entry := range environ {
+		key, value, _ := strings.Cut(entry, "=")
+		if name, ok := byEnv[key]; ok {
+			result = append(result, Override{Name: name, Value: value, Source: key})
+		}
+	}
+	return result
+}
+
+// ApplyOverrides sets each of the overrides in order, so later ones win
+// This is for startup, before the settings are shared. Values that can't be parsed are an ErrInvalidSettings, but nothing else is checked here, see Validate
+func (s *Settings) ApplyOverrides(overrides []Override) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	if s.overrides == nil {
+		s.overrides = make(map[string]overriddenValue)
+	}
+	for _, override := range overrides {
+		field, ok := s.fieldByName(override.Name)
+		if !ok {
+			return fmt.Errorf("%w: %s: no setting called %s", ErrInvalidSettings, override.Source, override.Name)
+		}
+		fileValue, err := json.Marshal(field.Interface())
+		if err != nil {
+			return err
+		}
+		invalid := fmt.Errorf("%w: %s: %q is not a valid %s for %s", ErrInvalidSettings, override.Source, override.Value, field.Type(), override.Name)
+		value := overrideJSON(field.Type(), override.Value)
+		if !json.Valid(value) {
+			return invalid
+		}
+		// Parsed on its own, so lists and maps are replaced rather than merged into
+		patch, err := json.Marshal(map[string]json.RawMessage{override.Name: value})
+		if err != nil {
+			return err
+		}
+		parsed := &Settings{}
+		if err := json.Unmarshal(patch, parsed); err != nil {
+			return invalid
+		}
+		parsedField, _ := parsed.fieldByName(override.Name)
+		field.Set(parsedField)
+		if previous, ok := s.overrides[override.Name]; ok {
+			fileValue = previous.fileValue // Overridden twice, keep what the file had
+		}
+		s.overrides[override.Name] = overriddenValue{fileValue: fileValue}
+	}
+	s.cleanPaths()
+	s.hashPlaintextPasswords()
+	// Record the values once cleaned and hashed, so Save can tell if they are changed later
+	for name, value := range s.overrides {
+		field, _ := s.fieldByName(name)
+		value.override, _ = json.Marshal(field.Interface())
+		s.overrides[name] = value
+	}
+	return nil
+}
+
+// fileSettings returns the settings as they should be saved, with overridden values swapped back for the settings file's own
+// Overridden settings changed since (such as by Update) are saved as they are now
+// Must be called with authLock held, or on settings not shared yet
+func (s *Settings) fileSettings() (*Settings, error) {
+	saved, err := s.configured()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range s.overrides {
+		field, _ := saved.fieldByName(name)
+		if current, err := json.Marshal(field.Interface()); err != nil || !bytes.Equal(current, value.override) {
+			continue
+		}
+		if err := saved.setFieldJSON(name, value.fileValue); err != nil {
+			return nil, err
+		}
+	}
+	return saved, nil
+}
+
+// setFieldJSON sets the field with the json name from its json value
+func (s *Settings) setFieldJSON(name string, value json.RawMessage) error {
+	parsed := &Settings{}
+	if err := json.Unmarshal(json.RawMessage(fmt.Sprintf(`{%q:%s}`, name, value)), parsed); err != nil {
+		return err
+	}
+	field, _ := s.fieldByName(name)
+	parsedField, _ := parsed.fieldByName(name)
+	field.Set(parsedField)
+	return nil
+}
+
+// fieldByName returns the field with the json name
+func (s *Settings) fieldByName(name string) (reflect.Value, bool) {
+	value := reflect.ValueOf(s).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if fieldName, ok := jsonFieldName(value.Type().Field(i)); ok && fieldName == name {
+			return value.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// overrideJSON turns an override value into json for the field type
+// Strings are taken as they are, lists of simple values can be comma separated, everything else is json (which numbers and bools already are)
+func overrideJSON(fieldType reflect.Type, value string) json.RawMessage {
+	trimmed := strings.TrimSpace(value)
+	switch fieldType.Kind() {
+	case reflect.String:
+		quoted, _ := json.Marshal(value)
+		return quoted
+	case reflect.Slice:
+		if strings.HasPrefix(trimmed, "[") {
+			return json.RawMessage(trimmed)
+		}
+		switch fieldType.Elem().Kind() {
+		case reflect.Struct, reflect.Map, reflect.Slice:
+			// Objects have commas of their own, so can only be json, a single one is taken as a list of one
+			return json.RawMessage("[" + trimmed + "]")
+		}
+		items := []json.RawMessage{}
+		if len(trimmed) > 0 {
+			for _, item := range strings.Split(trimmed, ",") {
+				items = append(items, overrideJSON(fieldType.Elem(), strings.TrimSpace(item)))
+			}
+		}
+		list, _ := json.Marshal(items)
+		return list
+	}
+	if len(trimmed) == 0 {
+		return json.RawMessage(`""`) // Reported as the wrong type, rather than as broken json
+	}
+	return json.RawMessage(trimmed)
+}
+
+// flagName turns a json name into a flag name, such as httpPort to http-port and FTPPassivePorts to ftp-passive-ports
+func flagName(name string) string {
+	runes := []rune(name)
+	result := []rune{}
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			previousLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1])
+			if previousLower || nextLower {
+				result = append(result, '-')
+			}
+		}
+		result = append(result, unicode.ToLower(r))
+	}
+	return string(result)
+}
@@ -0,0 +1,304 @@
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Settings changed while running are applied with Update, which validates the change before using it
+// The running settings are never changed in place, Update swaps in a changed copy that is read through Current
+// Most settings are read as they are used, so take effect straight away. Subsystems that only read some settings at startup
+// subscribe to the fields they can re-apply while running. Any other changed startup fields are saved, but the running
+// settings keep the old values until a restart, so nothing sees a change that is only partly applied
+
+var ErrInvalidSettings = errors.New("invalid settings")
+
+// ChangeHandler re-applies changed settings to a running subsystem
+// old and updated are copies of the settings before and after the change, so the handler can read them without racing later updates
+type ChangeHandler func(old, updated *Settings) error
+
+type subscription struct {
+	name    string
+	fields  []string // json names of the fields the handler applies
+	handler ChangeHandler
+}
+
+type subscriptions struct {
+	sync.Mutex
+	list []subscription
+}
+
+// UpdateResult describes what a settings update changed, and what still needs a restart to be used
+type UpdateResult struct {
+	Changed         []string          `json:"changed"`          // json names of the changed fields
+	Applied         []string          `json:"applied"`          // Subsystems that were reconfigured
+	RestartRequired []string          `json:"restartRequired"`  // Changed fields that are only used after a restart
+	Errors          map[string]string `json:"errors,omitempty"` // Subsystems that failed to apply the change, and why
+}
+
+// restartFields are only read at startup, so changes need a restart unless a running subsystem subscribes to them
+var restartFields = []string{
+	"preferredLanguageOrder", "titlesDbUrls", "versionsDBURL", "cacheFolder",
+	"sourceFolders", "storageFolder", "storageFolders",
+	"tlsEnabled", "tlsCertFile", "tlsKeyFile", "httpPort",
+	"publicIP", "ftpPort", "FTPPassivePorts", "FTPHost", "ftpsMode", "ftpsCertFile", "ftpsKeyFile", "ftpForceTLS", "allowAnonFTP", "serverMOTD",
+	"workerThreadCount", "watchFolders", "watchDebounceSeconds", "revalidateEveryHours",
+	"logLevel", "logPath", "queueLength", "useIndexCache", "jobHistoryLength",
+}
+
+// Subscribe registers handler to be called after an Update changes any of the fields (by their json names)
+func (s *Settings) Subscribe(name string, fields []string, handler ChangeHandler) {
+	s.subscribers.Lock()
+	defer s.subscribers.Unlock()
+	s.subscribers.list = append(s.subscribers.list, subscription{name: name, fields: fields, handler: handler})
+}
+
+// Update applies a (partial) json settings document to the running settings
+// The result is validated before anything is changed, it is an ErrInvalidSettings if it can't be parsed or has invalid values
+// Problems with values are also ValidationErrors, listing each of them
+// Subscribers to the changed fields are told so they can reconfigure, and the changes are saved
+func (s *Settings) Update(reader io.Reader) (UpdateResult, error) {
+	result := UpdateResult{Changed: []string{}, Applied: []string{}, RestartRequired: []string{}}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return result, err
+	}
+	// One update at a time, so each is worked out from the settings the last one left and subscribers see them in order
+	s.updateLock.Lock()
+	defer s.updateLock.Unlock()
+	s.authLock.RLock()
+	old, err := s.running()
+	var configured, updated *Settings
+	if err == nil {
+		configured, err = s.configured()
+	}
+	if err == nil {
+		updated, err = s.configured()
+	}
+	s.authLock.RUnlock()
+	if err != nil {
+		return result, err
+	}
+	// Users are decoded fresh rather than over the current ones, so secrets left out can be told apart and kept
+	if fields := map[string]json.RawMessage{}; json.Unmarshal(data, &fields) == nil && fields["users"] != nil {
+		updated.Users = nil
+	}
+	if err := json.Unmarshal(data, updated); err != nil {
+		return result, parseError(data, err)
+	}
+	updated.cleanPaths()
+	updated.keepUserSecrets(configured)
+	updated.hashPlaintextPasswords()
+
+	result.Changed = changedFields(configured, updated)
+	if len(result.Changed) == 0 {
+		return result, nil
+	}
+	// Only the folders and ports being changed are checked, as the running servers are using the current ports
+	if problems := updated.validate(result.Changed); problems != nil {
+		return result, fmt.Errorf("%w: %w", ErrInvalidSettings, problems)
+	}
+	log.Info().Strs("fields", result.Changed).Msg("Settings updated")
+
+	s.subscribers.Lock()
+	subscribers := slices.DeleteFunc(slices.Clone(s.subscribers.list), func(sub subscription) bool {
+		return !slices.ContainsFunc(sub.fields, func(field string) bool { return slices.Contains(result.Changed, field) })
+	})
+	s.subscribers.Unlock()
+	subscribed := []string{}
+	for _, sub := range subscribers {
+		subscribed = append(subscribed, sub.fields...)
+	}
+	// Startup fields are only used now if a subscriber re-applies them, this includes any changed earlier and not in use yet
+	applied := []string{}
+	s.authLock.Lock()
+	for _, field := range result.Changed {
+		if !slices.Contains(restartFields, field) || slices.Contains(subscribed, field) {
+			applied = append(applied, field)
+		}
+	}
+	for field := range s.pending {
+		if slices.Contains(subscribed, field) && !slices.Contains(applied, field) {
+			applied = append(applied, field)
+		}
+	}
+	err = s.apply(updated, applied)
+	s.authLock.Unlock()
+	if err != nil {
+		return result, err
+	}
+
+	handled := []string{}
+	failed := []string{}
+	for _, sub := range subscribers {
+		if err := sub.handler(old, updated); err != nil {
+			log.Warn().Err(err).Str("subsystem", sub.name).Msg("Couldn't apply settings change")
+			if result.Errors == nil {
+				result.Errors = make(map[string]string)
+			}
+			result.Errors[sub.name] = err.Error()
+			failed = append(failed, sub.fields...)
+			continue
+		}
+		result.Applied = append(result.Applied, sub.name)
+		handled = append(handled, sub.fields...)
+	}
+	// The running settings go back to what the subsystems that couldn't apply the change are still using
+	reverted := slices.DeleteFunc(slices.Clone(applied), func(field string) bool {
+		return !slices.Contains(restartFields, field) || !slices.Contains(failed, field) || slices.Contains(handled, field)
+	})
+
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	if len(reverted) > 0 {
+		if err := s.apply(old, reverted); err != nil {
+			return result, err
+		}
+	}
+	for _, field := range slices.Concat(result.Changed, applied) {
+		if slices.Contains(applied, field) && !slices.Contains(reverted, field) {
+			delete(s.pending, field)
+		} else if err := s.setPending(field, updated); err != nil {
+			return result, err
+		}
+	}
+	s.Save()
+
+	for _, field := range result.Changed {
+		if slices.Contains(restartFields, field) && !slices.Contains(handled, field) {
+			result.RestartRequired = append(result.RestartRequired, field)
+		}
+	}
+	if len(result.RestartRequired) > 0 {
+		log.Warn().Strs("fields", result.RestartRequired).Msg("Settings changes will be used after a restart")
+	}
+	return result, nil
+}
+
+// Current returns the running settings
+// Update never changes these in place, it swaps in a changed copy, so what is returned can be read without locking
+// Settings that can change while running are read through this, rather than from the Settings loaded at startup
+// The users are left out of the copies, they are read and changed through the methods for them
+func (s *Settings) Current() *Settings {
+	if live := s.live.Load(); live != nil {
+		return live
+	}
+	return s
+}
+
+// apply swaps in running settings with the fields named (by their json names) taken from other
+// Must be called with authLock held for writing
+func (s *Settings) apply(other *Settings, names []string) error {
+	live, err := s.running()
+	if err != nil {
+		return err
+	}
+	live.copyFields(other, names)
+	if slices.Contains(names, "users") {
+		s.Users = live.Users
+	}
+	live.Users = nil
+	s.live.Store(live)
+	return nil
+}
+
+// setPending records a changed startup field to be saved, it is only used after a restart
+// Must be called with authLock held for writing
+func (s *Settings) setPending(name string, other *Settings) error {
+	field, _ := other.fieldByName(name)
+	value, err := json.Marshal(field.Interface())
+	if err != nil {
+		return err
+	}
+	running, _ := s.Current().fieldByName(name)
+	if current, err := json.Marshal(running.Interface()); err == nil && bytes.Equal(current, value) {
+		delete(s.pending, name) // Changed back to what is in use
+		return nil
+	}
+	if s.pending == nil {
+		s.pending = make(map[string]json.RawMessage)
+	}
+	s.pending[name] = value
+	return nil
+}
+
+// running returns a detached copy of the running settings, along with the users
+// Must be called with authLock held
+func (s *Settings) running() (*Settings, error) {
+	data, err := json.Marshal(s.Current())
+	if err != nil {
+		return nil, err
+	}
+	copied := &Settings{filePath: s.filePath}
+	if err := json.Unmarshal(data, copied); err != nil {
+		return nil, err
+	}
+	users, err := json.Marshal(s.Users)
+	if err != nil {
+		return nil, err
+	}
+	copied.Users = nil
+	if err := json.Unmarshal(users, &copied.Users); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// configured returns a detached copy of the settings as they are set, the running settings along with startup fields changed but not in use yet
+// Must be called with authLock held
+func (s *Settings) configured() (*Settings, error) {
+	copied, err := s.running()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range s.pending {
+		if err := copied.setFieldJSON(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return copied, nil
+}
+
+// copyFields overwrites the fields named (by their json names) with those from other
+// Only for settings that are not shared yet
+func (s *Settings) copyFields(other *Settings, names []string) {
+	dst := reflect.ValueOf(s).Elem()
+	src := reflect.ValueOf(other).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if name, ok := jsonFieldName(dst.Type().Field(i)); ok && slices.Contains(names, name) {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// changedFields returns the json names of the fields that differ between the two settings
+func changedFields(a, b *Settings) []string {
+	changed := []string{}
+	aValue := reflect.ValueOf(a).Elem()
+	bValue := reflect.ValueOf(b).Elem()
+	for i := 0; i < aValue.NumField(); i++ {
+		name, ok := jsonFieldName(aValue.Type().Field(i))
+		if ok && !reflect.DeepEqual(aValue.Field(i).Interface(), bValue.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// jsonFieldName returns the name of the field in the settings file, false if it is not saved
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if !field.IsExported() || name == "" || name == "-" {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,123 @@
+package settings
+
+import (
+	"embed"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+)
+
+// The JSON Schema is made from the settings structs, so editors can check and autocomplete the settings file
+// Descriptions are taken from the comments on each field, read from the source embedded here
+
+//go:embed settings.go auth.go
+var settingsSource embed.FS
+
+// JSONSchema returns a JSON Schema (draft 7) describing the settings file
+func JSONSchema() ([]byte, error) {
+	comments, err := fieldComments()
+	if err != nil {
+		return nil, err
+	}
+	schema := schemaFor(reflect.TypeOf(Settings{}), comments)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "switchhost settings"
+
+	// Fill in the defaults, other than the demo account
+	data, err := json.Marshal(defaultSettings(""))
+	if err != nil {
+		return nil, err
+	}
+	defaults := map[string]interface{}{}
+	if err := json.Unmarshal(data, &defaults); err != nil {
+		return nil, err
+	}
+	for name, property := range schema["properties"].(map[string]interface{}) {
+		if value, ok := defaults[name]; ok && name != "users" {
+			property.(map[string]interface{})["default"] = value
+		}
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+func schemaFor(typ reflect.Type, comments map[string]map[string]string) map[string]interface{} {
+	switch typ.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaFor(typ.Elem(), comments)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(typ.Elem(), comments)}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name, ok := jsonFieldName(field)
+			if !ok {
+				continue
+			}
+			property := schemaFor(field.Type, comments)
+			if description := comments[typ.Name()][field.Name]; description != "" {
+				property["description"] = description
+			}
+			if values, ok := enumValues[name]; ok && typ == reflect.TypeOf(Settings{}) {
+				property["enum"] = values
+			}
+			properties[name] = property
+		}
+		return map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+	}
+	return map[string]interface{}{}
+}
+
+// fieldComments returns the comment on each struct field in the settings source, by type name then field name
+func fieldComments() (map[string]map[string]string, error) {
+	comments := map[string]map[string]string{}
+	files, err := settingsSource.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+	fileSet := token.NewFileSet()
+	for _, file := range files {
+		source, err := settingsSource.ReadFile(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parser.ParseFile(fileSet, file.Name(), source, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		ast.Inspect(parsed, func(node ast.Node) bool {
+			spec, ok := node.(*ast.TypeSpec)
+			if !ok {
+				return true
+			}
+			structType, ok := spec.Type.(*ast.StructType)
+			if !ok {
+				return false
+			}
+			fields := map[string]string{}
+			for _, field := range structType.Fields.List {
+				comment := field.Comment
+				if comment == nil {
+					comment = field.Doc
+				}
+				for _, name := range field.Names {
+					fields[name.Name] = strings.TrimSpace(comment.Text())
+				}
+			}
+			comments[spec.Name.Name] = fields
+			return false
+		})
+	}
+	return comments, nil
+}
@@ -1,24 +1,64 @@
 package settings
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	stdlog "log"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// Policies for picking which storage root a file is sorted into
+const (
+	StoragePlacementSameDisk      = "sameDisk"      // Keep files with the rest of their title, new titles go to the root with the most free space
+	StoragePlacementMostFree      = "mostFree"      // The root with the most free space
+	StoragePlacementFirstWithRoom = "firstWithRoom" // The first root in the list with room for the file
+)
+
+// When the shop index is sent in the Tinfoil format rather than plain json
+const (
+	TinfoilIndexNever   = "never"
+	TinfoilIndexAlways  = "always"
+	TinfoilIndexTinfoil = "tinfoil" // Only when the client's User-Agent is Tinfoil
+)
+
+// How FTP is secured with TLS (FTPS)
+const (
+	FTPSOff      = "off"
+	FTPSExplicit = "explicit" // Clients upgrade the connection with AUTH TLS
+	FTPSImplicit = "implicit" // The connection is TLS from the start
+)
+
 type AuthUser struct {
-	Username      string `json:"username"`      // User username for authentication
-	Password      string `json:"password"`      // User password for authentication
-	AllowFTP      bool   `json:"allowFTP"`      // Can user use the ftp server
-	AllowHTTP     bool   `json:"allowHTTP"`     // Can user use the http server
-	AllowUpload   bool   `json:"allowUpload"`   // Can user upload new files
-	AllowSettings bool   `json:"allowSettings"` // Can user edit settings
+	Username      string          `json:"username"`           // User username for authentication
+	Password      string          `json:"password,omitempty"` // Plaintext password, hashed into passwordHash and removed when the settings are loaded
+	PasswordHash  string          `json:"passwordHash"`       // bcrypt hash of the user password for authentication
+	Tokens        []DownloadToken `json:"tokens"`             // Revocable download tokens, used in URLs instead of the password
+	AllowFTP      bool            `json:"allowFTP"`           // Can user use the ftp server
+	AllowHTTP     bool            `json:"allowHTTP"`          // Can user use the http server
+	AllowUpload   bool            `json:"allowUpload"`        // Can user upload new files
+	AllowSettings bool            `json:"allowSettings"`      // Can user edit settings
+	RateLimitKBps int             `json:"rateLimitKBps"`      // Download speed limit for the user, 0 uses userRateLimitKBps, -1 for no limit
+	MaxTransfers  int             `json:"maxTransfers"`       // Downloads the user can run at once, 0 uses userMaxTransfers, -1 for no limit
+	Allow         []AccessRule    `json:"allow"`              // If set, the user can only see titles matching one of these rules
+	Deny          []AccessRule    `json:"deny"`               // Titles matching any of these are hidden from the user, even if allowed
+}
+
+// AccessRule matches files by title, every field that is set must match
+type AccessRule struct {
+	TitleID   string `json:"titleID,omitempty"`   // Hex TitleID of the exact title, update or DLC
+	BaseTitle string `json:"baseTitle,omitempty"` // Hex TitleID of a base title, matching it along with its updates and DLC
+	Type      string `json:"type,omitempty"`      // Content type, "base", "update" or "dlc"
+	Tag       string `json:"tag,omitempty"`       // A tag from titleTags
 }
 
 type Settings struct {
@@ -30,90 +70,204 @@ type Settings struct {
 	FoldersToScan      []string `json:"sourceFolders"`          // Folders to look for new files in
 	CacheFolder        string   `json:"cacheFolder"`            // Folder to cache downloads and other temp files, if preserved will avoid re-downloads. Can be /tmp/ though
 	// Organisation
-	StorageFolder       string `json:"storageFolder"`       // Where sorted files are stored to
-	OrganisationFormat  string `json:"organisationFormat"`  // Organisation format string
-	EnableSorting       bool   `json:"enableSorting"`       // If sorting should be performed
-	CleanupEmptyFolders bool   `json:"cleanupEmptyFolders"` // Should we cleanup empty folders in the search and storage paths
+	StorageFolder       string   `json:"storageFolder"`       // Where sorted files are stored to
+	StorageFolders      []string `json:"storageFolders"`      // Extra storage roots, the library spans storageFolder and all of these
+	StoragePlacement    string   `json:"storagePlacement"`    // How the storage root for a file is picked, one of the StoragePlacement* values
+	StorageReserveMB    int      `json:"storageReserveMB"`    // Free space to leave on each storage root when placing files
+	OrganisationFormat  string   `json:"organisationFormat"`  // Organisation format string
+	EnableSorting       bool     `json:"enableSorting"`       // If sorting should be performed
+	CleanupEmptyFolders bool     `json:"cleanupEmptyFolders"` // Should we cleanup empty folders in the search and storage paths
 
 	Deduplicate      bool `json:"deduplicate"`      // If we remove duplicate files for the same titleID, or old update files
 	PreferXCI        bool `json:"preferXCI"`        // If when we find duplicates we pick the xci/xcz file over nsp/nsz
 	PreferCompressed bool `json:"preferCompressed"` // Prefer compressed form of files on duplicate
+	DryRun           bool `json:"dryRun"`           // Files already in the scan folders are not moved or deleted by sorting and deduplication, the changes are planned instead
 
 	//Serving files
 	HTTPSRewriteDomain string     `json:"httpsRewriteDomain"` // If this domain is used for HTTP, use HTTPS in response
+	TLSEnabled         bool       `json:"tlsEnabled"`         // Serve HTTPS rather than HTTP on httpPort
+	TLSCertFile        string     `json:"tlsCertFile"`        // PEM certificate (chain) for TLS, if this and tlsKeyFile are empty a self-signed one is made in the cacheFolder
+	TLSKeyFile         string     `json:"tlsKeyFile"`         // PEM private key for tlsCertFile
 	PublicIP           string     `json:"publicIP"`           // Public IP, required for FTP
 	HTTPPort           int        `json:"httpPort"`           // Port used for HTTP
 	FTPPort            int        `json:"ftpPort"`            // Port used for FTP
 	FTPPassivePorts    string     `json:"FTPPassivePorts"`    // Passive port range for FTP
 	FTPHost            string     `json:"FTPHost"`            //
+	FTPSMode           string     `json:"ftpsMode"`           // FTPS for the FTP server, one of the FTPS* values
+	FTPSCertFile       string     `json:"ftpsCertFile"`       // PEM certificate for FTPS, if this and ftpsKeyFile are empty the HTTP TLS certificate is shared
+	FTPSKeyFile        string     `json:"ftpsKeyFile"`        // PEM private key for ftpsCertFile
+	FTPForceTLS        bool       `json:"ftpForceTLS"`        // Users logging in with a password must use FTPS, anonymous access can still be plaintext
 	AllowAnonFTP       bool       `json:"allowAnonFTP"`       // Allow anon (open to public) FTP
 	AllowAnonHTTP      bool       `json:"allowAnonHTTP"`      // Allow anon (open to public) HTTP
 	Users              []AuthUser `json:"users"`              // User accounts
 	JSONLocations      []string   `json:"jsonLocations"`      // Extra locations to add to locations field in json for backup instances
 	ServerMOTD         string     `json:"serverMOTD"`         // Server title used for public facing info
+	ShopAllVersions    bool       `json:"shopAllVersions"`    // List every stored version of updates and DLC in the shop json, rather than just the newest
+	ShopNSZAsNSP       bool       `json:"shopNSZAsNSP"`       // List NSZ files as the NSP they expand to in the shop json, for installers that can't handle NSZ
+	TinfoilIndexMode   string     `json:"tinfoilIndexMode"`   // When index.json is sent in the Tinfoil format, one of the TinfoilIndex* values
+	TinfoilCompression string     `json:"tinfoilCompression"` // Compression used for the Tinfoil format index: "zstd", "zlib" or "none"
+	TinfoilPublicKey   string     `json:"tinfoilPublicKey"`   // Path to the PEM RSA public key the Tinfoil format index is encrypted for, if empty it is not encrypted
+
+	// Access control
+	TitleTags map[string][]string `json:"titleTags"` // Named groups of hex TitleIDs for user access rules, base TitleIDs include their updates and DLC
+
+	// Transfer limits, 0 for no limit
+	RateLimitKBps     int `json:"rateLimitKBps"`     // Total download speed over HTTP and FTP
+	UserRateLimitKBps int `json:"userRateLimitKBps"` // Download speed of each user, or each client for anonymous access
+	MaxTransfers      int `json:"maxTransfers"`      // Total downloads running at once
+	UserMaxTransfers  int `json:"userMaxTransfers"`  // Downloads running at once for each user, or each client for anonymous access
+
+	// Prometheus metrics on /metrics
+	MetricsEnabled  bool   `json:"metricsEnabled"`  // Serve the metrics endpoint
+	MetricsUsername string `json:"metricsUsername"` // If set, scrapes must use this basic auth login instead of a user account
+	MetricsPassword string `json:"metricsPassword"` // Password for metricsUsername
 
 	// Incoming
-	UploadingAllowed bool   `json:"uploadingAllowed"`  // Can FTP be used to push new files
-	TempFilesFolder  string `json:"tempFilesFolder"`   // Temporary file storage location for FTP uploads
-	OpTheadCounts    int    `json:"workerThreadCount"` // Optional thread count override
+	UploadingAllowed     bool   `json:"uploadingAllowed"`     // Can FTP or HTTP be used to push new files
+	TempFilesFolder      string `json:"tempFilesFolder"`      // Temporary file storage location for uploads
+	OpTheadCounts        int    `json:"workerThreadCount"`    // Optional thread count override
+	WatchFolders         bool   `json:"watchFolders"`         // Watch the source and storage folders for changes while running
+	WatchDebounceSeconds int    `json:"watchDebounceSeconds"` // How long a file must go without changes before a watched file is scanned
 	// File validation
-	ValidateLibrary         bool `json:"validateLibrary"`       // If all files found in the main library location are validated for checksums
-	ValidateNewFiles        bool `json:"validateUploads"`       // If uploads must validate before being added, even if above toggles are off
-	ValidateCompressedFiles bool `json:"validateCompressed"`    // If files are re-validated after compression
-	DeleteValidationFails   bool `json:"deleteValidationFails"` // If a file fails validation, should it be deleted
+	ValidateLibrary         bool   `json:"validateLibrary"`       // If all files found in the main library location are validated for checksums
+	ValidateNewFiles        bool   `json:"validateUploads"`       // If uploads must validate before being added, even if above toggles are off
+	ValidateCompressedFiles bool   `json:"validateCompressed"`    // If files are re-validated after compression
+	DeleteValidationFails   bool   `json:"deleteValidationFails"` // If a file fails validation, should it be deleted
+	QuarantineFolder        string `json:"quarantineFolder"`      // If set, files failing parsing or validation are moved here instead of being deleted or left in place
+	RevalidateEveryHours    int    `json:"revalidateEveryHours"`  // Hours between background re-validation runs over the library, 0 turns it off
+	RevalidateMaxFiles      int    `json:"revalidateMaxFiles"`    // Max files checked per re-validation run, 0 for no limit
+	RevalidateMaxGB         int    `json:"revalidateMaxGB"`       // Max GB read per re-validation run, 0 for no limit
+	RevalidateMinAgeDays    int    `json:"revalidateMinAgeDays"`  // Files checked more recently than this are skipped by re-validation runs
 
 	// Compression
-	NSZCommandLine         string `json:"NSZCommandLine"`         // Base command line used to run NSZ
 	CompressionEnabled     bool   `json:"compressionEnabled"`     // Should files be converted to their compressed verions
 	CompressionTimeoutMins uint32 `json:"compressionTimeoutMins"` // How many mins compression can take max
+	CompressionLevel       int    `json:"compressionLevel"`       // zstd level used for compression (1-22), same as nsz
+	CompressionBlockBits   int    `json:"compressionBlockBits"`   // Compression blocks are 2^bits bytes (14-24)
 
 	// Misc
-	LogLevel    int    `json:"logLevel"`    // Log level, higher numbers reduce log output
-	LogFilePath string `json:"logPath"`     // Path to persist logs to, if empty none are persisted
-	QueueLength int    `json:"queueLength"` // How deep our internal queues are
+	LogLevel         int    `json:"logLevel"`         // Log level, higher numbers reduce log output
+	LogFilePath      string `json:"logPath"`          // Path to persist logs to, if empty none are persisted
+	QueueLength      int    `json:"queueLength"`      // How deep our internal queues are
+	UseIndexCache    bool   `json:"useIndexCache"`    // Persist the file index to the cache folder so unchanged files are not re-parsed at startup
+	JobHistoryLength int    `json:"jobHistoryLength"` // How many ingest jobs are remembered for the jobs API
 	// Private
-	filePath string
-	logFile  *os.File
+	filePath      string
+	logFile       *os.File
+	logOutput     io.Writer    // Console output from SetupLogging, kept for reloading the logging
+	authLock      sync.RWMutex // Held while reading or changing users and folders
+	authCacheLock sync.Mutex
+	authCache     map[string]authCacheEntry
+	subscribers   subscriptions              // Told about settings changes made by Update
+	updateLock    sync.Mutex                 // Held for the whole of an Update
+	live          atomic.Pointer[Settings]   // Running settings swapped in by Update, see Current
+	pending       map[string]json.RawMessage // Startup fields changed by Update, by json name. Saved, but only used after a restart. Guarded by authLock
+	overrides     map[string]overriddenValue // Settings overridden from the environment or command line, by json name. Only set at startup
 }
 
 // NewSettings creates settings with sane defaults
 // And then loads any settings from the provided path (overwriting defaults)
+// If the file can't be parsed the problem is logged, and the file is left alone so it can be fixed
 func NewSettings(path string) *Settings {
+	settings, err := OpenSettings(path)
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Settings file couldn't be loaded, it won't be saved over until fixed")
+	}
+	return settings
+}
+
+// OpenSettings is NewSettings, returning an error rather than carrying on if the settings file can't be parsed
+func OpenSettings(path string) (*Settings, error) {
+	settings, err := ReadSettings(path)
+	if err == nil {
+		// Save to preserve if we have added anything to the file, and drop no-longer used settings for clarity
+		settings.Save()
+		log.Info().Msg("Settings loaded, merged and saved")
+	}
+	settings.Subscribe("logging", []string{"logLevel", "logPath"}, settings.reloadLogging)
+	return settings, err
+}
+
+// ReadSettings loads the settings file over the defaults, without saving anything back
+// A missing file is not an error, the defaults are used
+func ReadSettings(path string) (*Settings, error) {
+	settings := defaultSettings(path)
+	// Load the settings file if it exsts, which will override the defaults if specified
+	err := settings.Load()
+	// Clean up paths
+	settings.cleanPaths()
+	return settings, err
+}
 
-	settings := &Settings{
+func defaultSettings(path string) *Settings {
+	return &Settings{
 		OpTheadCounts:          -1, // No thread count override
 		filePath:               path,
 		PreferredLangOrder:     []int{1, 0},
 		FoldersToScan:          []string{"./incoming_files"},                                         // Search locations
 		JSONLocations:          []string{},                                                           // Locations in the json to point to backup instances
 		StorageFolder:          "./game_library",                                                     // Storage location
+		StorageFolders:         []string{},                                                           // No extra storage roots
+		StoragePlacement:       StoragePlacementSameDisk,                                             // Keep titles together
+		StorageReserveMB:       1024,                                                                 // Leave some room on each disk
 		CacheFolder:            "/tmp/",                                                              // Where to cache downloaded files to (titledb)
 		EnableSorting:          false,                                                                // default "safe"
 		CleanupEmptyFolders:    true,                                                                 // Relatively safe
 		HTTPPort:               8080,                                                                 // Ports
+		TLSEnabled:             false,                                                                // Plain HTTP, as most installers can't check certificates
+		TLSCertFile:            "",                                                                   // Self-signed if TLS is turned on
+		TLSKeyFile:             "",                                                                   // Self-signed if TLS is turned on
 		FTPPort:                2121,                                                                 // Ports
 		FTPPassivePorts:        "2130-2140",                                                          // FTP Passive ports
 		FTPHost:                "::",                                                                 // Default to all ftp hosts
+		FTPSMode:               FTPSOff,                                                              // Plain FTP, as most installers don't support FTPS
+		FTPSCertFile:           "",                                                                   // Share the HTTP certificate
+		FTPSKeyFile:            "",                                                                   // Share the HTTP certificate
+		FTPForceTLS:            false,                                                                // Only useful once FTPS is on
 		PublicIP:               "",                                                                   // Default to not set
 		ServerMOTD:             "Switchroot",                                                         // MOTD to include in the json file
+		TitleTags:              map[string][]string{},                                                // No tags until made
+		RateLimitKBps:          0,                                                                    // Unlimited
+		UserRateLimitKBps:      0,                                                                    // Unlimited
+		MaxTransfers:           0,                                                                    // Unlimited
+		UserMaxTransfers:       0,                                                                    // Unlimited
+		MetricsEnabled:         true,                                                                 // Behind the normal auth by default
+		MetricsUsername:        "",                                                                   // Use the normal auth
+		MetricsPassword:        "",                                                                   // Use the normal auth
+		ShopAllVersions:        false,                                                                // Most clients only want the newest files
+		ShopNSZAsNSP:           false,                                                                // Most clients can install NSZ
+		TinfoilIndexMode:       TinfoilIndexNever,                                                    // Plain json unless asked for
+		TinfoilCompression:     "zstd",                                                               // Smallest, and supported by Tinfoil
+		TinfoilPublicKey:       "",                                                                   // No encryption
 		LogLevel:               1,                                                                    // Info
 		LogFilePath:            "",                                                                   // No log file
 		OrganisationFormat:     "{TitleName}/{TitleName} {Type} {VersionDec} [{TitleID}][{Version}]", // Path used for organising files
-		NSZCommandLine:         "nsz --verify -w -C -p -t 4 --rm-source ",                            // NSZ command used for file compression
-		CompressionEnabled:     false,                                                                // Should files be compressed using NSZ
+		CompressionEnabled:     false,                                                                // Should files be compressed to NSZ/XCZ
+		CompressionLevel:       18,                                                                   // Same default as nsz
+		CompressionBlockBits:   20,                                                                   // 1MB blocks, same default as nsz
 		PreferCompressed:       true,                                                                 // Should compressed files be preferred over non-compressed on duplicate
 		PreferXCI:              false,                                                                // Should XCI files be preferred over nsp on duplicate
 		UploadingAllowed:       false,                                                                // Should FTP allow file uploads
+		WatchFolders:           true,                                                                 // Pick up new and removed files while running
+		WatchDebounceSeconds:   10,                                                                   // Long enough for most copies to show progress
 		Deduplicate:            false,                                                                // Should the software delete duplicate files
+		DryRun:                 false,                                                                // Plan sorting and deduplication changes rather than doing them
 		AllowAnonFTP:           false,                                                                // Should anon users be allowed FTP access
 		AllowAnonHTTP:          false,                                                                // Should anon users be allowed HTTP access
 		DeleteValidationFails:  false,                                                                //
+		QuarantineFolder:       "",                                                                   // Off by default, as it moves files
+		RevalidateEveryHours:   0,                                                                    // Off by default, as it is heavy on the disks
+		RevalidateMaxFiles:     50,                                                                   // About a nights worth
+		RevalidateMaxGB:        100,                                                                  // About a nights worth
+		RevalidateMinAgeDays:   30,                                                                   // Roughly monthly
 		logFile:                nil,                                                                  // Optional path to a file to log to
 		TempFilesFolder:        "/tmp",                                                               // Temp files location used for staging FTP uploads
 		ValidateLibrary:        false,                                                                // Should all existing library files be validated
 		ValidateNewFiles:       true,                                                                 // Should "new" files be validated (upload + not library)
 		QueueLength:            128,                                                                  // Default to a medium sized queue. Large values are good for speed but consume ram
 		CompressionTimeoutMins: 60,                                                                   // We are super conservative incase of user with slow pc
+		UseIndexCache:          true,                                                                 // Cache is advisory, so safe to have on
+		JobHistoryLength:       1024,                                                                 // Enough to follow a batch of uploads, without holding the whole library scan
 		//Add a demo account
 		Users: []AuthUser{
 			{
@@ -131,34 +285,25 @@ func NewSettings(path string) *Settings {
 		},
 		VersionsDBURL: "https://raw.githubusercontent.com/blawar/titledb/master/versions.json",
 	}
-	// Load the settings file if it exsts, which will override the defaults above if specified
-	settings.Load()
-	// Clean up paths
-	settings.cleanPaths()
-	// Save to preserve if we have added anything to the file, and drop no-longer used settings for clarity
-	settings.Save()
-	log.Info().Msg("Settings loaded, merged and saved")
-	return settings
-}
-func (s *Settings) LoadFrom(reader io.Reader) {
-	data, err := io.ReadAll(reader)
-	if err != nil {
-		return
-	}
-	if err := json.Unmarshal(data, s); err != nil {
-		log.Warn().Err(err).Msg("Couldn't load settings")
-	}
 }
-func (s *Settings) Load() {
-	//Load existing settings file if possible; if not load do nothing
+
+// Load reads the settings file over the current settings, it is not an error if the file does not exist
+func (s *Settings) Load() error {
 	log.Info().Str("path", s.filePath).Msg("Loading settings")
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
 	data, err := os.ReadFile(s.filePath)
-	if err != nil {
-		return
+	if os.IsNotExist(err) || (err == nil && len(bytes.TrimSpace(data)) == 0) {
+		return nil // Nothing saved yet
+	} else if err != nil {
+		return err
 	}
 	if err := json.Unmarshal(data, s); err != nil {
-		log.Warn().Err(err).Msg("Couldn't load settings")
+		return parseError(data, err)
 	}
+	// Plaintext passwords are never kept, the hashes are saved back by NewSettings
+	s.hashPlaintextPasswords()
+	return nil
 }
 func (s *Settings) SaveTo(wr io.Writer) error {
 	data, err := json.MarshalIndent(s, "", "  ")
@@ -171,8 +316,53 @@ func (s *Settings) SaveTo(wr io.Writer) error {
 	}
 	return nil
 }
+
+// SaveRedactedTo writes the settings as SaveTo does, but without the secrets: password hashes, download tokens and the metrics password
+// Settings posted back to Update without these keep the current values
+// Startup fields changed but not in use until a restart are listed as they are set
+func (s *Settings) SaveRedactedTo(wr io.Writer) error {
+	s.authLock.RLock()
+	configured, err := s.configured()
+	s.authLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(configured)
+	if err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	delete(fields, "metricsPassword")
+	users := []map[string]json.RawMessage{}
+	if err := json.Unmarshal(fields["users"], &users); err != nil {
+		return err
+	}
+	for _, user := range users {
+		delete(user, "password")
+		delete(user, "passwordHash")
+		delete(user, "tokens")
+	}
+	if fields["users"], err = json.Marshal(users); err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = wr.Write(data)
+	return err
+}
+
 func (s *Settings) Save() {
-	data, err := json.MarshalIndent(s, "", "  ")
+	saved, err := s.fileSettings()
+	if err != nil {
+		log.Warn().Err(err).Msg("Couldn't save settings - removing overrides")
+		return
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
 	if err != nil {
 		log.Warn().Err(err).Msg("Couldn't save settings - JSONification")
 		return
@@ -182,10 +372,30 @@ func (s *Settings) Save() {
 	}
 }
 
-func (s *Settings) GetAllScanFolders() []string {
+// GetStorageFolders returns all of the storage roots the library is spread across, the main storage folder first
+func (s *Settings) GetStorageFolders() []string {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	return s.Current().storageFolders()
+}
+
+func (s *Settings) storageFolders() []string {
 	res := []string{s.StorageFolder}
-	for _, folder := range s.FoldersToScan {
-		if folder != s.StorageFolder {
+	for _, folder := range s.StorageFolders {
+		if len(folder) > 0 && !slices.Contains(res, folder) {
+			res = append(res, folder)
+		}
+	}
+	return res
+}
+
+func (s *Settings) GetAllScanFolders() []string {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	current := s.Current()
+	res := current.storageFolders()
+	for _, folder := range current.FoldersToScan {
+		if !slices.Contains(res, folder) {
 			res = append(res, folder)
 		}
 	}
@@ -193,8 +403,12 @@ func (s *Settings) GetAllScanFolders() []string {
 }
 
 func (s *Settings) SetupLogging(logoutput io.Writer) {
+	s.setupLogging(logoutput, s.LogLevel, s.LogFilePath)
+}
+
+func (s *Settings) setupLogging(logoutput io.Writer, level int, logFilePath string) {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	zerolog.SetGlobalLevel(zerolog.Level(s.LogLevel))
+	zerolog.SetGlobalLevel(zerolog.Level(level))
 
 	consoleWriter := zerolog.ConsoleWriter{
 		Out:        logoutput,
@@ -203,12 +417,17 @@ func (s *Settings) SetupLogging(logoutput io.Writer) {
 
 	stdlog.SetOutput(consoleWriter)
 	log.Logger = log.Output(consoleWriter)
+	s.logOutput = logoutput
+	if s.logFile != nil {
+		s.logFile.Close()
+		s.logFile = nil
+	}
 
-	if len(s.LogFilePath) > 0 {
+	if len(logFilePath) > 0 {
 		//Setup a mirror of the log to the specified file
-		logfile, err := os.OpenFile(s.LogFilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		logfile, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
 		if err != nil {
-			log.Warn().Str("file", s.LogFilePath).Err(err).Msg("Couldn't open log file for writing")
+			log.Warn().Str("file", logFilePath).Err(err).Msg("Couldn't open log file for writing")
 			return
 		}
 		s.logFile = logfile
@@ -222,11 +441,32 @@ func (s *Settings) SetupLogging(logoutput io.Writer) {
 	}
 }
 
+// reloadLogging applies a changed log level or log file
+func (s *Settings) reloadLogging(old, updated *Settings) error {
+	if s.logOutput == nil {
+		zerolog.SetGlobalLevel(zerolog.Level(updated.LogLevel)) // Logging not setup yet, it will pick up the rest
+		return nil
+	}
+	s.setupLogging(s.logOutput, updated.LogLevel, updated.LogFilePath)
+	if len(updated.LogFilePath) > 0 && s.logFile == nil {
+		return fmt.Errorf("couldn't open log file %s", updated.LogFilePath)
+	}
+	return nil
+}
+
 func (s *Settings) cleanPaths() {
 	//Since users may make mistakes and start or end the paths with a string, clean all of these up
 	s.TempFilesFolder = strings.TrimSpace(s.TempFilesFolder)
 	s.StorageFolder = strings.TrimSpace(s.StorageFolder)
+	for i, v := range s.StorageFolders {
+		s.StorageFolders[i] = strings.TrimSpace(v)
+	}
 	s.CacheFolder = strings.TrimSpace(s.CacheFolder)
+	s.QuarantineFolder = strings.TrimSpace(s.QuarantineFolder)
+	s.TLSCertFile = strings.TrimSpace(s.TLSCertFile)
+	s.TLSKeyFile = strings.TrimSpace(s.TLSKeyFile)
+	s.FTPSCertFile = strings.TrimSpace(s.FTPSCertFile)
+	s.FTPSKeyFile = strings.TrimSpace(s.FTPSKeyFile)
 	for i, v := range s.FoldersToScan {
 		s.FoldersToScan[i] = strings.TrimSpace(v)
 	}
@@ -1,7 +1,13 @@
 package settings_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
 	"os"
+	"path"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -23,19 +29,372 @@ func TestNewSettings(t *testing.T) {
 
 }
 
-func TestLoadFrom(t *testing.T) {
+func TestLoad(t *testing.T) {
 	//Test that settings will init
 	tempFile, err := os.CreateTemp("", "settings_test_*")
 	if err != nil {
 		t.Error(err)
 	}
 	defer os.Remove(tempFile.Name())
-	newSettings := settings.NewSettings(tempFile.Name())
 	demoStr := "{\"cacheFolder\":\"testessetsteset\"}"
-	reader := strings.NewReader(demoStr)
-	newSettings.LoadFrom(reader)
+	_, _ = tempFile.WriteString(demoStr)
+	tempFile.Close()
+	newSettings := settings.NewSettings(tempFile.Name())
 	if newSettings.CacheFolder != "testessetsteset" {
 		t.Error("Should setup cache folder as demo overwrite")
 	}
 
 }
+
+func TestPasswordsHashedOnLoad(t *testing.T) {
+	tempFile, err := os.CreateTemp("", "settings_test_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, _ = tempFile.WriteString(`{"users":[{"username":"test","password":"testPass","allowHTTP":true}]}`)
+	tempFile.Close()
+
+	newSettings := settings.NewSettings(tempFile.Name())
+	if newSettings.Users[0].Password != "" || !strings.HasPrefix(newSettings.Users[0].PasswordHash, "$2") {
+		t.Errorf("Password should be hashed, got %+v", newSettings.Users[0])
+	}
+	saved, err := os.ReadFile(tempFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(saved), "testPass") {
+		t.Error("Plaintext password should not be saved")
+	}
+	if _, ok := newSettings.AuthenticateUser("test", "testPass"); !ok {
+		t.Error("Should accept the password")
+	}
+	// Second time uses the cache
+	if _, ok := newSettings.AuthenticateUser("test", "testPass"); !ok {
+		t.Error("Should accept the password again")
+	}
+	if _, ok := newSettings.AuthenticateUser("test", "wrong"); ok {
+		t.Error("Should reject the wrong password")
+	}
+	if err := newSettings.SetUserPassword("test", "newPass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := newSettings.AuthenticateUser("test", "testPass"); ok {
+		t.Error("Old password should no longer work")
+	}
+	if _, ok := newSettings.AuthenticateUser("test", "newPass"); !ok {
+		t.Error("Should accept the new password")
+	}
+}
+
+func TestDownloadTokens(t *testing.T) {
+	tempFile, err := os.CreateTemp("", "settings_test_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	newSettings := settings.NewSettings(tempFile.Name())
+
+	if _, err := newSettings.CreateDownloadToken("nobody", ""); err != settings.ErrUserNotFound {
+		t.Error("Should need a real user")
+	}
+	auto, err := newSettings.DownloadTokenFor("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := newSettings.DownloadTokenFor("demo"); again != auto {
+		t.Error("Should reuse the existing token")
+	}
+	if strings.ContainsAny(auto, "-./") {
+		t.Errorf("Token must be safe to put in file URLs, got %s", auto)
+	}
+	if user, ok := newSettings.UserForToken(auto); !ok || user.Username != "demo" {
+		t.Error("Token should map to its user")
+	}
+	tokens, err := newSettings.ListDownloadTokens("demo")
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("Should list the token, got %+v", tokens)
+	}
+	if err := newSettings.RevokeDownloadToken("demo", tokens[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := newSettings.UserForToken(auto); ok {
+		t.Error("Revoked token should not work")
+	}
+	if err := newSettings.RevokeDownloadToken("demo", tokens[0].ID); err != settings.ErrTokenNotFound {
+		t.Error("Token should already be gone")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tempFile, err := os.CreateTemp("", "settings_test_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	newSettings := settings.NewSettings(tempFile.Name())
+	oldPorts := []int{}
+	newPorts := []int{}
+	newSettings.Subscribe("ftp", []string{"ftpPort"}, func(old, updated *settings.Settings) error {
+		if updated == newSettings {
+			t.Error("Subscribers should get a copy of the settings, not the live ones")
+		}
+		oldPorts = append(oldPorts, old.FTPPort)
+		newPorts = append(newPorts, updated.FTPPort)
+		return nil
+	})
+
+	result, err := newSettings.Update(strings.NewReader(`{"ftpPort":2200,"queueLength":64,"enableSorting":true,"users":[{"username":"new","password":"pass"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(result.Changed, ",") != "enableSorting,ftpPort,users,queueLength" {
+		t.Errorf("Wrong changed fields, got %v", result.Changed)
+	}
+	if len(result.Applied) != 1 || len(oldPorts) != 1 || oldPorts[0] != 2121 || newPorts[0] != 2200 || newSettings.Current().FTPPort != 2200 {
+		t.Errorf("Subscriber should see the old and new port, got %v %v %v", result.Applied, oldPorts, newPorts)
+	}
+	if len(result.RestartRequired) != 1 || result.RestartRequired[0] != "queueLength" {
+		t.Errorf("Queue length should need a restart, got %v", result.RestartRequired)
+	}
+	if newSettings.Current().QueueLength == 64 || !newSettings.Current().EnableSorting {
+		t.Error("Startup fields should keep their running values until a restart, others should be used straight away")
+	}
+	if _, ok := newSettings.AuthenticateUser("new", "pass"); !ok || newSettings.Users[0].Password != "" {
+		t.Error("New users should be usable, with their password hashed")
+	}
+	saved, err := os.ReadFile(tempFile.Name())
+	if err != nil || !strings.Contains(string(saved), `"ftpPort": 2200`) || !strings.Contains(string(saved), `"queueLength": 64`) {
+		t.Error("Update should be saved")
+	}
+
+	for _, patch := range []string{`{"ftpPort":"nope"}`, `{"httpPort":0}`, `{"ftpsMode":"sometimes"}`} {
+		if _, err := newSettings.Update(strings.NewReader(patch)); !errors.Is(err, settings.ErrInvalidSettings) {
+			t.Errorf("%s should be rejected, got %v", patch, err)
+		}
+	}
+	if newSettings.Current().FTPPort != 2200 || newSettings.Current().HTTPPort != 8080 || len(oldPorts) != 1 {
+		t.Error("Rejected updates should not change anything")
+	}
+	if result, err := newSettings.Update(strings.NewReader(`{"ftpPort":2200}`)); err != nil || len(result.Changed) != 0 {
+		t.Errorf("Nothing should change, got %+v %v", result, err)
+	}
+
+	// Posting back the redacted settings keeps the secrets that were left out
+	token, err := newSettings.CreateDownloadToken("new", "dbi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted := &bytes.Buffer{}
+	if err := newSettings.SaveRedactedTo(redacted); err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.Replace(redacted.String(), `"allowFTP": false`, `"allowFTP": true`, 1)
+	if result, err := newSettings.Update(strings.NewReader(edited)); err != nil || strings.Join(result.Changed, ",") != "users" {
+		t.Errorf("Only the users should change, got %+v %v", result, err)
+	}
+	if _, ok := newSettings.AuthenticateUser("new", "pass"); !ok || !newSettings.Users[0].AllowFTP {
+		t.Error("Password should be kept when it is left out")
+	}
+	if _, ok := newSettings.UserForToken(token.Token); !ok {
+		t.Error("Tokens should be kept when they are left out")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tempFolder, err := os.MkdirTemp("", "settings_test_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempFolder)
+	newSettings := settings.NewSettings(path.Join(tempFolder, "settings.json"))
+	newSettings.StorageFolder = tempFolder
+	newSettings.FoldersToScan = []string{tempFolder}
+	newSettings.HTTPPort = 18080
+	newSettings.FTPPort = 12121
+	newSettings.FTPHost = "127.0.0.1"
+	if problems := newSettings.Validate(); problems != nil {
+		t.Fatalf("Settings should be valid, got %v", problems)
+	}
+
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inUse.Close()
+	newSettings.FTPPort = inUse.Addr().(*net.TCPAddr).Port
+	newSettings.StorageFolder = path.Join(tempFolder, "missing")
+	newSettings.OrganisationFormat = "{TitleName}/{TitleName} {Type}"
+	newSettings.FTPPassivePorts = "2140-2130"
+	newSettings.CompressionBlockBits = 32
+	newSettings.Users = []settings.AuthUser{{Username: "user", Allow: []settings.AccessRule{{Type: "game"}}}, {Username: "user"}}
+	problems := newSettings.Validate()
+	fields := []string{}
+	for _, problem := range problems {
+		fields = append(fields, problem.Field)
+	}
+	if strings.Join(fields, ",") != "FTPPassivePorts,compressionBlockBits,ftpPort,organisationFormat,storageFolder,users[0].allow[0].type,users[1].username" {
+		t.Errorf("Wrong problems found, got %v", problems)
+	}
+	newSettings.EnableSorting = true
+	for _, problem := range newSettings.Validate() {
+		if problem.Field == "storageFolder" {
+			t.Error("Storage folder is made when sorting starts, so it doesn't have to exist")
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tempFile, err := os.CreateTemp("", "settings_test_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	broken := "{\n  \"httpPort\": 8080,\n  \"ftpPort\": 2121\n  \"logLevel\": 1\n}"
+	_, _ = tempFile.WriteString(broken)
+	tempFile.Close()
+
+	if _, err := settings.ReadSettings(tempFile.Name()); err == nil || !strings.Contains(err.Error(), "line 4 column 3") {
+		t.Errorf("Should report where the problem is, got %v", err)
+	}
+	settings.NewSettings(tempFile.Name())
+	if saved, _ := os.ReadFile(tempFile.Name()); string(saved) != broken {
+		t.Error("Broken settings file should not be saved over")
+	}
+
+	if err := os.WriteFile(tempFile.Name(), []byte(`{"httpPort":"8080"}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err = settings.ReadSettings(tempFile.Name())
+	var problems settings.ValidationErrors
+	if !errors.As(err, &problems) || problems[0].Field != "httpPort" || !errors.Is(err, settings.ErrInvalidSettings) {
+		t.Errorf("Should report the field with the wrong type, got %v", err)
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	data, err := settings.JSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type property struct {
+		Type        string              `json:"type"`
+		Description string              `json:"description"`
+		Default     interface{}         `json:"default"`
+		Enum        []string            `json:"enum"`
+		Items       *property           `json:"items"`
+		Properties  map[string]property `json:"properties"`
+	}
+	schema := property{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if port := schema.Properties["httpPort"]; port.Type != "integer" || port.Description != "Port used for HTTP" || port.Default != float64(8080) {
+		t.Errorf("Wrong httpPort schema, got %+v", port)
+	}
+	if mode := schema.Properties["ftpsMode"]; strings.Join(mode.Enum, ",") != "off,explicit,implicit" {
+		t.Errorf("Wrong ftpsMode schema, got %+v", mode)
+	}
+	users := schema.Properties["users"]
+	if users.Type != "array" || users.Items == nil || users.Items.Properties["allowFTP"].Description != "Can user use the ftp server" {
+		t.Errorf("Wrong users schema, got %+v", users)
+	}
+	settingsType := reflect.TypeOf(settings.Settings{})
+	for i := 0; i < settingsType.NumField(); i++ {
+		name, _, _ := strings.Cut(settingsType.Field(i).Tag.Get("json"), ",")
+		if _, ok := schema.Properties[name]; name != "" && !ok {
+			t.Errorf("%s is missing from the schema", name)
+		}
+	}
+}
+
+func TestOverridableSettings(t *testing.T) {
+	names := map[string]settings.Overridable{}
+	for _, setting := range settings.OverridableSettings() {
+		names[setting.Name] = setting
+	}
+	for name, expected := range map[string][2]string{
+		"httpPort":        {"http-port", "SWITCHHOST_HTTP_PORT"},
+		"FTPPassivePorts": {"ftp-passive-ports", "SWITCHHOST_FTP_PASSIVE_PORTS"},
+		"sourceFolders":   {"source-folders", "SWITCHHOST_SOURCE_FOLDERS"},
+	} {
+		if setting := names[name]; setting.Flag != expected[0] || setting.Env != expected[1] {
+			t.Errorf("%s should be %v, got %+v", name, expected, setting)
+		}
+	}
+	if names["httpPort"].Description == "" {
+		t.Error("Descriptions should come from the field comments")
+	}
+	if !names["dryRun"].Bool || names["httpPort"].Bool {
+		t.Error("Only bool settings should be marked as bools")
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	tempFile, err := os.CreateTemp("", "settings_test_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, _ = tempFile.WriteString(`{"httpPort":8000,"ftpPort":2000,"sourceFolders":["/old"]}`)
+	tempFile.Close()
+	newSettings, err := settings.OpenSettings(tempFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overrides := settings.EnvironmentOverrides([]string{
+		"SWITCHHOST_HTTP_PORT=9000",
+		"SWITCHHOST_FTP_PORT=2100",
+		"SWITCHHOST_SOURCE_FOLDERS=/a, /b",
+		`SWITCHHOST_USERS={"username":"docker","password":"pass"}`,
+		"HOME=/root",
+	})
+	if len(overrides) != 4 {
+		t.Fatalf("Only switchhost variables should be used, got %+v", overrides)
+	}
+	// Flags are applied after the environment, so win
+	overrides = append(overrides, settings.Override{Name: "ftpPort", Value: "2200", Source: "--ftp-port"})
+	if err := newSettings.ApplyOverrides(overrides); err != nil {
+		t.Fatal(err)
+	}
+	if newSettings.HTTPPort != 9000 || newSettings.FTPPort != 2200 {
+		t.Errorf("Ports should be overridden, got %d %d", newSettings.HTTPPort, newSettings.FTPPort)
+	}
+	if !reflect.DeepEqual(newSettings.FoldersToScan, []string{"/a", "/b"}) {
+		t.Errorf("Comma separated folders should be split and trimmed, got %v", newSettings.FoldersToScan)
+	}
+	if _, ok := newSettings.AuthenticateUser("docker", "pass"); !ok || newSettings.Users[0].Password != "" {
+		t.Error("Users should be usable, with their password hashed")
+	}
+
+	// Overrides are not saved, but later changes are
+	if _, err := newSettings.Update(strings.NewReader(`{"ftpPort":2300}`)); err != nil {
+		t.Fatal(err)
+	}
+	saved := map[string]interface{}{}
+	data, _ := os.ReadFile(tempFile.Name())
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved["httpPort"] != float64(8000) || saved["ftpPort"] != float64(2300) || !reflect.DeepEqual(saved["sourceFolders"], []interface{}{"/old"}) {
+		t.Errorf("Only the update should be saved, got %v %v %v", saved["httpPort"], saved["ftpPort"], saved["sourceFolders"])
+	}
+	if users, _ := saved["users"].([]interface{}); len(users) != 1 || users[0].(map[string]interface{})["username"] == "docker" {
+		t.Errorf("Overridden users should not be saved, got %v", saved["users"])
+	}
+	if newSettings.HTTPPort != 9000 {
+		t.Error("Saving should not undo the overrides")
+	}
+
+	for _, override := range []settings.Override{
+		{Name: "httpPort", Value: "lots", Source: "SWITCHHOST_HTTP_PORT"},
+		{Name: "enableSorting", Value: "", Source: "--enable-sorting"},
+		{Name: "nothing", Value: "1", Source: "--nothing"},
+	} {
+		err := newSettings.ApplyOverrides([]settings.Override{override})
+		if !errors.Is(err, settings.ErrInvalidSettings) || !strings.Contains(err.Error(), override.Source) {
+			t.Errorf("%+v should be rejected naming where it came from, got %v", override, err)
+		}
+	}
+}
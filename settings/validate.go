@@ -0,0 +1,257 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Validation checks that the settings can actually be used, reporting each problem against the setting (by its json name) at fault
+
+// FieldError is a problem with one setting
+type FieldError struct {
+	Field   string `json:"field"`   // json name of the setting, with the index for list entries, such as users[1].username
+	Message string `json:"message"` // What is wrong with it
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors holds every problem found with the settings
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	problems := make([]string, 0, len(v))
+	for _, problem := range v {
+		problems = append(problems, problem.Error())
+	}
+	return strings.Join(problems, ", ")
+}
+
+// Allowed values of settings picking from a list, an empty value uses the default
+var enumValues = map[string][]string{
+	"storagePlacement":   {StoragePlacementSameDisk, StoragePlacementMostFree, StoragePlacementFirstWithRoom},
+	"tinfoilIndexMode":   {TinfoilIndexNever, TinfoilIndexAlways, TinfoilIndexTinfoil},
+	"tinfoilCompression": {"zstd", "zlib", "none"},
+	"ftpsMode":           {FTPSOff, FTPSExplicit, FTPSImplicit},
+}
+
+// Validate checks every setting, returning all of the problems found or nil if there are none
+// As well as the values themselves this checks the folders exist and the ports are free, so should be run before the servers are started
+func (s *Settings) Validate() ValidationErrors {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	return s.validate(nil)
+}
+
+// validate checks the settings, the folders and ports are only checked if their json names are in changed (or changed is nil)
+// Must be called with authLock held, or on settings not shared yet
+func (s *Settings) validate(changed []string) ValidationErrors {
+	problems := ValidationErrors{}
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	checking := func(field string) bool {
+		return changed == nil || slices.Contains(changed, field)
+	}
+	checkFolder := func(field, folder string, createdBySorting bool) {
+		if info, err := os.Stat(folder); err != nil {
+			if createdBySorting && s.EnableSorting {
+				if _, err := os.Stat(filepath.Dir(filepath.Clean(folder))); err == nil {
+					return // Made when the library starts
+				}
+			}
+			add(field, "folder %s does not exist", folder)
+		} else if !info.IsDir() {
+			add(field, "%s is not a folder", folder)
+		}
+	}
+	checkRange := func(field string, value, min, max int) {
+		if value < min || value > max {
+			add(field, "must be between %d and %d", min, max)
+		}
+	}
+
+	// Values
+	checkRange("httpPort", s.HTTPPort, 1, 65535)
+	checkRange("ftpPort", s.FTPPort, 1, 65535)
+	if s.HTTPPort == s.FTPPort {
+		add("ftpPort", "must be different to httpPort")
+	}
+	if err := checkPortRange(s.FTPPassivePorts); err != nil {
+		add("FTPPassivePorts", "%v", err)
+	}
+	if len(s.StorageFolder) == 0 {
+		add("storageFolder", "must be set")
+	}
+	if !strings.Contains(s.OrganisationFormat, "{TitleID}") {
+		add("organisationFormat", "must contain {TitleID}, or different titles can be sorted to the same file")
+	}
+	for _, field := range []string{"storagePlacement", "tinfoilIndexMode", "tinfoilCompression", "ftpsMode"} {
+		value := s.enumValue(field)
+		if value != "" && !slices.Contains(enumValues[field], value) {
+			add(field, "must be one of %s", strings.Join(enumValues[field], ", "))
+		}
+	}
+	if s.QueueLength < 1 {
+		add("queueLength", "must be at least 1")
+	}
+	checkRange("logLevel", s.LogLevel, -1, 7)
+	checkRange("compressionLevel", s.CompressionLevel, 1, 22)
+	checkRange("compressionBlockBits", s.CompressionBlockBits, 14, 24)
+	usernames := []string{}
+	for i, user := range s.Users {
+		if len(user.Username) == 0 {
+			add(fmt.Sprintf("users[%d].username", i), "must be set")
+		} else if slices.Contains(usernames, user.Username) {
+			add(fmt.Sprintf("users[%d].username", i), "%s is already used by another user", user.Username)
+		}
+		usernames = append(usernames, user.Username)
+		for kind, rules := range map[string][]AccessRule{"allow": user.Allow, "deny": user.Deny} {
+			for j, rule := range rules {
+				s.validateAccessRule(fmt.Sprintf("users[%d].%s[%d]", i, kind, j), rule, add)
+			}
+		}
+	}
+
+	// Environment
+	if checking("storageFolder") && len(s.StorageFolder) > 0 {
+		checkFolder("storageFolder", s.StorageFolder, true)
+	}
+	if checking("storageFolders") {
+		for i, folder := range s.StorageFolders {
+			checkFolder(fmt.Sprintf("storageFolders[%d]", i), folder, true)
+		}
+	}
+	if checking("sourceFolders") {
+		for i, folder := range s.FoldersToScan {
+			checkFolder(fmt.Sprintf("sourceFolders[%d]", i), folder, false)
+		}
+	}
+	if checking("httpPort") {
+		if err := checkPortFree("", s.HTTPPort); err != nil {
+			add("httpPort", "%v", err)
+		}
+	}
+	if checking("ftpPort") {
+		if err := checkPortFree(s.FTPHost, s.FTPPort); err != nil {
+			add("ftpPort", "%v", err)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(problems, func(a, b FieldError) int { return strings.Compare(a.Field, b.Field) })
+	return problems
+}
+
+func (s *Settings) enumValue(field string) string {
+	switch field {
+	case "storagePlacement":
+		return s.StoragePlacement
+	case "tinfoilIndexMode":
+		return s.TinfoilIndexMode
+	case "tinfoilCompression":
+		return s.TinfoilCompression
+	case "ftpsMode":
+		return s.FTPSMode
+	}
+	return ""
+}
+
+func (s *Settings) validateAccessRule(field string, rule AccessRule, add func(field, format string, args ...interface{})) {
+	if len(rule.TitleID) > 0 {
+		if _, err := strconv.ParseUint(rule.TitleID, 16, 64); err != nil {
+			add(field+".titleID", "%s is not a hex TitleID", rule.TitleID)
+		}
+	}
+	if len(rule.BaseTitle) > 0 {
+		if _, err := strconv.ParseUint(rule.BaseTitle, 16, 64); err != nil {
+			add(field+".baseTitle", "%s is not a hex TitleID", rule.BaseTitle)
+		}
+	}
+	if len(rule.Type) > 0 && !slices.Contains([]string{"base", "update", "dlc"}, rule.Type) {
+		add(field+".type", "must be one of base, update, dlc")
+	}
+	if len(rule.Tag) > 0 {
+		if _, ok := s.TitleTags[rule.Tag]; !ok {
+			add(field+".tag", "tag %s is not in titleTags", rule.Tag)
+		}
+	}
+}
+
+// checkPortRange checks the FTP passive port range is in the min-max form, empty is allowed to let the OS pick
+func checkPortRange(portRange string) error {
+	if len(portRange) == 0 {
+		return nil
+	}
+	minText, maxText, ok := strings.Cut(portRange, "-")
+	if !ok {
+		return errors.New("must be a range of ports, such as 2130-2140")
+	}
+	minPort, minErr := strconv.Atoi(strings.TrimSpace(minText))
+	maxPort, maxErr := strconv.Atoi(strings.TrimSpace(maxText))
+	if minErr != nil || maxErr != nil {
+		return errors.New("must be a range of ports, such as 2130-2140")
+	}
+	if minPort < 1 || maxPort > 65535 || minPort >= maxPort {
+		return fmt.Errorf("%d-%d is not a range of ports, the first must be lower than the second", minPort, maxPort)
+	}
+	return nil
+}
+
+// checkPortFree checks the port can be listened on
+func checkPortFree(host string, port int) error {
+	if port < 1 || port > 65535 {
+		return nil // Reported with the value checks
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("port %d is already in use", port)
+	} else if err != nil {
+		return fmt.Errorf("can't listen on port %d: %v", port, err)
+	}
+	listener.Close()
+	return nil
+}
+
+// parseError describes where in the json a parsing error is
+func parseError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, column := position(data, syntaxErr.Offset-1) // The offset is just after the bad character
+		return fmt.Errorf("%w: line %d column %d: %v", ErrInvalidSettings, line, column, err)
+	case errors.As(err, &typeErr):
+		line, column := position(data, typeErr.Offset)
+		return fmt.Errorf("%w: %w", ErrInvalidSettings, ValidationErrors{{
+			Field:   typeErr.Field,
+			Message: fmt.Sprintf("must be %s, not %s (line %d column %d)", typeErr.Type, typeErr.Value, line, column),
+		}})
+	}
+	return fmt.Errorf("%w: %v", ErrInvalidSettings, err)
+}
+
+// position returns the line and column of the byte offset in the data, both starting from 1
+func position(data []byte, offset int64) (int, int) {
+	line, column := 1, 1
+	for _, b := range data[:min(int(offset), len(data))] {
+		if b == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
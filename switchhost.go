@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -13,21 +14,26 @@ import (
 	"github.com/ralim/switchhost/settings"
 	"github.com/ralim/switchhost/termui"
 	"github.com/ralim/switchhost/titledb"
-	"github.com/ralim/switchhost/utilities"
 	"github.com/rivo/tview"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
 )
 
 type SwitchHost struct {
 	ConfigFilePath string `flag:"config" help:"Path to config file"`
 	KeysFilePath   string `flag:"keys" help:"Path to your switch's keyfile"`
 	NoCUI          bool   `flag:"noCUI" help:"Disable the Console UI"`
+	CheckConfig    bool   `flag:"check-config" help:"Check the config file for problems and exit, without starting the servers"`
+	Schema         bool   `flag:"schema" help:"Print the JSON Schema of the config file and exit"`
 
 	lib       *library.Library      `flag:"-"`
 	ui        *termui.TermUI        `flag:"-"`
 	settings  *settings.Settings    `flag:"-"`
 	titleDB   *titledb.TitlesDB     `flag:"-"`
 	versionDB *versionsdb.VersionDB `flag:"-"`
+
+	settingFlags *pflag.FlagSet `flag:"-"` // Holds a flag for each setting, to override the config file
 }
 
 func NewSwitchHost() *SwitchHost {
@@ -41,7 +47,25 @@ func (m *SwitchHost) Run() error {
 	if m.ConfigFilePath != "" {
 		settingsPath = m.ConfigFilePath
 	}
-	m.settings = settings.NewSettings(settingsPath)
+	if m.Schema {
+		schema, err := settings.JSONSchema()
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(schema))
+		return nil
+	}
+	if m.CheckConfig {
+		return checkConfig(settingsPath, m.settingOverrides())
+	}
+	var err error
+	m.settings, err = settings.OpenSettings(settingsPath)
+	if err != nil {
+		return fmt.Errorf("config file %s could not be loaded (check it with --check-config): %w", settingsPath, err)
+	}
+	if err := m.settings.ApplyOverrides(m.settingOverrides()); err != nil {
+		return err
+	}
 	m.ui = termui.NewTermUI(m.NoCUI)
 	if !m.NoCUI {
 		m.settings.SetupLogging(tview.ANSIWriter(m.ui.LogsView))
@@ -64,6 +88,11 @@ func (m *SwitchHost) Run() error {
 		}()
 	}
 
+	// Problems are reported, but the parts of the program not affected can still run
+	for _, problem := range m.settings.Validate() {
+		log.Warn().Str("setting", problem.Field).Msg(problem.Message)
+	}
+
 	m.loadVersionInfo()
 	// Download TitlesDB
 	m.loadTitlesDB()
@@ -74,7 +103,7 @@ func (m *SwitchHost) Run() error {
 
 	m.lib.Start()
 
-	server := server.NewServer(m.lib, m.titleDB, m.settings)
+	server := server.NewServer(m.lib, m.titleDB, m.settings, m.ui)
 
 	server.Run()
 
@@ -91,28 +120,56 @@ func (m *SwitchHost) Run() error {
 	return nil
 }
 
-func (m *SwitchHost) checkKeys(pathUsed string) {
-	//So this is a bit of a hack around because nsz.py is inflexible in the prod.keys file location
-	//So we check, if we have been told to load from a not ~/.switch/ location, and the dest file does not exist, we copy it there for nsz.py
-	if userHomeDir, err := os.UserHomeDir(); err == nil {
-		homeFileFolderPath := path.Join(userHomeDir, ".switch")
-		err := os.MkdirAll(homeFileFolderPath, os.ModePerm)
-		if err == nil {
-			homeFilePath := path.Join(homeFileFolderPath, "prod.keys")
-
-			if homeFilePath != pathUsed && !utilities.Exists(homeFilePath) {
-				log.Info().Str("pathUsed", pathUsed).Msg("Path used for keys does not equal the one nsz wants, so going to try and copy it there")
-				err := utilities.CopyFile(pathUsed, homeFilePath)
-				if err != nil {
-					log.Warn().Err(err).Msg("Failed to copy the prod.keys file, nsz.py may not work")
-				}
-			}
-		} else {
-			log.Warn().Err(err).Msg("Failed to copy the prod.keys file, as could not make folder; nsz.py may not work")
+// addSettingFlags adds a flag for every setting
+func (m *SwitchHost) addSettingFlags(flags *pflag.FlagSet) {
+	m.settingFlags = flags
+	for _, setting := range settings.OverridableSettings() {
+		flags.String(setting.Flag, "", fmt.Sprintf("Override %s: %s (or set %s)", setting.Name, setting.Description, setting.Env))
+		if setting.Bool {
+			// --dry-run is --dry-run=true, a value has to be given with = as a separate word is taken as an argument
+			flags.Lookup(setting.Flag).NoOptDefVal = "true"
 		}
 	}
 }
 
+// settingOverrides returns the settings set in the environment and then the command line, so the command line wins
+func (m *SwitchHost) settingOverrides() []settings.Override {
+	overrides := settings.EnvironmentOverrides(os.Environ())
+	if m.settingFlags == nil {
+		return overrides
+	}
+	for _, setting := range settings.OverridableSettings() {
+		if m.settingFlags.Changed(setting.Flag) {
+			value, _ := m.settingFlags.GetString(setting.Flag)
+			overrides = append(overrides, settings.Override{Name: setting.Name, Value: value, Source: "--" + setting.Flag})
+		}
+	}
+	return overrides
+}
+
+// checkConfig reports any problems with the config file, along with the overrides
+func checkConfig(settingsPath string, overrides []settings.Override) error {
+	// Logs from loading would get mixed up with the report
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	loaded, err := settings.ReadSettings(settingsPath)
+	if err != nil {
+		return fmt.Errorf("%s could not be loaded: %w", settingsPath, err)
+	}
+	if err := loaded.ApplyOverrides(overrides); err != nil {
+		return err
+	}
+	problems := loaded.Validate()
+	if len(problems) == 0 {
+		fmt.Printf("%s is OK\n", settingsPath)
+		return nil
+	}
+	fmt.Printf("%s has problems:\n", settingsPath)
+	for _, problem := range problems {
+		fmt.Printf("  %s\n", problem.Error())
+	}
+	return errors.New("config check failed")
+}
+
 func (m *SwitchHost) loadTitlesDB() {
 	if m.ui != nil {
 		titlesDBInfo := m.ui.RegisterTask("TitlesDB")
@@ -132,7 +189,7 @@ func (m *SwitchHost) loadVersionInfo() {
 		versionInfo.UpdateStatus("Downloading")
 		defer versionInfo.UpdateStatus("Done")
 	}
-	versionInfo := versionsdb.NewVersionDBFromURL(m.settings.VersionsDBURL, m.settings.CacheFolder)
+	versionInfo := versionsdb.NewVersionDBFromURL(m.settings.Current().VersionsDBURL, m.settings.Current().CacheFolder)
 	m.versionDB = versionInfo
 }
 func (m *SwitchHost) tryAndLoadKeys() {
@@ -175,7 +232,6 @@ func (m *SwitchHost) loadKeys(filePath string, lib *library.Library) bool {
 			log.Info().Err(err).Msg("Could not load keys")
 			return false
 		}
-		m.checkKeys(filePath)
 		return true
 	}
 	return false
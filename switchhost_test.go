@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestSettingFlags(t *testing.T) {
+	host := NewSwitchHost()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	host.addSettingFlags(flags)
+	if err := flags.Parse([]string{"--dry-run", "--enable-sorting=false", "--http-port", "9000", "organise"}); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, override := range host.settingOverrides() {
+		values[override.Name] = override.Value
+	}
+	if values["dryRun"] != "true" || values["enableSorting"] != "false" || values["httpPort"] != "9000" {
+		t.Errorf("Bool flags should work on their own or with a value, got %v", values)
+	}
+	if args := flags.Args(); len(args) != 1 || args[0] != "organise" {
+		t.Errorf("Arguments after the flags should be kept, got %v", args)
+	}
+}
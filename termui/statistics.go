@@ -14,6 +14,15 @@ type Statistics struct {
 	TotalUpdates int
 	TotalDLC     int
 
+	// Background re-validation of the library
+	BitrotDetected   int    // Files that failed their last check
+	LastRevalidation string // When the last run finished
+
+	// Downloads served over HTTP and FTP
+	Downloads       int   // Completed downloads
+	DownloadedBytes int64 // Bytes sent, including aborted downloads
+	ActiveTransfers int   // Downloads running now
+
 	table *tview.Table
 	app   *tview.Application
 }
@@ -22,6 +31,14 @@ func (s Statistics) Redraw() {
 	newTitles := fmt.Sprintf("%d", s.TotalTitles)
 	newUpdates := fmt.Sprintf("%d", s.TotalUpdates)
 	newDLC := fmt.Sprintf("%d", s.TotalDLC)
+	newBitrot := fmt.Sprintf("%d", s.BitrotDetected)
+	lastRevalidation := s.LastRevalidation
+	if lastRevalidation == "" {
+		lastRevalidation = "Never"
+	}
+	newDownloads := fmt.Sprintf("%d", s.Downloads)
+	newDownloaded := formatBytes(s.DownloadedBytes)
+	newActive := fmt.Sprintf("%d", s.ActiveTransfers)
 	if s.app != nil {
 		s.app.QueueUpdateDraw(func() {
 			s.table.SetCellSimple(0, 0, "Total Titles")
@@ -30,6 +47,16 @@ func (s Statistics) Redraw() {
 			s.table.SetCellSimple(1, 1, newUpdates)
 			s.table.SetCellSimple(2, 0, "Total DLC")
 			s.table.SetCellSimple(2, 1, newDLC)
+			s.table.SetCellSimple(0, 2, "Bitrot Detected")
+			s.table.SetCellSimple(0, 3, newBitrot)
+			s.table.SetCellSimple(1, 2, "Last Revalidation")
+			s.table.SetCellSimple(1, 3, lastRevalidation)
+			s.table.SetCellSimple(0, 4, "Downloads")
+			s.table.SetCellSimple(0, 5, newDownloads)
+			s.table.SetCellSimple(1, 4, "Downloaded")
+			s.table.SetCellSimple(1, 5, newDownloaded)
+			s.table.SetCellSimple(2, 4, "Active Transfers")
+			s.table.SetCellSimple(2, 5, newActive)
 		})
 	}
 }
@@ -47,5 +74,29 @@ func newStatistics(app *tview.Application) *Statistics {
 	s.table.SetCellSimple(1, 1, "0")
 	s.table.SetCellSimple(2, 0, "Total DLC")
 	s.table.SetCellSimple(2, 1, "0")
+	s.table.SetCellSimple(0, 2, "Bitrot Detected")
+	s.table.SetCellSimple(0, 3, "0")
+	s.table.SetCellSimple(1, 2, "Last Revalidation")
+	s.table.SetCellSimple(1, 3, "Never")
+	s.table.SetCellSimple(0, 4, "Downloads")
+	s.table.SetCellSimple(0, 5, "0")
+	s.table.SetCellSimple(1, 4, "Downloaded")
+	s.table.SetCellSimple(1, 5, formatBytes(0))
+	s.table.SetCellSimple(2, 4, "Active Transfers")
+	s.table.SetCellSimple(2, 5, "0")
 	return s
 }
+
+// formatBytes renders a byte count in the largest fitting binary unit
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -28,6 +28,23 @@ func (t *TermUI) RegisterTask(taskName string) *TaskState {
 	return state
 }
 
+// TaskStatus is the name and current status of a task
+type TaskStatus struct {
+	Name   string
+	Status string
+}
+
+// TaskStates lists the status of every registered task, tasks with multiple workers are listed once for each
+func (t *TermUI) TaskStates() []TaskStatus {
+	t.Lock()
+	defer t.Unlock()
+	states := make([]TaskStatus, 0, len(t.tasks))
+	for _, task := range t.tasks {
+		states = append(states, TaskStatus{Name: task.name, Status: task.Status()})
+	}
+	return states
+}
+
 func (t *TermUI) sortTasks() {
 	//Sorts tasks alphabetically and redraws the list
 	sort.SliceStable(t.tasks, func(i, j int) bool {
@@ -1,6 +1,8 @@
 package termui
 
 import (
+	"sync"
+
 	"github.com/rivo/tview"
 
 	"github.com/rs/zerolog/log"
@@ -8,6 +10,7 @@ import (
 
 type TaskState struct {
 	name        string
+	lock        sync.Mutex // Guards lastStatus, as it is read for metrics
 	lastStatus  string
 	statusTable *tview.Table
 	parent      *TermUI
@@ -17,6 +20,8 @@ type TaskState struct {
 }
 
 func (t *TaskState) UpdateStatus(state string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	if t.lastStatus != state {
 		t.lastStatus = state
 		if t.parent.running {
@@ -29,11 +34,19 @@ func (t *TaskState) UpdateStatus(state string) {
 	}
 }
 
+// Status returns the last status set for the task
+func (t *TaskState) Status() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.lastStatus
+}
+
 //redraw draws title and contents again
 func (t *TaskState) redraw() {
 	if t.parent.running {
+		status := t.Status()
 		t.parent.app.QueueUpdateDraw(func() {
-			t.statusTable.SetCellSimple(t.row, t.col, t.lastStatus)
+			t.statusTable.SetCellSimple(t.row, t.col, status)
 			t.statusTable.SetCellSimple(t.row, t.col-1, t.name)
 		})
 	}
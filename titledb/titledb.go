@@ -59,10 +59,10 @@ func CreateTitlesDB(settings *settings.Settings) *TitlesDB {
 
 // UpdateTitlesDB will sync latest titlesdb, then update the internal memory state
 func (db *TitlesDB) UpdateTitlesDB() {
-	_ = os.MkdirAll(db.settings.CacheFolder, 0755)
+	_ = os.MkdirAll(db.settings.Current().CacheFolder, 0755)
 	wg := &sync.WaitGroup{}
 	// Download the latest titlesdb to the current folder
-	for _, fileURL := range db.settings.TitlesDBURLs {
+	for _, fileURL := range db.settings.Current().TitlesDBURLs {
 		wg.Add(1)
 		go db.downloadFileAndInjest(fileURL, wg)
 	}
@@ -71,7 +71,7 @@ func (db *TitlesDB) UpdateTitlesDB() {
 
 func (db *TitlesDB) downloadFileAndInjest(fileURL string, wg *sync.WaitGroup) {
 	defer wg.Done()
-	path, err := utilities.DownloadFileWithVersioning(fileURL, db.settings.CacheFolder)
+	path, err := utilities.DownloadFileWithVersioning(fileURL, db.settings.Current().CacheFolder)
 	if err != nil {
 		log.Warn().Err(err).Msg("Downloading latest TitlesDB failed, will continue using cached")
 	}
@@ -0,0 +1,160 @@
+package utilities
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Names of the generated self-signed certificate in the cache folder
+const (
+	SelfSignedCertName = "switchhost_tls.crt"
+	SelfSignedKeyName  = "switchhost_tls.key"
+)
+
+// CertificateLoader holds a TLS certificate loaded from disk
+// The files are checked on each handshake, and reloaded if they have changed so certificates can be renewed without a restart
+type CertificateLoader struct {
+	certFile string
+	keyFile  string
+
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// NewCertificateLoader loads the certificate and key, returning an error if they are not usable
+func NewCertificateLoader(certFile, keyFile string) (*CertificateLoader, error) {
+	loader := &CertificateLoader{certFile: certFile, keyFile: keyFile}
+	certModTime, keyModTime, err := loader.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := loader.load(certModTime, keyModTime); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+func (c *CertificateLoader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// load must be called with the lock held (or before the loader is shared)
+func (c *CertificateLoader) load(certModTime, keyModTime time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.certificate = &certificate
+	c.certModTime = certModTime
+	c.keyModTime = keyModTime
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the files have changed
+// If the reload fails (say, only one of the files has been replaced so far) the old certificate keeps being used
+func (c *CertificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	certModTime, keyModTime, err := c.modTimes()
+	if err == nil && (!certModTime.Equal(c.certModTime) || !keyModTime.Equal(c.keyModTime)) {
+		if err := c.load(certModTime, keyModTime); err != nil {
+			log.Warn().Err(err).Str("cert", c.certFile).Msg("Reloading TLS certificate failed, keeping the old one")
+		} else {
+			log.Info().Str("cert", c.certFile).Msg("Reloaded TLS certificate")
+		}
+	}
+	return c.certificate, nil
+}
+
+// TLSConfig returns a server config using this certificate
+func (c *CertificateLoader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// EnsureSelfSignedCertificate returns the paths of a self-signed certificate in folder, creating it if there is not a current one
+// hosts are added to the certificate as the names (or IPs) it is valid for
+func EnsureSelfSignedCertificate(folder string, hosts []string) (string, string, error) {
+	certPath := path.Join(folder, SelfSignedCertName)
+	keyPath := path.Join(folder, SelfSignedKeyName)
+
+	if existing, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		if parsed, err := x509.ParseCertificate(existing.Certificate[0]); err == nil && time.Now().Add(24*time.Hour).Before(parsed.NotAfter) {
+			return certPath, keyPath, nil
+		}
+	}
+	log.Info().Str("path", certPath).Msg("Generating self-signed TLS certificate")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Switch Host"}, CommonName: "switchhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range append([]string{"localhost", "127.0.0.1", "::1"}, hosts...) {
+		if len(host) == 0 {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return "", "", err
+	}
+	// Key first, so the pair is never seen with a new certificate and the old key
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
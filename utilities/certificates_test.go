@@ -0,0 +1,82 @@
+package utilities_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ralim/switchhost/utilities"
+)
+
+func TestSelfSignedCertificateReload(t *testing.T) {
+	t.Parallel()
+	tempFolder := t.TempDir()
+
+	certPath, keyPath, err := utilities.EnsureSelfSignedCertificate(tempFolder, []string{"switch.example", "10.0.0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader, err := utilities.NewCertificateLoader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := loader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(first.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.VerifyHostname("switch.example"); err != nil {
+		t.Error(err)
+	}
+	if err := parsed.VerifyHostname("10.0.0.5"); err != nil {
+		t.Error(err)
+	}
+
+	// A current certificate is reused
+	if _, _, err := utilities.EnsureSelfSignedCertificate(tempFolder, nil); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := loader.GetCertificate(nil)
+	if !bytes.Equal(again.Certificate[0], first.Certificate[0]) {
+		t.Error("certificate should not have been regenerated")
+	}
+
+	// Replacing the files is picked up on the next handshake
+	_ = os.Remove(certPath)
+	_ = os.Remove(keyPath)
+	if _, _, err := utilities.EnsureSelfSignedCertificate(tempFolder, nil); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certPath, future, future)
+	_ = os.Chtimes(keyPath, future, future)
+	reloaded, _ := loader.GetCertificate(nil)
+	if bytes.Equal(reloaded.Certificate[0], first.Certificate[0]) {
+		t.Error("certificate should have been reloaded")
+	}
+
+	// A broken file keeps the old certificate
+	if err := os.WriteFile(certPath, []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	_ = os.Chtimes(certPath, future, future)
+	kept, err := loader.GetCertificate(nil)
+	if err != nil || !bytes.Equal(kept.Certificate[0], reloaded.Certificate[0]) {
+		t.Error("broken certificate should not replace the loaded one")
+	}
+}
+
+func TestCertificateLoaderMissingFiles(t *testing.T) {
+	t.Parallel()
+	tempFolder := t.TempDir()
+	if _, err := utilities.NewCertificateLoader(path.Join(tempFolder, "a.crt"), path.Join(tempFolder, "a.key")); err == nil {
+		t.Error("missing files should fail")
+	}
+}
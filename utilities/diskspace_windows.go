@@ -0,0 +1,18 @@
+//go:build windows
+
+package utilities
+
+import "golang.org/x/sys/windows"
+
+// FreeSpace returns the bytes available to this user on the disk holding path
+func FreeSpace(path string) (uint64, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(pathPtr, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
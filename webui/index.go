@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"io"
 	"strings"
+
+	"github.com/ralim/switchhost/index"
 )
 
-func (web *WebUI) RenderGameListing(writer io.Writer) error {
+// RenderGameListing renders the tiles of all titles the filter allows
+func (web *WebUI) RenderGameListing(writer io.Writer, filter *index.AccessFilter) error {
 	templateParts := strings.Split(titlePageTemplate, "{GameTitleCards}")
 	if len(templateParts) != 2 {
 		return ErrBadTemplate
@@ -17,6 +20,9 @@ func (web *WebUI) RenderGameListing(writer io.Writer) error {
 
 	i := 0
 	for _, game := range web.lib.FileIndex.ListTitleFiles() {
+		if records, ok := web.lib.FileIndex.GetTitleRecords(game.TitleID); !ok || !filter.AllowsAny(records.GetFiles()) {
+			continue
+		}
 		if i > 0 && i%4 == 0 {
 			if _, err := writer.Write([]byte(`</div><div class="row">`)); err != nil {
 				return ErrBadTemplate
@@ -4,9 +4,16 @@ import (
 	"fmt"
 	"io"
 	"strings"
+
+	"github.com/ralim/switchhost/index"
 )
 
-func (web *WebUI) RenderTitleInfo(titleID uint64, writer io.Writer) error {
+// RenderTitleInfo renders the details of the title, only showing files the filter allows
+func (web *WebUI) RenderTitleInfo(titleID uint64, writer io.Writer, filter *index.AccessFilter) error {
+	filesTracked := filter.Filter(web.lib.FileIndex.GetAllRecordsForTitle(titleID))
+	if filter != nil && len(filesTracked) == 0 {
+		return ErrBadTemplate // Hidden from this user
+	}
 	//Render out a web page of the info we have on the title
 	titleDetails, ok := web.titleDB.QueryGameFromTitleID(titleID)
 	if !ok {
@@ -18,7 +25,6 @@ func (web *WebUI) RenderTitleInfo(titleID uint64, writer io.Writer) error {
 	template = strings.Replace(template, "{GameBannerImageURI}", titleDetails.BannerURL, -1)
 	template = strings.Replace(template, "{GameTitle}", titleDetails.Name, -1)
 	//Generate info table
-	filesTracked := web.lib.FileIndex.GetAllRecordsForTitle(titleID)
 	tableInfo := ""
 	for _, record := range filesTracked {
 		tableInfo += fmt.Sprintf("<tr><td>%s</td><td>%d</td><td>%d</td></tr>\n", record.Name, record.Version, record.Size)